@@ -0,0 +1,171 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"github.com/go-openapi/spec"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+const pkg = "github.com/thetirefire/badidea/apis/badidea/v1alpha1."
+
+// GetOpenAPIDefinitions returns the OpenAPI definitions of the types of the badidea group, written
+// by hand in the shape openapi-gen generates.
+func GetOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
+	return map[string]common.OpenAPIDefinition{
+		pkg + "Instance": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "Instance describes a running badidea server.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kind":       property("Kind is a string value representing the REST resource this object represents.", "string"),
+						"apiVersion": property("APIVersion defines the versioned schema of this representation of an object.", "string"),
+						"metadata": {
+							SchemaProps: spec.SchemaProps{Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta")},
+						},
+						"status": {
+							SchemaProps: spec.SchemaProps{Ref: ref(pkg + "InstanceStatus")},
+						},
+					},
+					Required: []string{"status"},
+				},
+			},
+			Dependencies: []string{"k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta", pkg + "InstanceStatus"},
+		},
+		pkg + "InstanceStatus": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "InstanceStatus is the configuration and readiness of a badidea server.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"features": {
+							SchemaProps: spec.SchemaProps{
+								Description: "Features are the badidea feature gates and whether they are enabled.",
+								Type:        []string{"object"},
+								AdditionalProperties: &spec.SchemaOrBool{
+									Allows: true,
+									Schema: &spec.Schema{SchemaProps: spec.SchemaProps{Type: []string{"boolean"}}},
+								},
+							},
+						},
+						"versions": {
+							SchemaProps: spec.SchemaProps{
+								Description: "Versions are the versions of the components of the server.",
+								Ref:         ref(pkg + "InstanceVersions"),
+							},
+						},
+						"etcd":           property("Etcd is how the server runs etcd.", "string"),
+						"subsystems":     arrayProperty("Subsystems are the optional subsystems of the server and whether they are enabled.", ref(pkg+"Subsystem")),
+						"ready":          property("Ready is whether the server is ready, as reported by /readyz.", "boolean"),
+						"readyzChecks":   arrayProperty("ReadyzChecks are the checks of /readyz.", ref(pkg+"ReadyzCheck")),
+						"normalizations": arrayProperty("Normalizations are the flag values the server changed at startup.", ref(pkg+"Normalization")),
+					},
+					Required: []string{"versions", "etcd", "ready"},
+				},
+			},
+			Dependencies: []string{pkg + "InstanceVersions", pkg + "Normalization", pkg + "ReadyzCheck", pkg + "Subsystem"},
+		},
+		pkg + "InstanceVersions": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "InstanceVersions are the versions of the components of a badidea server.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kubernetes": property("Kubernetes is the version of the Kubernetes libraries the server is built from.", "string"),
+						"etcd":       property("Etcd is the version of the embedded etcd server. It is empty with external etcd servers.", "string"),
+						"go":         property("Go is the version of Go the server is built with.", "string"),
+					},
+					Required: []string{"kubernetes", "go"},
+				},
+			},
+		},
+		pkg + "Subsystem": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "Subsystem is an optional subsystem of a badidea server.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"name":    property("Name is the name of the subsystem, like garbage-collector.", "string"),
+						"enabled": property("Enabled is whether the subsystem is enabled.", "boolean"),
+					},
+					Required: []string{"name", "enabled"},
+				},
+			},
+		},
+		pkg + "ReadyzCheck": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "ReadyzCheck is a check of /readyz.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"name":  property("Name is the name of the check, like etcd.", "string"),
+						"ready": property("Ready is whether the check passed.", "boolean"),
+					},
+					Required: []string{"name", "ready"},
+				},
+			},
+		},
+		pkg + "Normalization": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "Normalization is a flag value a badidea server changed at startup.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"flag":   property("Flag is the flag whose value was changed, like --runtime-config.", "string"),
+						"from":   property("From is the value set by the user.", "string"),
+						"to":     property("To is the value the server uses, empty if it ignores the value.", "string"),
+						"reason": property("Reason is why the value was changed.", "string"),
+					},
+					Required: []string{"flag", "from", "reason"},
+				},
+			},
+		},
+		pkg + "InstanceList": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "InstanceList is a list of Instances.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kind":       property("Kind is a string value representing the REST resource this object represents.", "string"),
+						"apiVersion": property("APIVersion defines the versioned schema of this representation of an object.", "string"),
+						"metadata": {
+							SchemaProps: spec.SchemaProps{Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ListMeta")},
+						},
+						"items": arrayProperty("", ref(pkg+"Instance")),
+					},
+					Required: []string{"items"},
+				},
+			},
+			Dependencies: []string{"k8s.io/apimachinery/pkg/apis/meta/v1.ListMeta", pkg + "Instance"},
+		},
+	}
+}
+
+func property(description, typ string) spec.Schema {
+	return spec.Schema{SchemaProps: spec.SchemaProps{Description: description, Type: []string{typ}}}
+}
+
+func arrayProperty(description string, items spec.Ref) spec.Schema {
+	return spec.Schema{
+		SchemaProps: spec.SchemaProps{
+			Description: description,
+			Type:        []string{"array"},
+			Items:       &spec.SchemaOrArray{Schema: &spec.Schema{SchemaProps: spec.SchemaProps{Ref: items}}},
+		},
+	}
+}
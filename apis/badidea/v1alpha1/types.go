@@ -0,0 +1,201 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package v1alpha1 is version v1alpha1 of the badidea.x-k8s.io group, which describes the badidea
+// server itself. It serves a single cluster-scoped Instance, computed on every read.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+// GroupName is the name of the badidea group.
+const GroupName = "badidea.x-k8s.io"
+
+// InstanceName is the name of the only Instance, the server serving the request.
+const InstanceName = "self"
+
+// SchemeGroupVersion is the group version of the types of this package.
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+var (
+	// Scheme holds the types of the badidea group, as versioned and internal types alike.
+	Scheme = runtime.NewScheme()
+	// Codecs serves the types of Scheme.
+	Codecs = serializer.NewCodecFactory(Scheme)
+)
+
+func init() {
+	if err := AddToScheme(Scheme); err != nil {
+		panic(err)
+	}
+
+	// the options and types the endpoints use whatever the group
+	metav1.AddToGroupVersion(Scheme, schema.GroupVersion{Version: "v1"})
+	unversioned := schema.GroupVersion{Group: "", Version: "v1"}
+	Scheme.AddUnversionedTypes(unversioned, &metav1.Status{}, &metav1.APIVersions{}, &metav1.APIGroupList{}, &metav1.APIGroup{}, &metav1.APIResourceList{})
+}
+
+// AddToScheme registers the types of the badidea group with scheme, as versioned and internal types.
+func AddToScheme(scheme *runtime.Scheme) error {
+	for _, gv := range []schema.GroupVersion{SchemeGroupVersion, {Group: GroupName, Version: runtime.APIVersionInternal}} {
+		scheme.AddKnownTypes(gv, &Instance{}, &InstanceList{})
+	}
+
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+
+	return nil
+}
+
+// EtcdMode is how a server runs etcd.
+type EtcdMode string
+
+const (
+	// EtcdEmbedded is an etcd server started in-process.
+	EtcdEmbedded EtcdMode = "Embedded"
+	// EtcdExternal are etcd servers run by someone else.
+	EtcdExternal EtcdMode = "External"
+)
+
+// Instance describes a running badidea server.
+type Instance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status InstanceStatus `json:"status"`
+}
+
+// InstanceStatus is the configuration and readiness of a badidea server.
+type InstanceStatus struct {
+	// Features are the badidea feature gates and whether they are enabled.
+	Features map[string]bool `json:"features,omitempty"`
+	// Versions are the versions of the components of the server.
+	Versions InstanceVersions `json:"versions"`
+	// Etcd is how the server runs etcd.
+	Etcd EtcdMode `json:"etcd"`
+	// Subsystems are the optional subsystems of the server and whether they are enabled.
+	Subsystems []Subsystem `json:"subsystems,omitempty"`
+	// Ready is whether the server is ready, as reported by /readyz.
+	Ready bool `json:"ready"`
+	// ReadyzChecks are the checks of /readyz.
+	ReadyzChecks []ReadyzCheck `json:"readyzChecks,omitempty"`
+	// Normalizations are the flag values the server changed at startup.
+	Normalizations []Normalization `json:"normalizations,omitempty"`
+}
+
+// InstanceVersions are the versions of the components of a badidea server.
+type InstanceVersions struct {
+	// Kubernetes is the version of the Kubernetes libraries the server is built from.
+	Kubernetes string `json:"kubernetes"`
+	// Etcd is the version of the embedded etcd server. It is empty with external etcd servers.
+	Etcd string `json:"etcd,omitempty"`
+	// Go is the version of Go the server is built with.
+	Go string `json:"go"`
+}
+
+// Subsystem is an optional subsystem of a badidea server.
+type Subsystem struct {
+	// Name is the name of the subsystem, like garbage-collector.
+	Name string `json:"name"`
+	// Enabled is whether the subsystem is enabled.
+	Enabled bool `json:"enabled"`
+}
+
+// ReadyzCheck is a check of /readyz.
+type ReadyzCheck struct {
+	// Name is the name of the check, like etcd.
+	Name string `json:"name"`
+	// Ready is whether the check passed.
+	Ready bool `json:"ready"`
+}
+
+// Normalization is a flag value a badidea server changed at startup.
+type Normalization struct {
+	// Flag is the flag whose value was changed, like --runtime-config.
+	Flag string `json:"flag"`
+	// From is the value set by the user.
+	From string `json:"from"`
+	// To is the value the server uses, empty if it ignores the value.
+	To string `json:"to,omitempty"`
+	// Reason is why the value was changed.
+	Reason string `json:"reason"`
+}
+
+// InstanceList is a list of Instances.
+type InstanceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Instance `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *Instance) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopy copies the Instance.
+func (in *Instance) DeepCopy() *Instance {
+	if in == nil {
+		return nil
+	}
+
+	out := &Instance{TypeMeta: in.TypeMeta, Status: in.Status}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+
+	if in.Status.Features != nil {
+		out.Status.Features = make(map[string]bool, len(in.Status.Features))
+		for name, enabled := range in.Status.Features {
+			out.Status.Features[name] = enabled
+		}
+	}
+
+	if in.Status.Subsystems != nil {
+		out.Status.Subsystems = append([]Subsystem{}, in.Status.Subsystems...)
+	}
+
+	if in.Status.ReadyzChecks != nil {
+		out.Status.ReadyzChecks = append([]ReadyzCheck{}, in.Status.ReadyzChecks...)
+	}
+
+	if in.Status.Normalizations != nil {
+		out.Status.Normalizations = append([]Normalization{}, in.Status.Normalizations...)
+	}
+
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *InstanceList) DeepCopyObject() runtime.Object {
+	if in == nil {
+		return nil
+	}
+
+	out := &InstanceList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+
+	if in.Items != nil {
+		out.Items = make([]Instance, len(in.Items))
+		for i := range in.Items {
+			out.Items[i] = *in.Items[i].DeepCopy()
+		}
+	}
+
+	return out
+}
@@ -23,9 +23,18 @@ import (
 	"sync"
 	"time"
 
+	"github.com/go-openapi/spec"
+	"github.com/thetirefire/badidea/bootstrap"
 	"github.com/thetirefire/badidea/controllers/crdregistration"
+	"github.com/thetirefire/badidea/controllers/garbagecollector"
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	"github.com/thetirefire/badidea/restmapping"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
 	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	apiextensionsv1informers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
 	apiextensionsopenapi "k8s.io/apiextensions-apiserver/pkg/generated/openapi"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -33,13 +42,13 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
 	genericapiserver "k8s.io/apiserver/pkg/server"
-	"k8s.io/apiserver/pkg/server/filters"
 	"k8s.io/apiserver/pkg/server/healthz"
 	genericoptions "k8s.io/apiserver/pkg/server/options"
 	"k8s.io/apiserver/pkg/server/resourceconfig"
 	"k8s.io/client-go/informers"
-	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/version"
 	"k8s.io/klog"
 	v1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
 	v1helper "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1/helper"
@@ -53,49 +62,45 @@ import (
 	"k8s.io/kube-openapi/pkg/common"
 )
 
-// priority defines group priority that is used in discovery. This controls
+// Priority defines group priority that is used in discovery. This controls
 // group position in the kubectl output.
-type priority struct {
-	// group indicates the order of the group relative to other groups.
-	group int32
-	// version indicates the relative order of the version inside of its group.
-	version int32
+type Priority struct {
+	// Group indicates the order of the group relative to other groups.
+	Group int32
+	// Version indicates the relative order of the version inside of its group.
+	Version int32
 }
 
+var customResourceDefinitionKind = apiextensionsv1.Kind("CustomResourceDefinition")
+
 // This is a subset copied from: https://github.com/kubernetes/kubernetes/blob/c7911a384cbc11a4b5003da081b181d6b814d07e/cmd/kube-apiserver/app/aggregator.go#L231-L281
-var apiVersionPriorities = map[schema.GroupVersion]priority{
-	{Group: "", Version: "v1"}: {group: 18000, version: 1},
+var apiVersionPriorities = map[schema.GroupVersion]Priority{
+	{Group: "", Version: "v1"}: {Group: 18000, Version: 1},
 	// to my knowledge, nothing below here collides
-	{Group: "apiextensions.k8s.io", Version: "v1"}:              {group: 16700, version: 15},
-	{Group: "apiextensions.k8s.io", Version: "v1beta1"}:         {group: 16700, version: 9},
-	{Group: "admissionregistration.k8s.io", Version: "v1"}:      {group: 16700, version: 15},
-	{Group: "admissionregistration.k8s.io", Version: "v1beta1"}: {group: 16700, version: 12},
+	{Group: "apiextensions.k8s.io", Version: "v1"}:              {Group: 16700, Version: 15},
+	{Group: "apiextensions.k8s.io", Version: "v1beta1"}:         {Group: 16700, Version: 9},
+	{Group: "admissionregistration.k8s.io", Version: "v1"}:      {Group: 16700, Version: 15},
+	{Group: "admissionregistration.k8s.io", Version: "v1beta1"}: {Group: 16700, Version: 12},
 }
 
-func CreateAggregatorConfig(sharedConfig genericapiserver.Config, sharedEtcdOptions genericoptions.EtcdOptions) (*aggregatorapiserver.Config, error) {
+// CreateAggregatorConfig creates the configuration of the aggregator from the configuration shared
+// with the apiextensions server. It is configured as the top of the chain by configureTopServer.
+func CreateAggregatorConfig(o options.CompletedServerRunOptions, sharedConfig genericapiserver.Config, sharedEtcdOptions genericoptions.EtcdOptions, versionedInformers informers.SharedInformerFactory) (*aggregatorapiserver.Config, error) {
 	// make a shallow copy to let us twiddle a few things
 	// most of the config actually remains the same.  We only need to mess with a couple items related to the particulars of the aggregator
 	genericConfig := sharedConfig
 	genericConfig.PostStartHooks = map[string]genericapiserver.PostStartHookConfigEntry{}
 	genericConfig.RESTOptionsGetter = nil
-
-	getOpenAPIConfig := func(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
-		result := apiextensionsopenapi.GetOpenAPIDefinitions(ref)
-		for k, v := range aggregatoropenapi.GetOpenAPIDefinitions(ref) {
-			result[k] = v
-		}
-
-		return result
+	// the extensions server appends its own checks to slices sharing these backing arrays
+	genericConfig.HealthzChecks = append([]healthz.HealthChecker{}, genericConfig.HealthzChecks...)
+	genericConfig.ReadyzChecks = append([]healthz.HealthChecker{}, genericConfig.ReadyzChecks...)
+
+	if !o.DisableOpenAPI {
+		genericConfig.OpenAPIConfig = newOpenAPIConfig(o,
+			[]common.GetOpenAPIDefinitions{apiextensionsopenapi.GetOpenAPIDefinitions, aggregatoropenapi.GetOpenAPIDefinitions},
+			apiextensionsapiserver.Scheme, aggregatorscheme.Scheme)
 	}
 
-	genericConfig.OpenAPIConfig = genericapiserver.DefaultOpenAPIConfig(getOpenAPIConfig, openapinamer.NewDefinitionNamer(apiextensionsapiserver.Scheme, aggregatorscheme.Scheme))
-	genericConfig.OpenAPIConfig.Info.Title = "BadIdea"
-	genericConfig.OpenAPIConfig.Info.Version = "0.1"
-	genericConfig.LongRunningFunc = filters.BasicLongRunningRequestCheck(
-		sets.NewString("watch"),
-		sets.NewString(),
-	)
-
 	// TODO: Do we need to override AdmissionControl similar to: https://github.com/kubernetes/kubernetes/blob/c7911a384cbc11a4b5003da081b181d6b814d07e/cmd/kube-apiserver/app/aggregator.go#L70-L80?
 
 	// copy the etcd options so we don't mutate originals.
@@ -104,17 +109,19 @@ func CreateAggregatorConfig(sharedConfig genericapiserver.Config, sharedEtcdOpti
 	etcdOptions.StorageConfig.EncodeVersioner = runtime.NewMultiGroupVersioner(v1beta1.SchemeGroupVersion, schema.GroupKind{Group: v1beta1.GroupName})
 	genericConfig.RESTOptionsGetter = &genericoptions.SimpleRestOptionsFactory{Options: etcdOptions}
 
-	// override MergedResourceConfig with aggregator defaults and registry
-	// trying nil, since this is sourced from k8s.io/component-base/cli/flag.ConfigurationMap
-	mergedResourceConfig, err := resourceconfig.MergeAPIResourceConfigs(aggregatorapiserver.DefaultAPIResourceConfigSource(), nil, aggregatorscheme.Scheme)
+	// override MergedResourceConfig with aggregator defaults and registry. --runtime-config is shared
+	// with the apiextensions server, each server picks the groups of its own registry.
+	mergedResourceConfig, err := resourceconfig.MergeAPIResourceConfigs(aggregatorapiserver.DefaultAPIResourceConfigSource(), o.Extensions.APIEnablement.RuntimeConfig, aggregatorscheme.Scheme)
 	if err != nil {
 		return nil, err
 	}
 
 	genericConfig.MergedResourceConfig = mergedResourceConfig
 
-	// TODO: fake it until we make it
-	versionedInformers := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 10*time.Minute)
+	if !mergedResourceConfig.VersionEnabled(v1.SchemeGroupVersion) {
+		return nil, NewStageError(ErrInvalidOptions, fmt.Errorf("--runtime-config disables %v, which the aggregator serves its APIServices with, enable it or set --disable-aggregator", v1.SchemeGroupVersion))
+	}
+
 	serviceResolver := aggregatorapiserver.NewClusterIPServiceResolver(versionedInformers.Core().V1().Services().Lister())
 
 	aggregatorConfig := &aggregatorapiserver.Config{
@@ -133,35 +140,88 @@ func CreateAggregatorConfig(sharedConfig genericapiserver.Config, sharedEtcdOpti
 	return aggregatorConfig, nil
 }
 
-func CreateAggregatorServer(aggregatorConfig *aggregatorapiserver.Config, delegateAPIServer genericapiserver.DelegationTarget, apiExtensionInformers apiextensionsinformers.SharedInformerFactory) (*aggregatorapiserver.APIAggregator, error) {
-	aggregatorServer, err := aggregatorConfig.Complete().NewWithDelegate(delegateAPIServer)
+// CreateAggregatorServer creates the aggregator delegating to delegateAPIServer. The group versions
+// served by the delegates that have a priority in priorities are registered as APIServices, and those
+// of the CRDs if apiExtensionInformers is not nil. The autoregistration controllers report to
+// heartbeats unless it is nil.
+func CreateAggregatorServer(o options.CompletedServerRunOptions, aggregatorConfig *aggregatorapiserver.Config, delegateAPIServer genericapiserver.DelegationTarget, apiExtensionInformers apiextensionsinformers.SharedInformerFactory, restMapper *restmapping.RESTMapper, clients *LoopbackClients, heartbeats *Heartbeats, priorities map[schema.GroupVersion]Priority) (*aggregatorapiserver.APIAggregator, error) {
+	bootstrapApplier, err := newBootstrapApplier(o, restMapper)
 	if err != nil {
 		return nil, err
 	}
 
+	if bootstrapApplier != nil {
+		aggregatorConfig.GenericConfig.ReadyzChecks = append(aggregatorConfig.GenericConfig.ReadyzChecks, bootstrapApplier)
+	}
+
+	aggregatorServer, err := newAggregatorWithDelegate(aggregatorConfig.Complete(), delegateAPIServer)
+	if err != nil {
+		return nil, err
+	}
+
+	restMapper.ResetOn(aggregatorServer.APIRegistrationInformers.Apiregistration().V1().APIServices().Informer())
+	clients.InvalidateDiscoveryOn(aggregatorServer.APIRegistrationInformers.Apiregistration().V1().APIServices().Informer())
+
+	if bootstrapApplier != nil {
+		if err := addBootstrapHook(aggregatorServer.GenericAPIServer, bootstrapApplier, clients); err != nil {
+			return nil, err
+		}
+	}
+
+	// without an OpenAPI config the aggregator neither builds the spec nor runs its OpenAPI aggregation controller
+	if o.DisableOpenAPI {
+		aggregatorServer.GenericAPIServer.Handler.NonGoRestfulMux.HandlePrefix("/openapi/", openAPIDisabledHandler)
+	}
+
 	// create controllers for auto-registration
-	apiRegistrationClient, err := apiregistrationclient.NewForConfig(aggregatorConfig.GenericConfig.LoopbackClientConfig)
+	apiRegistrationClient, err := apiregistrationclient.NewForConfig(clients.ComponentConfig("autoregister"))
 	if err != nil {
 		return nil, err
 	}
 
 	autoRegistrationController := autoregister.NewAutoRegisterController(aggregatorServer.APIRegistrationInformers.Apiregistration().V1().APIServices(), apiRegistrationClient)
-	apiServices := apiServicesToRegister(delegateAPIServer, autoRegistrationController)
-	crdRegistrationController := crdregistration.NewCRDRegistrationController(
-		apiExtensionInformers.Apiextensions().V1().CustomResourceDefinitions(),
-		autoRegistrationController)
+	apiServices := apiServicesToRegister(delegateAPIServer, autoRegistrationController, priorities)
+
+	// startCRDRegistration starts the CRD registration controller and blocks until it has processed the
+	// initial set of CRDs. It is a no-op when CRDs or their auto-registration are disabled.
+	startCRDRegistration := func(stopCh <-chan struct{}) {}
+
+	switch {
+	case apiExtensionInformers == nil:
+		klog.Infof("CRDs are disabled, CRD group versions will not be registered as APIServices")
+	case o.FeatureGate.Enabled(features.BadIdeaCRDAutoRegistration):
+		crdRegistrationController := crdregistration.NewCRDRegistrationController(
+			apiExtensionInformers.Apiextensions().V1().CustomResourceDefinitions(),
+			autoRegistrationController)
+		if heartbeats != nil {
+			crdRegistrationController.SetHeartbeat(heartbeats.Period(), heartbeats.Register("crd-autoregistration").Beat)
+		}
 
-	err = aggregatorServer.GenericAPIServer.AddPostStartHook("kube-apiserver-autoregistration", func(context genericapiserver.PostStartHookContext) error {
-		go crdRegistrationController.Run(5, context.StopCh)
-		go func() {
+		startCRDRegistration = func(stopCh <-chan struct{}) {
+			goHook("kube-apiserver-autoregistration", o.RestartPanickedHooks, stopCh, func() {
+				crdRegistrationController.Run(5, stopCh, goHookWorker("kube-apiserver-autoregistration", o.RestartPanickedHooks, stopCh))
+			})
 			// let the CRD controller process the initial set of CRDs before starting the autoregistration controller.
 			// this prevents the autoregistration controller's initial sync from deleting APIServices for CRDs that still exist.
-			// we only need to do this if CRDs are enabled on this server.  We can't use discovery because we are the source for discovery.
-			if aggregatorConfig.GenericConfig.MergedResourceConfig.AnyVersionForGroupEnabled("apiextensions.k8s.io") {
-				crdRegistrationController.WaitForInitialSync()
-			}
+			// CRDs are served whenever there are apiextensions informers. The merged resource config of the
+			// aggregator only holds its own group, so it cannot tell.
+			crdRegistrationController.WaitForInitialSync()
+		}
+	default:
+		klog.Infof("Feature gate %s is disabled, CRD group versions will not be registered as APIServices", features.BadIdeaCRDAutoRegistration)
+	}
+
+	err = aggregatorServer.GenericAPIServer.AddPostStartHook("kube-apiserver-autoregistration", func(context genericapiserver.PostStartHookContext) error {
+		heartbeat := heartbeats.Register("autoregistration")
+
+		// the autoregistration controller shuts its queue down when Run returns, so it cannot be restarted
+		goHook("kube-apiserver-autoregistration", false, context.StopCh, func() {
+			startCRDRegistration(context.StopCh)
+			// the autoregistration controller cannot report heartbeats, so they only show that the hook
+			// got to start it within the grace period
+			heartbeat.Stop()
 			autoRegistrationController.Run(5, context.StopCh)
-		}()
+		})
 		return nil
 	})
 	if err != nil {
@@ -182,6 +242,194 @@ func CreateAggregatorServer(aggregatorConfig *aggregatorapiserver.Config, delega
 	return aggregatorServer, nil
 }
 
+// newAggregatorWithDelegate creates the aggregator like NewWithDelegate, returning the error the
+// storage of APIServices panics with if it cannot be created, like a misconfigured etcd transport.
+func newAggregatorWithDelegate(config aggregatorapiserver.CompletedConfig, delegateAPIServer genericapiserver.DelegationTarget) (server *aggregatorapiserver.APIAggregator, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		if recovered, ok := r.(error); ok {
+			err = fmt.Errorf("failed to create the aggregator: %w", recovered)
+		} else {
+			err = fmt.Errorf("failed to create the aggregator: %v", r)
+		}
+	}()
+
+	return config.NewWithDelegate(delegateAPIServer)
+}
+
+// configureTopServer configures the server at the top of the chain, whose handler chain serves all
+// requests. quota is nil without --max-stored-objects, heartbeats without --livez-heartbeat-threshold,
+// attribution without --enable-client-attribution, tenancy without --enable-crd-tenancy. writes pauses
+// the writes served by the handler chain. deprecated is read by the handler chain, which is built by New, so resources can be added to it until then.
+func configureTopServer(o options.CompletedServerRunOptions, config *genericapiserver.Config, quota *storageQuota, heartbeats *Heartbeats, deprecated map[schema.GroupVersionResource]filters.Deprecation, attribution *filters.RequestAttribution, writes *filters.WritePause, readiness *filters.Readiness, tenancy *crdTenancy, selectable func(schema.GroupResource) []string) {
+	config.BuildHandlerChainFunc = buildHandlerChainFunc(o, quota, deprecated, attribution, writes, readiness, tenancy, selectable)
+
+	if quota != nil {
+		config.ReadyzChecks = append(config.ReadyzChecks, quota)
+	}
+
+	// losing etcd makes the server unready, but restarting it does not bring etcd back
+	config.LivezChecks = withoutHealthCheck(config.LivezChecks, "etcd")
+
+	if heartbeats != nil {
+		config.LivezChecks = append(config.LivezChecks, heartbeats)
+	}
+}
+
+// completeTopServer adds what the aggregator provides otherwise to s, the server at the top of the
+// chain without the aggregator: the discovery of the groups including the CRD groups if crdInformer
+// is not nil, the application of the bootstrap manifests if bootstrapApplier is not nil, and the
+// handler of a disabled OpenAPI spec.
+func completeTopServer(o options.CompletedServerRunOptions, s *genericapiserver.GenericAPIServer, crdInformer apiextensionsv1informers.CustomResourceDefinitionInformer, bootstrapApplier *bootstrap.Applier, clients *LoopbackClients) error {
+	// the apiextensions server disables the discovery of groups of the servers it is configured with
+	s.Handler.GoRestfulContainer.Add(s.DiscoveryGroupManager.WebService())
+
+	if crdInformer != nil {
+		addCRDGroupsToDiscovery(s.DiscoveryGroupManager, crdInformer)
+	}
+
+	if bootstrapApplier != nil {
+		if err := addBootstrapHook(s, bootstrapApplier, clients); err != nil {
+			return err
+		}
+	}
+
+	if o.DisableOpenAPI {
+		s.Handler.NonGoRestfulMux.HandlePrefix("/openapi/", openAPIDisabledHandler)
+	}
+
+	return nil
+}
+
+// newOpenAPIConfig returns the OpenAPI config of a server of the chain serving the types defined by
+// definitions, named after schemes. Every server has the same info, so the spec keeps it whichever
+// server serves it.
+func newOpenAPIConfig(o options.CompletedServerRunOptions, definitions []common.GetOpenAPIDefinitions, schemes ...*runtime.Scheme) *common.Config {
+	getOpenAPIDefinitions := func(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
+		result := map[string]common.OpenAPIDefinition{}
+		for _, getDefinitions := range definitions {
+			for k, v := range getDefinitions(ref) {
+				result[k] = v
+			}
+		}
+
+		return result
+	}
+
+	config := genericapiserver.DefaultOpenAPIConfig(getOpenAPIDefinitions, openapinamer.NewDefinitionNamer(schemes...))
+	config.Info.Title = o.OpenAPITitle
+	config.Info.Version = o.OpenAPIVersion
+	config.Info.Description = o.OpenAPIDescription
+
+	if config.Info.Version == "" {
+		config.Info.Version = version.Get().GitVersion
+	}
+
+	if o.OpenAPIContactName != "" || o.OpenAPIContactURL != "" || o.OpenAPIContactEmail != "" {
+		config.Info.Contact = &spec.ContactInfo{Name: o.OpenAPIContactName, URL: o.OpenAPIContactURL, Email: o.OpenAPIContactEmail}
+	}
+
+	return config
+}
+
+// newBootstrapApplier returns the applier of the manifests in --bootstrap-manifests-dir, or nil if
+// it is not set.
+func newBootstrapApplier(o options.CompletedServerRunOptions, restMapper *restmapping.RESTMapper) (*bootstrap.Applier, error) {
+	if o.BootstrapManifestsDir == "" {
+		return nil, nil
+	}
+
+	manifests, err := bootstrap.LoadManifests(o.BootstrapManifestsDir)
+	if err != nil {
+		return nil, NewStageError(ErrInvalidOptions, fmt.Errorf("failed to load bootstrap manifests: %w", err))
+	}
+
+	if !crdsEnabled(o) {
+		for _, manifest := range manifests {
+			if manifest.Object.GroupVersionKind().GroupKind() == customResourceDefinitionKind {
+				return nil, NewStageError(ErrInvalidOptions, fmt.Errorf("bootstrap manifest %v cannot be applied without CRDs, --disable-crds or --runtime-config disable them", manifest))
+			}
+		}
+	}
+
+	return bootstrap.NewApplier(manifests, restMapper), nil
+}
+
+// addBootstrapHook applies the bootstrap manifests with the loopback clients once s has started.
+func addBootstrapHook(s *genericapiserver.GenericAPIServer, bootstrapApplier *bootstrap.Applier, clients *LoopbackClients) error {
+	return s.AddPostStartHook("badidea-bootstrap-manifests", func(context genericapiserver.PostStartHookContext) error {
+		goHook("badidea-bootstrap-manifests", false, context.StopCh, func() {
+			bootstrapApplier.Run(clients.ComponentConfig("bootstrap-manifests"), context.StopCh)
+		})
+		return nil
+	})
+}
+
+// addGarbageCollectorHook runs the garbage collector with the loopback clients once s has started,
+// while leaderElection leads it. The resources to watch are discovered again after the changes of the
+// CRDs if crdInformer is not nil. The garbage collector reports to heartbeats unless it is nil.
+func addGarbageCollectorHook(s *genericapiserver.GenericAPIServer, crdInformer apiextensionsv1informers.CustomResourceDefinitionInformer, restMapper *restmapping.RESTMapper, clients *LoopbackClients, heartbeats *Heartbeats, leaderElection *LeaderElection) error {
+	config := clients.ComponentConfig("garbage-collector")
+
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	discoveryClient, err := clients.ComponentDiscovery("garbage-collector")
+	if err != nil {
+		return err
+	}
+
+	// the garbage collector shuts its queue down when Run returns, so every leadership runs a new one
+	var (
+		lock sync.Mutex
+		gc   *garbagecollector.GarbageCollector
+	)
+
+	resync := func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if gc != nil {
+			gc.Resync()
+		}
+	}
+
+	if crdInformer != nil {
+		crdInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { resync() },
+			UpdateFunc: func(oldObj, newObj interface{}) { resync() },
+			DeleteFunc: func(obj interface{}) { resync() },
+		})
+	}
+
+	return s.AddPostStartHook("badidea-garbage-collector", func(context genericapiserver.PostStartHookContext) error {
+		goHook("badidea-garbage-collector", false, context.StopCh, func() {
+			leaderElection.Run("garbage-collector", context.StopCh, func(stopCh <-chan struct{}) {
+				lock.Lock()
+				gc = garbagecollector.New(metadataClient, discoveryClient, restMapper, 30*time.Second)
+				lock.Unlock()
+
+				// the followers send no heartbeats
+				heartbeat := heartbeats.Register("garbage-collector")
+				defer heartbeat.Stop()
+
+				if heartbeats != nil {
+					gc.SetHeartbeat(heartbeats.Period(), heartbeat.Beat)
+				}
+
+				gc.Run(5, stopCh)
+			})
+		})
+		return nil
+	})
+}
+
 // RunAggregator runs the API Aggregator.
 func RunAggregator(server *aggregatorapiserver.APIAggregator, stopCh <-chan struct{}) error {
 	prepared, err := server.PrepareRun()
@@ -192,15 +440,29 @@ func RunAggregator(server *aggregatorapiserver.APIAggregator, stopCh <-chan stru
 	return prepared.Run(stopCh)
 }
 
-func apiServicesToRegister(delegateAPIServer genericapiserver.DelegationTarget, registration autoregister.AutoAPIServiceRegistration) []*v1.APIService {
+func apiServicesToRegister(delegateAPIServer genericapiserver.DelegationTarget, registration autoregister.AutoAPIServiceRegistration, priorities map[schema.GroupVersion]Priority) []*v1.APIService {
 	apiServices := []*v1.APIService{}
 
+	for _, gv := range servedGroupVersions(delegateAPIServer) {
+		apiService := makeAPIService(gv, priorities)
+		if apiService == nil {
+			continue
+		}
+
+		registration.AddAPIServiceToSyncOnStart(apiService)
+		apiServices = append(apiServices, apiService)
+	}
+
+	return apiServices
+}
+
+// servedGroupVersions returns the group versions served by delegateAPIServer and its delegates.
+func servedGroupVersions(delegateAPIServer genericapiserver.DelegationTarget) []schema.GroupVersion {
+	gvs := []schema.GroupVersion{}
+
 	for _, curr := range delegateAPIServer.ListedPaths() {
 		if curr == "/api/v1" {
-			apiService := makeAPIService(schema.GroupVersion{Group: "", Version: "v1"})
-			registration.AddAPIServiceToSyncOnStart(apiService)
-			apiServices = append(apiServices, apiService)
-
+			gvs = append(gvs, schema.GroupVersion{Group: "", Version: "v1"})
 			continue
 		}
 
@@ -214,20 +476,14 @@ func apiServicesToRegister(delegateAPIServer genericapiserver.DelegationTarget,
 			continue
 		}
 
-		apiService := makeAPIService(schema.GroupVersion{Group: tokens[2], Version: tokens[3]})
-		if apiService == nil {
-			continue
-		}
-
-		registration.AddAPIServiceToSyncOnStart(apiService)
-		apiServices = append(apiServices, apiService)
+		gvs = append(gvs, schema.GroupVersion{Group: tokens[2], Version: tokens[3]})
 	}
 
-	return apiServices
+	return gvs
 }
 
-func makeAPIService(gv schema.GroupVersion) *v1.APIService {
-	apiServicePriority, ok := apiVersionPriorities[gv]
+func makeAPIService(gv schema.GroupVersion, priorities map[schema.GroupVersion]Priority) *v1.APIService {
+	apiServicePriority, ok := priorities[gv]
 	if !ok {
 		// if we aren't found, then we shouldn't register ourselves because it could result in a CRD group version
 		// being permanently stuck in the APIServices list.
@@ -241,8 +497,8 @@ func makeAPIService(gv schema.GroupVersion) *v1.APIService {
 		Spec: v1.APIServiceSpec{
 			Group:                gv.Group,
 			Version:              gv.Version,
-			GroupPriorityMinimum: apiServicePriority.group,
-			VersionPriority:      apiServicePriority.version,
+			GroupPriorityMinimum: apiServicePriority.Group,
+			VersionPriority:      apiServicePriority.Version,
 		},
 	}
 }
@@ -289,3 +545,21 @@ func makeAPIServiceAvailableHealthCheck(name string, apiServices []*v1.APIServic
 		return nil
 	})
 }
+
+// withoutHealthCheck returns a copy of checks without the check called name.
+func withoutHealthCheck(checks []healthz.HealthChecker, name string) []healthz.HealthChecker {
+	result := []healthz.HealthChecker{}
+
+	for _, check := range checks {
+		if check.Name() != name {
+			result = append(result, check)
+		}
+	}
+
+	return result
+}
+
+// openAPIDisabledHandler answers requests for the OpenAPI spec of a server started with --disable-openapi.
+var openAPIDisabledHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "the OpenAPI spec is disabled on this server (--disable-openapi)", http.StatusNotFound)
+})
@@ -17,58 +17,126 @@ limitations under the License.
 package apiserver
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/url"
-	"os"
-	"time"
 
+	badideav1alpha1 "github.com/thetirefire/badidea/apis/badidea/v1alpha1"
+	"github.com/thetirefire/badidea/options"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
 	apiextensionsserveroptions "k8s.io/apiextensions-apiserver/pkg/cmd/server/options"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	genericoptions "k8s.io/apiserver/pkg/server/options"
 	"k8s.io/apiserver/pkg/util/proxy"
 	"k8s.io/client-go/informers"
-	"k8s.io/client-go/kubernetes/fake"
 	corev1 "k8s.io/client-go/listers/core/v1"
+	aggregatorscheme "k8s.io/kube-aggregator/pkg/apiserver/scheme"
 )
 
-// CreateExtensions creates the Exensions Server.
-func CreateExtensions() (genericapiserver.Config, genericoptions.EtcdOptions, *apiextensionsapiserver.CustomResourceDefinitions, error) {
-	o := apiextensionsserveroptions.NewCustomResourceDefinitionsServerOptions(os.Stdout, os.Stderr)
-	o.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{"unix://etcd-socket:2379"}
-	o.RecommendedOptions.SecureServing.BindPort = 6443
-	o.RecommendedOptions.Authentication.RemoteKubeConfigFileOptional = true
-	o.RecommendedOptions.Authorization.RemoteKubeConfigFileOptional = true
-	o.RecommendedOptions.Authorization.AlwaysAllowPaths = []string{"*"}
-	o.RecommendedOptions.Authorization.AlwaysAllowGroups = []string{"system:unauthenticated"}
-	o.RecommendedOptions.CoreAPI = nil
-	o.RecommendedOptions.Admission = nil
+// CreateExtensionsConfig creates the configuration of the Extensions Server. The self-signed serving
+// certificates are generated here, once for the whole chain.
+func CreateExtensionsConfig(serverOptions options.CompletedServerRunOptions, versionedInformers informers.SharedInformerFactory) (*apiextensionsapiserver.Config, genericoptions.EtcdOptions, error) {
+	o := serverOptions.Extensions
 
 	if err := o.Complete(); err != nil {
-		return genericapiserver.Config{}, *o.RecommendedOptions.Etcd, nil, err
+		return nil, *o.RecommendedOptions.Etcd, NewStageError(ErrInvalidOptions, err)
 	}
 
-	if err := o.Validate(); err != nil {
-		return genericapiserver.Config{}, *o.RecommendedOptions.Etcd, nil, err
+	if err := validateRuntimeConfig(o.APIEnablement.RuntimeConfig, serverOptions.AllowUnknownRuntimeConfig, apiextensionsapiserver.Scheme, aggregatorscheme.Scheme, flowControlScheme, badideav1alpha1.Scheme); err != nil {
+		return nil, *o.RecommendedOptions.Etcd, NewStageError(ErrInvalidOptions, err)
 	}
 
-	// TODO have a "real" external address
-	if err := o.RecommendedOptions.SecureServing.MaybeDefaultWithSelfSignedCerts("localhost", nil, []net.IP{net.ParseIP("127.0.0.1")}); err != nil {
-		return genericapiserver.Config{}, *o.RecommendedOptions.Etcd, nil, fmt.Errorf("error creating self-signed certificates: %w", err)
+	// the runtime config holds the groups of the other servers too, which o.Validate rejects, and
+	// validateRuntimeConfig checked it
+	if err := utilerrors.NewAggregate(o.RecommendedOptions.Validate()); err != nil {
+		return nil, *o.RecommendedOptions.Etcd, NewStageError(ErrInvalidOptions, err)
+	}
+
+	if serverOptions.BindUnixSocket != "" {
+		listener, err := listenUnixSocket(serverOptions.BindUnixSocket)
+		if err != nil {
+			return nil, *o.RecommendedOptions.Etcd, NewStageError(ErrInvalidOptions, fmt.Errorf("failed to listen on --bind-unix-socket: %w", err))
+		}
+
+		o.RecommendedOptions.SecureServing.Listener = listener
+	}
+
+	// clients on this machine keep connecting through the loopback addresses
+	alternateIPs := []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback, serverOptions.AdvertiseAddress}
+	if err := o.RecommendedOptions.SecureServing.MaybeDefaultWithSelfSignedCerts(serverOptions.ExternalHostname, []string{"localhost"}, alternateIPs); err != nil {
+		return nil, *o.RecommendedOptions.Etcd, NewStageError(ErrInvalidServingCerts, fmt.Errorf("error creating self-signed certificates: %w", err))
+	}
+
+	// loaded here to tell broken certificates apart from the other failures of ApplyTo
+	if certKey := o.RecommendedOptions.SecureServing.ServerCert.CertKey; certKey.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(certKey.CertFile, certKey.KeyFile); err != nil {
+			return nil, *o.RecommendedOptions.Etcd, NewStageError(ErrInvalidServingCerts, err)
+		}
 	}
 
 	serverConfig := genericapiserver.NewRecommendedConfig(apiextensionsapiserver.Codecs)
 	if err := o.RecommendedOptions.ApplyTo(serverConfig); err != nil {
-		return genericapiserver.Config{}, *o.RecommendedOptions.Etcd, nil, err
+		return nil, *o.RecommendedOptions.Etcd, err
+	}
+
+	// the codec stores the CRDs as v1beta1, which the versioner tells the storage version hash of their
+	// discovery from
+	etcdOptions := *o.RecommendedOptions.Etcd
+	etcdOptions.StorageConfig.EncodeVersioner = runtime.NewMultiGroupVersioner(apiextensionsv1beta1.SchemeGroupVersion, schema.GroupKind{Group: apiextensionsv1beta1.GroupName})
+	serverConfig.RESTOptionsGetter = &genericoptions.SimpleRestOptionsFactory{Options: etcdOptions}
+
+	// Complete authorizes system:masters on top, which the loopback clients belong to
+	switch serverOptions.AuthorizationMode {
+	case options.AuthorizationModeAlwaysAllow:
+		serverConfig.Authorization.Authorizer = authorizerfactory.NewAlwaysAllowAuthorizer()
+	case options.AuthorizationModeAlwaysDeny:
+		serverConfig.Authorization.Authorizer = authorizerfactory.NewAlwaysDenyAuthorizer()
+	}
+
+	serverConfig.SecureServing.Listener = newServingListener(serverConfig.SecureServing.Listener, serverOptions.MaxConnections, serverOptions.TCPKeepAlivePeriod)
+
+	serverConfig.ShutdownDelayDuration = serverOptions.ShutdownDelayDuration
+
+	// the other servers of the chain copy this config, so they all tell long-running requests apart alike
+	serverConfig.LongRunningFunc = isLongRunningRequest
+	serverConfig.RequestTimeout = serverOptions.RequestTimeout
+
+	// the endpoint handlers of every server of the chain, including those of custom resources, read
+	// bodies up to this limit. Without one they keep their own.
+	if serverOptions.MaxRequestBodyBytes > 0 {
+		serverConfig.MaxRequestBodyBytes = serverOptions.MaxRequestBodyBytes
+		serverConfig.JSONPatchMaxCopyBytes = serverOptions.MaxRequestBodyBytes
+	}
+	serverConfig.CorsAllowedOriginList = serverOptions.CorsAllowedOrigins
+
+	// Complete appends the secure port, bracketing IPv6 addresses
+	serverConfig.PublicAddress = serverOptions.AdvertiseAddress
+	serverConfig.ExternalAddress = serverOptions.ExternalHostname
+
+	if serverOptions.BindUnixSocket != "" {
+		serverConfig.LoopbackClientConfig.Dial = UnixSocketDialer(serverOptions.BindUnixSocket)
+	}
+
+	// every internal client of the chain, including those the libraries create, is built from this config
+	if serverOptions.InternalClientQPS > 0 {
+		serverConfig.LoopbackClientConfig.QPS = serverOptions.InternalClientQPS
+	}
+
+	if serverOptions.InternalClientBurst > 0 {
+		serverConfig.LoopbackClientConfig.Burst = serverOptions.InternalClientBurst
 	}
 
 	if err := o.APIEnablement.ApplyTo(&serverConfig.Config, apiextensionsapiserver.DefaultAPIResourceConfigSource(), apiextensionsapiserver.Scheme); err != nil {
-		return serverConfig.Config, *o.RecommendedOptions.Etcd, nil, err
+		return nil, *o.RecommendedOptions.Etcd, err
 	}
 
-	// TODO: fake it until we make it
-	serverConfig.SharedInformerFactory = informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 10*time.Minute)
+	serverConfig.SharedInformerFactory = versionedInformers
 
 	config := &apiextensionsapiserver.Config{
 		GenericConfig: serverConfig,
@@ -79,12 +147,7 @@ func CreateExtensions() (genericapiserver.Config, genericoptions.EtcdOptions, *a
 		},
 	}
 
-	server, err := config.Complete().New(genericapiserver.NewEmptyDelegate())
-	if err != nil {
-		return serverConfig.Config, *o.RecommendedOptions.Etcd, nil, err
-	}
-
-	return serverConfig.Config, *o.RecommendedOptions.Etcd, server, nil
+	return config, *o.RecommendedOptions.Etcd, nil
 }
 
 type serviceResolver struct {
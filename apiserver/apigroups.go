@@ -0,0 +1,237 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
+	apiextensionsopenapi "k8s.io/apiextensions-apiserver/pkg/generated/openapi"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/healthz"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	"k8s.io/klog"
+	aggregatorscheme "k8s.io/kube-aggregator/pkg/apiserver/scheme"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+// apiGroup is an API group implemented in-process, added with WithAPIGroup.
+type apiGroup struct {
+	info               *genericapiserver.APIGroupInfo
+	priorities         map[schema.GroupVersion]Priority
+	openAPIDefinitions common.GetOpenAPIDefinitions
+}
+
+// builtinGroups are the groups served by the chain itself. The core group is listed for the clients
+// relying on it being reserved, the badidea group whether or not BadIdeaInstanceStatus serves it, and
+// the flowcontrol group whether or not the runtime config enables it.
+var builtinGroups = map[string]bool{
+	"":                             true,
+	"apiextensions.k8s.io":         true,
+	"apiregistration.k8s.io":       true,
+	"badidea.x-k8s.io":             true,
+	"flowcontrol.apiserver.k8s.io": true,
+}
+
+// WithAPIGroup adds an API group implemented by the storage in apiGroupInfo to the chain, e.g. one
+// with custom rest.Storage instead of CRDs. If apiGroupInfo has no scheme, the group is served with
+// the scheme and codecs of the chain. The group is served by a server between the aggregator
+// and the apiextensions server, created by New, and is registered as APIServices with priorities,
+// which must hold a priority of every version. The OpenAPI spec of the group is built from
+// openAPIDefinitions, which need to cover its types only. If any group is added without
+// openAPIDefinitions, all of them are left out of the spec. Groups served by the chain itself or
+// added before are rejected. A CRD of the group is shadowed by it.
+func (c *ServerChainConfig) WithAPIGroup(apiGroupInfo genericapiserver.APIGroupInfo, priorities map[schema.GroupVersion]Priority, openAPIDefinitions common.GetOpenAPIDefinitions) error {
+	if len(apiGroupInfo.PrioritizedVersions) == 0 {
+		return fmt.Errorf("API group has no versions")
+	}
+
+	group := apiGroupInfo.PrioritizedVersions[0].Group
+	if builtinGroups[group] || c.hasGroup(group) {
+		return fmt.Errorf("API group %q is already served", group)
+	}
+
+	for _, gv := range apiGroupInfo.PrioritizedVersions {
+		if gv.Group != group {
+			return fmt.Errorf("API group %q has a version of group %q", group, gv.Group)
+		}
+
+		if p, ok := priorities[gv]; !ok || p.Group <= 0 || p.Version <= 0 {
+			return fmt.Errorf("API group version %v needs a positive group and version priority", gv)
+		}
+	}
+
+	c.apiGroups = append(c.apiGroups, apiGroup{info: &apiGroupInfo, priorities: priorities, openAPIDefinitions: openAPIDefinitions})
+
+	return nil
+}
+
+// WithDeprecatedResource marks gvr, a resource of an API group added with WithAPIGroup, deprecated.
+// Requests for it get a Warning header and are tracked by the badidea_requested_deprecated_apis
+// metric, an audit annotation and a daily log line per client. It overrides the entry of gvr in the
+// DeprecatedResources of the options.
+func (c *ServerChainConfig) WithDeprecatedResource(gvr schema.GroupVersionResource, deprecation filters.Deprecation) error {
+	for _, g := range c.apiGroups {
+		if _, ok := g.info.VersionedResourcesStorageMap[gvr.Version][gvr.Resource]; ok && g.info.PrioritizedVersions[0].Group == gvr.Group {
+			c.deprecated[gvr] = deprecation
+			return nil
+		}
+	}
+
+	return fmt.Errorf("resource %v is not served by an API group added with WithAPIGroup", gvr)
+}
+
+// enableAPIGroups drops the versions of the groups added in-process that the runtime config of o
+// disables, and the groups left without versions, so the meta keys like api/all=false apply to them
+// like to the built-in groups. The enabled and disabled versions are recorded in
+// apiGroupsResourceConfig.
+func (c *ServerChainConfig) enableAPIGroups(o options.CompletedServerRunOptions) error {
+	enabled := []apiGroup{}
+	c.apiGroupsResourceConfig = serverstorage.NewResourceConfig()
+
+	for _, g := range c.apiGroups {
+		registry := g.info.Scheme
+		if registry == nil {
+			registry = c.scheme
+		}
+
+		versions, err := enabledVersions(o.Extensions.APIEnablement.RuntimeConfig, g.info.PrioritizedVersions, registry)
+		if err != nil {
+			return err
+		}
+
+		c.apiGroupsResourceConfig.DisableVersions(g.info.PrioritizedVersions...)
+		c.apiGroupsResourceConfig.EnableVersions(versions...)
+
+		if len(versions) == 0 {
+			klog.Infof("Skipping API group %s, --runtime-config disables all its versions", g.info.PrioritizedVersions[0].Group)
+			continue
+		}
+
+		info := *g.info
+		info.PrioritizedVersions = versions
+		info.VersionedResourcesStorageMap = map[string]map[string]rest.Storage{}
+
+		for _, gv := range versions {
+			info.VersionedResourcesStorageMap[gv.Version] = g.info.VersionedResourcesStorageMap[gv.Version]
+		}
+
+		g.info = &info
+		enabled = append(enabled, g)
+	}
+
+	c.apiGroups = enabled
+
+	return nil
+}
+
+func (c *ServerChainConfig) hasGroup(group string) bool {
+	for gv := range apiVersionPriorities {
+		if gv.Group == group {
+			return true
+		}
+	}
+
+	for _, g := range c.apiGroups {
+		if g.info.PrioritizedVersions[0].Group == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiVersionPriorities returns the priorities of the built-in group versions and of the groups added
+// with WithAPIGroup.
+func (c *ServerChainConfig) apiVersionPriorities() map[schema.GroupVersion]Priority {
+	priorities := map[schema.GroupVersion]Priority{}
+
+	for gv, p := range apiVersionPriorities {
+		priorities[gv] = p
+	}
+
+	for _, g := range c.apiGroups {
+		for _, gv := range g.info.PrioritizedVersions {
+			priorities[gv] = g.priorities[gv]
+		}
+	}
+
+	return priorities
+}
+
+// createAPIGroupsServer creates the server of the groups added with WithAPIGroup, delegating to
+// delegateAPIServer, and returns it with its configuration.
+func (c *ServerChainConfig) createAPIGroupsServer(o options.CompletedServerRunOptions, delegateAPIServer genericapiserver.DelegationTarget) (*genericapiserver.GenericAPIServer, *genericapiserver.Config, error) {
+	// a shallow copy like the one of the aggregator. The hooks and checks are inherited from the delegate.
+	genericConfig := c.Extensions.GenericConfig.Config
+	genericConfig.PostStartHooks = map[string]genericapiserver.PostStartHookConfigEntry{}
+	genericConfig.HealthzChecks = append([]healthz.HealthChecker{}, genericConfig.HealthzChecks...)
+	genericConfig.ReadyzChecks = append([]healthz.HealthChecker{}, genericConfig.ReadyzChecks...)
+	genericConfig.LivezChecks = append([]healthz.HealthChecker{}, genericConfig.LivezChecks...)
+	genericConfig.OpenAPIConfig = nil
+	// the aggregator or completeTopServer serves the discovery of groups
+	genericConfig.EnableDiscovery = false
+	genericConfig.MergedResourceConfig = c.apiGroupsResourceConfig
+
+	if c.Aggregator == nil {
+		configureTopServer(o, &genericConfig, c.storage.quota, c.Heartbeats, c.deprecated, c.attribution, c.writes, c.readiness, c.tenancy, c.selectableFields)
+	}
+
+	schemes := []*runtime.Scheme{apiextensionsapiserver.Scheme, aggregatorscheme.Scheme, c.scheme}
+	definitions := []common.GetOpenAPIDefinitions{apiextensionsopenapi.GetOpenAPIDefinitions}
+
+	// the spec of the server has to define the types of every route
+	withOpenAPI := !o.DisableOpenAPI
+
+	for _, g := range c.apiGroups {
+		if g.info.Scheme == nil {
+			g.info.Scheme = c.scheme
+			g.info.ParameterCodec = runtime.NewParameterCodec(c.scheme)
+			g.info.NegotiatedSerializer = c.Codecs()
+			if g.info.OptionsExternalVersion == nil {
+				g.info.OptionsExternalVersion = &schema.GroupVersion{Version: "v1"}
+			}
+		} else {
+			schemes = append(schemes, g.info.Scheme)
+		}
+
+		definitions = append(definitions, g.openAPIDefinitions)
+		withOpenAPI = withOpenAPI && g.openAPIDefinitions != nil
+	}
+
+	if withOpenAPI {
+		genericConfig.OpenAPIConfig = newOpenAPIConfig(o, definitions, schemes...)
+	}
+
+	s, err := genericConfig.Complete(c.Extensions.GenericConfig.SharedInformerFactory).New("badidea-apigroups", delegateAPIServer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, g := range c.apiGroups {
+		if err := s.InstallAPIGroup(g.info); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return s, &genericConfig, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	"github.com/thetirefire/badidea/filters"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+)
+
+func TestWithAPIGroup(t *testing.T) {
+	gadgets := schema.GroupVersion{Group: "example.badidea.dev", Version: "v1"}
+
+	c := &ServerChainConfig{}
+	if err := c.WithAPIGroup(genericapiserver.APIGroupInfo{PrioritizedVersions: []schema.GroupVersion{gadgets}}, map[schema.GroupVersion]Priority{gadgets: {Group: 1500, Version: 15}}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if p := c.apiVersionPriorities()[gadgets]; p.Group != 1500 || p.Version != 15 {
+		t.Errorf("expected the priority of %v to be registered, got %v", gadgets, p)
+	}
+
+	tests := []struct {
+		name       string
+		versions   []schema.GroupVersion
+		priorities map[schema.GroupVersion]Priority
+	}{
+		{name: "no versions"},
+		{
+			name:       "core group",
+			versions:   []schema.GroupVersion{{Version: "v1"}},
+			priorities: map[schema.GroupVersion]Priority{{Version: "v1"}: {Group: 1, Version: 1}},
+		},
+		{
+			name:       "group of the chain",
+			versions:   []schema.GroupVersion{{Group: "apiregistration.k8s.io", Version: "v2"}},
+			priorities: map[schema.GroupVersion]Priority{{Group: "apiregistration.k8s.io", Version: "v2"}: {Group: 1, Version: 1}},
+		},
+		{
+			name:       "group with a built-in priority",
+			versions:   []schema.GroupVersion{{Group: "admissionregistration.k8s.io", Version: "v1"}},
+			priorities: map[schema.GroupVersion]Priority{{Group: "admissionregistration.k8s.io", Version: "v1"}: {Group: 1, Version: 1}},
+		},
+		{
+			name:       "group added before",
+			versions:   []schema.GroupVersion{{Group: gadgets.Group, Version: "v2"}},
+			priorities: map[schema.GroupVersion]Priority{{Group: gadgets.Group, Version: "v2"}: {Group: 1, Version: 1}},
+		},
+		{
+			name:     "version without priority",
+			versions: []schema.GroupVersion{{Group: "other.badidea.dev", Version: "v1"}},
+		},
+		{
+			name:       "versions of several groups",
+			versions:   []schema.GroupVersion{{Group: "other.badidea.dev", Version: "v1"}, {Group: "third.badidea.dev", Version: "v1"}},
+			priorities: map[schema.GroupVersion]Priority{{Group: "other.badidea.dev", Version: "v1"}: {Group: 1, Version: 1}, {Group: "third.badidea.dev", Version: "v1"}: {Group: 1, Version: 1}},
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			if err := c.WithAPIGroup(genericapiserver.APIGroupInfo{PrioritizedVersions: test.versions}, test.priorities, nil); err == nil {
+				t.Error("expected the API group to be rejected")
+			}
+		})
+	}
+
+	if len(c.apiGroups) != 1 {
+		t.Errorf("expected only the first API group to be added, got %d", len(c.apiGroups))
+	}
+}
+
+func TestWithDeprecatedResource(t *testing.T) {
+	gadgets := schema.GroupVersion{Group: "example.badidea.dev", Version: "v1"}
+
+	c := &ServerChainConfig{deprecated: map[schema.GroupVersionResource]filters.Deprecation{}}
+	if err := c.WithAPIGroup(genericapiserver.APIGroupInfo{
+		PrioritizedVersions:          []schema.GroupVersion{gadgets},
+		VersionedResourcesStorageMap: map[string]map[string]rest.Storage{"v1": {"gadgets": nil}},
+	}, map[schema.GroupVersion]Priority{gadgets: {Group: 1500, Version: 15}}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deprecation := filters.Deprecation{Replacement: "example.badidea.dev/v2 gadgets", RemovedRelease: "v2.0"}
+	if err := c.WithDeprecatedResource(gadgets.WithResource("gadgets"), deprecation); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.deprecated[gadgets.WithResource("gadgets")] != deprecation {
+		t.Errorf("expected the deprecation of gadgets to be registered, got %v", c.deprecated)
+	}
+
+	for _, gvr := range []schema.GroupVersionResource{
+		gadgets.WithResource("gizmos"),
+		{Group: gadgets.Group, Version: "v2", Resource: "gadgets"},
+		{Group: "other.badidea.dev", Version: "v1", Resource: "gadgets"},
+	} {
+		if err := c.WithDeprecatedResource(gvr, deprecation); err == nil {
+			t.Errorf("expected %v to be rejected", gvr)
+		}
+	}
+}
@@ -14,20 +14,462 @@ limitations under the License.
 package apiserver
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/thetirefire/badidea/bootstrap"
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	"github.com/thetirefire/badidea/restmapping"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	apiextensionsv1informers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	apiextensionsopenapi "k8s.io/apiextensions-apiserver/pkg/generated/openapi"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/admission"
+	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
 	aggregatorapiserver "k8s.io/kube-aggregator/pkg/apiserver"
+	aggregatorscheme "k8s.io/kube-aggregator/pkg/apiserver/scheme"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+var serverChainDuration = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Name:           "badidea_server_chain_duration_seconds",
+		Help:           "Time it took to construct the server chain at startup, broken down by phase.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"phase"},
 )
 
+func init() {
+	legacyregistry.MustRegister(serverChainDuration)
+}
+
+// ServerChainConfig holds the configuration of every server in the chain.
+type ServerChainConfig struct {
+	Extensions *apiextensionsapiserver.Config
+	Aggregator *aggregatorapiserver.Config
+
+	// ServingCA is the PEM bundle clients have to trust to talk to a serving certificate generated
+	// in memory. It is nil if the certificate was read from or written to files.
+	ServingCA []byte
+	// RESTMapper maps the kinds and resources served by the chain through the loopback client. The
+	// servers created by New reset it when CRDs and APIServices change.
+	RESTMapper *restmapping.RESTMapper
+	// Clients are the loopback clients shared by the components of the chain and embedders.
+	Clients *LoopbackClients
+	// InsecureServing serves the chain over plain HTTP. It is nil unless --insecure-bind-port is set.
+	InsecureServing *genericapiserver.DeprecatedInsecureServingInfo
+	// Heartbeats fail /livez when the controllers of the chain are wedged. Embedders can register
+	// their own controllers. It is nil without --livez-heartbeat-threshold.
+	Heartbeats *Heartbeats
+	// LeaderElection runs the controllers of the chain only while it leads them. Embedders can run
+	// their own controllers with it. It is nil without --leader-elect.
+	LeaderElection *LeaderElection
+
+	storage   *storageTracker
+	apiGroups []apiGroup
+	// apiGroupsResourceConfig holds the versions of apiGroups the runtime config enables and disables.
+	apiGroupsResourceConfig *serverstorage.ResourceConfig
+	// deprecated holds the deprecated resources tracked by the handler chain of the top server.
+	deprecated map[schema.GroupVersionResource]filters.Deprecation
+	// attribution attributes the requests of the top server to their clients. It is nil without
+	// --enable-client-attribution.
+	attribution *filters.RequestAttribution
+	// writes tracks the writes of the top server in flight, and pauses them for backups.
+	writes *filters.WritePause
+	// readiness caches whether the top server is ready and shutting down, for its handler chain.
+	readiness *filters.Readiness
+	// etcdProbe probes the round-trip time of etcd. It is nil without --etcd-probe-interval.
+	etcdProbe *etcdProbe
+	// tenancy confines the CRDs of tenants to their members. It is nil without --enable-crd-tenancy.
+	tenancy *crdTenancy
+	// selectableFields returns the selectable fields of a custom resource. It is nil without the
+	// BadIdeaCRDSelectableFields feature.
+	selectableFields func(schema.GroupResource) []string
+
+	// scheme holds the types of the API groups added with WithAPIGroup, served with codecs.
+	scheme *runtime.Scheme
+	codecs *serializer.CodecFactory
+	// storageVersions are the versions the groups with storage of RESTOptionsGetter are stored as.
+	storageVersions map[string]schema.GroupVersion
+
+	etcdOptions     genericoptions.EtcdOptions
+	watchCacheSizes *watchCacheSizes
+	limits          metadataLimits
+}
+
+// Server is the server at the top of the chain, which serves the requests.
+type Server struct {
+	// GenericAPIServer is the generic server of the aggregator, or of the server at the top of the
+	// chain if the aggregator is disabled.
+	GenericAPIServer *genericapiserver.GenericAPIServer
+	// Aggregator is nil if the aggregator is disabled.
+	Aggregator *aggregatorapiserver.APIAggregator
+
+	readiness *filters.Readiness
+}
+
+// Run serves until stopCh is closed.
+func (s *Server) Run(stopCh <-chan struct{}) error {
+	// requests are rejected from the start of the shutdown delay, as the shutdown readyz check fails
+	if s.readiness != nil {
+		go func() {
+			<-stopCh
+			s.readiness.ShutDown()
+		}()
+	}
+
+	if s.Aggregator != nil {
+		return RunAggregator(s.Aggregator, stopCh)
+	}
+
+	return s.GenericAPIServer.PrepareRun().Run(stopCh)
+}
+
 // CreateServerChain creates the chained aggregated server.
-func CreateServerChain() (*aggregatorapiserver.APIAggregator, error) {
-	genericConfig, genericEtcdOptions, extensionServer, err := CreateExtensions()
+func CreateServerChain(o options.CompletedServerRunOptions) (*Server, error) {
+	config, err := CreateServerChainConfig(o)
 	if err != nil {
 		return nil, err
 	}
 
-	config, err := CreateAggregatorConfig(genericConfig, genericEtcdOptions)
+	return config.New(o)
+}
+
+// CreateServerChainConfig creates the configuration of the chained aggregated server. It does not talk
+// to etcd, so it can run while etcd is starting up. Generating the serving and loopback certificates
+// dominates its run time. Errors are StageErrors.
+func CreateServerChainConfig(o options.CompletedServerRunOptions) (*ServerChainConfig, error) {
+	start := time.Now()
+
+	// one factory for the whole chain. Only the first server's informer start hook is registered,
+	// so a factory of the aggregator's own would never be started.
+	// TODO: fake it until we make it, there are no core APIs to back a loopback client
+	versionedInformers := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 10*time.Minute)
+
+	extensionsConfig, genericEtcdOptions, err := CreateExtensionsConfig(o, versionedInformers)
 	if err != nil {
-		return nil, err
+		return nil, NewStageError(ErrExtensionsServer, err)
+	}
+
+	var aggregatorConfig *aggregatorapiserver.Config
+
+	if !o.DisableAggregator {
+		aggregatorConfig, err = CreateAggregatorConfig(o, extensionsConfig.GenericConfig.Config, genericEtcdOptions, versionedInformers)
+		if err != nil {
+			return nil, NewStageError(ErrAggregatorServer, err)
+		}
+	}
+
+	storage := newStorageTracker()
+	storage.quota = newStorageQuota(o.MaxStoredObjects)
+	storage.stampUsers = o.FeatureGate.Enabled(features.BadIdeaUserAnnotations)
+	storage.selectableFields = o.FeatureGate.Enabled(features.BadIdeaCRDSelectableFields)
+	storage.maxDeleteCollectionObjects = o.MaxDeleteCollectionObjects
+
+	if o.DisableEmbeddedEtcd && !o.WaitForEtcd {
+		storage.etcdGate = newEtcdGate()
+	}
+
+	heartbeats := newHeartbeats(o.LivezHeartbeatThreshold, o.LivezHeartbeatGracePeriod)
+
+	leaderElection, err := newLeaderElection(o)
+	if err != nil {
+		return nil, NewStageError(ErrExtensionsServer, err)
+	}
+
+	deprecated := map[schema.GroupVersionResource]filters.Deprecation{}
+	for gvr, replacement := range o.DeprecatedResources {
+		deprecated[gvr] = filters.Deprecation{Replacement: replacement}
+	}
+
+	var attribution *filters.RequestAttribution
+	if o.EnableClientAttribution {
+		attribution = filters.NewRequestAttribution(o.ClientAttributionMaxClients, o.ClientAttributionTop, o.ClientAttributionHashUsers)
+	}
+
+	writes := filters.NewWritePause(o.MaxWritePause, isPrivilegedUser)
+	readiness := filters.NewReadiness()
+
+	var tenancy *crdTenancy
+	if o.EnableCRDTenancy {
+		tenancy = &crdTenancy{}
+	}
+
+	var selectable func(schema.GroupResource) []string
+	if storage.selectableFields {
+		selectable = func(resource schema.GroupResource) []string {
+			return selectableFields(storage.counts.crd(resource))
+		}
+	}
+
+	if aggregatorConfig != nil {
+		configureTopServer(o, &aggregatorConfig.GenericConfig.Config, storage.quota, heartbeats, deprecated, attribution, writes, readiness, tenancy, selectable)
+	}
+
+	sizes, err := genericoptions.ParseWatchCacheSizes(o.Extensions.RecommendedOptions.Etcd.WatchCacheSizes)
+	if err != nil {
+		return nil, NewStageError(ErrInvalidOptions, err)
+	}
+
+	cacheSizes := &watchCacheSizes{sizes: sizes, defaultSize: o.Extensions.RecommendedOptions.Etcd.DefaultWatchCacheSize}
+
+	limits := metadataLimits{maxAnnotationBytes: o.MaxAnnotationBytes, annotationWarningBytes: o.AnnotationSizeWarningBytes}
+	config := &ServerChainConfig{
+		Extensions:       extensionsConfig,
+		Aggregator:       aggregatorConfig,
+		Heartbeats:       heartbeats,
+		LeaderElection:   leaderElection,
+		storage:          storage,
+		deprecated:       deprecated,
+		attribution:      attribution,
+		writes:           writes,
+		readiness:        readiness,
+		etcdProbe:        newEtcdProbe(o),
+		tenancy:          tenancy,
+		selectableFields: selectable,
+		scheme:           newChainScheme(),
+		storageVersions:  map[string]schema.GroupVersion{},
+		etcdOptions:      genericEtcdOptions,
+		watchCacheSizes:  cacheSizes,
+		limits:           limits,
+	}
+
+	// the server of the API groups copies the admission control of the apiextensions server
+	checks := admission.NewChainHandler(creationTimestampCheck{}, &dryRunChecks{limits: limits, apis: storage.apis})
+	extensionsConfig.GenericConfig.AdmissionControl = checks
+	if aggregatorConfig != nil {
+		aggregatorConfig.GenericConfig.AdmissionControl = checks
+	}
+
+	extensionsConfig.GenericConfig.RESTOptionsGetter = config.storage.wrap(extensionsConfig.GenericConfig.RESTOptionsGetter, cacheSizes, limits)
+	extensionsConfig.ExtraConfig.CRDRESTOptionsGetter = config.storage.wrap(extensionsConfig.ExtraConfig.CRDRESTOptionsGetter, cacheSizes, limits)
+	if aggregatorConfig != nil {
+		aggregatorConfig.GenericConfig.RESTOptionsGetter = config.storage.wrap(aggregatorConfig.GenericConfig.RESTOptionsGetter, cacheSizes, limits)
 	}
 
-	return CreateAggregatorServer(config, extensionServer.GenericAPIServer, extensionServer.Informers)
+	config.Clients, err = newLoopbackClients(extensionsConfig.GenericConfig.LoopbackClientConfig, o.InternalClientDiscoveryTTL)
+	if err != nil {
+		return nil, NewStageError(ErrExtensionsServer, err)
+	}
+
+	config.RESTMapper, err = restmapping.NewForConfig(config.Clients.ComponentConfig("rest-mapper"))
+	if err != nil {
+		return nil, NewStageError(ErrExtensionsServer, err)
+	}
+
+	if o.FeatureGate.Enabled(features.BadIdeaInstanceStatus) {
+		instances, err := newInstanceAPIGroup(o, config.Clients)
+		if err != nil {
+			return nil, NewStageError(ErrExtensionsServer, err)
+		}
+
+		config.apiGroups = append(config.apiGroups, instances)
+	}
+
+	flowControl, err := flowControlEnabled(o)
+	if err != nil {
+		return nil, NewStageError(ErrInvalidOptions, err)
+	}
+
+	if flowControl {
+		config.apiGroups = append(config.apiGroups, newFlowControlAPIGroup())
+	}
+
+	if err := o.InsecureServing.ApplyTo(&config.InsecureServing); err != nil {
+		return nil, NewStageError(ErrInvalidOptions, err)
+	}
+
+	if generatedCert := o.Extensions.RecommendedOptions.SecureServing.ServerCert.GeneratedCert; generatedCert != nil {
+		// the generated certificate is followed by the self-signed CA it was issued by
+		config.ServingCA, _ = generatedCert.CurrentCertKeyContent()
+	}
+
+	serverChainDuration.WithLabelValues("config").Set(time.Since(start).Seconds())
+
+	return config, nil
+}
+
+// New creates the servers of the chain in delegation order. etcd must be reachable. Errors are
+// StageErrors.
+func (c *ServerChainConfig) New(o options.CompletedServerRunOptions) (*Server, error) {
+	start := time.Now()
+
+	if err := c.enableAPIGroups(o); err != nil {
+		return nil, NewStageError(ErrInvalidOptions, err)
+	}
+
+	// without the aggregator, the server at the top of the chain is the one of the API groups added
+	// in-process if there are any, and the apiextensions server otherwise. Without either, the server
+	// of the API groups serves no groups, but the health of the server.
+	crds := crdsEnabled(o)
+	if c.tenancy != nil && !crds {
+		return nil, NewStageError(ErrInvalidOptions, fmt.Errorf("--enable-crd-tenancy requires the %s group", apiextensionsv1.GroupName))
+	}
+
+	apiGroupsServer := len(c.apiGroups) > 0 || (c.Aggregator == nil && !crds)
+
+	var bootstrapApplier *bootstrap.Applier
+
+	if c.Aggregator == nil {
+		if len(c.apiGroups) == 0 && !crds {
+			klog.Infof("Serving no API groups, --runtime-config and --disable-crds leave none")
+		}
+
+		var err error
+
+		bootstrapApplier, err = newBootstrapApplier(o, c.RESTMapper)
+		if err != nil {
+			return nil, err
+		}
+
+		// the server of the API groups copies the checks of the apiextensions server
+		if bootstrapApplier != nil {
+			c.Extensions.GenericConfig.ReadyzChecks = append(c.Extensions.GenericConfig.ReadyzChecks, bootstrapApplier)
+		}
+
+		if !apiGroupsServer {
+			configureTopServer(o, &c.Extensions.GenericConfig.Config, c.storage.quota, c.Heartbeats, c.deprecated, c.attribution, c.writes, c.readiness, c.tenancy, c.selectableFields)
+
+			if !o.DisableOpenAPI {
+				// there are no definitions of the apiextensions types, so the spec covers the CRDs only
+				c.Extensions.GenericConfig.OpenAPIConfig = newOpenAPIConfig(o, []common.GetOpenAPIDefinitions{apiextensionsopenapi.GetOpenAPIDefinitions}, apiextensionsapiserver.Scheme)
+				c.Extensions.GenericConfig.OpenAPIConfig.IgnorePrefixes = []string{"/apis/" + apiextensionsv1.GroupName + "/"}
+			}
+		}
+	}
+
+	var (
+		delegate    genericapiserver.DelegationTarget = genericapiserver.NewEmptyDelegate()
+		topServer   *genericapiserver.GenericAPIServer
+		topConfig   *genericapiserver.Config
+		crdInformer apiextensionsv1informers.CustomResourceDefinitionInformer
+
+		extensionInformers apiextensionsinformers.SharedInformerFactory
+	)
+
+	if crds {
+		extensionServer, err := c.Extensions.Complete().New(delegate)
+		if err != nil {
+			return nil, NewStageError(ErrExtensionsServer, err)
+		}
+
+		if err := checkInstalledVersions(o, "apiextensions", extensionServer.GenericAPIServer, c.Extensions.GenericConfig.MergedResourceConfig); err != nil {
+			return nil, NewStageError(ErrExtensionsServer, err)
+		}
+
+		extensionInformers = extensionServer.Informers
+		crdInformer = extensionInformers.Apiextensions().V1().CustomResourceDefinitions()
+		c.RESTMapper.ResetOn(crdInformer.Informer())
+		c.Clients.InvalidateDiscoveryOn(crdInformer.Informer())
+		c.storage.counts.setCRDLister(crdInformer.Lister())
+		c.storage.apis.setCRDLister(crdInformer.Lister())
+
+		if c.tenancy != nil {
+			c.tenancy.setCRDInformer(crdInformer)
+		}
+
+		delegate, topServer, topConfig = extensionServer.GenericAPIServer, extensionServer.GenericAPIServer, &c.Extensions.GenericConfig.Config
+	}
+
+	if apiGroupsServer {
+		var err error
+
+		topServer, topConfig, err = c.createAPIGroupsServer(o, delegate)
+		if err != nil {
+			return nil, NewStageError(ErrExtensionsServer, err)
+		}
+
+		if err := checkInstalledVersions(o, "API groups", topServer, c.apiGroupsResourceConfig); err != nil {
+			return nil, NewStageError(ErrExtensionsServer, err)
+		}
+
+		delegate = topServer
+
+		if c.Aggregator == nil && crds {
+			addEnabledGroupToDiscovery(topServer.DiscoveryGroupManager, apiextensionsv1.GroupName, apiextensionsapiserver.Scheme.PrioritizedVersionsForGroup(apiextensionsv1.GroupName), c.Extensions.GenericConfig.MergedResourceConfig)
+		}
+	}
+
+	server := &Server{GenericAPIServer: topServer, readiness: c.readiness}
+	topStage := ErrExtensionsServer
+
+	if c.Aggregator != nil {
+		if openAPIConfig := c.Aggregator.GenericConfig.OpenAPIConfig; openAPIConfig != nil {
+			openAPIConfig.GetDefinitionName = openapinamer.NewDefinitionNamer(apiextensionsapiserver.Scheme, aggregatorscheme.Scheme, c.scheme).GetDefinitionName
+		}
+
+		var err error
+
+		// the aggregator serves its own group
+		c.storage.apis.setGroupVersions(append(servedGroupVersions(delegate), aggregatorscheme.Scheme.PrioritizedVersionsAllGroups()...), c.apiVersionPriorities())
+
+		server.Aggregator, err = CreateAggregatorServer(o, c.Aggregator, delegate, extensionInformers, c.RESTMapper, c.Clients, c.Heartbeats, c.apiVersionPriorities())
+		if err != nil {
+			return nil, NewStageError(ErrAggregatorServer, err)
+		}
+
+		if err := checkInstalledVersions(o, "aggregator", server.Aggregator.GenericAPIServer, c.Aggregator.GenericConfig.MergedResourceConfig); err != nil {
+			return nil, NewStageError(ErrAggregatorServer, err)
+		}
+
+		server.GenericAPIServer, topConfig = server.Aggregator.GenericAPIServer, &c.Aggregator.GenericConfig.Config
+		topStage = ErrAggregatorServer
+	} else if err := completeTopServer(o, topServer, crdInformer, bootstrapApplier, c.Clients); err != nil {
+		return nil, NewStageError(ErrExtensionsServer, err)
+	}
+
+	if o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection {
+		if err := addGarbageCollectorHook(server.GenericAPIServer, crdInformer, c.RESTMapper, c.Clients, c.Heartbeats, c.LeaderElection); err != nil {
+			return nil, NewStageError(topStage, err)
+		}
+	}
+
+	if c.etcdProbe != nil {
+		if err := addEtcdProbeHook(server.GenericAPIServer, c.etcdProbe); err != nil {
+			return nil, NewStageError(topStage, err)
+		}
+	}
+
+	if c.storage.etcdGate != nil {
+		if err := c.addEtcdGateHook(server.GenericAPIServer, o); err != nil {
+			return nil, NewStageError(topStage, err)
+		}
+	}
+
+	if c.attribution != nil {
+		server.GenericAPIServer.Handler.NonGoRestfulMux.Handle("/debug/badidea/clients", c.attribution)
+	}
+
+	server.GenericAPIServer.Handler.NonGoRestfulMux.Handle("/debug/badidea/writes", c.writes)
+
+	if c.InsecureServing != nil {
+		if err := addInsecureServing(o, server.GenericAPIServer, topConfig, c.InsecureServing); err != nil {
+			return nil, NewStageError(topStage, err)
+		}
+	}
+
+	serverChainDuration.WithLabelValues("servers").Set(time.Since(start).Seconds())
+
+	return server, nil
+}
+
+// DestroyStorage closes the etcd clients and stops the watch caches of the servers created by New. It
+// must only be called once they stopped serving.
+func (c *ServerChainConfig) DestroyStorage() {
+	c.storage.destroy()
 }
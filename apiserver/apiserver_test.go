@@ -0,0 +1,619 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/generic"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/apiserver/pkg/storage/storagebackend/factory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+// newTestServerRunOptions returns options serving on a random local port with certificates in certDir.
+// The listener is closed by the returned func.
+func newTestServerRunOptions(tb testing.TB, certDir string) (*options.ServerRunOptions, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	o, err := options.NewServerRunOptions()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	o.Extensions.RecommendedOptions.SecureServing.Listener = listener
+	o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertDirectory = certDir
+
+	return o, func() { listener.Close() }
+}
+
+// BenchmarkCreateServerChainConfig measures the part of the startup that overlaps with etcd coming up.
+func BenchmarkCreateServerChainConfig(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		certDir, err := ioutil.TempDir("", "badidea-bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		o, closeListener := newTestServerRunOptions(b, certDir)
+
+		completed, err := o.Complete()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+
+		if _, err := CreateServerChainConfig(completed); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+
+		closeListener()
+		os.RemoveAll(certDir)
+	}
+}
+
+// TestDisableOpenAPI checks that --disable-openapi leaves the aggregator without an OpenAPI config.
+// Measured on a fresh server, this saves about 3MB of heap and 6MB of RSS before any CRD is created.
+func TestDisableOpenAPI(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "badidea-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+
+	tests := []struct {
+		name           string
+		disableOpenAPI bool
+	}{
+		{name: "enabled", disableOpenAPI: false},
+		{name: "disabled", disableOpenAPI: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, closeListener := newTestServerRunOptions(t, certDir)
+			defer closeListener()
+
+			o.DisableOpenAPI = test.disableOpenAPI
+
+			completed, err := o.Complete()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			config, err := CreateServerChainConfig(completed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if hasConfig := config.Aggregator.GenericConfig.OpenAPIConfig != nil; hasConfig == test.disableOpenAPI {
+				t.Errorf("expected OpenAPI config %v, got %v", !test.disableOpenAPI, hasConfig)
+			}
+		})
+	}
+}
+
+func TestOpenAPIDisabledHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	openAPIDisabledHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi/v2", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if body := w.Body.String(); body != "the OpenAPI spec is disabled on this server (--disable-openapi)\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestInternalClientRateLimits(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "badidea-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+
+	o, closeListener := newTestServerRunOptions(t, certDir)
+	defer closeListener()
+
+	o.InternalClientQPS = 123
+	o.InternalClientBurst = 456
+
+	completed, err := o.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := CreateServerChainConfig(completed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	loopbackConfigs := map[string]*rest.Config{
+		"extensions": config.Extensions.GenericConfig.LoopbackClientConfig,
+		"aggregator": config.Aggregator.GenericConfig.LoopbackClientConfig,
+	}
+
+	for name, loopbackConfig := range loopbackConfigs {
+		if loopbackConfig.QPS != 123 || loopbackConfig.Burst != 456 {
+			t.Errorf("expected QPS 123 and burst 456 for the %s loopback config, got %v and %d", name, loopbackConfig.QPS, loopbackConfig.Burst)
+		}
+	}
+}
+
+func TestSharedInformerFactory(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "badidea-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+
+	o, closeListener := newTestServerRunOptions(t, certDir)
+	defer closeListener()
+
+	completed, err := o.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := CreateServerChainConfig(completed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	versionedInformers := config.Extensions.GenericConfig.SharedInformerFactory
+	if config.Aggregator.GenericConfig.SharedInformerFactory != versionedInformers {
+		t.Fatalf("expected the aggregator to share the informer factory of the extensions server")
+	}
+
+	// starting the factory once, like the informer start hook of the extensions server does, has to
+	// sync the informers both servers asked for
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	versionedInformers.Start(stopCh)
+
+	for informerType, synced := range versionedInformers.WaitForCacheSync(stopCh) {
+		if !synced {
+			t.Errorf("expected informer for %v to sync", informerType)
+		}
+	}
+
+	if len(versionedInformers.WaitForCacheSync(stopCh)) == 0 {
+		t.Errorf("expected the servers to request informers")
+	}
+}
+
+// saturatedHandlerChain returns the handler chain of the aggregator with a limit of one request in
+// flight, taken by a blocked list of widgets until the returned func is called.
+func saturatedHandlerChain(t *testing.T) (http.Handler, *genericapiserver.Config, func()) {
+	genericConfig, cleanup := newTestHandlerChainConfig(t, nil)
+	genericConfig.MaxRequestsInFlight = 1
+	genericConfig.MaxMutatingRequestsInFlight = 1
+
+	unblock := make(chan struct{})
+	blocked := make(chan struct{})
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/apis/example.com/v1/widgets" {
+			close(blocked)
+			<-unblock
+		}
+	})
+	handler := genericConfig.BuildHandlerChainFunc(apiHandler, genericConfig)
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/widgets", nil))
+	<-blocked
+
+	return handler, genericConfig, func() {
+		close(unblock)
+		cleanup()
+	}
+}
+
+// TestLoopbackExemptFromMaxInFlight floods the handler chain with external requests and checks that
+// the server's own loopback clients still get through.
+func TestLoopbackExemptFromMaxInFlight(t *testing.T) {
+	handler, genericConfig, unblock := saturatedHandlerChain(t)
+	defer unblock()
+
+	external := httptest.NewRecorder()
+	handler.ServeHTTP(external, httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/gadgets", nil))
+
+	if external.Code != http.StatusTooManyRequests {
+		t.Errorf("expected external request to be throttled with %d, got %d", http.StatusTooManyRequests, external.Code)
+	}
+
+	internal := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/gadgets", nil)
+	req.Header.Set("Authorization", "Bearer "+genericConfig.LoopbackClientConfig.BearerToken)
+	handler.ServeHTTP(internal, req)
+
+	if internal.Code != http.StatusOK {
+		t.Errorf("expected loopback request to be served with %d, got %d", http.StatusOK, internal.Code)
+	}
+}
+
+// TestPriorityExemptFromMaxInFlight checks that health checks and discovery are served right away
+// while slow lists saturate the server.
+func TestPriorityExemptFromMaxInFlight(t *testing.T) {
+	handler, _, unblock := saturatedHandlerChain(t)
+	defer unblock()
+
+	for _, path := range []string{"/readyz", "/livez", "/apis", "/apis/example.com/v1"} {
+		start := time.Now()
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected %s to be served with %d, got %d", path, http.StatusOK, w.Code)
+		}
+
+		if latency := time.Since(start); latency > time.Second {
+			t.Errorf("expected %s to be served right away, took %v", path, latency)
+		}
+	}
+}
+
+func TestCreateServerChainConfigStageErrors(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "badidea-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certDir)
+
+	tests := []struct {
+		name     string
+		modify   func(o *options.ServerRunOptions)
+		expected error
+	}{
+		{
+			name: "unknown runtime config group",
+			modify: func(o *options.ServerRunOptions) {
+				_ = o.Extensions.APIEnablement.RuntimeConfig.Set("example.com/v1=true")
+			},
+			expected: ErrInvalidOptions,
+		},
+		{
+			name: "invalid runtime config value",
+			modify: func(o *options.ServerRunOptions) {
+				_ = o.Extensions.APIEnablement.RuntimeConfig.Set("api/beta=off")
+			},
+			expected: ErrInvalidOptions,
+		},
+		{
+			name: "aggregator without its group",
+			modify: func(o *options.ServerRunOptions) {
+				_ = o.Extensions.APIEnablement.RuntimeConfig.Set("api/all=false")
+			},
+			expected: ErrInvalidOptions,
+		},
+		{
+			name: "invalid watch cache size",
+			modify: func(o *options.ServerRunOptions) {
+				o.Extensions.RecommendedOptions.Etcd.WatchCacheSizes = []string{"widgets.example.com#many"}
+			},
+			expected: ErrInvalidOptions,
+		},
+		{
+			name: "missing serving certificate",
+			modify: func(o *options.ServerRunOptions) {
+				o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertKey.CertFile = certDir + "/missing.crt"
+				o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertKey.KeyFile = certDir + "/missing.key"
+			},
+			expected: ErrInvalidServingCerts,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, closeListener := newTestServerRunOptions(t, certDir)
+			defer closeListener()
+
+			test.modify(o)
+
+			completed, err := o.Complete()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = CreateServerChainConfig(completed)
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected an error of stage %q, got %v", test.expected, err)
+			}
+
+			var stageErr *StageError
+			if !errors.As(err, &stageErr) || stageErr.Err == nil {
+				t.Errorf("expected a StageError recording the failure, got %#v", err)
+			}
+		})
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	manifestsDir, err := ioutil.TempDir("", "badidea-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(manifestsDir)
+
+	crd := "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.example.com\n"
+	if err := ioutil.WriteFile(manifestsDir+"/crd.yaml", []byte(crd), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(o *options.ServerRunOptions)
+	}{
+		{
+			name: "CRD manifests without CRDs",
+			modify: func(o *options.ServerRunOptions) {
+				o.DisableCRDs = true
+				o.BootstrapManifestsDir = manifestsDir
+			},
+		},
+		{
+			name: "CRD manifests with CRDs disabled by the runtime config",
+			modify: func(o *options.ServerRunOptions) {
+				_ = o.Extensions.APIEnablement.RuntimeConfig.Set("apiextensions.k8s.io/v1=false")
+				o.BootstrapManifestsDir = manifestsDir
+			},
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, closeListener := newTestServerRunOptions(t, "")
+			defer closeListener()
+
+			o.InMemoryServingCert = true
+			test.modify(o)
+
+			completed, err := o.Complete()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			config, err := CreateServerChainConfig(completed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := config.New(completed); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("expected an error of stage %q, got %v", ErrInvalidOptions, err)
+			}
+		})
+	}
+}
+
+// failingRESTOptionsGetter fails to get the options of every resource if err is set, and returns
+// options whose decorator fails otherwise.
+type failingRESTOptionsGetter struct {
+	err error
+}
+
+func (g failingRESTOptionsGetter) GetRESTOptions(resource schema.GroupResource) (generic.RESTOptions, error) {
+	if g.err != nil {
+		return generic.RESTOptions{}, g.err
+	}
+
+	return generic.RESTOptions{
+		StorageConfig:  &storagebackend.Config{},
+		ResourcePrefix: resource.String(),
+		Decorator: func(*storagebackend.Config, string, func(runtime.Object) (string, error), func() runtime.Object, func() runtime.Object, storage.AttrFunc, storage.IndexerFuncs, *cache.Indexers) (storage.Interface, factory.DestroyFunc, error) {
+			return nil, nil, fmt.Errorf("etcd transport is misconfigured")
+		},
+	}, nil
+}
+
+func TestNewStorageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		getter failingRESTOptionsGetter
+
+		expectedMessage string
+	}{
+		{
+			name:            "options",
+			getter:          failingRESTOptionsGetter{err: fmt.Errorf("etcd is misconfigured")},
+			expectedMessage: "failed to get the storage options of apiservices.apiregistration.k8s.io: etcd is misconfigured",
+		},
+		{
+			name:            "decorator",
+			expectedMessage: "failed to create the storage of apiservices.apiregistration.k8s.io: etcd transport is misconfigured",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, closeListener := newTestServerRunOptions(t, "")
+			defer closeListener()
+
+			o.InMemoryServingCert = true
+			o.DisableCRDs = true
+
+			completed, err := o.Complete()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			config, err := CreateServerChainConfig(completed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the storage of APIServices panics on errors, which are returned instead
+			config.Aggregator.GenericConfig.RESTOptionsGetter = config.storage.wrap(test.getter, nil, config.limits)
+
+			_, err = config.New(completed)
+			if !errors.Is(err, ErrAggregatorServer) {
+				t.Fatalf("expected an error of stage %q, got %v", ErrAggregatorServer, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedMessage) {
+				t.Errorf("expected the error to contain %q, got %q", test.expectedMessage, err.Error())
+			}
+		})
+	}
+}
+
+// TestIPv6AdvertiseAddress checks that an IPv6 advertise address ends up bracketed in the URLs the
+// server generates and in the SANs of the generated serving certificate.
+func TestIPv6AdvertiseAddress(t *testing.T) {
+	o, closeListener := newTestServerRunOptions(t, "")
+	defer closeListener()
+
+	o.InMemoryServingCert = true
+	o.AdvertiseAddress = net.ParseIP("fd00::1")
+
+	completed, err := o.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := CreateServerChainConfig(completed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	genericConfig := config.Aggregator.GenericConfig.Config
+	genericConfig.Complete(nil)
+
+	serverURL, err := url.Parse("https://" + genericConfig.ExternalAddress)
+	if err != nil {
+		t.Fatalf("invalid external address %q: %v", genericConfig.ExternalAddress, err)
+	}
+
+	if serverURL.Hostname() != "fd00::1" || serverURL.Port() == "" {
+		t.Errorf("expected the external address to hold fd00::1 and a port, got %q", genericConfig.ExternalAddress)
+	}
+
+	certs, err := certutil.ParseCertsPEM(config.ServingCA)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ips := sets.NewString()
+	for _, ip := range certs[0].IPAddresses {
+		ips.Insert(ip.String())
+	}
+
+	if expected := sets.NewString("fd00::1", "127.0.0.1", "::1"); !ips.IsSuperset(expected) {
+		t.Errorf("expected the serving certificate to be valid for %v, got %v", expected.List(), ips.List())
+	}
+
+	if err := certs[0].VerifyHostname("localhost"); err != nil {
+		t.Errorf("expected the serving certificate to be valid for localhost: %v", err)
+	}
+}
+
+func TestInsecureHandlerChain(t *testing.T) {
+	o, closeListener := newTestServerRunOptions(t, "")
+	defer closeListener()
+
+	o.InMemoryServingCert = true
+	o.InsecureUser = "debugger"
+
+	completed, err := o.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := CreateServerChainConfig(completed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	genericConfig := config.Aggregator.GenericConfig.Config
+	genericConfig.Complete(nil)
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if u, ok := request.UserFrom(req.Context()); ok {
+			fmt.Fprintf(w, "%s %v", u.GetName(), u.GetGroups())
+		}
+	})
+	handler := insecureHandlerChain(completed, apiHandler, genericConfig)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "debugger []" {
+		t.Errorf("expected non-resource request to be served as debugger, got %d %q", w.Code, w.Body.String())
+	}
+
+	// the authorizer still applies, and only allows the groups of the secure port
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apis/apiregistration.k8s.io/v1/apiservices", nil))
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `User \"debugger\" cannot list resource`) {
+		t.Errorf("expected resource request of debugger to be forbidden, got %d %q", w.Code, w.Body.String())
+	}
+
+	completed.InsecureGroups = []string{"system:masters"}
+	handler = insecureHandlerChain(completed, apiHandler, genericConfig)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apis/apiregistration.k8s.io/v1/apiservices", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "debugger [system:masters]" {
+		t.Errorf("expected resource request to be served as debugger in system:masters, got %d %q", w.Code, w.Body.String())
+	}
+
+	// the names of the components are reserved whatever authenticates them
+	completed.InsecureUser = componentUserPrefix + "debugger"
+	handler = insecureHandlerChain(completed, apiHandler, genericConfig)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a user authenticated with a component name to be forbidden, got %d %q", w.Code, w.Body.String())
+	}
+}
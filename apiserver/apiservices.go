@@ -0,0 +1,192 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/warning"
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+// apiServicesResource is the resource of the APIServices of the aggregator.
+var apiServicesResource = apiregistration.Resource("apiservices")
+
+// localAPIs are the group versions served by the servers of the chain below the aggregator, and
+// the highest priority of their groups.
+type localAPIs struct {
+	lock             sync.Mutex
+	groupVersions    map[schema.GroupVersion]bool
+	maxGroupPriority int32
+	crds             crdlisters.CustomResourceDefinitionLister
+}
+
+func newLocalAPIs() *localAPIs {
+	return &localAPIs{groupVersions: map[schema.GroupVersion]bool{}}
+}
+
+// setGroupVersions sets the group versions served by the servers of the chain, whose groups have
+// priorities.
+func (a *localAPIs) setGroupVersions(gvs []schema.GroupVersion, priorities map[schema.GroupVersion]Priority) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.groupVersions = map[schema.GroupVersion]bool{}
+	for _, gv := range gvs {
+		a.groupVersions[gv] = true
+	}
+
+	a.maxGroupPriority = 0
+	for _, priority := range priorities {
+		if priority.Group > a.maxGroupPriority {
+			a.maxGroupPriority = priority.Group
+		}
+	}
+}
+
+// setCRDLister sets the lister of the CRDs, whose served versions are local too.
+func (a *localAPIs) setCRDLister(crds crdlisters.CustomResourceDefinitionLister) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.crds = crds
+}
+
+// serves returns whether gv is served by the servers of the chain. The core group is never served by
+// anyone else, even though badidea does not serve it.
+func (a *localAPIs) serves(gv schema.GroupVersion) bool {
+	a.lock.Lock()
+	served, crds := a.groupVersions[gv], a.crds
+	a.lock.Unlock()
+
+	if served || gv.Group == "" {
+		return true
+	}
+
+	if crds == nil {
+		return false
+	}
+
+	list, err := crds.List(labels.Everything())
+	if err != nil {
+		return false
+	}
+
+	for _, crd := range list {
+		if crd.Spec.Group != gv.Group {
+			continue
+		}
+
+		for _, version := range crd.Spec.Versions {
+			if version.Name == gv.Version && version.Served {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *localAPIs) highestGroupPriority() int32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.maxGroupPriority
+}
+
+// apiServiceCheckingStorage keeps users from registering APIServices for the group versions served
+// by the server, which would take over their requests and discovery. Only the loopback clients, like
+// the autoregister controller, may create APIServices for them or change their specs. Users may still
+// change their metadata and delete them. APIServices whose group is listed before all groups served
+// by the server get a warning. It runs in place of an admission plugin, since badidea has no
+// admission chain.
+type apiServiceCheckingStorage struct {
+	storage.Interface
+
+	apis *localAPIs
+}
+
+func (s *apiServiceCheckingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	if err := s.check(ctx, nil, obj); err != nil {
+		return err
+	}
+
+	return s.Interface.Create(ctx, key, obj, out, ttl)
+}
+
+func (s *apiServiceCheckingStorage) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	checkingTryUpdate := func(input runtime.Object, res storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		// the spec is copied before tryUpdate, which may modify input
+		var old *apiregistration.APIService
+		if apiService, ok := input.(*apiregistration.APIService); ok {
+			old = apiService.DeepCopy()
+		}
+
+		output, ttl, err := tryUpdate(input, res)
+		if err != nil {
+			return output, ttl, err
+		}
+
+		if err := s.check(ctx, old, output); err != nil {
+			return nil, nil, err
+		}
+
+		return output, ttl, nil
+	}
+
+	return s.Interface.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, checkingTryUpdate, suggestion...)
+}
+
+// check checks obj, which replaces old if old is not nil.
+func (s *apiServiceCheckingStorage) check(ctx context.Context, old *apiregistration.APIService, obj runtime.Object) error {
+	apiService, ok := obj.(*apiregistration.APIService)
+	if !ok {
+		return nil
+	}
+
+	if u, ok := request.UserFrom(ctx); ok && isLoopbackUser(u) {
+		return nil
+	}
+
+	if old != nil && equality.Semantic.DeepEqual(old.Spec, apiService.Spec) {
+		return nil
+	}
+
+	gv := schema.GroupVersion{Group: apiService.Spec.Group, Version: apiService.Spec.Version}
+	if s.apis.serves(gv) {
+		return apierrors.NewInvalid(apiregistration.Kind("APIService"), apiService.Name, field.ErrorList{
+			field.Forbidden(field.NewPath("spec"), fmt.Sprintf("%s is served by this server, only the server registers APIServices for it", gv)),
+		})
+	}
+
+	if maxGroupPriority := s.apis.highestGroupPriority(); apiService.Spec.GroupPriorityMinimum > maxGroupPriority {
+		warning.AddWarning(ctx, "", fmt.Sprintf("spec.groupPriorityMinimum: %d is higher than the priority of every group served by this server, %d, so discovery lists the group first", apiService.Spec.GroupPriorityMinimum, maxGroupPriority))
+	}
+
+	return nil
+}
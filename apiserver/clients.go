@@ -0,0 +1,195 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// componentUserPrefix prefixes the users impersonated by the components of the server. It is reserved
+// for them: the handler chain rejects the users authenticated with such names, and their impersonation
+// by anyone but the loopback user.
+const componentUserPrefix = "system:badidea:"
+
+// LoopbackClients are the clients of the chain talking to itself, constructed on first use. They
+// share one transport and rate limiter, so the components of the server and embedders using them
+// share one connection pool and the QPS of the loopback config.
+type LoopbackClients struct {
+	config       *rest.Config
+	discoveryTTL time.Duration
+
+	lock           sync.Mutex
+	dynamicClient  dynamic.Interface
+	metadataClient metadata.Interface
+	// discoveryClients are the discovery clients by component, "" for the one of Discovery.
+	discoveryClients map[string]*cachedDiscovery
+}
+
+// newLoopbackClients returns the clients of loopbackConfig. Their discovery information is dropped
+// after discoveryTTL, unless it is zero.
+func newLoopbackClients(loopbackConfig *rest.Config, discoveryTTL time.Duration) (*LoopbackClients, error) {
+	config := rest.CopyConfig(loopbackConfig)
+
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the transport holds the TLS config and the dialer, and authenticates the requests
+	config.Transport = transport
+	config.TLSClientConfig = rest.TLSClientConfig{}
+	config.Dial = nil
+	config.BearerToken = ""
+
+	if config.QPS > 0 {
+		config.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(config.QPS, config.Burst)
+	}
+
+	return &LoopbackClients{config: config, discoveryTTL: discoveryTTL, discoveryClients: map[string]*cachedDiscovery{}}, nil
+}
+
+// Config returns a copy of the config the clients are constructed from. Clients constructed from it
+// share the transport and rate limiter of the clients.
+func (c *LoopbackClients) Config() *rest.Config {
+	return rest.CopyConfig(c.config)
+}
+
+// ComponentConfig returns a copy of the config for the named component of the server, like
+// "garbage-collector". Its requests name the component in their user agent and impersonate the user
+// system:badidea:<component> in the system:masters group, so the audit events and logs of the
+// components can be told apart. Audit policies still see the loopback user system:apiserver, which
+// impersonates the component user.
+func (c *LoopbackClients) ComponentConfig(component string) *rest.Config {
+	config := rest.AddUserAgent(c.Config(), component)
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: componentUserPrefix + component,
+		Groups:   []string{user.SystemPrivilegedGroup},
+	}
+
+	return config
+}
+
+// isLoopbackUser returns whether u is the loopback user or a user impersonated by a component of the
+// server. Only the loopback user may impersonate the users of the components.
+func isLoopbackUser(u user.Info) bool {
+	return u.GetName() == user.APIServerUser || strings.HasPrefix(u.GetName(), componentUserPrefix)
+}
+
+// isPrivilegedUser returns whether u is a loopback user or a member of system:masters.
+func isPrivilegedUser(u user.Info) bool {
+	return isLoopbackUser(u) || sets.NewString(u.GetGroups()...).Has(user.SystemPrivilegedGroup)
+}
+
+// Dynamic returns the dynamic client.
+func (c *LoopbackClients) Dynamic() (dynamic.Interface, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dynamicClient == nil {
+		client, err := dynamic.NewForConfig(c.config)
+		if err != nil {
+			return nil, err
+		}
+
+		c.dynamicClient = client
+	}
+
+	return c.dynamicClient, nil
+}
+
+// Discovery returns the discovery client. It caches the discovery information in memory until the
+// CRDs or APIServices change, or for --internal-client-discovery-ttl at most.
+func (c *LoopbackClients) Discovery() (discovery.CachedDiscoveryInterface, error) {
+	return c.discovery("", c.config)
+}
+
+// ComponentDiscovery returns the discovery client of the named component, with the config of
+// ComponentConfig, caching like Discovery.
+func (c *LoopbackClients) ComponentDiscovery(component string) (discovery.CachedDiscoveryInterface, error) {
+	return c.discovery(component, c.ComponentConfig(component))
+}
+
+// discovery returns the discovery client of component with config, constructed on first use.
+func (c *LoopbackClients) discovery(component string, config *rest.Config) (*cachedDiscovery, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client, ok := c.discoveryClients[component]; ok {
+		return client, nil
+	}
+
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	name := component
+	if name == "" {
+		name = "loopback"
+	}
+
+	c.discoveryClients[component] = newCachedDiscovery(client, name, c.discoveryTTL)
+
+	return c.discoveryClients[component], nil
+}
+
+// InvalidateDiscoveryOn invalidates the discovery clients whenever an object of informer is added,
+// updated or deleted, e.g. a CustomResourceDefinition changing its versions.
+func (c *LoopbackClients) InvalidateDiscoveryOn(informer cache.SharedInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.invalidateDiscovery() },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.invalidateDiscovery() },
+		DeleteFunc: func(obj interface{}) { c.invalidateDiscovery() },
+	})
+}
+
+func (c *LoopbackClients) invalidateDiscovery() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, client := range c.discoveryClients {
+		client.Invalidate()
+	}
+}
+
+// Metadata returns the client of the metadata of objects.
+func (c *LoopbackClients) Metadata() (metadata.Interface, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.metadataClient == nil {
+		client, err := metadata.NewForConfig(c.config)
+		if err != nil {
+			return nil, err
+		}
+
+		c.metadataClient = client
+	}
+
+	return c.metadataClient, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/warning"
+)
+
+// crdsResource is the resource of the CustomResourceDefinitions of the apiextensions server.
+var crdsResource = apiextensions.Resource("customresourcedefinitions")
+
+// crdCheckingStorage checks the versions of the CustomResourceDefinitions written to the storage.
+// CRDs must serve at least one version, or their clients, controllers included, lose every endpoint
+// of the resource. CRDs whose storage version is not served, and CRDs that stop serving a version
+// with stored objects, get a warning. CRDs that served no version before may keep doing so. It runs
+// in place of an admission plugin, since badidea has no admission chain.
+type crdCheckingStorage struct {
+	storage.Interface
+}
+
+func (s *crdCheckingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	if err := s.check(ctx, nil, obj); err != nil {
+		return err
+	}
+
+	return s.Interface.Create(ctx, key, obj, out, ttl)
+}
+
+func (s *crdCheckingStorage) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	checkingTryUpdate := func(input runtime.Object, res storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		// the spec is copied before tryUpdate, which may modify input
+		var old *apiextensions.CustomResourceDefinition
+		if crd, ok := input.(*apiextensions.CustomResourceDefinition); ok {
+			old = crd.DeepCopy()
+		}
+
+		output, ttl, err := tryUpdate(input, res)
+		if err != nil {
+			return output, ttl, err
+		}
+
+		if err := s.check(ctx, old, output); err != nil {
+			return nil, nil, err
+		}
+
+		return output, ttl, nil
+	}
+
+	return s.Interface.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, checkingTryUpdate, suggestion...)
+}
+
+// check checks obj, which replaces old if old is not nil.
+func (s *crdCheckingStorage) check(ctx context.Context, old *apiextensions.CustomResourceDefinition, obj runtime.Object) error {
+	crd, ok := obj.(*apiextensions.CustomResourceDefinition)
+	if !ok {
+		return nil
+	}
+
+	if old != nil && equality.Semantic.DeepEqual(old.Spec.Versions, crd.Spec.Versions) {
+		return nil
+	}
+
+	served := servedVersions(crd)
+	if served.Len() == 0 && (old == nil || servedVersions(old).Len() > 0) {
+		return apierrors.NewInvalid(apiextensions.Kind("CustomResourceDefinition"), crd.Name, field.ErrorList{
+			field.Invalid(field.NewPath("spec", "versions"), len(crd.Spec.Versions), "at least one version must be served"),
+		})
+	}
+
+	for _, version := range crd.Spec.Versions {
+		if version.Storage && !version.Served {
+			warning.AddWarning(ctx, "", fmt.Sprintf("spec.versions: the storage version %s is not served, so objects are stored in a version their clients cannot read back", version.Name))
+		}
+	}
+
+	if old != nil {
+		for _, version := range crd.Status.StoredVersions {
+			if servedVersions(old).Has(version) && !served.Has(version) {
+				warning.AddWarning(ctx, "", fmt.Sprintf("spec.versions: %s is no longer served but objects may still be stored in it, migrate them to the storage version and remove it from status.storedVersions before removing the version", version))
+			}
+		}
+	}
+
+	return nil
+}
+
+// servedVersions returns the names of the versions served by crd.
+func servedVersions(crd *apiextensions.CustomResourceDefinition) sets.String {
+	served := sets.NewString()
+
+	for _, version := range crd.Spec.Versions {
+		if version.Served {
+			served.Insert(version.Name)
+		}
+	}
+
+	return served
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// deleteCollectionLimitingStorage rejects deletecollection requests that would delete more than
+// maxObjects objects with 413 Request Entity Too Large before deleting any. The registries list the
+// objects to delete in one go, so the list is limited to one object more than maxObjects unless the
+// client pages it with a lower limit.
+type deleteCollectionLimitingStorage struct {
+	storage.Interface
+
+	resource   schema.GroupResource
+	maxObjects int
+}
+
+func (s *deleteCollectionLimitingStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	info, ok := request.RequestInfoFrom(ctx)
+	if !ok || info.Verb != "deletecollection" {
+		return s.Interface.List(ctx, key, opts, listObj)
+	}
+
+	if opts.Predicate.Limit <= 0 || opts.Predicate.Limit > int64(s.maxObjects) {
+		opts.Predicate.Limit = int64(s.maxObjects) + 1
+	}
+
+	if err := s.Interface.List(ctx, key, opts, listObj); err != nil {
+		return err
+	}
+
+	// a list served from the watch cache ignores the limit
+	if meta.LenList(listObj) > s.maxObjects {
+		return apierrors.NewRequestEntityTooLargeError(fmt.Sprintf(
+			"deletecollection of %s would delete more than %d objects, delete them in pages with the limit parameter or in parts with label or field selectors",
+			s.resource, s.maxObjects))
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/generic"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// collectionStorage lists objects objects, up to the limit of the list.
+type collectionStorage struct {
+	storage.Interface
+
+	objects int
+}
+
+func (s *collectionStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	list := listObj.(*unstructured.UnstructuredList)
+
+	for i := 0; i < s.objects && (opts.Predicate.Limit <= 0 || int64(i) < opts.Predicate.Limit); i++ {
+		item := unstructured.Unstructured{}
+		item.SetName(fmt.Sprintf("widget-%d", i))
+		list.Items = append(list.Items, item)
+	}
+
+	return nil
+}
+
+func TestDeleteCollectionLimitingStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		verb    string
+		objects int
+		limit   int64
+
+		expectedItems int
+		expectedErr   bool
+	}{
+		{name: "within the limit", verb: "deletecollection", objects: 10, expectedItems: 10},
+		{name: "over the limit", verb: "deletecollection", objects: 11, expectedErr: true},
+		{name: "far over the limit", verb: "deletecollection", objects: 50000, expectedErr: true},
+		{name: "page within the limit", verb: "deletecollection", objects: 50000, limit: 5, expectedItems: 5},
+		{name: "page over the limit", verb: "deletecollection", objects: 50000, limit: 20, expectedErr: true},
+		{name: "list", verb: "list", objects: 50000, expectedItems: 50000},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			s := &deleteCollectionLimitingStorage{
+				Interface:  &collectionStorage{objects: test.objects},
+				resource:   schema.GroupResource{Group: "example.com", Resource: "widgets"},
+				maxObjects: 10,
+			}
+
+			ctx := request.WithRequestInfo(context.TODO(), &request.RequestInfo{IsResourceRequest: true, Verb: test.verb})
+			opts := storage.ListOptions{Predicate: storage.Everything}
+			opts.Predicate.Limit = test.limit
+			list := &unstructured.UnstructuredList{}
+
+			err := s.List(ctx, "/widgets", opts, list)
+			if test.expectedErr {
+				if !apierrors.IsRequestEntityTooLargeError(err) {
+					t.Errorf("expected a 413, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(list.Items) != test.expectedItems {
+				t.Errorf("expected %d items, got %d", test.expectedItems, len(list.Items))
+			}
+		})
+	}
+}
+
+func TestDeleteCollectionWorkers(t *testing.T) {
+	o, closeListener := newTestServerRunOptions(t, "")
+	defer closeListener()
+
+	o.InMemoryServingCert = true
+	o.Extensions.RecommendedOptions.Etcd.DeleteCollectionWorkers = 4
+
+	completed, err := o.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := CreateServerChainConfig(completed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	getters := []struct {
+		resource schema.GroupResource
+		getter   generic.RESTOptionsGetter
+	}{
+		{resource: crdsResource, getter: config.Extensions.GenericConfig.RESTOptionsGetter},
+		{resource: schema.GroupResource{Group: "example.com", Resource: "widgets"}, getter: config.Extensions.ExtraConfig.CRDRESTOptionsGetter},
+		{resource: apiServicesResource, getter: config.Aggregator.GenericConfig.RESTOptionsGetter},
+	}
+
+	for _, g := range getters {
+		opts, err := g.getter.GetRESTOptions(g.resource)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if opts.DeleteCollectionWorkers != 4 {
+			t.Errorf("expected 4 deletecollection workers of %s, got %d", g.resource, opts.DeleteCollectionWorkers)
+		}
+	}
+}
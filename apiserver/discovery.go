@@ -0,0 +1,117 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"sort"
+
+	apiextensionshelpers "k8s.io/apiextensions-apiserver/pkg/apihelpers"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apiserver/pkg/endpoints/discovery"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// addCRDGroupsToDiscovery lists the groups of the established CRDs in the /apis discovery of groups,
+// which the aggregator does through APIServices otherwise.
+func addCRDGroupsToDiscovery(groups discovery.GroupManager, crdInformer apiextensionsinformers.CustomResourceDefinitionInformer) {
+	lister := crdInformer.Lister()
+
+	sync := func(group string) {
+		crds, err := lister.List(labels.Everything())
+		if err != nil {
+			klog.Errorf("Failed to list CRDs for the discovery of group %q: %v", group, err)
+			return
+		}
+
+		versions := map[string]bool{}
+
+		for _, crd := range crds {
+			if crd.Spec.Group != group || !apiextensionshelpers.IsCRDConditionTrue(crd, apiextensionsv1.Established) {
+				continue
+			}
+
+			for _, v := range crd.Spec.Versions {
+				if v.Served {
+					versions[v.Name] = true
+				}
+			}
+		}
+
+		if len(versions) == 0 {
+			groups.RemoveGroup(group)
+			return
+		}
+
+		groups.AddGroup(discoveryGroup(group, versions))
+	}
+
+	syncCRD := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+
+		if crd, ok := obj.(*apiextensionsv1.CustomResourceDefinition); ok {
+			sync(crd.Spec.Group)
+		}
+	}
+
+	crdInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    syncCRD,
+		UpdateFunc: func(_, obj interface{}) { syncCRD(obj) },
+		DeleteFunc: syncCRD,
+	})
+}
+
+// addEnabledGroupToDiscovery lists the versions of group enabled in resourceConfig in the /apis
+// discovery of groups.
+func addEnabledGroupToDiscovery(groups discovery.GroupManager, group string, versions []schema.GroupVersion, resourceConfig *serverstorage.ResourceConfig) {
+	enabled := map[string]bool{}
+
+	for _, gv := range versions {
+		if gv.Group == group && resourceConfig.VersionEnabled(gv) {
+			enabled[gv.Version] = true
+		}
+	}
+
+	if len(enabled) > 0 {
+		groups.AddGroup(discoveryGroup(group, enabled))
+	}
+}
+
+// discoveryGroup returns the discovery of group, preferring the highest of versions like kubectl.
+func discoveryGroup(group string, versions map[string]bool) metav1.APIGroup {
+	apiGroup := metav1.APIGroup{Name: group}
+
+	for v := range versions {
+		apiGroup.Versions = append(apiGroup.Versions, metav1.GroupVersionForDiscovery{GroupVersion: group + "/" + v, Version: v})
+	}
+
+	sort.Slice(apiGroup.Versions, func(i, j int) bool {
+		return version.CompareKubeAwareVersionStrings(apiGroup.Versions[i].Version, apiGroup.Versions[j].Version) > 0
+	})
+
+	apiGroup.PreferredVersion = apiGroup.Versions[0]
+
+	return apiGroup
+}
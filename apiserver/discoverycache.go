@@ -0,0 +1,135 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var discoveryCacheRequests = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Name:           "badidea_discovery_cache_requests_total",
+		Help:           "Counter of discovery lookups of the loopback clients, broken down by client and whether they were served from the cache.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"client", "result"},
+)
+
+func init() {
+	legacyregistry.MustRegister(discoveryCacheRequests)
+}
+
+// cachedDiscovery caches the discovery information of a server in memory like the memory cached
+// discovery client, but for at most ttl unless it is zero, so the information is never staler than
+// ttl even if an invalidation is missed. Its lookups are counted in
+// badidea_discovery_cache_requests_total.
+type cachedDiscovery struct {
+	discovery.CachedDiscoveryInterface
+
+	client string
+	ttl    time.Duration
+	// now is time.Now, except in tests.
+	now func() time.Time
+
+	lock sync.Mutex
+	// filled is when the cache was last filled, zero until the first lookup and after an invalidation.
+	filled time.Time
+}
+
+var _ discovery.CachedDiscoveryInterface = &cachedDiscovery{}
+
+// newCachedDiscovery returns a cache of the discovery information of delegate, counted as client.
+func newCachedDiscovery(delegate discovery.DiscoveryInterface, client string, ttl time.Duration) *cachedDiscovery {
+	return &cachedDiscovery{
+		CachedDiscoveryInterface: memory.NewMemCacheClient(delegate),
+		client:                   client,
+		ttl:                      ttl,
+		now:                      time.Now,
+	}
+}
+
+// lookup drops the cached information once it is older than the ttl, and counts a lookup.
+func (d *cachedDiscovery) lookup() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+
+	switch {
+	case d.filled.IsZero():
+	case d.ttl > 0 && now.Sub(d.filled) >= d.ttl:
+		d.CachedDiscoveryInterface.Invalidate()
+	default:
+		discoveryCacheRequests.WithLabelValues(d.client, "hit").Inc()
+		return
+	}
+
+	d.filled = now
+	discoveryCacheRequests.WithLabelValues(d.client, "miss").Inc()
+}
+
+// ServerGroups implements discovery.DiscoveryInterface.
+func (d *cachedDiscovery) ServerGroups() (*metav1.APIGroupList, error) {
+	d.lookup()
+	return d.CachedDiscoveryInterface.ServerGroups()
+}
+
+// ServerResourcesForGroupVersion implements discovery.DiscoveryInterface.
+func (d *cachedDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	d.lookup()
+	return d.CachedDiscoveryInterface.ServerResourcesForGroupVersion(groupVersion)
+}
+
+// ServerResources implements discovery.DiscoveryInterface.
+func (d *cachedDiscovery) ServerResources() ([]*metav1.APIResourceList, error) {
+	d.lookup()
+	return d.CachedDiscoveryInterface.ServerResources()
+}
+
+// ServerGroupsAndResources implements discovery.DiscoveryInterface.
+func (d *cachedDiscovery) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	d.lookup()
+	return d.CachedDiscoveryInterface.ServerGroupsAndResources()
+}
+
+// ServerPreferredResources implements discovery.DiscoveryInterface.
+func (d *cachedDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	d.lookup()
+	return d.CachedDiscoveryInterface.ServerPreferredResources()
+}
+
+// ServerPreferredNamespacedResources implements discovery.DiscoveryInterface.
+func (d *cachedDiscovery) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	d.lookup()
+	return d.CachedDiscoveryInterface.ServerPreferredNamespacedResources()
+}
+
+// Invalidate implements discovery.CachedDiscoveryInterface.
+func (d *cachedDiscovery) Invalidate() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.filled = time.Time{}
+	d.CachedDiscoveryInterface.Invalidate()
+}
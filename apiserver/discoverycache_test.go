@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// countingDiscovery counts the discoveries of the groups of a server.
+type countingDiscovery struct {
+	*fakediscovery.FakeDiscovery
+
+	groups int
+}
+
+func (d *countingDiscovery) ServerGroups() (*metav1.APIGroupList, error) {
+	d.groups++
+	return d.FakeDiscovery.ServerGroups()
+}
+
+func TestCachedDiscovery(t *testing.T) {
+	delegate := &countingDiscovery{FakeDiscovery: &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{}}}
+	delegate.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget", Verbs: []string{"get"}}}},
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	d := newCachedDiscovery(delegate, "test", time.Minute)
+	d.now = func() time.Time { return now }
+
+	counts := func() (float64, float64) {
+		hits, err := testutil.GetCounterMetricValue(discoveryCacheRequests.WithLabelValues("test", "hit"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		misses, err := testutil.GetCounterMetricValue(discoveryCacheRequests.WithLabelValues("test", "miss"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hits, misses
+	}
+
+	discover := func() {
+		if _, err := d.ServerPreferredResources(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	discover()
+
+	// lookups within the ttl are served from the cache
+	now = now.Add(30 * time.Second)
+	discover()
+
+	if delegate.groups != 1 {
+		t.Errorf("expected the server to be discovered once, got %d", delegate.groups)
+	}
+
+	if hits, misses := counts(); hits != 1 || misses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %v and %v", hits, misses)
+	}
+
+	// the information is dropped once it is as old as the ttl
+	now = now.Add(30 * time.Second)
+	discover()
+
+	if delegate.groups != 2 {
+		t.Errorf("expected the server to be discovered again after the ttl, got %d discoveries", delegate.groups)
+	}
+
+	// an invalidation drops it before, and a new resource is discovered
+	delegate.Resources = append(delegate.Resources, &metav1.APIResourceList{
+		GroupVersion: "example.com/v2", APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget", Verbs: []string{"get"}}},
+	})
+
+	now = now.Add(time.Second)
+	d.Invalidate()
+
+	resources, err := d.ServerResourcesForGroupVersion("example.com/v2")
+	if err != nil {
+		t.Fatalf("expected the new group version to be discovered after an invalidation: %v", err)
+	}
+
+	if len(resources.APIResources) != 1 {
+		t.Errorf("expected a resource, got %v", resources.APIResources)
+	}
+
+	if hits, misses := counts(); hits != 1 || misses != 3 {
+		t.Errorf("expected 1 hit and 3 misses, got %v and %v", hits, misses)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration"
+)
+
+// dryRunChecks is the admission control of the servers of the chain. The registries answer dry-run
+// creates and updates without writing to the storage, so the checks of the storage wrappers of the
+// chain are applied to dry-run requests here, and dry runs fail like the requests would.
+type dryRunChecks struct {
+	limits metadataLimits
+	apis   *localAPIs
+}
+
+var _ admission.ValidationInterface = &dryRunChecks{}
+
+// Handles implements admission.Interface.
+func (c *dryRunChecks) Handles(operation admission.Operation) bool {
+	return operation == admission.Create || operation == admission.Update
+}
+
+// Validate implements admission.ValidationInterface. Requests that are no dry runs are checked by the
+// storage.
+func (c *dryRunChecks) Validate(ctx context.Context, a admission.Attributes, _ admission.ObjectInterfaces) error {
+	if !a.IsDryRun() || a.GetObject() == nil {
+		return nil
+	}
+
+	resource := a.GetResource().GroupResource()
+
+	metadata := &metadataCheckingStorage{resource: resource, limits: c.limits}
+	if err := metadata.check(ctx, a.GetOldObject(), a.GetObject()); err != nil {
+		return err
+	}
+
+	if resource == apiServicesResource {
+		old, _ := a.GetOldObject().(*apiregistration.APIService)
+
+		apiServices := &apiServiceCheckingStorage{apis: c.apis}
+		if err := apiServices.check(ctx, old, a.GetObject()); err != nil {
+			return err
+		}
+	}
+
+	if resource == crdsResource {
+		old, _ := a.GetOldObject().(*apiextensions.CustomResourceDefinition)
+
+		crds := &crdCheckingStorage{}
+		if err := crds.check(ctx, old, a.GetObject()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"errors"
+)
+
+// The stages of the construction and running of the server chain. A StageError of a stage matches
+// its error with errors.Is.
+var (
+	// ErrInvalidOptions is the stage of completing and validating the server options.
+	ErrInvalidOptions = errors.New("invalid server options")
+	// ErrInvalidServingCerts is the stage of loading or generating the serving certificate.
+	ErrInvalidServingCerts = errors.New("invalid serving certificates")
+	// ErrEtcdUnavailable is the stage of starting the embedded etcd.
+	ErrEtcdUnavailable = errors.New("etcd unavailable")
+	// ErrStorageVersionSkew is the stage of checking that etcd holds no objects stored by a newer
+	// server in versions the server cannot decode.
+	ErrStorageVersionSkew = errors.New("incompatible storage versions")
+	// ErrExtensionsServer is the stage of creating the apiextensions server.
+	ErrExtensionsServer = errors.New("failed to create the apiextensions server")
+	// ErrAggregatorServer is the stage of configuring and creating the aggregator.
+	ErrAggregatorServer = errors.New("failed to create the aggregator")
+	// ErrServing is the stage of serving, once the server chain was created.
+	ErrServing = errors.New("failed to serve")
+)
+
+// StageError is a failure in a stage of the construction or running of the server chain. It matches
+// the error of its stage with errors.Is and unwraps to the error the stage failed with.
+type StageError struct {
+	// Stage is the error of the stage that failed, e.g. ErrEtcdUnavailable.
+	Stage error
+	// Err is the error the stage failed with.
+	Err error
+}
+
+func (e *StageError) Error() string {
+	return e.Stage.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error the stage failed with.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the error of the stage.
+func (e *StageError) Is(target error) bool {
+	return target == e.Stage
+}
+
+// NewStageError returns a StageError of stage for err, or nil if err is nil. Errors that already
+// record a stage are returned as they are.
+func NewStageError(stage, err error) error {
+	var stageErr *StageError
+	if err == nil || errors.As(err, &stageErr) {
+		return err
+	}
+
+	return &StageError{Stage: stage, Err: err}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"math"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/thetirefire/badidea/options"
+	"go.etcd.io/etcd/clientv3"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+)
+
+// etcdProbeTimeout bounds dialing etcd and every probe.
+const etcdProbeTimeout = 5 * time.Second
+
+var (
+	etcdProbeDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Name:           "badidea_etcd_probe_duration_seconds",
+			Help:           "Round-trip time of the linearized reads etcd is probed with, in seconds.",
+			Buckets:        metrics.ExponentialBuckets(0.0001, 2, 16),
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	etcdProbeFailures = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Name:           "badidea_etcd_probe_failures_total",
+			Help:           "Number of probes of etcd that failed or timed out.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(etcdProbeDuration)
+	legacyregistry.MustRegister(etcdProbeFailures)
+}
+
+// etcdProbe measures the round-trip time of etcd as the server sees it, with linearized reads of a key
+// that does not exist, so the reads go through the raft log of etcd like the writes of the server
+// but cost nothing else. The round-trip times of every summary period are logged, as a warning if
+// their 99th percentile exceeds the threshold or a probe failed.
+type etcdProbe struct {
+	transport     storagebackend.TransportConfig
+	key           string
+	interval      time.Duration
+	summaryPeriod time.Duration
+	threshold     time.Duration
+	// warningf is klog.Warningf, except in tests.
+	warningf func(format string, args ...interface{})
+
+	// samples and failures are the round-trip times and failed probes since the last summary.
+	samples  []time.Duration
+	failures int
+}
+
+// newEtcdProbe returns the probe of the etcd of the storage, or nil without --etcd-probe-interval.
+func newEtcdProbe(o options.CompletedServerRunOptions) *etcdProbe {
+	if o.EtcdProbeInterval <= 0 {
+		return nil
+	}
+
+	storageConfig := o.Extensions.RecommendedOptions.Etcd.StorageConfig
+
+	return &etcdProbe{
+		transport:     storageConfig.Transport,
+		key:           path.Join("/", storageConfig.Prefix, "badidea", "probe"),
+		interval:      o.EtcdProbeInterval,
+		summaryPeriod: o.EtcdProbeSummaryPeriod,
+		threshold:     o.EtcdProbeWarningThreshold,
+		warningf:      klog.Warningf,
+	}
+}
+
+// run probes etcd until stopCh is closed. A failure to dial etcd counts as a failed probe, and it is
+// dialed again on the next one.
+func (p *etcdProbe) run(stopCh <-chan struct{}) {
+	var client *clientv3.Client
+
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	probes := time.NewTicker(p.interval)
+	defer probes.Stop()
+
+	summaries := time.NewTicker(p.summaryPeriod)
+	defer summaries.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-summaries.C:
+			p.summarize()
+		case <-probes.C:
+			if client == nil {
+				var err error
+				if client, err = newEtcdClient(p.transport, etcdProbeTimeout); err != nil {
+					klog.V(2).Infof("Failed to dial etcd to probe it: %v", err)
+					p.record(0, err)
+
+					continue
+				}
+			}
+
+			p.record(p.probe(client))
+		}
+	}
+}
+
+// probe reads the key of the probe and returns how long it took.
+func (p *etcdProbe) probe(client *clientv3.Client) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(clientv3.WithRequireLeader(context.Background()), etcdProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.Get(ctx, p.key, clientv3.WithCountOnly())
+
+	return time.Since(start), err
+}
+
+// record records the round-trip time of a probe, or its failure.
+func (p *etcdProbe) record(rtt time.Duration, err error) {
+	if err != nil {
+		klog.V(2).Infof("Failed to probe etcd: %v", err)
+		etcdProbeFailures.Inc()
+		p.failures++
+
+		return
+	}
+
+	etcdProbeDuration.Observe(rtt.Seconds())
+	p.samples = append(p.samples, rtt)
+}
+
+// summarize logs the round-trip times and failures since the last summary and starts the next one.
+func (p *etcdProbe) summarize() {
+	samples, failures := p.samples, p.failures
+	p.samples, p.failures = nil, 0
+
+	if len(samples) == 0 {
+		if failures > 0 {
+			p.warningf("All %d probes of etcd in the last %v failed", failures, p.summaryPeriod)
+		}
+
+		return
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	p50, p99, max := percentile(samples, 0.5), percentile(samples, 0.99), samples[len(samples)-1]
+
+	if p99 > p.threshold || failures > 0 {
+		p.warningf("etcd round trips of the last %v are slow or failing: p99 %v, threshold %v, p50 %v, max %v, %d probes, %d failed",
+			p.summaryPeriod, p99, p.threshold, p50, max, len(samples)+failures, failures)
+
+		return
+	}
+
+	klog.V(1).Infof("etcd round trips of the last %v: p50 %v, p99 %v, max %v, %d probes",
+		p.summaryPeriod, p50, p99, max, len(samples))
+}
+
+// percentile returns the q-quantile of the sorted samples, by the nearest-rank method.
+func percentile(samples []time.Duration, q float64) time.Duration {
+	rank := int(math.Ceil(q*float64(len(samples)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return samples[rank]
+}
+
+// addEtcdProbeHook probes etcd with probe once s has started.
+func addEtcdProbeHook(s *genericapiserver.GenericAPIServer, probe *etcdProbe) error {
+	return s.AddPostStartHook("badidea-etcd-probe", func(context genericapiserver.PostStartHookContext) error {
+		goHook("badidea-etcd-probe", false, context.StopCh, func() {
+			probe.run(context.StopCh)
+		})
+		return nil
+	})
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+)
+
+// startDelayingProxy forwards the connections to target, delaying every write to it by delay, like a
+// slow disk delays the reads of etcd. It returns the address it listens on.
+func startDelayingProxy(t *testing.T, target string, delay time.Duration) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			backend, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				defer backend.Close()
+
+				buf := make([]byte, 32*1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+
+					time.Sleep(delay)
+
+					if _, err := backend.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, backend)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestEtcdProbe(t *testing.T) {
+	stopEtcd := make(chan struct{})
+	defer close(stopEtcd)
+
+	etcdConfig := startEtcd(t, stopEtcd)
+
+	tests := []struct {
+		name            string
+		delay           time.Duration
+		threshold       time.Duration
+		expectedWarning bool
+	}{
+		{name: "fast", threshold: time.Second},
+		{name: "delayed", delay: 50 * time.Millisecond, threshold: 20 * time.Millisecond, expectedWarning: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := startDelayingProxy(t, strings.TrimPrefix(etcdConfig.ClientURL, "http://"), test.delay)
+
+			warnings := make(chan string, 10)
+
+			probe := &etcdProbe{
+				transport:     storagebackend.TransportConfig{ServerList: []string{"http://" + proxy}},
+				key:           "/registry/badidea/probe",
+				interval:      10 * time.Millisecond,
+				summaryPeriod: 500 * time.Millisecond,
+				threshold:     test.threshold,
+				warningf: func(format string, args ...interface{}) {
+					select {
+					case warnings <- fmt.Sprintf(format, args...):
+					default:
+					}
+				},
+			}
+
+			stopCh := make(chan struct{})
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				probe.run(stopCh)
+			}()
+
+			select {
+			case warning := <-warnings:
+				if !test.expectedWarning {
+					t.Errorf("unexpected warning: %s", warning)
+				}
+			case <-time.After(2 * time.Second):
+				if test.expectedWarning {
+					t.Error("expected a warning about the slow round trips")
+				}
+			}
+
+			close(stopCh)
+			<-done
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	samples := []time.Duration{}
+	for i := 1; i <= 200; i++ {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+
+	if p50, p99 := percentile(samples, 0.5), percentile(samples, 0.99); p50 != 100*time.Millisecond || p99 != 198*time.Millisecond {
+		t.Errorf("expected a p50 of 100ms and a p99 of 198ms, got %v and %v", p50, p99)
+	}
+
+	if p99 := percentile(samples[:1], 0.99); p99 != time.Millisecond {
+		t.Errorf("expected the p99 of one sample to be the sample, got %v", p99)
+	}
+}
@@ -0,0 +1,373 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/thetirefire/badidea/options"
+	"go.etcd.io/etcd/clientv3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/etcd3"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/apiserver/pkg/storage/storagebackend/factory"
+	"k8s.io/klog"
+)
+
+// etcdWaitReadTimeout bounds dialing etcd and a read while waiting for it.
+const etcdWaitReadTimeout = 5 * time.Second
+
+// etcdWaitBackoff spaces the reads while waiting for etcd, so a late etcd is noticed quickly, and many
+// servers waiting for the same etcd do not read in lockstep. It is retried at the cap until the wait
+// times out.
+var etcdWaitBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.2,
+	Steps:    10,
+	Cap:      5 * time.Second,
+}
+
+// errStoppedWaitingForEtcd is returned when the wait for etcd is stopped before etcd answered.
+var errStoppedWaitingForEtcd = errors.New("stopped waiting for etcd")
+
+// WaitForEtcd waits for the etcd servers of the storage options to answer a linearized read, for up
+// to --etcd-wait-timeout or until stopCh is closed. Errors are StageErrors of ErrEtcdUnavailable.
+func WaitForEtcd(o options.CompletedServerRunOptions, stopCh <-chan struct{}) error {
+	storageConfig := o.Extensions.RecommendedOptions.Etcd.StorageConfig
+
+	if err := waitForEtcd(storageConfig.Transport, etcdWaitKey(storageConfig.Prefix), o.EtcdWaitTimeout, stopCh); err != nil {
+		return NewStageError(ErrEtcdUnavailable, err)
+	}
+
+	return nil
+}
+
+// etcdWaitKey is the key read while waiting for etcd, which does not have to exist.
+func etcdWaitKey(prefix string) string {
+	return path.Join("/", prefix, "badidea", "wait")
+}
+
+// waitForEtcd reads key until etcd answers, backing off by etcdWaitBackoff between the reads. A zero
+// timeout waits until stopCh is closed.
+func waitForEtcd(transport storagebackend.TransportConfig, key string, timeout time.Duration, stopCh <-chan struct{}) error {
+	client, err := newEtcdClient(transport, etcdWaitReadTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial etcd: %w", err)
+	}
+	defer client.Close()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	backoff := etcdWaitBackoff
+
+	for attempt := 1; ; attempt++ {
+		readTimeout := etcdWaitReadTimeout
+		if !deadline.IsZero() && time.Until(deadline) < readTimeout {
+			readTimeout = time.Until(deadline)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+		_, err := client.Get(ctx, key, clientv3.WithCountOnly())
+		cancel()
+
+		if err == nil {
+			if attempt > 1 {
+				klog.Infof("etcd answered after %d attempts", attempt)
+			}
+
+			return nil
+		}
+
+		delay := backoff.Step()
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return fmt.Errorf("etcd did not answer within %v: %w", timeout, err)
+			}
+
+			if delay > remaining {
+				delay = remaining
+			}
+		}
+
+		klog.V(2).Infof("Waiting %v for etcd to answer: %v", delay, err)
+
+		select {
+		case <-stopCh:
+			return errStoppedWaitingForEtcd
+		case <-time.After(delay):
+		}
+	}
+}
+
+// etcdGate holds back the storage of the servers of the chain until etcd answered and the storage
+// versions were checked, when the servers are created without waiting for etcd.
+type etcdGate struct {
+	opened   chan struct{}
+	openOnce sync.Once
+}
+
+func newEtcdGate() *etcdGate {
+	return &etcdGate{opened: make(chan struct{})}
+}
+
+// open lets the storage be created.
+func (g *etcdGate) open() {
+	g.openOnce.Do(func() { close(g.opened) })
+}
+
+// isOpen returns whether the storage can be created.
+func (g *etcdGate) isOpen() bool {
+	select {
+	case <-g.opened:
+		return true
+	default:
+		return false
+	}
+}
+
+// addEtcdGateHook adds the post-start hook opening the gate once etcd answered and the storage
+// versions were checked. The hook only returns then, so /readyz fails until etcd answers. A skew of
+// the storage versions is fatal like it is when starting.
+func (c *ServerChainConfig) addEtcdGateHook(s *genericapiserver.GenericAPIServer, o options.CompletedServerRunOptions) error {
+	storageConfig := o.Extensions.RecommendedOptions.Etcd.StorageConfig
+
+	return s.AddPostStartHook("badidea-wait-for-etcd", func(context genericapiserver.PostStartHookContext) error {
+		backoff := etcdWaitBackoff
+
+		for {
+			err := waitForEtcd(storageConfig.Transport, etcdWaitKey(storageConfig.Prefix), 0, context.StopCh)
+			if errors.Is(err, errStoppedWaitingForEtcd) {
+				return nil
+			}
+
+			if err == nil {
+				err = c.CheckStorageVersions(o)
+			}
+
+			if err == nil {
+				c.storage.etcdGate.open()
+				return nil
+			}
+
+			if !errors.Is(err, ErrEtcdUnavailable) {
+				return err
+			}
+
+			// etcd went away again, or the client could not be created
+			klog.Warningf("Failed to reach etcd to check the storage versions: %v", err)
+
+			select {
+			case <-context.StopCh:
+				return nil
+			case <-time.After(backoff.Step()):
+			}
+		}
+	})
+}
+
+// gatedStorage answers requests with a 503 until the gate opens and the storage could be created.
+// The storage is created in the background then, retried by etcdWaitBackoff.
+type gatedStorage struct {
+	resource schema.GroupResource
+
+	lock      sync.Mutex
+	storage   storage.Interface
+	destroyed bool
+	// destroyStorage destroys the storage once it was created.
+	destroyStorage factory.DestroyFunc
+	stopCh         chan struct{}
+}
+
+var _ storage.Interface = &gatedStorage{}
+
+// newGatedStorage returns the storage of resource, created by create once gate opens.
+func newGatedStorage(resource schema.GroupResource, gate *etcdGate, create func() (storage.Interface, factory.DestroyFunc, error)) (*gatedStorage, factory.DestroyFunc) {
+	s := &gatedStorage{resource: resource, stopCh: make(chan struct{})}
+
+	go s.run(gate, create)
+
+	return s, s.destroy
+}
+
+func (s *gatedStorage) run(gate *etcdGate, create func() (storage.Interface, factory.DestroyFunc, error)) {
+	select {
+	case <-s.stopCh:
+		return
+	case <-gate.opened:
+	}
+
+	backoff := etcdWaitBackoff
+
+	for {
+		created, destroy, err := create()
+		if err == nil {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			if s.destroyed {
+				if destroy != nil {
+					destroy()
+				}
+
+				return
+			}
+
+			s.storage, s.destroyStorage = created, destroy
+
+			return
+		}
+
+		klog.Errorf("Failed to create the storage of %s: %v", s.resource, err)
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// destroy stops creating the storage, or destroys it once it was created.
+func (s *gatedStorage) destroy() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.destroyed {
+		return
+	}
+
+	s.destroyed = true
+	close(s.stopCh)
+
+	if s.destroyStorage != nil {
+		s.destroyStorage()
+	}
+}
+
+// current returns the storage, or a 503 until it was created.
+func (s *gatedStorage) current() (storage.Interface, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.storage == nil {
+		return nil, apierrors.NewServiceUnavailable(fmt.Sprintf("the storage of %s is not available until etcd answers", s.resource))
+	}
+
+	return s.storage, nil
+}
+
+// Versioner of the etcd3 storage, which the storage has once it was created.
+func (s *gatedStorage) Versioner() storage.Versioner {
+	return etcd3.APIObjectVersioner{}
+}
+
+func (s *gatedStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return current.Create(ctx, key, obj, out, ttl)
+}
+
+func (s *gatedStorage) Delete(ctx context.Context, key string, out runtime.Object, preconditions *storage.Preconditions, validateDeletion storage.ValidateObjectFunc) error {
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return current.Delete(ctx, key, out, preconditions, validateDeletion)
+}
+
+func (s *gatedStorage) Watch(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	current, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return current.Watch(ctx, key, opts)
+}
+
+func (s *gatedStorage) WatchList(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	current, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return current.WatchList(ctx, key, opts)
+}
+
+func (s *gatedStorage) Get(ctx context.Context, key string, opts storage.GetOptions, objPtr runtime.Object) error {
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return current.Get(ctx, key, opts, objPtr)
+}
+
+func (s *gatedStorage) GetToList(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return current.GetToList(ctx, key, opts, listObj)
+}
+
+func (s *gatedStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return current.List(ctx, key, opts, listObj)
+}
+
+func (s *gatedStorage) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, precondtions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return current.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, precondtions, tryUpdate, suggestion...)
+}
+
+func (s *gatedStorage) Count(key string) (int64, error) {
+	current, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+
+	return current.Count(key)
+}
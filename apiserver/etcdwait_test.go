@@ -0,0 +1,159 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/etcd"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/apiserver/pkg/storage/storagebackend/factory"
+)
+
+func TestEtcdWaitBackoff(t *testing.T) {
+	backoff := etcdWaitBackoff
+	base := etcdWaitBackoff.Duration
+
+	for i := 0; i < 20; i++ {
+		delay := backoff.Step()
+
+		maxDelay := time.Duration(float64(base) * (1 + etcdWaitBackoff.Jitter))
+		if delay < base || delay > maxDelay {
+			t.Errorf("step %d: expected a delay between %v and %v, got %v", i, base, maxDelay, delay)
+		}
+
+		if base *= 2; base > etcdWaitBackoff.Cap {
+			base = etcdWaitBackoff.Cap
+		}
+	}
+
+	if base != 5*time.Second {
+		t.Errorf("expected the delays to be capped at 5s, got %v", base)
+	}
+}
+
+func TestWaitForEtcd(t *testing.T) {
+	// etcd is not started on the ports of the config
+	etcdConfig := newEtcdConfig(t)
+	transport := storagebackend.TransportConfig{ServerList: []string{etcdConfig.ClientURL}}
+
+	start := time.Now()
+
+	err := waitForEtcd(transport, "/registry/badidea/wait", time.Second, nil)
+	if err == nil {
+		t.Fatalf("expected the wait for a missing etcd to time out")
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("expected the wait to time out after 1s, took %v", elapsed)
+	}
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	if err := waitForEtcd(transport, "/registry/badidea/wait", 0, stopCh); !errors.Is(err, errStoppedWaitingForEtcd) {
+		t.Errorf("expected the wait to stop, got %v", err)
+	}
+
+	// etcd coming up while waiting
+	stopEtcd := make(chan struct{})
+	defer close(stopEtcd)
+
+	etcdErr := make(chan error, 1)
+
+	go func() {
+		time.Sleep(time.Second)
+
+		_, err := etcd.StartEtcdServer(etcdConfig, stopEtcd)
+		etcdErr <- err
+	}()
+
+	if err := waitForEtcd(transport, "/registry/badidea/wait", wait.ForeverTestTimeout, nil); err != nil {
+		t.Errorf("expected the wait to end once etcd came up, got %v", err)
+	}
+
+	if err := <-etcdErr; err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+}
+
+func TestGatedStorage(t *testing.T) {
+	resource := schema.GroupResource{Group: "example.com", Resource: "widgets"}
+
+	created := make(chan struct{}, 1)
+	destroyed := make(chan struct{}, 1)
+	create := func() (storage.Interface, factory.DestroyFunc, error) {
+		created <- struct{}{}
+		return &failingStorage{err: errors.New("created")}, func() { destroyed <- struct{}{} }, nil
+	}
+
+	gate := newEtcdGate()
+
+	s, destroy := newGatedStorage(resource, gate, create)
+
+	if err := s.Create(context.TODO(), "/widgets/a", nil, nil, 0); !apierrors.IsServiceUnavailable(err) {
+		t.Errorf("expected a 503 before the gate opened, got %v", err)
+	}
+
+	if _, err := s.Count("/widgets"); !apierrors.IsServiceUnavailable(err) {
+		t.Errorf("expected a 503 before the gate opened, got %v", err)
+	}
+
+	gate.open()
+
+	select {
+	case <-created:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected the storage to be created once the gate opened")
+	}
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := s.current()
+		return err == nil, nil
+	}); err != nil {
+		t.Fatalf("expected the storage to be served once it was created")
+	}
+
+	if err := s.Create(context.TODO(), "/widgets/a", nil, nil, 0); err == nil || err.Error() != "created" {
+		t.Errorf("expected the request to reach the created storage, got %v", err)
+	}
+
+	destroy()
+
+	select {
+	case <-destroyed:
+	default:
+		t.Errorf("expected the created storage to be destroyed")
+	}
+
+	// storage destroyed before the gate opens is never created
+	_, destroy = newGatedStorage(resource, newEtcdGate(), create)
+	destroy()
+
+	select {
+	case <-created:
+		t.Errorf("expected the storage not to be created")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+
+	"github.com/go-openapi/spec"
+	"github.com/thetirefire/badidea/options"
+	flowcontrolv1alpha1 "k8s.io/api/flowcontrol/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	flowcontrolbootstrap "k8s.io/apiserver/pkg/apis/flowcontrol/bootstrap"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/resourceconfig"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+var (
+	// flowControlScheme holds the types of the flowcontrol.apiserver.k8s.io group, which is only
+	// served with the runtime config enabling it.
+	flowControlScheme = runtime.NewScheme()
+	flowControlCodecs = serializer.NewCodecFactory(flowControlScheme)
+
+	flowSchemasResource                 = flowcontrolv1alpha1.SchemeGroupVersion.WithResource("flowschemas").GroupResource()
+	priorityLevelConfigurationsResource = flowcontrolv1alpha1.SchemeGroupVersion.WithResource("prioritylevelconfigurations").GroupResource()
+)
+
+func init() {
+	utilruntime.Must(flowcontrolv1alpha1.AddToScheme(flowControlScheme))
+	metav1.AddToGroupVersion(flowControlScheme, schema.GroupVersion{Version: "v1"})
+}
+
+// flowControlEnabled returns whether the runtime config of o enables the flowcontrol.apiserver.k8s.io
+// group, which is disabled by default.
+func flowControlEnabled(o options.CompletedServerRunOptions) (bool, error) {
+	defaults := serverstorage.NewResourceConfig()
+	defaults.DisableVersions(flowcontrolv1alpha1.SchemeGroupVersion)
+
+	config, err := resourceconfig.MergeAPIResourceConfigs(defaults, o.Extensions.APIEnablement.RuntimeConfig, flowControlScheme)
+	if err != nil {
+		return false, err
+	}
+
+	return config.VersionEnabled(flowcontrolv1alpha1.SchemeGroupVersion), nil
+}
+
+// newFlowControlAPIGroup returns the flowcontrol.apiserver.k8s.io group, serving the bootstrap
+// FlowSchemas and PriorityLevelConfigurations of the Kubernetes API server read-only from memory, so
+// tools discovering the flow control of servers can list them. The server does not enforce them.
+func newFlowControlAPIGroup() apiGroup {
+	flowSchemas := []runtime.Object{}
+	for _, flowSchema := range append(flowcontrolbootstrap.MandatoryFlowSchemas, flowcontrolbootstrap.SuggestedFlowSchemas...) {
+		flowSchemas = append(flowSchemas, flowSchema)
+	}
+
+	priorityLevels := []runtime.Object{}
+	for _, priorityLevel := range append(flowcontrolbootstrap.MandatoryPriorityLevelConfigurations, flowcontrolbootstrap.SuggestedPriorityLevelConfigurations...) {
+		priorityLevels = append(priorityLevels, priorityLevel)
+	}
+
+	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(flowcontrolv1alpha1.GroupName, flowControlScheme, runtime.NewParameterCodec(flowControlScheme), flowControlCodecs)
+	apiGroupInfo.VersionedResourcesStorageMap[flowcontrolv1alpha1.SchemeGroupVersion.Version] = map[string]rest.Storage{
+		"flowschemas": &readOnlyREST{
+			TableConvertor: rest.NewDefaultTableConvertor(flowSchemasResource),
+			resource:       flowSchemasResource,
+			newFunc:        func() runtime.Object { return &flowcontrolv1alpha1.FlowSchema{} },
+			newListFunc:    func() runtime.Object { return &flowcontrolv1alpha1.FlowSchemaList{} },
+			objects:        flowSchemas,
+		},
+		"prioritylevelconfigurations": &readOnlyREST{
+			TableConvertor: rest.NewDefaultTableConvertor(priorityLevelConfigurationsResource),
+			resource:       priorityLevelConfigurationsResource,
+			newFunc:        func() runtime.Object { return &flowcontrolv1alpha1.PriorityLevelConfiguration{} },
+			newListFunc:    func() runtime.Object { return &flowcontrolv1alpha1.PriorityLevelConfigurationList{} },
+			objects:        priorityLevels,
+		},
+	}
+
+	return apiGroup{
+		info:               &apiGroupInfo,
+		priorities:         map[schema.GroupVersion]Priority{flowcontrolv1alpha1.SchemeGroupVersion: {Group: 16100, Version: 9}},
+		openAPIDefinitions: getFlowControlOpenAPIDefinitions,
+	}
+}
+
+// readOnlyREST serves fixed cluster-scoped objects. Writes are not allowed.
+type readOnlyREST struct {
+	rest.TableConvertor
+
+	resource    schema.GroupResource
+	newFunc     func() runtime.Object
+	newListFunc func() runtime.Object
+	objects     []runtime.Object
+}
+
+var (
+	_ rest.Getter = &readOnlyREST{}
+	_ rest.Lister = &readOnlyREST{}
+)
+
+func (r *readOnlyREST) New() runtime.Object {
+	return r.newFunc()
+}
+
+func (r *readOnlyREST) NewList() runtime.Object {
+	return r.newListFunc()
+}
+
+func (r *readOnlyREST) NamespaceScoped() bool {
+	return false
+}
+
+func (r *readOnlyREST) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+	for _, obj := range r.objects {
+		if obj.(metav1.Object).GetName() == name {
+			return obj.DeepCopyObject(), nil
+		}
+	}
+
+	return nil, apierrors.NewNotFound(r.resource, name)
+}
+
+func (r *readOnlyREST) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	items := []runtime.Object{}
+
+	for _, obj := range r.objects {
+		if options == nil || options.LabelSelector == nil || options.LabelSelector.Matches(labels.Set(obj.(metav1.Object).GetLabels())) {
+			items = append(items, obj.DeepCopyObject())
+		}
+	}
+
+	list := r.newListFunc()
+	if err := meta.SetList(list, items); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// getFlowControlOpenAPIDefinitions returns the OpenAPI definitions of the served flowcontrol types,
+// written by hand. Their spec and status are left open, short of the generated definitions of
+// k8s.io/kubernetes.
+func getFlowControlOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
+	const pkg = "k8s.io/api/flowcontrol/v1alpha1."
+
+	object := func(description string) common.OpenAPIDefinition {
+		return common.OpenAPIDefinition{
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: description,
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kind":       {SchemaProps: spec.SchemaProps{Type: []string{"string"}}},
+						"apiVersion": {SchemaProps: spec.SchemaProps{Type: []string{"string"}}},
+						"metadata":   {SchemaProps: spec.SchemaProps{Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta")}},
+						"spec":       {SchemaProps: spec.SchemaProps{Type: []string{"object"}}},
+						"status":     {SchemaProps: spec.SchemaProps{Type: []string{"object"}}},
+					},
+				},
+			},
+			Dependencies: []string{"k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+		}
+	}
+
+	list := func(description, item string) common.OpenAPIDefinition {
+		return common.OpenAPIDefinition{
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: description,
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kind":       {SchemaProps: spec.SchemaProps{Type: []string{"string"}}},
+						"apiVersion": {SchemaProps: spec.SchemaProps{Type: []string{"string"}}},
+						"metadata":   {SchemaProps: spec.SchemaProps{Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ListMeta")}},
+						"items": {
+							SchemaProps: spec.SchemaProps{
+								Type:  []string{"array"},
+								Items: &spec.SchemaOrArray{Schema: &spec.Schema{SchemaProps: spec.SchemaProps{Ref: ref(pkg + item)}}},
+							},
+						},
+					},
+					Required: []string{"items"},
+				},
+			},
+			Dependencies: []string{"k8s.io/apimachinery/pkg/apis/meta/v1.ListMeta", pkg + item},
+		}
+	}
+
+	return map[string]common.OpenAPIDefinition{
+		pkg + "FlowSchema":                     object("FlowSchema defines the schema of a group of flows."),
+		pkg + "FlowSchemaList":                 list("FlowSchemaList is a list of FlowSchema objects.", "FlowSchema"),
+		pkg + "PriorityLevelConfiguration":     object("PriorityLevelConfiguration represents the configuration of a priority level."),
+		pkg + "PriorityLevelConfigurationList": list("PriorityLevelConfigurationList is a list of PriorityLevelConfiguration objects.", "PriorityLevelConfiguration"),
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"net/http"
+
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authorization/union"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
+)
+
+// isLongRunningRequest tells the requests that stream for as long as the client wants apart from the
+// ones --request-timeout applies to, like kube-apiserver: watches, the proxy verb, and the streaming
+// subresources served by aggregated servers or groups added with WithAPIGroup.
+var isLongRunningRequest = genericfilters.BasicLongRunningRequestCheck(
+	sets.NewString("watch", "proxy"),
+	sets.NewString("attach", "exec", "proxy", "log", "portforward"),
+)
+
+// buildHandlerChainFunc returns the handler chain of the aggregator. The aggregator fronts every
+// request served by badidea, so the badidea filters only need to be installed there.
+//
+// This is a copy of genericapiserver.DefaultBuildHandlerChain with the badidea filters spliced in.
+// Keep it in sync when bumping the apiserver dependency.
+func buildHandlerChainFunc(o options.CompletedServerRunOptions, quota *storageQuota, deprecated map[schema.GroupVersionResource]filters.Deprecation, attribution *filters.RequestAttribution, writes *filters.WritePause, readiness *filters.Readiness, tenancy *crdTenancy, selectable func(schema.GroupResource) []string) func(http.Handler, *genericapiserver.Config) http.Handler {
+	return func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		authz := c.Authorization.Authorizer
+		if tenancy != nil {
+			// the tenancy denies before the authorizer of the chain may allow
+			authz = union.New(tenancy, authz)
+		}
+
+		handler := filters.WithHealthCheckExclusions(apiHandler, map[string][]string{
+			"/readyz": o.ReadyzExclude,
+			"/livez":  o.LivezExclude,
+		})
+		readyz := handler
+		handler = filters.WithAPIServiceErrorStatus(handler, c.Serializer)
+		if quota != nil {
+			handler = filters.WithStorageQuota(handler, quota.exceededError, c.Serializer)
+		}
+		handler = filters.WithWritePause(handler, writes, isLoopbackUser, c.Serializer)
+		handler = filters.WithRequestBodyLimits(handler, filters.RequestBodyLimits{
+			MaxBytes:               c.MaxRequestBodyBytes,
+			MaxJSONPatchOperations: o.MaxJSONPatchOperations,
+			MaxNestingDepth:        o.MaxRequestNestingDepth,
+		}, c.Serializer)
+		handler = filters.WithLabelSelectorLimits(handler, filters.LabelSelectorLimits{
+			MaxRequirements: o.MaxLabelSelectorRequirements,
+			MaxValues:       o.MaxLabelSelectorValues,
+		}, c.Serializer)
+		if selectable != nil {
+			handler = filters.WithSelectableFields(handler, selectable)
+		}
+		handler = filters.WithDeleteCollectionMetrics(handler)
+		handler = filters.WithDeprecationWarnings(handler, deprecated, o.SuppressDeprecationWarningsUserAgents)
+		handler = filters.WithoutResponseCompression(handler, o.UncompressedResources)
+		handler = filters.WithResponseCompressionMetrics(handler)
+		if tenancy != nil {
+			handler = filters.WithHiddenAPIs(handler, tenancy.hiddenAPIs, c.Serializer)
+		}
+		handler = filters.WithDiscoveryETags(handler)
+		handler = filters.WithWatchLimits(handler, filters.WatchLimits{
+			MaxPerUser:      o.MaxWatchesPerUser,
+			MaxPerNamespace: o.MaxWatchesPerNamespace,
+		}, isLoopbackUser, c.Serializer)
+		handler = genericapifilters.WithAuthorization(handler, authz, c.Serializer)
+		priority := handler
+		if c.FlowControl != nil {
+			handler = genericfilters.WithPriorityAndFairness(handler, c.LongRunningFunc, c.FlowControl)
+		} else {
+			handler = genericfilters.WithMaxInFlightLimit(handler, c.MaxRequestsInFlight, c.MaxMutatingRequestsInFlight, c.LongRunningFunc)
+		}
+		handler = filters.WithPriority(handler, priority, o.MaxPriorityRequestsInFlight)
+		handler = filters.WithImpersonation(handler, c.Authorization.Authorizer, c.Serializer)
+		handler = filters.WithReservedUserNames(handler, componentUserPrefix, isLoopbackUser, c.Serializer)
+		handler = filters.WithRetryAfter(handler, readyz, readiness, c.Serializer)
+		handler = genericapifilters.WithAudit(handler, c.AuditBackend, c.AuditPolicyChecker, c.LongRunningFunc)
+		handler = filters.WithRequestLogging(handler, c.LongRunningFunc, o.EnableRequestLogging, o.SlowRequestThreshold)
+		handler = filters.WithRequestAttribution(handler, attribution)
+		handler = filters.WithRequestOrigin(handler)
+		failedHandler := genericapifilters.Unauthorized(c.Serializer)
+		failedHandler = genericapifilters.WithFailedAuthenticationAudit(failedHandler, c.AuditBackend, c.AuditPolicyChecker)
+		handler = genericapifilters.WithAuthentication(handler, c.Authentication.Authenticator, failedHandler, c.Authentication.APIAudiences)
+		handler = genericfilters.WithCORS(handler, c.CorsAllowedOriginList, nil, nil, nil, "true")
+		handler = genericfilters.WithTimeoutForNonLongRunningRequests(handler, c.LongRunningFunc, c.RequestTimeout)
+		handler = genericfilters.WithWaitGroup(handler, c.LongRunningFunc, c.HandlerChainWaitGroup)
+		handler = genericapifilters.WithRequestInfo(handler, c.RequestInfoResolver)
+		if c.SecureServing != nil && !c.SecureServing.DisableHTTP2 && c.GoawayChance > 0 {
+			handler = genericfilters.WithProbabilisticGoaway(handler, c.GoawayChance)
+		}
+		handler = genericapifilters.WithAuditAnnotations(handler, c.AuditBackend, c.AuditPolicyChecker)
+		handler = genericapifilters.WithWarningRecorder(handler)
+		handler = genericapifilters.WithCacheControl(handler)
+		handler = filters.WithAuditID(handler)
+		handler = genericfilters.WithPanicRecovery(handler)
+
+		return handler
+	}
+}
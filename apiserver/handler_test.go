@@ -0,0 +1,384 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+)
+
+// newTestHandlerChainConfig returns the completed config of the aggregator, whose
+// BuildHandlerChainFunc builds the handler chain of badidea, for the options changed by customize.
+// The returned func cleans up.
+func newTestHandlerChainConfig(t *testing.T, customize func(*options.ServerRunOptions)) (*genericapiserver.Config, func()) {
+	certDir, err := ioutil.TempDir("", "badidea-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, closeListener := newTestServerRunOptions(t, certDir)
+	if customize != nil {
+		customize(o)
+	}
+
+	completed, err := o.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config, err := CreateServerChainConfig(completed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	genericConfig := config.Aggregator.GenericConfig.Config
+	genericConfig.Complete(nil)
+
+	return &genericConfig, func() {
+		closeListener()
+		os.RemoveAll(certDir)
+	}
+}
+
+// TestHandlerChainOptions checks that the options reach the filters of the handler chain. The
+// filters are tested on their own in the filters package.
+func TestHandlerChainOptions(t *testing.T) {
+	nested := `"deep"`
+	for i := 0; i < 21; i++ {
+		nested = `{"nested":` + nested + `}`
+	}
+
+	patch := func(operations int) string {
+		ops := make([]string, operations)
+		for i := range ops {
+			ops[i] = `{"op":"add","path":"/metadata/labels","value":{}}`
+		}
+
+		return "[" + strings.Join(ops, ",") + "]"
+	}
+
+	widgets := "/apis/example.com/v1/namespaces/default/widgets"
+
+	tests := []struct {
+		name      string
+		customize func(*options.ServerRunOptions)
+		method    string
+		path      string
+		header    http.Header
+		body      string
+		loopback  bool
+
+		expectedCode      int
+		expectedBody      string
+		expectedHeaders   map[string]string
+		unexpectedHeaders []string
+	}{
+		{
+			name:         "oversized body",
+			customize:    func(o *options.ServerRunOptions) { o.MaxRequestBodyBytes = 64 * 1024 },
+			method:       http.MethodPost,
+			path:         widgets,
+			body:         `{"spec":"` + strings.Repeat("x", 64*1024) + `"}`,
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "nested body",
+			customize:    func(o *options.ServerRunOptions) { o.MaxRequestNestingDepth = 20 },
+			method:       http.MethodPost,
+			path:         widgets,
+			body:         `{"spec":` + nested + `}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "the request body is nested 22 levels deep, the limit is 20",
+		},
+		{
+			name:         "nested body without a limit",
+			method:       http.MethodPost,
+			path:         widgets,
+			body:         `{"spec":` + nested + `}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "long JSON patch",
+			customize:    func(o *options.ServerRunOptions) { o.MaxJSONPatchOperations = 10 },
+			method:       http.MethodPatch,
+			path:         widgets + "/gizmo",
+			header:       http.Header{"Content-Type": {"application/json-patch+json"}},
+			body:         patch(11),
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "the JSON patch has 11 operations, the limit is 10",
+		},
+		{
+			name:         "JSON patch within the limit",
+			customize:    func(o *options.ServerRunOptions) { o.MaxJSONPatchOperations = 10 },
+			method:       http.MethodPatch,
+			path:         widgets + "/gizmo",
+			header:       http.Header{"Content-Type": {"application/json-patch+json"}},
+			body:         patch(10),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "label selector over the limits",
+			customize: func(o *options.ServerRunOptions) {
+				o.MaxLabelSelectorRequirements = 3
+				o.MaxLabelSelectorValues = 2
+			},
+			method:       http.MethodGet,
+			path:         widgets + "?labelSelector=app+in+(1,2,3)",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "label selector within the limits",
+			customize: func(o *options.ServerRunOptions) {
+				o.MaxLabelSelectorRequirements = 3
+				o.MaxLabelSelectorValues = 2
+			},
+			method:       http.MethodGet,
+			path:         widgets + "?labelSelector=app+in+(1,2),tier=web,!owner",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "deprecated resource",
+			customize: func(o *options.ServerRunOptions) {
+				o.DeprecatedResources = map[schema.GroupVersionResource]string{
+					{Group: "example.com", Version: "v1", Resource: "widgets"}: "example.com/v2 widgets",
+				}
+			},
+			method:          http.MethodGet,
+			path:            widgets,
+			expectedCode:    http.StatusOK,
+			expectedHeaders: map[string]string{"Warning": "example.com/v1 widgets is deprecated; use example.com/v2 widgets"},
+		},
+		{
+			name: "deprecated resource with a suppressed user agent",
+			customize: func(o *options.ServerRunOptions) {
+				o.DeprecatedResources = map[schema.GroupVersionResource]string{
+					{Group: "example.com", Version: "v1", Resource: "widgets"}: "example.com/v2 widgets",
+				}
+				o.SuppressDeprecationWarningsUserAgents = []string{"legacy-tool/"}
+			},
+			method:            http.MethodGet,
+			path:              widgets,
+			header:            http.Header{"User-Agent": {"legacy-tool/1.0"}},
+			expectedCode:      http.StatusOK,
+			unexpectedHeaders: []string{"Warning"},
+		},
+		{
+			name:         "uncompressed resource",
+			customize:    func(o *options.ServerRunOptions) { o.DisableResponseCompressionFor = []string{"widgets.example.com"} },
+			method:       http.MethodGet,
+			path:         widgets,
+			header:       http.Header{"Accept-Encoding": {"gzip"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `""`,
+		},
+		{
+			name:         "compressed resource",
+			customize:    func(o *options.ServerRunOptions) { o.DisableResponseCompressionFor = []string{"widgets.example.com"} },
+			method:       http.MethodGet,
+			path:         "/apis/example.com/v1/gadgets",
+			header:       http.Header{"Accept-Encoding": {"gzip"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `"gzip"`,
+		},
+		{
+			name:         "discovery",
+			method:       http.MethodGet,
+			path:         "/apis",
+			expectedCode: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"ETag":          `"`,
+				"Cache-Control": "no-cache",
+			},
+		},
+		{
+			name: "CORS preflight",
+			customize: func(o *options.ServerRunOptions) {
+				o.CorsAllowedOrigins = []string{`^https://dashboard\.example\.com$`}
+			},
+			method:       http.MethodOptions,
+			path:         "/apis",
+			header:       http.Header{"Origin": {"https://dashboard.example.com"}, "Access-Control-Request-Method": {http.MethodGet}},
+			expectedCode: http.StatusNoContent,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://dashboard.example.com",
+				"Access-Control-Allow-Methods":     http.MethodGet,
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			name: "CORS request of another origin",
+			customize: func(o *options.ServerRunOptions) {
+				o.CorsAllowedOrigins = []string{`^https://dashboard\.example\.com$`}
+			},
+			method:            http.MethodGet,
+			path:              "/apis",
+			header:            http.Header{"Origin": {"https://dashboard.example.com.evil.test"}},
+			expectedCode:      http.StatusOK,
+			unexpectedHeaders: []string{"Access-Control-Allow-Origin"},
+		},
+		{
+			name:         "impersonation denied",
+			method:       http.MethodGet,
+			path:         widgets,
+			header:       http.Header{"Impersonate-User": {"bob"}},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "impersonation allowed",
+			customize:    func(o *options.ServerRunOptions) { o.AuthorizationMode = options.AuthorizationModeAlwaysAllow },
+			method:       http.MethodGet,
+			path:         widgets,
+			header:       http.Header{"Impersonate-User": {"bob"}, "Impersonate-Group": {"developers"}, "Impersonate-Uid": {"1234"}},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "impersonating a UID without a user",
+			customize:    func(o *options.ServerRunOptions) { o.AuthorizationMode = options.AuthorizationModeAlwaysAllow },
+			method:       http.MethodGet,
+			path:         widgets,
+			header:       http.Header{"Impersonate-Uid": {"1234"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "impersonating a component",
+			customize:    func(o *options.ServerRunOptions) { o.AuthorizationMode = options.AuthorizationModeAlwaysAllow },
+			method:       http.MethodGet,
+			path:         widgets,
+			header:       http.Header{"Impersonate-User": {componentUserPrefix + "garbage-collector"}, "Impersonate-Group": {"system:masters"}},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "loopback impersonating a component",
+			method:       http.MethodGet,
+			path:         widgets,
+			header:       http.Header{"Impersonate-User": {componentUserPrefix + "garbage-collector"}, "Impersonate-Group": {"system:masters"}},
+			loopback:     true,
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(req.Header.Get("Accept-Encoding"))
+	})
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			genericConfig, cleanup := newTestHandlerChainConfig(t, test.customize)
+			defer cleanup()
+
+			handler := genericConfig.BuildHandlerChainFunc(apiHandler, genericConfig)
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			for key, values := range test.header {
+				req.Header[key] = values
+			}
+
+			if test.loopback {
+				req.Header.Set("Authorization", "Bearer "+genericConfig.LoopbackClientConfig.BearerToken)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedCode {
+				t.Fatalf("expected code %d, got %d: %s", test.expectedCode, w.Code, w.Body.String())
+			}
+
+			if !strings.Contains(w.Body.String(), test.expectedBody) {
+				t.Errorf("expected the body to contain %q, got %q", test.expectedBody, w.Body.String())
+			}
+
+			for key, expected := range test.expectedHeaders {
+				if value := w.Header().Get(key); !strings.Contains(value, expected) {
+					t.Errorf("expected the %s header to contain %q, got %q", key, expected, value)
+				}
+			}
+
+			for _, key := range test.unexpectedHeaders {
+				if value := w.Header().Get(key); value != "" {
+					t.Errorf("expected no %s header, got %q", key, value)
+				}
+			}
+		})
+	}
+}
+
+// TestHandlerChainWatchLimits checks that --max-watches-per-user applies to external clients only.
+func TestHandlerChainWatchLimits(t *testing.T) {
+	genericConfig, cleanup := newTestHandlerChainConfig(t, func(o *options.ServerRunOptions) {
+		o.MaxWatchesPerUser = 1
+	})
+	defer cleanup()
+
+	// the watches are held open until the test ends, the probes of /readyz are served
+	release := make(chan struct{})
+	watching := make(chan struct{})
+	done := make(chan struct{})
+
+	handler := genericConfig.BuildHandlerChainFunc(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("watch") == "true" {
+			watching <- struct{}{}
+			<-release
+		}
+	}), genericConfig)
+
+	watches := 0
+	open := func(bearerToken string) {
+		req := httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/widgets?watch=true", nil)
+		if bearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+bearerToken)
+		}
+
+		watches++
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			done <- struct{}{}
+		}()
+		<-watching
+	}
+
+	defer func() {
+		close(release)
+		for ; watches > 0; watches-- {
+			<-done
+		}
+	}()
+
+	open("")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/widgets?watch=true", nil))
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a watch over the limit to be rejected with %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	// the internal clients of the server are exempt
+	open(genericConfig.LoopbackClientConfig.BearerToken)
+	open(genericConfig.LoopbackClientConfig.BearerToken)
+}
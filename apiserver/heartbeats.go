@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Heartbeats are the heartbeats of the long-running controllers of the server. The /livez check
+// controller-heartbeats fails once a controller sent no heartbeat for longer than the threshold, so a
+// wedged controller gets the process restarted instead of leaving it alive but useless. Controllers
+// have the grace period for their first heartbeat, to sync their informers at startup. The methods of
+// nil Heartbeats do nothing, so controllers need not check whether they are enabled.
+type Heartbeats struct {
+	threshold time.Duration
+	grace     time.Duration
+	// now is time.Now, except in tests.
+	now func() time.Time
+
+	lock        sync.Mutex
+	controllers map[string]*Heartbeat
+}
+
+// Heartbeat is the heartbeat of one controller.
+type Heartbeat struct {
+	heartbeats *Heartbeats
+	name       string
+
+	// registered is when the controller was registered, last is its last heartbeat or zero.
+	registered time.Time
+	last       time.Time
+}
+
+// newHeartbeats returns the heartbeats failing /livez after threshold, or nil if threshold is zero.
+func newHeartbeats(threshold, grace time.Duration) *Heartbeats {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &Heartbeats{threshold: threshold, grace: grace, now: time.Now, controllers: map[string]*Heartbeat{}}
+}
+
+// Period is how often controllers should beat, often enough for a late heartbeat not to fail /livez.
+func (h *Heartbeats) Period() time.Duration {
+	if h == nil {
+		return 0
+	}
+
+	return h.threshold / 4
+}
+
+// Register tracks the heartbeats of the named controller, replacing a controller of the same name.
+func (h *Heartbeats) Register(name string) *Heartbeat {
+	if h == nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	heartbeat := &Heartbeat{heartbeats: h, name: name, registered: h.now()}
+	h.controllers[name] = heartbeat
+
+	return heartbeat
+}
+
+// Beat records a heartbeat of the controller.
+func (b *Heartbeat) Beat() {
+	if b == nil {
+		return
+	}
+
+	b.heartbeats.lock.Lock()
+	defer b.heartbeats.lock.Unlock()
+
+	b.last = b.heartbeats.now()
+}
+
+// Stop stops tracking the heartbeats of the controller, e.g. once it stopped for good.
+func (b *Heartbeat) Stop() {
+	if b == nil {
+		return
+	}
+
+	b.heartbeats.lock.Lock()
+	defer b.heartbeats.lock.Unlock()
+
+	if b.heartbeats.controllers[b.name] == b {
+		delete(b.heartbeats.controllers, b.name)
+	}
+}
+
+// Name implements healthz.HealthChecker.
+func (h *Heartbeats) Name() string {
+	return "controller-heartbeats"
+}
+
+// Check implements healthz.HealthChecker. It fails if a controller missed its heartbeats, naming the
+// controllers and how long they have been silent. Failures are logged, since /livez withholds the
+// reason of a failed check.
+func (h *Heartbeats) Check(_ *http.Request) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.now()
+	missed := []string{}
+
+	for name, heartbeat := range h.controllers {
+		since, limit := heartbeat.last, h.threshold
+		if since.IsZero() {
+			since = heartbeat.registered
+			if h.grace > limit {
+				limit = h.grace
+			}
+		}
+
+		if silent := now.Sub(since); silent > limit {
+			missed = append(missed, fmt.Sprintf("%s sent no heartbeat for %s", name, silent.Round(time.Second)))
+		}
+	}
+
+	if len(missed) == 0 {
+		return nil
+	}
+
+	sort.Strings(missed)
+
+	err := fmt.Errorf("controllers missed their heartbeats: %s", strings.Join(missed, ", "))
+	klog.Errorf("Failing /livez: %v", err)
+
+	return err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeats(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	heartbeats := newHeartbeats(time.Minute, 5*time.Minute)
+	heartbeats.now = func() time.Time { return now }
+
+	if period := heartbeats.Period(); period != 15*time.Second {
+		t.Errorf("expected a period of 15s, got %v", period)
+	}
+
+	beating := heartbeats.Register("beating")
+	stalled := heartbeats.Register("stalled")
+	stopped := heartbeats.Register("stopped")
+
+	// within the grace period, controllers need not have sent a heartbeat yet
+	now = now.Add(4 * time.Minute)
+	beating.Beat()
+	stalled.Beat()
+
+	if err := heartbeats.Check(nil); err != nil {
+		t.Errorf("expected the check to pass in the grace period, got %v", err)
+	}
+
+	// the stalled controller stops beating, the stopped one never beat but is no longer tracked
+	stopped.Stop()
+
+	for i := 0; i < 8; i++ {
+		now = now.Add(heartbeats.Period())
+		beating.Beat()
+	}
+
+	err := heartbeats.Check(nil)
+	if err == nil {
+		t.Fatalf("expected the check to fail")
+	}
+
+	if expected := "controllers missed their heartbeats: stalled sent no heartbeat for 2m0s"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	// a controller registered again replaces the stalled one
+	restarted := heartbeats.Register("stalled")
+	stalled.Stop()
+
+	if err := heartbeats.Check(nil); err != nil {
+		t.Errorf("expected the check to pass after the controller was registered again, got %v", err)
+	}
+
+	now = now.Add(6 * time.Minute)
+	restarted.Beat()
+	beating.Beat()
+
+	if err := heartbeats.Check(nil); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	beating.Beat()
+
+	if err := heartbeats.Check(nil); err == nil || !strings.Contains(err.Error(), "stalled sent no heartbeat") {
+		t.Errorf("expected the restarted controller to be tracked, got %v", err)
+	}
+}
+
+func TestHeartbeatsDisabled(t *testing.T) {
+	heartbeats := newHeartbeats(0, time.Minute)
+	if heartbeats != nil {
+		t.Fatalf("expected no heartbeats without a threshold")
+	}
+
+	// the methods of nil heartbeats do nothing
+	heartbeat := heartbeats.Register("controller")
+	heartbeat.Beat()
+	heartbeat.Stop()
+
+	if period := heartbeats.Period(); period != 0 {
+		t.Errorf("expected no period, got %v", period)
+	}
+}
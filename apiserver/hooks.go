@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"runtime/debug"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+)
+
+var hookPanics = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Name:           "badidea_hook_panics_total",
+		Help:           "Counter of panics recovered from goroutines started by post-start hooks, broken down by hook.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"hook"},
+)
+
+func init() {
+	legacyregistry.MustRegister(hookPanics)
+}
+
+// hookRestartBackoff is the backoff between restarts of a panicked hook goroutine.
+var hookRestartBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    10,
+	Cap:      time.Minute,
+}
+
+// goHook runs fn in a new goroutine on behalf of the named post-start hook. A panic in fn is logged
+// with the hook name and stack and counted in badidea_hook_panics_total. If restart is set, fn is
+// started again with backoff until stopCh is closed, so fn must be safe to call more than once.
+// Otherwise the panic is re-raised and takes the process down like before.
+func goHook(hook string, restart bool, stopCh <-chan struct{}, fn func()) {
+	go func() {
+		backoff := hookRestartBackoff
+
+		for {
+			if !runHook(hook, restart, fn) {
+				return
+			}
+
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(backoff.Step()):
+				klog.Infof("Restarting goroutine of post-start hook %q", hook)
+			}
+		}
+	}()
+}
+
+// goHookWorker returns a func starting the workers of a controller run by the named post-start hook
+// with goHook, so a panic in a worker is handled like a panic in the hook itself.
+func goHookWorker(hook string, restart bool, stopCh <-chan struct{}) func(worker func()) {
+	return func(worker func()) {
+		goHook(hook, restart, stopCh, worker)
+	}
+}
+
+// runHook calls fn and reports whether it panicked. A panic is only swallowed if restart is set.
+func runHook(hook string, restart bool, fn func()) (panicked bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		klog.Errorf("Goroutine of post-start hook %q panicked: %v\n%s", hook, r, debug.Stack())
+		hookPanics.WithLabelValues(hook).Inc()
+
+		if !restart {
+			panic(r)
+		}
+
+		panicked = true
+	}()
+
+	fn()
+
+	return false
+}
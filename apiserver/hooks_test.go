@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/controllers/crdregistration"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics/testutil"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+func TestGoHookRestartsPanickedController(t *testing.T) {
+	hookRestartBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 10}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	runs := make(chan int, 3)
+	calls := 0
+
+	// the fake controller panics on its first two runs and returns on the third
+	goHook("restarting-hook", true, stopCh, func() {
+		calls++
+		runs <- calls
+		if calls < 3 {
+			panic("fake controller failure")
+		}
+	})
+
+	for expected := 1; expected <= 3; expected++ {
+		select {
+		case run := <-runs:
+			if run != expected {
+				t.Fatalf("expected run %d, got %d", expected, run)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("timed out waiting for run %d", expected)
+		}
+	}
+
+	panics, err := testutil.GetCounterMetricValue(hookPanics.WithLabelValues("restarting-hook"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if panics != 2 {
+		t.Errorf("expected 2 panics to be counted, got %v", panics)
+	}
+}
+
+func TestRunHookRepanicsWithoutRestart(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "fake controller failure" {
+			t.Errorf("expected the panic to be re-raised, got %v", r)
+		}
+
+		panics, err := testutil.GetCounterMetricValue(hookPanics.WithLabelValues("crashing-hook"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if panics != 1 {
+			t.Errorf("expected 1 panic to be counted, got %v", panics)
+		}
+	}()
+
+	runHook("crashing-hook", false, func() {
+		panic("fake controller failure")
+	})
+}
+
+// panickingRegistration panics on the first APIService to sync and reports the others.
+type panickingRegistration struct {
+	calls int
+	added chan string
+}
+
+func (r *panickingRegistration) AddAPIServiceToSync(in *apiregistrationv1.APIService) {
+	r.calls++
+	if r.calls == 1 {
+		panic("fake worker failure")
+	}
+
+	r.added <- in.Name
+}
+
+func (r *panickingRegistration) RemoveAPIServiceToSync(name string) {}
+
+func TestGoHookRestartsPanickedWorker(t *testing.T) {
+	hookRestartBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 10}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	client := apiextensionsfake.NewSimpleClientset()
+	informers := apiextensionsinformers.NewSharedInformerFactory(client, 0)
+	registration := &panickingRegistration{added: make(chan string, 1)}
+
+	// the controller has one worker, so the calls of the registration do not race
+	controller := crdregistration.NewCRDRegistrationController(informers.Apiextensions().V1().CustomResourceDefinitions(), registration)
+	informers.Start(stopCh)
+
+	goHook("worker-hook", true, stopCh, func() {
+		controller.Run(1, stopCh, goHookWorker("worker-hook", true, stopCh))
+	})
+	controller.WaitForInitialSync()
+
+	// the worker panics on the first CRD. It has to be restarted to register the second.
+	for _, group := range []string{"one.example.com", "two.example.com"} {
+		crd := &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "widgets." + group},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Group:    group,
+				Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{Name: "v1", Served: true}},
+			},
+		}
+
+		if _, err := client.ApiextensionsV1().CustomResourceDefinitions().Create(context.TODO(), crd, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	select {
+	case name := <-registration.added:
+		if name != "v1.two.example.com" {
+			t.Errorf("expected v1.two.example.com to be registered, got %s", name)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the restarted worker")
+	}
+
+	panics, err := testutil.GetCounterMetricValue(hookPanics.WithLabelValues("worker-hook"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if panics != 1 {
+		t.Errorf("expected 1 panic to be counted, got %v", panics)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"net/http"
+
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/klog"
+)
+
+// insecureAuthenticator authenticates every request as its user.
+type insecureAuthenticator struct {
+	user user.Info
+}
+
+func (a insecureAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	auds, _ := authenticator.AudiencesFrom(req.Context())
+
+	return &authenticator.Response{User: a.user, Audiences: auds}, true, nil
+}
+
+// insecureHandlerChain wraps apiHandler in the handler chain of c, authenticating every request as
+// the insecure user of o.
+func insecureHandlerChain(o options.CompletedServerRunOptions, apiHandler http.Handler, c genericapiserver.Config) http.Handler {
+	c.Authentication.Authenticator = insecureAuthenticator{user: &user.DefaultInfo{Name: o.InsecureUser, Groups: o.InsecureGroups}}
+
+	return c.BuildHandlerChainFunc(apiHandler, &c)
+}
+
+// addInsecureServing serves s, the server at the top of the chain, over plain HTTP on the listener of
+// servingInfo once it has started. config is the completed configuration of s.
+func addInsecureServing(o options.CompletedServerRunOptions, s *genericapiserver.GenericAPIServer, config *genericapiserver.Config, servingInfo *genericapiserver.DeprecatedInsecureServingInfo) error {
+	handler := insecureHandlerChain(o, s.UnprotectedHandler(), *config)
+
+	return s.AddPostStartHook("badidea-insecure-serving", func(context genericapiserver.PostStartHookContext) error {
+		klog.Warningf("Serving insecurely on %s without TLS. Every process on this machine can send requests as user %q with groups %v",
+			servingInfo.Listener.Addr(), o.InsecureUser, o.InsecureGroups)
+
+		return servingInfo.Serve(handler, config.RequestTimeout, context.StopCh)
+	})
+}
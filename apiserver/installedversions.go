@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	"k8s.io/klog"
+)
+
+// checkInstalledVersions compares the group versions installed in s, one of the servers of the chain
+// called name, with the versions its resource config enables. A version enabled without storage
+// would be advertised by discovery and 404, a version installed although disabled would be served
+// against --runtime-config. With --allow-resource-config-mismatch the discrepancies are logged instead
+// of failing.
+func checkInstalledVersions(o options.CompletedServerRunOptions, name string, s *genericapiserver.GenericAPIServer, resourceConfig *serverstorage.ResourceConfig) error {
+	discrepancies := installedVersionDiscrepancies(resourceConfig, servedGroupVersions(s))
+	if len(discrepancies) == 0 {
+		return nil
+	}
+
+	if o.AllowResourceConfigMismatch {
+		for _, discrepancy := range discrepancies {
+			klog.Errorf("The %s server disagrees with its resource config: %s", name, discrepancy)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("the %s server disagrees with its resource config: %s (--allow-resource-config-mismatch starts anyway)", name, strings.Join(discrepancies, ", "))
+}
+
+// installedVersionDiscrepancies returns the versions of the groups of resourceConfig that it enables
+// but are not served, and the ones that are served but it does not enable. The versions of other
+// groups are served by the delegates of the server and are not compared.
+func installedVersionDiscrepancies(resourceConfig *serverstorage.ResourceConfig, served []schema.GroupVersion) []string {
+	groups := map[string]bool{}
+	versions := map[schema.GroupVersion]bool{}
+
+	for gv := range resourceConfig.GroupVersionConfigs {
+		groups[gv.Group] = true
+		versions[gv] = false
+	}
+
+	for _, gv := range served {
+		if groups[gv.Group] {
+			versions[gv] = true
+		}
+	}
+
+	discrepancies := []string{}
+
+	for gv, isServed := range versions {
+		switch enabled := resourceConfig.VersionEnabled(gv); {
+		case enabled && !isServed:
+			discrepancies = append(discrepancies, fmt.Sprintf("%s is enabled but not installed", gv))
+		case !enabled && isServed:
+			discrepancies = append(discrepancies, fmt.Sprintf("%s is installed but not enabled", gv))
+		}
+	}
+
+	sort.Strings(discrepancies)
+
+	return discrepancies
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+)
+
+func TestInstalledVersionDiscrepancies(t *testing.T) {
+	v1 := schema.GroupVersion{Group: "example.com", Version: "v1"}
+	v1beta1 := schema.GroupVersion{Group: "example.com", Version: "v1beta1"}
+	v2 := schema.GroupVersion{Group: "example.com", Version: "v2"}
+	// served by a delegate
+	other := schema.GroupVersion{Group: "other.example.com", Version: "v1"}
+
+	resourceConfig := serverstorage.NewResourceConfig()
+	resourceConfig.EnableVersions(v1)
+	resourceConfig.DisableVersions(v1beta1)
+
+	tests := []struct {
+		name     string
+		served   []schema.GroupVersion
+		expected []string
+	}{
+		{
+			name:     "consistent",
+			served:   []schema.GroupVersion{v1, other},
+			expected: []string{},
+		},
+		{
+			name:     "enabled version not installed",
+			served:   []schema.GroupVersion{other},
+			expected: []string{"example.com/v1 is enabled but not installed"},
+		},
+		{
+			name:     "disabled version installed",
+			served:   []schema.GroupVersion{v1, v1beta1},
+			expected: []string{"example.com/v1beta1 is installed but not enabled"},
+		},
+		{
+			name:   "unknown version installed",
+			served: []schema.GroupVersion{v2},
+			expected: []string{
+				"example.com/v1 is enabled but not installed",
+				"example.com/v2 is installed but not enabled",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if discrepancies := installedVersionDiscrepancies(resourceConfig, test.served); !reflect.DeepEqual(discrepancies, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, discrepancies)
+			}
+		})
+	}
+}
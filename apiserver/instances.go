@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"regexp"
+	goruntime "runtime"
+	"sort"
+
+	badideav1alpha1 "github.com/thetirefire/badidea/apis/badidea/v1alpha1"
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/options"
+	etcdversion "go.etcd.io/etcd/version"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/discovery"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/component-base/version"
+)
+
+var instancesResource = badideav1alpha1.SchemeGroupVersion.WithResource("instances").GroupResource()
+
+// readyzCheckLine matches the lines of the checks of /readyz?verbose, like "[+]etcd ok".
+var readyzCheckLine = regexp.MustCompile(`^\[([+-])\](\S+) `)
+
+// newInstanceAPIGroup returns the badidea.x-k8s.io group, serving the Instance of the server described
+// by o. Its readiness is read from /readyz through clients, as the user of the instance-status
+// component.
+func newInstanceAPIGroup(o options.CompletedServerRunOptions, clients *LoopbackClients) (apiGroup, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(clients.ComponentConfig("instance-status"))
+	if err != nil {
+		return apiGroup{}, err
+	}
+
+	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(badideav1alpha1.GroupName, badideav1alpha1.Scheme, runtime.NewParameterCodec(badideav1alpha1.Scheme), badideav1alpha1.Codecs)
+	apiGroupInfo.VersionedResourcesStorageMap[badideav1alpha1.SchemeGroupVersion.Version] = map[string]rest.Storage{
+		"instances": &instancesREST{
+			TableConvertor: rest.NewDefaultTableConvertor(instancesResource),
+			status:         instanceStatus(o),
+			client:         client.RESTClient(),
+		},
+	}
+
+	return apiGroup{
+		info:               &apiGroupInfo,
+		priorities:         map[schema.GroupVersion]Priority{badideav1alpha1.SchemeGroupVersion: {Group: 16600, Version: 9}},
+		openAPIDefinitions: badideav1alpha1.GetOpenAPIDefinitions,
+	}, nil
+}
+
+// instanceStatus returns the status of the Instance of a server with the options o, but for its
+// readiness.
+func instanceStatus(o options.CompletedServerRunOptions) badideav1alpha1.InstanceStatus {
+	status := badideav1alpha1.InstanceStatus{
+		Features: map[string]bool{},
+		Versions: badideav1alpha1.InstanceVersions{
+			Kubernetes: version.Get().GitVersion,
+			Go:         goruntime.Version(),
+		},
+		Etcd: badideav1alpha1.EtcdEmbedded,
+	}
+
+	for feature, enabled := range features.Enabled(o.FeatureGate) {
+		status.Features[string(feature)] = enabled
+	}
+
+	if o.DisableEmbeddedEtcd {
+		status.Etcd = badideav1alpha1.EtcdExternal
+	} else {
+		status.Versions.Etcd = etcdversion.Version
+	}
+
+	etcd := o.Extensions.RecommendedOptions.Etcd
+	subsystems := map[string]bool{
+		"aggregator":          !o.DisableAggregator,
+		"apiextensions":       crdsEnabled(o),
+		"bootstrap-manifests": o.BootstrapManifestsDir != "",
+		"garbage-collector":   etcd.EnableGarbageCollection,
+		"insecure-serving":    o.InsecureServing.BindPort > 0,
+		"leader-election":     o.LeaderElect,
+		"livez-heartbeats":    o.LivezHeartbeatThreshold > 0,
+		"openapi":             !o.DisableOpenAPI,
+		"storage-quota":       o.MaxStoredObjects > 0,
+		"watch-cache":         etcd.EnableWatchCache,
+	}
+
+	for name, enabled := range subsystems {
+		status.Subsystems = append(status.Subsystems, badideav1alpha1.Subsystem{Name: name, Enabled: enabled})
+	}
+
+	sort.Slice(status.Subsystems, func(i, j int) bool { return status.Subsystems[i].Name < status.Subsystems[j].Name })
+
+	for _, n := range o.Normalizations {
+		status.Normalizations = append(status.Normalizations, badideav1alpha1.Normalization{Flag: n.Flag, From: n.From, To: n.To, Reason: n.Reason})
+	}
+
+	return status
+}
+
+// instancesREST serves the Instance of the server. Its readiness is read on every request.
+type instancesREST struct {
+	rest.TableConvertor
+
+	status badideav1alpha1.InstanceStatus
+	client restclient.Interface
+}
+
+var (
+	_ rest.Getter = &instancesREST{}
+	_ rest.Lister = &instancesREST{}
+)
+
+func (r *instancesREST) New() runtime.Object {
+	return &badideav1alpha1.Instance{}
+}
+
+func (r *instancesREST) NewList() runtime.Object {
+	return &badideav1alpha1.InstanceList{}
+}
+
+func (r *instancesREST) NamespaceScoped() bool {
+	return false
+}
+
+func (r *instancesREST) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+	if name != badideav1alpha1.InstanceName {
+		return nil, apierrors.NewNotFound(instancesResource, name)
+	}
+
+	return r.instance(ctx)
+}
+
+func (r *instancesREST) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	instance, err := r.instance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &badideav1alpha1.InstanceList{Items: []badideav1alpha1.Instance{*instance}}, nil
+}
+
+// instance returns the Instance of the server with its current readiness.
+func (r *instancesREST) instance(ctx context.Context) (*badideav1alpha1.Instance, error) {
+	instance := &badideav1alpha1.Instance{
+		ObjectMeta: metav1.ObjectMeta{Name: badideav1alpha1.InstanceName},
+		Status:     r.status,
+	}
+	instance = instance.DeepCopy()
+
+	// /readyz fails with the checks in the body while the server is not ready
+	body, err := r.client.Get().AbsPath("/readyz").Param("verbose", "").Do(ctx).Raw()
+	if len(body) == 0 && err != nil {
+		return nil, apierrors.NewInternalError(err)
+	}
+
+	instance.Status.Ready = err == nil
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if match := readyzCheckLine.FindStringSubmatch(scanner.Text()); match != nil {
+			instance.Status.ReadyzChecks = append(instance.Status.ReadyzChecks, badideav1alpha1.ReadyzCheck{Name: match[2], Ready: match[1] == "+"})
+		}
+	}
+
+	return instance, nil
+}
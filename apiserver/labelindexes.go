@@ -0,0 +1,98 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/client-go/tools/cache"
+)
+
+// indexedLabelsAnnotation is the annotation of CRDs listing the label keys, separated by commas,
+// their watch cache indexes. Lists served from the watch cache selecting one of them with = or ==
+// only filter the objects carrying the label value instead of all. It is read when the storage of
+// the CRD is created: on the first request after the CRD is established, once its spec changes, and
+// on restart. Keys that are not valid label keys are ignored.
+const indexedLabelsAnnotation = "badidea.x-k8s.io/indexed-labels"
+
+// indexedLabels returns the label keys crd asks to be indexed.
+func indexedLabels(crd *apiextensionsv1.CustomResourceDefinition) []string {
+	if crd == nil {
+		return nil
+	}
+
+	var keys []string
+
+	for _, key := range strings.Split(crd.Annotations[indexedLabelsAnnotation], ",") {
+		key = strings.TrimSpace(key)
+		if key != "" && len(validation.IsQualifiedName(key)) == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// withLabelIndexers returns indexers with an index of every label key added, named as the watch
+// cache expects.
+func withLabelIndexers(indexers *cache.Indexers, keys []string) *cache.Indexers {
+	withLabels := cache.Indexers{}
+
+	if indexers != nil {
+		for name, index := range *indexers {
+			withLabels[name] = index
+		}
+	}
+
+	for _, key := range keys {
+		key := key
+		withLabels[storage.LabelIndex(key)] = func(obj interface{}) ([]string, error) {
+			accessor, err := meta.Accessor(obj)
+			if err != nil {
+				return nil, err
+			}
+
+			if value, ok := accessor.GetLabels()[key]; ok {
+				return []string{value}, nil
+			}
+
+			return nil, nil
+		}
+	}
+
+	return &withLabels
+}
+
+// labelIndexingStorage makes the watch cache it wraps use the indexes of the label keys for the lists
+// selecting them.
+type labelIndexingStorage struct {
+	storage.Interface
+
+	keys []string
+}
+
+func (s *labelIndexingStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	opts.Predicate.IndexLabels = append(append([]string{}, opts.Predicate.IndexLabels...), s.keys...)
+
+	return s.Interface.List(ctx, key, opts, listObj)
+}
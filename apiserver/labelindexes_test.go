@@ -0,0 +1,237 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/registry/generic"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/apiserver/pkg/storage/storagebackend/factory"
+	"k8s.io/client-go/tools/cache"
+)
+
+// predicateStorage records the predicate of the last list.
+type predicateStorage struct {
+	storage.Interface
+
+	predicate storage.SelectionPredicate
+}
+
+func (s *predicateStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	s.predicate = opts.Predicate
+
+	return nil
+}
+
+// indexersGetter hands out s, recording the indexers and the attrs function it is decorated with.
+type indexersGetter struct {
+	s        storage.Interface
+	indexers *cache.Indexers
+	getAttrs storage.AttrFunc
+}
+
+func (g *indexersGetter) GetRESTOptions(resource schema.GroupResource) (generic.RESTOptions, error) {
+	return generic.RESTOptions{
+		Decorator: func(config *storagebackend.Config, resourcePrefix string, keyFunc func(obj runtime.Object) (string, error), newFunc func() runtime.Object, newListFunc func() runtime.Object, getAttrsFunc storage.AttrFunc, triggerFuncs storage.IndexerFuncs, indexers *cache.Indexers) (storage.Interface, factory.DestroyFunc, error) {
+			g.indexers = indexers
+			g.getAttrs = getAttrsFunc
+
+			return g.s, func() {}, nil
+		},
+	}, nil
+}
+
+func newLabeledWidget(name string, l map[string]string) *unstructured.Unstructured {
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("example.com/v1")
+	widget.SetKind("Widget")
+	widget.SetNamespace("default")
+	widget.SetName(name)
+	widget.SetLabels(l)
+
+	return widget
+}
+
+func TestLabelIndexes(t *testing.T) {
+	widgets := schema.GroupResource{Group: "example.com", Resource: "widgets"}
+	gadgets := schema.GroupResource{Group: "example.com", Resource: "gadgets"}
+
+	crds := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{
+		{ObjectMeta: metav1.ObjectMeta{Name: widgets.String(), Annotations: map[string]string{indexedLabelsAnnotation: "app, example.com/tier,not a key!,"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: gadgets.String()}},
+	} {
+		if err := crds.Add(crd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := newStorageTracker()
+	defer tracker.destroy()
+
+	tracker.counts.setCRDLister(crdlisters.NewCustomResourceDefinitionLister(crds))
+
+	existing := func(obj interface{}) ([]string, error) { return nil, nil }
+
+	tests := []struct {
+		resource schema.GroupResource
+
+		expectedIndexes []string
+		expectedLabels  []string
+	}{
+		{
+			resource:        widgets,
+			expectedIndexes: []string{"existing", "l:app", "l:example.com/tier"},
+			expectedLabels:  []string{"app", "example.com/tier"},
+		},
+		{
+			resource:        gadgets,
+			expectedIndexes: []string{"existing"},
+		},
+		{
+			resource:        crdsResource,
+			expectedIndexes: []string{"existing"},
+		},
+	}
+
+	for _, test := range tests {
+		recording := &predicateStorage{}
+		getter := &indexersGetter{s: recording}
+
+		opts, err := tracker.wrap(getter, nil, metadataLimits{}).GetRESTOptions(test.resource)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		s, _, err := opts.Decorator(
+			&storagebackend.Config{},
+			"/"+test.resource.String(),
+			func(obj runtime.Object) (string, error) { return "", nil },
+			func() runtime.Object { return &unstructured.Unstructured{} },
+			func() runtime.Object { return &unstructured.UnstructuredList{} },
+			storage.DefaultNamespaceScopedAttr,
+			nil,
+			&cache.Indexers{"existing": existing},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var indexes []string
+		for name := range *getter.indexers {
+			indexes = append(indexes, name)
+		}
+
+		if !sets.NewString(indexes...).Equal(sets.NewString(test.expectedIndexes...)) {
+			t.Errorf("%s: expected the indexes %v, got %v", test.resource, test.expectedIndexes, indexes)
+		}
+
+		if err := s.List(context.TODO(), "/"+test.resource.String(), storage.ListOptions{Predicate: storage.Everything}, &unstructured.UnstructuredList{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !reflect.DeepEqual(recording.predicate.IndexLabels, test.expectedLabels) {
+			t.Errorf("%s: expected the lists to index the labels %v, got %v", test.resource, test.expectedLabels, recording.predicate.IndexLabels)
+		}
+	}
+
+	indexers := withLabelIndexers(nil, []string{"app"})
+	index := (*indexers)[storage.LabelIndex("app")]
+
+	if values, err := index(newLabeledWidget("sprocket", map[string]string{"app": "web"})); err != nil || !reflect.DeepEqual(values, []string{"web"}) {
+		t.Errorf("expected the index value web, got %v, %v", values, err)
+	}
+
+	if values, err := index(newLabeledWidget("cog", nil)); err != nil || len(values) != 0 {
+		t.Errorf("expected no index value without the label, got %v, %v", values, err)
+	}
+}
+
+// BenchmarkLabelIndexes compares listing the objects of a large collection carrying a rare label value
+// from a watch cache store with and without an index of the label.
+func BenchmarkLabelIndexes(b *testing.B) {
+	selector := labels.SelectorFromSet(labels.Set{"app": "rare"})
+
+	newStore := func(indexers cache.Indexers) cache.Indexer {
+		store := cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+
+		for i := 0; i < 10000; i++ {
+			app := "common"
+			if i%100 == 0 {
+				app = "rare"
+			}
+
+			if err := store.Add(newLabeledWidget(fmt.Sprintf("widget-%d", i), map[string]string{"app": app})); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		return store
+	}
+
+	filter := func(objs []interface{}) int {
+		matched := 0
+
+		for _, obj := range objs {
+			if selector.Matches(labels.Set(obj.(*unstructured.Unstructured).GetLabels())) {
+				matched++
+			}
+		}
+
+		return matched
+	}
+
+	b.Run("unindexed", func(b *testing.B) {
+		store := newStore(cache.Indexers{})
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if matched := filter(store.List()); matched != 100 {
+				b.Fatalf("expected 100 objects, got %d", matched)
+			}
+		}
+	})
+
+	b.Run("indexed", func(b *testing.B) {
+		store := newStore(*withLabelIndexers(nil, []string{"app"}))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			objs, err := store.ByIndex(storage.LabelIndex("app"), "rare")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if matched := filter(objs); matched != 100 {
+				b.Fatalf("expected 100 objects, got %d", matched)
+			}
+		}
+	})
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"time"
+
+	"github.com/thetirefire/badidea/options"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+)
+
+const (
+	// leaderElectionRetryPeriod is the wait before campaigning again after a leadership ended or a
+	// campaign failed.
+	leaderElectionRetryPeriod = 2 * time.Second
+	// leaderElectionTimeout bounds dialing etcd and resigning a leadership.
+	leaderElectionTimeout = 5 * time.Second
+)
+
+var controllerLeader = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Name:           "badidea_controller_leader",
+		Help:           "Whether the server leads the controller, 1 while it does and 0 otherwise, broken down by controller.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"controller"},
+)
+
+func init() {
+	legacyregistry.MustRegister(controllerLeader)
+}
+
+// LeaderElection runs the controllers of the server only while it leads them, so replicas of a server
+// sharing etcd run each controller once. Every controller has its own lock, an etcd election under the
+// storage prefix, held with a lease expiring leaseDuration after its leader stopped renewing it. Leaders
+// resign on shutdown, so the other replicas take over without waiting for the lease to expire. The
+// methods of nil LeaderElection run the controllers right away, so controllers need not check whether
+// it is enabled.
+type LeaderElection struct {
+	transport     storagebackend.TransportConfig
+	prefix        string
+	identity      string
+	leaseDuration time.Duration
+}
+
+// newLeaderElection returns the leader election of the controllers, or nil without --leader-elect.
+func newLeaderElection(o options.CompletedServerRunOptions) (*LeaderElection, error) {
+	if !o.LeaderElect {
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to name the leader election candidate: %w", err)
+	}
+
+	storageConfig := o.Extensions.RecommendedOptions.Etcd.StorageConfig
+
+	return &LeaderElection{
+		transport:     storageConfig.Transport,
+		prefix:        path.Join("/", storageConfig.Prefix, "badidea", "leaders"),
+		identity:      hostname + "_" + string(uuid.NewUUID()),
+		leaseDuration: o.LeaderElectLeaseDuration,
+	}, nil
+}
+
+// Run calls run each time the server becomes the leader of the named controller, until stopCh is
+// closed. The channel passed to run is closed once the leadership is lost or stopCh is closed, and the
+// leadership is resigned once run returned, so run has to stop the controller by then and start it
+// afresh on the next call. Run returns once stopCh is closed and run returned.
+func (e *LeaderElection) Run(controller string, stopCh <-chan struct{}, run func(stopCh <-chan struct{})) {
+	if e == nil {
+		run(stopCh)
+		return
+	}
+
+	for {
+		if err := e.lead(controller, stopCh, run); err != nil {
+			utilruntime.HandleError(fmt.Errorf("leader election of %s failed: %w", controller, err))
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(leaderElectionRetryPeriod):
+		}
+	}
+}
+
+// lead campaigns for the leadership of controller until stopCh is closed, and calls run while it
+// holds it.
+func (e *LeaderElection) lead(controller string, stopCh <-chan struct{}, run func(stopCh <-chan struct{})) error {
+	client, err := newEtcdClient(e.transport, leaderElectionTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// closing the session revokes its lease, which deletes the key of the candidate
+	session, err := concurrency.NewSession(client, concurrency.WithTTL(int(math.Ceil(e.leaseDuration.Seconds()))))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	election := concurrency.NewElection(session, e.prefix+"/"+controller+"/")
+	if err := election.Campaign(ctx, e.identity); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		return err
+	}
+
+	klog.Infof("%s became the leader of %s", e.identity, controller)
+	controllerLeader.WithLabelValues(controller).Set(1)
+
+	leading := make(chan struct{})
+
+	go func() {
+		defer close(leading)
+
+		select {
+		case <-ctx.Done():
+		case <-session.Done():
+			klog.Warningf("%s lost the leadership of %s, its lease expired", e.identity, controller)
+		}
+	}()
+
+	run(leading)
+
+	cancel()
+	<-leading
+	controllerLeader.WithLabelValues(controller).Set(0)
+
+	resignCtx, resignCancel := context.WithTimeout(context.Background(), leaderElectionTimeout)
+	defer resignCancel()
+
+	if err := election.Resign(resignCtx); err != nil {
+		return fmt.Errorf("failed to resign: %w", err)
+	}
+
+	klog.Infof("%s resigned the leadership of %s", e.identity, controller)
+
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+)
+
+// leadership records the candidates leading a controller.
+type leadership struct {
+	t *testing.T
+
+	lock    sync.Mutex
+	leaders map[string]bool
+	led     chan string
+}
+
+// run returns the controller of candidate, running until its stop channel is closed.
+func (l *leadership) run(candidate string) func(stopCh <-chan struct{}) {
+	return func(stopCh <-chan struct{}) {
+		l.lock.Lock()
+		for leader := range l.leaders {
+			l.t.Errorf("%s leads while %s still does", candidate, leader)
+		}
+		l.leaders[candidate] = true
+		l.lock.Unlock()
+
+		l.led <- candidate
+		<-stopCh
+
+		l.lock.Lock()
+		delete(l.leaders, candidate)
+		l.lock.Unlock()
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	stopEtcd := make(chan struct{})
+	defer close(stopEtcd)
+
+	etcdConfig := startEtcd(t, stopEtcd)
+
+	// the lease outlives the test, so a takeover within it is a handoff
+	newCandidate := func(identity string) *LeaderElection {
+		return &LeaderElection{
+			transport:     storagebackend.TransportConfig{ServerList: []string{etcdConfig.ClientURL}},
+			prefix:        "/registry/badidea/leaders",
+			identity:      identity,
+			leaseDuration: time.Minute,
+		}
+	}
+
+	gc := &leadership{t: t, leaders: map[string]bool{}, led: make(chan string, 2)}
+	other := &leadership{t: t, leaders: map[string]bool{}, led: make(chan string, 2)}
+
+	expectLeader := func(l *leadership, expected string) {
+		t.Helper()
+
+		select {
+		case leader := <-l.led:
+			if leader != expected {
+				t.Fatalf("expected %s to lead, got %s", expected, leader)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected %s to lead", expected)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	runCandidate := func(identity, controller string, l *leadership, stopCh <-chan struct{}) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			newCandidate(identity).Run(controller, stopCh, l.run(identity))
+		}()
+	}
+
+	stopA, stopB := make(chan struct{}), make(chan struct{})
+
+	runCandidate("a", "garbage-collector", gc, stopA)
+	expectLeader(gc, "a")
+
+	// the controllers have a lock each
+	runCandidate("b", "garbage-collector", gc, stopB)
+	runCandidate("b", "other", other, stopB)
+	expectLeader(other, "b")
+
+	select {
+	case leader := <-gc.led:
+		t.Fatalf("expected a to keep leading, %s took over", leader)
+	case <-time.After(time.Second):
+	}
+
+	// a resigns on shutdown
+	close(stopA)
+	expectLeader(gc, "b")
+
+	close(stopB)
+	wg.Wait()
+
+	// without leader election, controllers run right away
+	var election *LeaderElection
+
+	ran := false
+	election.Run("garbage-collector", stopA, func(stopCh <-chan struct{}) { ran = true })
+
+	if !ran {
+		t.Error("expected the controller to run without leader election")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var openConnections = metrics.NewGauge(
+	&metrics.GaugeOpts{
+		Name:           "badidea_open_connections",
+		Help:           "Number of connections open on the secure port.",
+		StabilityLevel: metrics.ALPHA,
+	},
+)
+
+func init() {
+	legacyregistry.MustRegister(openConnections)
+}
+
+var errListenerClosed = errors.New("use of closed network connection")
+
+// servingListener counts the connections of the secure listener in badidea_open_connections,
+// limits them and sets their keep-alive period. The generic apiserver sets a keep-alive period of
+// its own only on plain TCP connections, which the connections of servingListener are not.
+type servingListener struct {
+	net.Listener
+
+	// slots holds a token per open connection, nil if the connections are not limited.
+	slots           chan struct{}
+	keepAlivePeriod time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newServingListener wraps listener. maxConnections of zero means no limit, a keepAlivePeriod of
+// zero disables keep-alive probes.
+func newServingListener(listener net.Listener, maxConnections int, keepAlivePeriod time.Duration) *servingListener {
+	l := &servingListener{
+		Listener:        listener,
+		keepAlivePeriod: keepAlivePeriod,
+		closed:          make(chan struct{}),
+	}
+
+	if maxConnections > 0 {
+		l.slots = make(chan struct{}, maxConnections)
+	}
+
+	return l
+}
+
+// Accept waits for a free slot before accepting the next connection, so excess connections queue
+// in the backlog of the socket instead of being reset.
+func (l *servingListener) Accept() (net.Conn, error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.closed:
+			return nil, errListenerClosed
+		}
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetKeepAlive(l.keepAlivePeriod > 0); err != nil {
+			l.release()
+			conn.Close()
+
+			return nil, err
+		}
+
+		if l.keepAlivePeriod > 0 {
+			if err := tcpConn.SetKeepAlivePeriod(l.keepAlivePeriod); err != nil {
+				l.release()
+				conn.Close()
+
+				return nil, err
+			}
+		}
+	}
+
+	openConnections.Inc()
+
+	return &servingConn{Conn: conn, listener: l}, nil
+}
+
+func (l *servingListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return l.Listener.Close()
+}
+
+func (l *servingListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// servingConn gives its slot back when closed.
+type servingConn struct {
+	net.Conn
+
+	listener  *servingListener
+	closeOnce sync.Once
+}
+
+func (c *servingConn) Close() error {
+	c.closeOnce.Do(func() {
+		openConnections.Dec()
+		c.listener.release()
+	})
+
+	return c.Conn.Close()
+}
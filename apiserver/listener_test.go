@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestServingListener(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := newServingListener(tcpListener, 1, time.Second)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+
+	go func() {
+		defer close(accepted)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	openConnectionsBefore, err := testutil.GetGaugeMetricValue(openConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	first := <-accepted
+
+	if value, _ := testutil.GetGaugeMetricValue(openConnections); value != openConnectionsBefore+1 {
+		t.Errorf("expected %v open connections, got %v", openConnectionsBefore+1, value)
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("expected the second connection to wait for the first to be closed")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	first.Close()
+	first.Close()
+
+	second := <-accepted
+	defer second.Close()
+
+	if value, _ := testutil.GetGaugeMetricValue(openConnections); value != openConnectionsBefore+1 {
+		t.Errorf("expected %v open connections after closing the first twice, got %v", openConnectionsBefore+1, value)
+	}
+
+	// closing the listener ends the Accept waiting for a slot
+	listener.Close()
+
+	if _, ok := <-accepted; ok {
+		t.Error("expected no further connection after closing the listener")
+	}
+}
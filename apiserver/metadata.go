@@ -0,0 +1,169 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/thetirefire/badidea/options"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/warning"
+)
+
+// metadataLimits are the limits on object metadata beyond those of apimachinery.
+type metadataLimits struct {
+	// maxAnnotationBytes rejects objects whose annotations total more bytes. Zero keeps the limit of
+	// apimachinery.
+	maxAnnotationBytes int
+	// annotationWarningBytes warns about objects whose annotations total more bytes. Zero disables
+	// the warning.
+	annotationWarningBytes int
+}
+
+// metadataCheckingStorage checks the metadata of the objects written to the storage of resource. It
+// runs after the strategies of the registries validated the objects, for built-in and custom
+// resources alike, since badidea has no admission chain. Dry runs are checked by dryRunChecks.
+// Problems short of violating the limits are returned as warnings.
+type metadataCheckingStorage struct {
+	storage.Interface
+
+	resource schema.GroupResource
+	limits   metadataLimits
+}
+
+func (s *metadataCheckingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	if err := s.check(ctx, nil, obj); err != nil {
+		return err
+	}
+
+	return s.Interface.Create(ctx, key, obj, out, ttl)
+}
+
+func (s *metadataCheckingStorage) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	checkingTryUpdate := func(input runtime.Object, res storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		output, ttl, err := tryUpdate(input, res)
+		if err != nil {
+			return output, ttl, err
+		}
+
+		if err := s.check(ctx, input, output); err != nil {
+			return nil, nil, err
+		}
+
+		return output, ttl, nil
+	}
+
+	return s.Interface.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, checkingTryUpdate, suggestion...)
+}
+
+// check checks the metadata of obj, which replaces old if old is not nil. Objects stored before
+// maxAnnotationBytes was lowered can still be updated as long as their annotations do not grow.
+func (s *metadataCheckingStorage) check(ctx context.Context, old, obj runtime.Object) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+
+	annotationBytes := totalAnnotationBytes(accessor.GetAnnotations())
+
+	if s.limits.maxAnnotationBytes > 0 && annotationBytes > s.limits.maxAnnotationBytes {
+		grown := true
+		if old != nil {
+			if oldAccessor, err := meta.Accessor(old); err == nil {
+				grown = annotationBytes > totalAnnotationBytes(oldAccessor.GetAnnotations())
+			}
+		}
+
+		if grown {
+			kind := obj.GetObjectKind().GroupVersionKind().Kind
+			if kind == "" {
+				kind = s.resource.Resource
+			}
+
+			return apierrors.NewInvalid(schema.GroupKind{Group: s.resource.Group, Kind: kind}, accessor.GetName(), field.ErrorList{
+				field.TooLong(field.NewPath("metadata", "annotations"), "", s.limits.maxAnnotationBytes),
+			})
+		}
+	}
+
+	for _, text := range metadataWarnings(accessor, annotationBytes, s.limits) {
+		warning.AddWarning(ctx, "", text)
+	}
+
+	return nil
+}
+
+// metadataWarnings returns warnings about the metadata of an object with annotations totalling
+// annotationBytes.
+func metadataWarnings(accessor metav1.Object, annotationBytes int, limits metadataLimits) []string {
+	warnings := []string{}
+
+	if limits.annotationWarningBytes > 0 && annotationBytes > limits.annotationWarningBytes {
+		warnings = append(warnings, fmt.Sprintf("metadata.annotations: the annotations total %d bytes, close to the limit of %d bytes", annotationBytes, annotationLimit(limits)))
+	}
+
+	labelKeys := map[string][]string{}
+	for key := range accessor.GetLabels() {
+		lowerKey := strings.ToLower(key)
+		labelKeys[lowerKey] = append(labelKeys[lowerKey], key)
+	}
+
+	for _, keys := range labelKeys {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			warnings = append(warnings, fmt.Sprintf("metadata.labels: the keys %s differ only by case", strings.Join(keys, ", ")))
+		}
+	}
+
+	for _, finalizer := range accessor.GetFinalizers() {
+		// apimachinery only accepts the standard finalizers without a prefix
+		if tokens := strings.SplitN(finalizer, "/", 2); len(tokens) == 2 && !strings.Contains(tokens[0], ".") {
+			warnings = append(warnings, fmt.Sprintf("metadata.finalizers: the prefix of %q is no domain name, use a domain you own to avoid clashes with other controllers", finalizer))
+		}
+	}
+
+	sort.Strings(warnings)
+
+	return warnings
+}
+
+func annotationLimit(limits metadataLimits) int {
+	if limits.maxAnnotationBytes > 0 {
+		return limits.maxAnnotationBytes
+	}
+
+	return options.AnnotationBytesLimit
+}
+
+// totalAnnotationBytes returns the size of annotations the way apimachinery counts it.
+func totalAnnotationBytes(annotations map[string]string) int {
+	total := 0
+	for key, value := range annotations {
+		total += len(key) + len(value)
+	}
+
+	return total
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func newAnnotatedWidget(size int) *unstructured.Unstructured {
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("example.com/v1")
+	widget.SetKind("Widget")
+	widget.SetName("gizmo")
+	widget.SetAnnotations(map[string]string{"note": strings.Repeat("x", size)})
+
+	return widget
+}
+
+// TestMetadataCheckingStorageLoweredLimit checks that objects stored before --max-annotation-bytes
+// was lowered can be updated as long as their annotations do not grow.
+func TestMetadataCheckingStorageLoweredLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		old  runtime.Object
+		obj  runtime.Object
+
+		expectedInvalid bool
+	}{
+		{
+			name: "create within the limit",
+			obj:  newAnnotatedWidget(96),
+		},
+		{
+			name:            "create over the limit",
+			obj:             newAnnotatedWidget(200),
+			expectedInvalid: true,
+		},
+		{
+			name: "update of an object over the limit",
+			old:  newAnnotatedWidget(200),
+			obj:  newAnnotatedWidget(200),
+		},
+		{
+			name: "update shrinking the annotations",
+			old:  newAnnotatedWidget(300),
+			obj:  newAnnotatedWidget(200),
+		},
+		{
+			name:            "update growing the annotations",
+			old:             newAnnotatedWidget(200),
+			obj:             newAnnotatedWidget(300),
+			expectedInvalid: true,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			s := &metadataCheckingStorage{
+				resource: schema.GroupResource{Group: "example.com", Resource: "widgets"},
+				limits:   metadataLimits{maxAnnotationBytes: 100},
+			}
+
+			err := s.check(context.TODO(), test.old, test.obj)
+			if invalid := apierrors.IsInvalid(err); invalid != test.expectedInvalid {
+				t.Errorf("expected an invalid error %v, got %v", test.expectedInvalid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// maxObjectsAnnotation is the annotation of CRDs limiting the number of their objects. Values that
+	// are not a positive integer are ignored.
+	maxObjectsAnnotation = "badidea.x-k8s.io/max-objects"
+	// objectLimitSlackPercent is the share of the limit of a CRD its objects may overshoot it by while
+	// their count is uncertain, because objects were created or deleted since it was polled.
+	objectLimitSlackPercent = 10
+)
+
+var (
+	crdObjects = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "badidea_crd_objects",
+			Help:           "Number of objects of a CRD stored in etcd as last polled.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource"},
+	)
+	crdMaxObjects = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "badidea_crd_max_objects",
+			Help:           "Limit of the objects of a CRD set by its " + maxObjectsAnnotation + " annotation, as last polled.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(crdObjects)
+	legacyregistry.MustRegister(crdMaxObjects)
+}
+
+// objectCounts tracks the number of objects of every resource: the count polled from the storage
+// and the objects created and deleted through the storage since. It enforces the limits of the CRDs
+// annotated with maxObjectsAnnotation. The counts are eventually consistent, so a limit is enforced
+// conservatively: creates are rejected once the polled count reached it, or once the objects
+// created since push the count objectLimitSlackPercent past it. Resources whose count was not
+// polled yet are not limited.
+type objectCounts struct {
+	lock   sync.Mutex
+	crds   crdlisters.CustomResourceDefinitionLister
+	counts map[schema.GroupResource]*objectCount
+}
+
+// objectCount is the number of objects of a resource.
+type objectCount struct {
+	polled int64
+	// changed is the number of objects created minus those deleted since the count was polled.
+	changed int64
+}
+
+func newObjectCounts() *objectCounts {
+	return &objectCounts{counts: map[schema.GroupResource]*objectCount{}}
+}
+
+// setCRDLister sets the lister of the CRDs whose limits are enforced. Without one, no limits are.
+func (c *objectCounts) setCRDLister(crds crdlisters.CustomResourceDefinitionLister) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.crds = crds
+}
+
+// record sets the polled number of objects of resource.
+func (c *objectCounts) record(resource schema.GroupResource, count int64) {
+	crd := c.crd(resource)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.counts[resource] = &objectCount{polled: count}
+
+	if crd == nil {
+		return
+	}
+
+	crdObjects.WithLabelValues(resource.String()).Set(float64(count))
+
+	if limit, ok := maxObjects(crd); ok {
+		crdMaxObjects.WithLabelValues(resource.String()).Set(float64(limit))
+	} else {
+		crdMaxObjects.DeleteLabelValues(resource.String())
+	}
+}
+
+// forget stops counting the objects of resource, once its storage is destroyed.
+func (c *objectCounts) forget(resource schema.GroupResource) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.counts, resource)
+
+	crdObjects.DeleteLabelValues(resource.String())
+	crdMaxObjects.DeleteLabelValues(resource.String())
+}
+
+// add records that delta objects of resource were created, or deleted if it is negative.
+func (c *objectCounts) add(resource schema.GroupResource, delta int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if count, ok := c.counts[resource]; ok {
+		count.changed += delta
+	}
+}
+
+// limitError returns the error of a create of an object of resource rejected by the limit of its CRD,
+// or nil.
+func (c *objectCounts) limitError(resource schema.GroupResource) error {
+	crd := c.crd(resource)
+	if crd == nil {
+		return nil
+	}
+
+	limit, ok := maxObjects(crd)
+	if !ok {
+		return nil
+	}
+
+	c.lock.Lock()
+	count, ok := c.counts[resource]
+	if !ok {
+		c.lock.Unlock()
+		return nil
+	}
+	polled, estimated := count.polled, count.polled+count.changed
+	c.lock.Unlock()
+
+	slack := limit * objectLimitSlackPercent / 100
+	if slack < 1 {
+		slack = 1
+	}
+
+	if (polled >= limit && estimated >= limit) || estimated >= limit+slack {
+		return apierrors.NewForbidden(resource, "", fmt.Errorf("%d objects are stored, the %s annotation of the CustomResourceDefinition limits them to %d: delete objects to create more", estimated, maxObjectsAnnotation, limit))
+	}
+
+	return nil
+}
+
+// crd returns the CRD of resource, or nil if resource is not a custom resource.
+func (c *objectCounts) crd(resource schema.GroupResource) *apiextensionsv1.CustomResourceDefinition {
+	c.lock.Lock()
+	crds := c.crds
+	c.lock.Unlock()
+
+	if crds == nil {
+		return nil
+	}
+
+	// CRDs are named after their resource
+	crd, err := crds.Get(resource.String())
+	if err != nil {
+		return nil
+	}
+
+	return crd
+}
+
+// maxObjects returns the limit of the objects of crd.
+func maxObjects(crd *apiextensionsv1.CustomResourceDefinition) (int64, bool) {
+	value, ok := crd.Annotations[maxObjectsAnnotation]
+	if !ok {
+		return 0, false
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+
+	return limit, true
+}
+
+// countingStorage counts the objects created and deleted through the storage of resource in counts,
+// and rejects creates over the limit of the CRD of resource.
+type countingStorage struct {
+	storage.Interface
+
+	resource schema.GroupResource
+	counts   *objectCounts
+}
+
+func (s *countingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	if err := s.counts.limitError(s.resource); err != nil {
+		return err
+	}
+
+	if err := s.Interface.Create(ctx, key, obj, out, ttl); err != nil {
+		return err
+	}
+
+	s.counts.add(s.resource, 1)
+
+	return nil
+}
+
+func (s *countingStorage) Delete(ctx context.Context, key string, out runtime.Object, preconditions *storage.Preconditions, validateDeletion storage.ValidateObjectFunc) error {
+	if err := s.Interface.Delete(ctx, key, out, preconditions, validateDeletion); err != nil {
+		return err
+	}
+
+	s.counts.add(s.resource, -1)
+
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestObjectCounts(t *testing.T) {
+	widgets := schema.GroupResource{Group: "example.com", Resource: "widgets"}
+	gadgets := schema.GroupResource{Group: "example.com", Resource: "gadgets"}
+
+	crds := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	setLimit := func(resource schema.GroupResource, limit string) {
+		crd := &apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: resource.String()}}
+		if limit != "" {
+			crd.Annotations = map[string]string{maxObjectsAnnotation: limit}
+		}
+
+		if err := crds.Update(crd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := newObjectCounts()
+	counts.record(widgets, 20)
+
+	if err := counts.limitError(widgets); err != nil {
+		t.Errorf("expected no limits without a CRD lister, got %v", err)
+	}
+
+	counts.setCRDLister(crdlisters.NewCustomResourceDefinitionLister(crds))
+	setLimit(widgets, "20")
+	setLimit(gadgets, "not a number")
+	counts.record(gadgets, 100)
+
+	none := int64(-1)
+	limit := func(limit string) *string { return &limit }
+
+	steps := []struct {
+		name   string
+		limit  *string
+		polled int64
+		delta  int64
+
+		expectedRejected bool
+	}{
+		{name: "polled at the limit", polled: 20, expectedRejected: true},
+		{name: "deleted below the limit", polled: none, delta: -1},
+		{name: "created back to the limit", polled: none, delta: 1, expectedRejected: true},
+		{name: "polled below the limit", polled: 19},
+		{name: "created to the limit", polled: none, delta: 1},
+		{name: "created within the slack", polled: none, delta: 1},
+		{name: "created to the slack", polled: none, delta: 1, expectedRejected: true},
+		{name: "limit raised", limit: limit("30"), polled: none},
+		{name: "limit removed", limit: limit(""), polled: 100},
+		{name: "limit of one", limit: limit("1"), polled: 0},
+		{name: "created within the slack of one", polled: none, delta: 1},
+		{name: "created to the slack of one", polled: none, delta: 1, expectedRejected: true},
+	}
+
+	for _, step := range steps {
+		if step.limit != nil {
+			setLimit(widgets, *step.limit)
+		}
+
+		if step.polled != none {
+			counts.record(widgets, step.polled)
+		}
+
+		counts.add(widgets, step.delta)
+
+		err := counts.limitError(widgets)
+		if (err != nil) != step.expectedRejected {
+			t.Errorf("%s: expected a rejection %v, got %v", step.name, step.expectedRejected, err)
+		}
+
+		if err != nil && !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected a Forbidden error, got %v", step.name, err)
+		}
+	}
+
+	if err := counts.limitError(gadgets); err != nil {
+		t.Errorf("expected an invalid limit to be ignored, got %v", err)
+	}
+
+	counts.forget(widgets)
+
+	if err := counts.limitError(widgets); err != nil {
+		t.Errorf("expected no limit once the count is forgotten, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"k8s.io/apiserver/pkg/warning"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+)
+
+const (
+	// storageQuotaResumePercent is the share of the quota the stored objects have to drop below
+	// before writes are accepted again, so that writes do not flap around the quota.
+	storageQuotaResumePercent = 90
+	// storageQuotaWarningPercent is the share of the quota above which /readyz warns.
+	storageQuotaWarningPercent = 80
+)
+
+var (
+	storedObjects = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Name:           "badidea_storage_objects",
+			Help:           "Number of objects stored in etcd as last polled, counted against --max-stored-objects.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	storageQuotaExceeded = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Name:           "badidea_storage_quota_exceeded",
+			Help:           "1 while writes are rejected because the objects stored in etcd exceed --max-stored-objects, 0 otherwise.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(storedObjects)
+	legacyregistry.MustRegister(storageQuotaExceeded)
+}
+
+// storageQuota sums up the object counts polled from the storage of the chain and tracks whether
+// they exceed the quota. Once exceeded, it is only lifted below storageQuotaResumePercent of the
+// quota. As the counts are polled, the quota can be overshot by the writes of one poll period.
+type storageQuota struct {
+	maxObjects int64
+
+	lock     sync.Mutex
+	counts   map[string]int64
+	total    int64
+	exceeded bool
+}
+
+// newStorageQuota returns the quota of maxObjects, or nil if maxObjects is 0.
+func newStorageQuota(maxObjects int64) *storageQuota {
+	if maxObjects <= 0 {
+		return nil
+	}
+
+	return &storageQuota{maxObjects: maxObjects, counts: map[string]int64{}}
+}
+
+// record sets the number of objects stored under prefix. Storage sharing a prefix, like that of the
+// versions of a CRD, is only counted once.
+func (q *storageQuota) record(prefix string, count int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.total += count - q.counts[prefix]
+	q.counts[prefix] = count
+	q.update()
+}
+
+// forget stops counting the objects stored under prefix, once its storage is destroyed.
+func (q *storageQuota) forget(prefix string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.total -= q.counts[prefix]
+	delete(q.counts, prefix)
+	q.update()
+}
+
+// update flips exceeded with hysteresis. The lock has to be held.
+func (q *storageQuota) update() {
+	switch {
+	case !q.exceeded && q.total >= q.maxObjects:
+		q.exceeded = true
+		klog.Warningf("Rejecting writes, %d objects are stored in etcd, the quota is %d", q.total, q.maxObjects)
+	case q.exceeded && q.total*100 < q.maxObjects*storageQuotaResumePercent:
+		q.exceeded = false
+		klog.Infof("Accepting writes again, %d objects are stored in etcd, the quota is %d", q.total, q.maxObjects)
+	}
+
+	storedObjects.Set(float64(q.total))
+
+	if q.exceeded {
+		storageQuotaExceeded.Set(1)
+	} else {
+		storageQuotaExceeded.Set(0)
+	}
+}
+
+// exceededError returns the message for the writes rejected while the quota is exceeded, or nil.
+func (q *storageQuota) exceededError() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.exceeded {
+		return nil
+	}
+
+	return fmt.Errorf("the server stores %d objects, its quota is %d objects: delete objects until fewer than %d are stored to create or update objects again",
+		q.total, q.maxObjects, q.maxObjects*storageQuotaResumePercent/100)
+}
+
+// Name implements healthz.HealthChecker.
+func (q *storageQuota) Name() string {
+	return "storage-quota"
+}
+
+// Check implements healthz.HealthChecker. A server running out of its quota is still ready, so the
+// check passes, adding a warning to the response above storageQuotaWarningPercent of the quota.
+func (q *storageQuota) Check(req *http.Request) error {
+	q.lock.Lock()
+	total := q.total
+	q.lock.Unlock()
+
+	if total*100 > q.maxObjects*storageQuotaWarningPercent {
+		warning.AddWarning(req.Context(), "", fmt.Sprintf("the server stores %d objects, more than %d%% of its quota of %d objects", total, storageQuotaWarningPercent, q.maxObjects))
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apiserver/pkg/warning"
+)
+
+type testWarningRecorder []string
+
+func (r *testWarningRecorder) AddWarning(agent, text string) {
+	*r = append(*r, text)
+}
+
+func TestStorageQuota(t *testing.T) {
+	if newStorageQuota(0) != nil {
+		t.Error("expected no quota without a maximum")
+	}
+
+	quota := newStorageQuota(100)
+
+	steps := []struct {
+		name   string
+		prefix string
+		count  int64
+		forget bool
+
+		expectedExceeded bool
+		expectedWarning  bool
+	}{
+		{name: "below the warning", prefix: "/registry/widgets", count: 50},
+		{name: "above the warning", prefix: "/registry/gadgets", count: 40, expectedWarning: true},
+		{name: "at the quota", prefix: "/registry/widgets", count: 60, expectedExceeded: true, expectedWarning: true},
+		{name: "below the quota", prefix: "/registry/widgets", count: 55, expectedExceeded: true, expectedWarning: true},
+		{name: "below the resume threshold", prefix: "/registry/widgets", count: 49, expectedWarning: true},
+		{name: "below the quota again", prefix: "/registry/widgets", count: 55, expectedWarning: true},
+		{name: "destroyed storage", prefix: "/registry/gadgets", forget: true},
+	}
+
+	for _, step := range steps {
+		if step.forget {
+			quota.forget(step.prefix)
+		} else {
+			quota.record(step.prefix, step.count)
+		}
+
+		if err := quota.exceededError(); (err != nil) != step.expectedExceeded {
+			t.Errorf("%s: expected the quota to be exceeded %v, got %v", step.name, step.expectedExceeded, err)
+		}
+
+		recorder := &testWarningRecorder{}
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+
+		if err := quota.Check(req.WithContext(warning.WithWarningRecorder(req.Context(), recorder))); err != nil {
+			t.Errorf("%s: expected the readyz check to pass, got %v", step.name, err)
+		}
+
+		if (len(*recorder) > 0) != step.expectedWarning {
+			t.Errorf("%s: expected a warning %v, got %v", step.name, step.expectedWarning, *recorder)
+		}
+	}
+}
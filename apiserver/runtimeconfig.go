@@ -0,0 +1,192 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thetirefire/badidea/options"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/server/resourceconfig"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/klog"
+)
+
+// maxSuggestionDistance bounds the edit distance of the keys suggested for unknown keys.
+const maxSuggestionDistance = 3
+
+// runtimeConfigMetaKeys address the versions of all groups at once.
+var runtimeConfigMetaKeys = []string{resourceconfig.APIAll, resourceconfig.APIGA, resourceconfig.APIBeta, resourceconfig.APIAlpha}
+
+// validateRuntimeConfig rejects the keys of runtimeConfig that name no group version of registries,
+// suggesting the closest known key. The libraries would ignore keys of unknown groups. With
+// allowUnknown the unknown keys are logged and removed from runtimeConfig instead. The values have to
+// be booleans, which options.ServerRunOptions.Complete normalizes to "true" and "false", so the meta
+// keys accept the values the group version keys do. Unlike the libraries, api/all=false is accepted on
+// its own, for a server serving nothing but its health.
+func validateRuntimeConfig(runtimeConfig cliflag.ConfigurationMap, allowUnknown bool, registries ...resourceconfig.GroupVersionRegistry) error {
+	knownKeys := append([]string{}, runtimeConfigMetaKeys...)
+	for _, registry := range registries {
+		for _, gv := range registry.PrioritizedVersionsAllGroups() {
+			knownKeys = append(knownKeys, gv.String())
+		}
+	}
+
+	known := map[string]bool{}
+	for _, key := range knownKeys {
+		known[key] = true
+	}
+
+	keys := []string{}
+	for key := range runtimeConfig {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	errs := []error{}
+
+	for _, key := range keys {
+		if value := runtimeConfig[key]; value != "" {
+			if _, err := strconv.ParseBool(value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q of --runtime-config key %q, it has to be true or false", value, key))
+				continue
+			}
+		}
+
+		if strings.Count(key, "/") > 2 {
+			errs = append(errs, fmt.Errorf("invalid --runtime-config key %q, it has to be group/version or group/version/resource", key))
+			continue
+		}
+
+		// group/version/resource keys are valid if their group version is
+		groupVersion, resource := key, ""
+		if tokens := strings.SplitN(key, "/", 3); len(tokens) == 3 {
+			groupVersion, resource = tokens[0]+"/"+tokens[1], "/"+tokens[2]
+		}
+
+		if known[groupVersion] {
+			continue
+		}
+
+		message := fmt.Sprintf("unknown --runtime-config key %q", key)
+		if suggestion := closest(groupVersion, knownKeys); suggestion != "" {
+			message += fmt.Sprintf(", did you mean %q?", suggestion+resource)
+		}
+
+		if allowUnknown {
+			klog.Warningf("Ignoring %s", message)
+			delete(runtimeConfig, key)
+
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("%s (--allow-unknown-runtime-config ignores unknown keys)", message))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// enabledVersions returns the versions that runtimeConfig leaves enabled, all of them by default. The
+// meta keys apply like to the built-in groups, the keys of group versions if registry knows them.
+func enabledVersions(runtimeConfig cliflag.ConfigurationMap, versions []schema.GroupVersion, registry resourceconfig.GroupVersionRegistry) ([]schema.GroupVersion, error) {
+	defaults := serverstorage.NewResourceConfig()
+	defaults.EnableVersions(versions...)
+
+	config, err := resourceconfig.MergeAPIResourceConfigs(defaults, runtimeConfig, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := []schema.GroupVersion{}
+
+	for _, gv := range versions {
+		if config.VersionEnabled(gv) {
+			enabled = append(enabled, gv)
+		}
+	}
+
+	return enabled, nil
+}
+
+// crdsEnabled returns whether the chain serves CRDs: not with --disable-crds, nor with a runtime config
+// disabling apiextensions.k8s.io/v1, which the controllers of the apiextensions server need. The
+// runtime config must have been validated.
+func crdsEnabled(o options.CompletedServerRunOptions) bool {
+	if o.DisableCRDs {
+		return false
+	}
+
+	config, err := resourceconfig.MergeAPIResourceConfigs(apiextensionsapiserver.DefaultAPIResourceConfigSource(), o.Extensions.APIEnablement.RuntimeConfig, apiextensionsapiserver.Scheme)
+
+	return err == nil && config.VersionEnabled(apiextensionsv1.SchemeGroupVersion)
+}
+
+// closest returns the candidate with the smallest edit distance to s, or "" if all candidates are
+// further than maxSuggestionDistance.
+func closest(s string, candidates []string) string {
+	result, resultDistance := "", maxSuggestionDistance+1
+
+	for _, candidate := range candidates {
+		if distance := editDistance(s, candidate); distance < resultDistance {
+			result, resultDistance = candidate, distance
+		}
+	}
+
+	return result
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), substitution)
+		}
+
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"reflect"
+	"testing"
+
+	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
+	cliflag "k8s.io/component-base/cli/flag"
+	aggregatorscheme "k8s.io/kube-aggregator/pkg/apiserver/scheme"
+)
+
+func TestValidateRuntimeConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		runtimeConfig cliflag.ConfigurationMap
+		allowUnknown  bool
+		expectedErr   string
+		expected      cliflag.ConfigurationMap
+	}{
+		{
+			name: "known keys",
+			runtimeConfig: cliflag.ConfigurationMap{
+				"api/beta":                              "false",
+				"apiextensions.k8s.io/v1beta1":          "true",
+				"apiregistration.k8s.io/v1/apiservices": "true",
+				"apiregistration.k8s.io/v1beta1":        "false",
+			},
+			expected: cliflag.ConfigurationMap{
+				"api/beta":                              "false",
+				"apiextensions.k8s.io/v1beta1":          "true",
+				"apiregistration.k8s.io/v1/apiservices": "true",
+				"apiregistration.k8s.io/v1beta1":        "false",
+			},
+		},
+		{
+			name: "values left to Complete to normalize",
+			runtimeConfig: cliflag.ConfigurationMap{
+				"api/all":                 "",
+				"api/alpha":               "0",
+				"apiextensions.k8s.io/v1": "True",
+			},
+			expected: cliflag.ConfigurationMap{
+				"api/all":                 "",
+				"api/alpha":               "0",
+				"apiextensions.k8s.io/v1": "True",
+			},
+		},
+		{
+			name:          "only api/all=false",
+			runtimeConfig: cliflag.ConfigurationMap{"api/all": "false"},
+			expected:      cliflag.ConfigurationMap{"api/all": "false"},
+		},
+		{
+			name:          "invalid value",
+			runtimeConfig: cliflag.ConfigurationMap{"api/beta": "off"},
+			expectedErr:   `invalid value "off" of --runtime-config key "api/beta", it has to be true or false`,
+		},
+		{
+			name:          "too many segments",
+			runtimeConfig: cliflag.ConfigurationMap{"apiextensions.k8s.io/v1/customresourcedefinitions/status": "false"},
+			expectedErr:   `invalid --runtime-config key "apiextensions.k8s.io/v1/customresourcedefinitions/status", it has to be group/version or group/version/resource`,
+		},
+		{
+			name:          "misspelled group",
+			runtimeConfig: cliflag.ConfigurationMap{"apiextensionsk8s.io/v1": "false"},
+			expectedErr:   `unknown --runtime-config key "apiextensionsk8s.io/v1", did you mean "apiextensions.k8s.io/v1"? (--allow-unknown-runtime-config ignores unknown keys)`,
+		},
+		{
+			name:          "misspelled version of a resource key",
+			runtimeConfig: cliflag.ConfigurationMap{"apiregistration.k8s.io/v1beta/apiservices": "false"},
+			expectedErr:   `unknown --runtime-config key "apiregistration.k8s.io/v1beta/apiservices", did you mean "apiregistration.k8s.io/v1beta1/apiservices"? (--allow-unknown-runtime-config ignores unknown keys)`,
+		},
+		{
+			name:          "misspelled meta key",
+			runtimeConfig: cliflag.ConfigurationMap{"api/bta": "true"},
+			expectedErr:   `unknown --runtime-config key "api/bta", did you mean "api/beta"? (--allow-unknown-runtime-config ignores unknown keys)`,
+		},
+		{
+			name:          "unrelated group",
+			runtimeConfig: cliflag.ConfigurationMap{"batch/v1": "false"},
+			expectedErr:   `unknown --runtime-config key "batch/v1" (--allow-unknown-runtime-config ignores unknown keys)`,
+		},
+		{
+			name: "unknown keys allowed",
+			runtimeConfig: cliflag.ConfigurationMap{
+				"apiextensions.k8s.io/v2": "true",
+				"apiextensions.k8s.io/v1": "true",
+				"batch/v1":                "false",
+			},
+			allowUnknown: true,
+			expected:     cliflag.ConfigurationMap{"apiextensions.k8s.io/v1": "true"},
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRuntimeConfig(test.runtimeConfig, test.allowUnknown, apiextensionsapiserver.Scheme, aggregatorscheme.Scheme)
+			if test.expectedErr != "" {
+				if err == nil || err.Error() != test.expectedErr {
+					t.Fatalf("expected error %q, got %v", test.expectedErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(test.runtimeConfig, test.expected) {
+				t.Errorf("expected runtime config %v, got %v", test.expected, test.runtimeConfig)
+			}
+		})
+	}
+}
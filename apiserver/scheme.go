@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/registry/generic"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+)
+
+// newChainScheme returns a scheme with the types the endpoints of every group use.
+func newChainScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+
+	metav1.AddToGroupVersion(scheme, schema.GroupVersion{Version: "v1"})
+
+	unversioned := schema.GroupVersion{Group: "", Version: "v1"}
+	scheme.AddUnversionedTypes(unversioned, &metav1.Status{}, &metav1.APIVersions{}, &metav1.APIGroupList{}, &metav1.APIGroup{}, &metav1.APIResourceList{})
+
+	return scheme
+}
+
+// AddToScheme registers the types of API groups added with WithAPIGroup with the scheme of the chain.
+// The scheme is separate from those of the apiextensions server and the aggregator, whose codecs are
+// fixed. It fails once the codecs of the scheme are constructed by Codecs, RESTOptionsGetter or New.
+func (c *ServerChainConfig) AddToScheme(builders ...func(*runtime.Scheme) error) error {
+	if c.codecs != nil {
+		return fmt.Errorf("the codecs of the chain are constructed already")
+	}
+
+	for _, builder := range builders {
+		if err := builder(c.scheme); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Scheme returns the scheme of the chain, holding the types registered with AddToScheme.
+func (c *ServerChainConfig) Scheme() *runtime.Scheme {
+	return c.scheme
+}
+
+// Codecs returns the codecs of the scheme of the chain. API groups added with WithAPIGroup without a
+// scheme of their own are served with them.
+func (c *ServerChainConfig) Codecs() serializer.CodecFactory {
+	if c.codecs == nil {
+		codecs := serializer.NewCodecFactory(c.scheme)
+		c.codecs = &codecs
+	}
+
+	return *c.codecs
+}
+
+// RESTOptionsGetter returns the storage options of resources of a group registered with AddToScheme,
+// encoded as storageVersion in etcd. The storage is destroyed with the other storage of the chain, and
+// the storage version is checked by CheckStorageVersions.
+func (c *ServerChainConfig) RESTOptionsGetter(storageVersion schema.GroupVersion) generic.RESTOptionsGetter {
+	c.storageVersions[storageVersion.Group] = storageVersion
+
+	etcdOptions := c.etcdOptions
+	etcdOptions.StorageConfig.Codec = c.Codecs().LegacyCodec(storageVersion)
+	etcdOptions.StorageConfig.EncodeVersioner = runtime.NewMultiGroupVersioner(storageVersion, schema.GroupKind{Group: storageVersion.Group})
+
+	return c.storage.wrap(&genericoptions.SimpleRestOptionsFactory{Options: etcdOptions}, c.watchCacheSizes, c.limits)
+}
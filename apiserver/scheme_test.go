@@ -0,0 +1,135 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+)
+
+var testWidgetVersion = schema.GroupVersion{Group: "example.badidea.dev", Version: "v1"}
+
+type testWidget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Size int64 `json:"size,omitempty"`
+}
+
+func (in *testWidget) DeepCopyObject() runtime.Object {
+	out := &testWidget{TypeMeta: in.TypeMeta, Size: in.Size}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+
+	return out
+}
+
+func addTestWidget(scheme *runtime.Scheme) error {
+	for _, gv := range []schema.GroupVersion{testWidgetVersion, {Group: testWidgetVersion.Group, Version: runtime.APIVersionInternal}} {
+		scheme.AddKnownTypeWithName(gv.WithKind("Widget"), &testWidget{})
+	}
+
+	metav1.AddToGroupVersion(scheme, testWidgetVersion)
+
+	return nil
+}
+
+func TestChainSchemeCodecs(t *testing.T) {
+	c := &ServerChainConfig{
+		scheme:          newChainScheme(),
+		storage:         newStorageTracker(),
+		storageVersions: map[string]schema.GroupVersion{},
+		etcdOptions:     *genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("/registry", nil)),
+	}
+
+	if err := c.AddToScheme(addTestWidget); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	codecs := c.Codecs()
+
+	widget := &testWidget{ObjectMeta: metav1.ObjectMeta{Name: "sprocket"}, Size: 3}
+
+	for _, mediaType := range []string{runtime.ContentTypeJSON, "application/yaml"} {
+		info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+		if !ok {
+			t.Fatalf("expected a serializer for %s", mediaType)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := codecs.EncoderForVersion(info.Serializer, testWidgetVersion).Encode(widget, buf); err != nil {
+			t.Fatalf("failed to encode as %s: %v", mediaType, err)
+		}
+
+		decoded, _, err := codecs.UniversalDecoder(testWidgetVersion).Decode(buf.Bytes(), nil, nil)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", mediaType, err)
+		}
+
+		if decoded, ok := decoded.(*testWidget); !ok || !reflect.DeepEqual(decoded.ObjectMeta, widget.ObjectMeta) || decoded.Size != widget.Size {
+			t.Errorf("expected %s to round-trip the widget, got %#v", mediaType, decoded)
+		}
+	}
+
+	// only types with generated protobuf marshalling can be served as protobuf, like the meta types
+	info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), runtime.ContentTypeProtobuf)
+	if !ok {
+		t.Fatal("expected a protobuf serializer")
+	}
+
+	status := &metav1.Status{Status: metav1.StatusFailure, Message: "gone", Code: 410}
+	buf := &bytes.Buffer{}
+
+	if err := codecs.EncoderForVersion(info.Serializer, schema.GroupVersion{Version: "v1"}).Encode(status, buf); err != nil {
+		t.Fatalf("failed to encode as protobuf: %v", err)
+	}
+
+	decoded, _, err := codecs.UniversalDeserializer().Decode(buf.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatalf("failed to decode protobuf: %v", err)
+	}
+
+	if decoded, ok := decoded.(*metav1.Status); !ok || decoded.Message != status.Message || decoded.Code != status.Code {
+		t.Errorf("expected protobuf to round-trip the status, got %#v", decoded)
+	}
+
+	opts, err := c.RESTOptionsGetter(testWidgetVersion).GetRESTOptions(testWidgetVersion.WithResource("widgets").GroupResource())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf.Reset()
+
+	if err := opts.StorageConfig.Codec.Encode(widget, buf); err != nil {
+		t.Fatalf("failed to encode for storage: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), `"apiVersion":"example.badidea.dev/v1"`) {
+		t.Errorf("expected the widget to be stored as %v, got %s", testWidgetVersion, buf.String())
+	}
+
+	if err := c.AddToScheme(addTestWidget); err == nil {
+		t.Error("expected AddToScheme to fail once the codecs are constructed")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/thetirefire/badidea/filters"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/client-go/tools/cache"
+)
+
+// selectableFieldsAnnotation is the annotation of CRDs listing the fields of their custom resources,
+// as JSON paths like .spec.nodeName separated by commas, that field selectors may select in lists and
+// watches, like the selectableFields of newer CRDs. The selector names them without the leading dot,
+// like spec.nodeName=a. String, integer and boolean fields are selectable, objects without the field
+// or with another type have the empty value. The fields are indexed by the watch cache. It is read
+// when the storage of the CRD is created: on the first request after the CRD is established, once its
+// spec changes, and on restart. Paths that are not field paths, and the paths of metadata, are
+// ignored.
+const selectableFieldsAnnotation = "badidea.x-k8s.io/selectable-fields"
+
+// selectableFields returns the fields crd makes selectable, without their leading dot.
+func selectableFields(crd *apiextensionsv1.CustomResourceDefinition) []string {
+	if crd == nil {
+		return nil
+	}
+
+	var names []string
+
+	for _, path := range strings.Split(crd.Annotations[selectableFieldsAnnotation], ",") {
+		path = strings.TrimSpace(path)
+		if !strings.HasPrefix(path, ".") || strings.HasPrefix(path, ".metadata.") {
+			continue
+		}
+
+		name := path[1:]
+		if name != "" && !strings.Contains(name, "..") && !strings.HasSuffix(name, ".") {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// selectableFieldValue returns the value of the field name of obj as a field selector matches it.
+func selectableFieldValue(obj runtime.Object, name string) string {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return ""
+	}
+
+	value, found, err := unstructured.NestedFieldNoCopy(u.Object, strings.Split(name, ".")...)
+	if !found || err != nil {
+		return ""
+	}
+
+	switch value := value.(type) {
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
+
+// withSelectableFieldAttrs returns getAttrs adding the values of the fields names to the fields of the
+// objects.
+func withSelectableFieldAttrs(getAttrs storage.AttrFunc, names []string) storage.AttrFunc {
+	return func(obj runtime.Object) (labels.Set, fields.Set, error) {
+		objLabels, objFields, err := getAttrs(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		withSelectable := fields.Set{}
+		for name, value := range objFields {
+			withSelectable[name] = value
+		}
+
+		for _, name := range names {
+			withSelectable[name] = selectableFieldValue(obj, name)
+		}
+
+		return objLabels, withSelectable, nil
+	}
+}
+
+// withSelectableFieldIndexers returns indexers with an index of every field of names added, named as
+// the watch cache expects.
+func withSelectableFieldIndexers(indexers *cache.Indexers, names []string) *cache.Indexers {
+	withFields := cache.Indexers{}
+
+	if indexers != nil {
+		for name, index := range *indexers {
+			withFields[name] = index
+		}
+	}
+
+	for _, name := range names {
+		name := name
+		withFields[storage.FieldIndex(name)] = func(obj interface{}) ([]string, error) {
+			object, ok := obj.(runtime.Object)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object %T", obj)
+			}
+
+			return []string{selectableFieldValue(object, name)}, nil
+		}
+	}
+
+	return &withFields
+}
+
+// selectableFieldStorage matches the field selectors on selectable fields that filters.WithSelectableFields
+// moved into the context of the lists and watches, using the indexes of the fields in the watch cache
+// it wraps.
+type selectableFieldStorage struct {
+	storage.Interface
+
+	names []string
+}
+
+func (s *selectableFieldStorage) Watch(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	opts, err := s.withSelector(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Interface.Watch(ctx, key, opts)
+}
+
+func (s *selectableFieldStorage) WatchList(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	opts, err := s.withSelector(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Interface.WatchList(ctx, key, opts)
+}
+
+func (s *selectableFieldStorage) GetToList(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	opts, err := s.withSelector(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return s.Interface.GetToList(ctx, key, opts, listObj)
+}
+
+func (s *selectableFieldStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	opts, err := s.withSelector(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return s.Interface.List(ctx, key, opts, listObj)
+}
+
+// withSelector adds the field selector on selectable fields of ctx to the predicate of opts, and the
+// indexes of the fields. The fields have to be selectable in the storage, which only learns of the
+// fields added to the annotation of the CRD once it is recreated.
+func (s *selectableFieldStorage) withSelector(ctx context.Context, opts storage.ListOptions) (storage.ListOptions, error) {
+	selector, ok := filters.SelectableFieldSelectorFrom(ctx)
+	if !ok {
+		return opts, nil
+	}
+
+	names := sets.NewString(s.names...)
+	for _, requirement := range selector.Requirements() {
+		if !names.Has(requirement.Field) {
+			return opts, apierrors.NewBadRequest(fmt.Sprintf("field label not supported: %s, it becomes selectable once the spec of the CustomResourceDefinition changes or the server restarts", requirement.Field))
+		}
+	}
+
+	pred := opts.Predicate
+	if pred.Field == nil {
+		pred.Field = selector
+	} else {
+		pred.Field = fields.AndSelectors(pred.Field, selector)
+	}
+
+	if pred.GetAttrs != nil {
+		pred.GetAttrs = withSelectableFieldAttrs(pred.GetAttrs, s.names)
+	}
+
+	pred.IndexFields = append(append([]string{}, pred.IndexFields...), s.names...)
+	opts.Predicate = pred
+
+	return opts, nil
+}
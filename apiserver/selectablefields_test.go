@@ -0,0 +1,186 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/thetirefire/badidea/filters"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSelectableFields(t *testing.T) {
+	widgets := schema.GroupResource{Group: "example.com", Resource: "widgets"}
+	gadgets := schema.GroupResource{Group: "example.com", Resource: "gadgets"}
+
+	crds := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{
+		{ObjectMeta: metav1.ObjectMeta{Name: widgets.String(), Annotations: map[string]string{selectableFieldsAnnotation: ".spec.color, .spec.size,.metadata.uid,spec,.spec..x,"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: gadgets.String()}},
+	} {
+		if err := crds.Add(crd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := newStorageTracker()
+	defer tracker.destroy()
+
+	tracker.selectableFields = true
+	tracker.counts.setCRDLister(crdlisters.NewCustomResourceDefinitionLister(crds))
+
+	// contexts are given the field selectors by the filter
+	selectorContext := func(resource schema.GroupResource, selector string) context.Context {
+		req := httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/"+resource.Resource+"?fieldSelector="+selector, nil)
+		req = req.WithContext(request.WithRequestInfo(req.Context(), &request.RequestInfo{
+			IsResourceRequest: true,
+			Verb:              "list",
+			APIGroup:          resource.Group,
+			Resource:          resource.Resource,
+		}))
+
+		var ctx context.Context
+
+		filters.WithSelectableFields(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx = req.Context()
+		}), func(schema.GroupResource) []string { return []string{"spec.color", "spec.size"} }).ServeHTTP(httptest.NewRecorder(), req)
+
+		return ctx
+	}
+
+	newWidget := func(spec map[string]interface{}) *unstructured.Unstructured {
+		widget := newLabeledWidget("sprocket", nil)
+		widget.Object["spec"] = spec
+
+		return widget
+	}
+
+	red := newWidget(map[string]interface{}{"color": "red", "size": int64(3)})
+	blue := newWidget(map[string]interface{}{"color": "blue", "size": true})
+
+	decorate := func(resource schema.GroupResource) (storage.Interface, *predicateStorage, *indexersGetter) {
+		recording := &predicateStorage{}
+		getter := &indexersGetter{s: recording}
+
+		opts, err := tracker.wrap(getter, nil, metadataLimits{}).GetRESTOptions(resource)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		s, _, err := opts.Decorator(
+			&storagebackend.Config{},
+			"/"+resource.String(),
+			func(obj runtime.Object) (string, error) { return "", nil },
+			func() runtime.Object { return &unstructured.Unstructured{} },
+			func() runtime.Object { return &unstructured.UnstructuredList{} },
+			storage.DefaultNamespaceScopedAttr,
+			nil,
+			&cache.Indexers{},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return s, recording, getter
+	}
+
+	s, recording, getter := decorate(widgets)
+
+	var indexes []string
+	for name := range *getter.indexers {
+		indexes = append(indexes, name)
+	}
+
+	if expected := []string{"f:spec.color", "f:spec.size"}; !sets.NewString(indexes...).Equal(sets.NewString(expected...)) {
+		t.Errorf("expected the indexes %v, got %v", expected, indexes)
+	}
+
+	if values, err := (*getter.indexers)[storage.FieldIndex("spec.size")](red); err != nil || !reflect.DeepEqual(values, []string{"3"}) {
+		t.Errorf("expected the index value 3, got %v, %v", values, err)
+	}
+
+	// the watch cache matches the fields of the attrs function it is decorated with
+	if _, objFields, err := getter.getAttrs(red); err != nil || objFields["spec.color"] != "red" || objFields["spec.size"] != "3" || objFields["metadata.name"] != "sprocket" {
+		t.Errorf("expected the selectable fields in the attrs, got %v, %v", objFields, err)
+	}
+
+	if _, objFields, _ := getter.getAttrs(blue); objFields["spec.size"] != "true" {
+		t.Errorf("expected a boolean field in the attrs, got %v", objFields)
+	}
+
+	list := func(ctx context.Context) error {
+		return s.List(ctx, "/widgets", storage.ListOptions{Predicate: storage.SelectionPredicate{
+			Label:    storage.Everything.Label,
+			Field:    storage.Everything.Field,
+			GetAttrs: storage.DefaultNamespaceScopedAttr,
+		}}, &unstructured.UnstructuredList{})
+	}
+
+	if err := list(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(recording.predicate.IndexFields) != 0 {
+		t.Errorf("expected no indexes without a selector, got %v", recording.predicate.IndexFields)
+	}
+
+	if err := list(selectorContext(widgets, "spec.color%3Dred,spec.size!%3D4")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := []string{"spec.color", "spec.size"}; !reflect.DeepEqual(recording.predicate.IndexFields, expected) {
+		t.Errorf("expected the lists to index the fields %v, got %v", expected, recording.predicate.IndexFields)
+	}
+
+	if matches, err := recording.predicate.Matches(red); err != nil || !matches {
+		t.Errorf("expected the red widget to match, got %v, %v", matches, err)
+	}
+
+	if matches, err := recording.predicate.Matches(blue); err != nil || matches {
+		t.Errorf("expected the blue widget not to match, got %v, %v", matches, err)
+	}
+
+	// the storage of gadgets has no selectable fields
+	s, _, getter = decorate(gadgets)
+
+	if len(*getter.indexers) != 0 {
+		t.Errorf("expected no indexes, got %v", *getter.indexers)
+	}
+
+	if _, objFields, _ := getter.getAttrs(red); objFields["spec.color"] != "" {
+		t.Errorf("expected no selectable fields in the attrs, got %v", objFields)
+	}
+
+	if err := list(selectorContext(gadgets, "spec.color%3Dred")); !apierrors.IsBadRequest(err) {
+		t.Errorf("expected a selector on fields unknown to the storage to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thetirefire/badidea/filters"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/registry/generic"
+	"k8s.io/apiserver/pkg/storage"
+	etcd3metrics "k8s.io/apiserver/pkg/storage/etcd3/metrics"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/apiserver/pkg/storage/storagebackend/factory"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// storageTracker records the destroy funcs of the storage handed out by the servers of the chain.
+// The generic server never destroys the storage of its registries, so their etcd clients, watch
+// caches and compactor would outlive the server otherwise.
+type storageTracker struct {
+	// quota is fed the polled object counts of the storage if it is not nil.
+	quota *storageQuota
+	// counts is fed the polled object counts of the storage, and the objects created and deleted.
+	counts *objectCounts
+	// stampUsers stamps the objects written by users with the user annotations.
+	stampUsers bool
+	// selectableFields makes the fields of custom resources their CRD lists in the selectable fields
+	// annotation selectable.
+	selectableFields bool
+	// maxDeleteCollectionObjects is the limit of the objects deleted by a deletecollection request, if
+	// it is positive.
+	maxDeleteCollectionObjects int
+	// compactions looks up the revisions etcd was compacted at for expired watches.
+	compactions *etcdCompactions
+	// apis are the group versions served by the chain, which users may not register APIServices for.
+	apis *localAPIs
+	// etcdGate holds back the creation of the storage until it opens, if it is not nil.
+	etcdGate *etcdGate
+	// timestamps stamps the created objects with their creationTimestamp.
+	timestamps *creationTimestamps
+
+	lock         sync.Mutex
+	nextID       int
+	destroyFuncs map[int]factory.DestroyFunc
+}
+
+func newStorageTracker() *storageTracker {
+	return &storageTracker{
+		counts:       newObjectCounts(),
+		compactions:  newEtcdCompactions(),
+		apis:         newLocalAPIs(),
+		timestamps:   newCreationTimestamps(),
+		destroyFuncs: map[int]factory.DestroyFunc{},
+	}
+}
+
+// wrap returns a RESTOptionsGetter whose storage is tracked and checks the metadata of the objects
+// it writes against limits. The resources watchCacheSizes disables get no watch cache, which the
+// CRDRESTOptionsGetter ignores otherwise. A nil watchCacheSizes disables none.
+func (t *storageTracker) wrap(delegate generic.RESTOptionsGetter, watchCacheSizes *watchCacheSizes, limits metadataLimits) generic.RESTOptionsGetter {
+	return &trackingRESTOptionsGetter{delegate: delegate, tracker: t, watchCacheSizes: watchCacheSizes, limits: limits}
+}
+
+// track records destroy and returns a destroy func that forgets it again, so storage destroyed
+// early, like that of a deleted CustomResourceDefinition, is not kept alive.
+func (t *storageTracker) track(destroy factory.DestroyFunc) factory.DestroyFunc {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	id := t.nextID
+	t.nextID++
+	t.destroyFuncs[id] = destroy
+
+	return func() {
+		t.lock.Lock()
+		delete(t.destroyFuncs, id)
+		t.lock.Unlock()
+
+		destroy()
+	}
+}
+
+// destroy destroys all storage that is still tracked. It must only be called once the servers stopped.
+func (t *storageTracker) destroy() {
+	t.lock.Lock()
+	destroyFuncs := t.destroyFuncs
+	t.destroyFuncs = map[int]factory.DestroyFunc{}
+	t.lock.Unlock()
+
+	for _, destroy := range destroyFuncs {
+		destroy()
+	}
+
+	t.compactions.close()
+}
+
+// watchCacheSizes are the watch cache sizes of --watch-cache-sizes by resource, and
+// --default-watch-cache-size of the other resources.
+type watchCacheSizes struct {
+	sizes       map[schema.GroupResource]int
+	defaultSize int
+}
+
+// disabled returns whether resource gets no watch cache. Watch caches are sized dynamically, so only
+// a size of zero, disabling the cache, has an effect.
+func (s *watchCacheSizes) disabled(resource schema.GroupResource) bool {
+	if s == nil {
+		return false
+	}
+
+	size, ok := s.sizes[resource]
+	if !ok {
+		size = s.defaultSize
+	}
+
+	return size <= 0
+}
+
+type trackingRESTOptionsGetter struct {
+	delegate        generic.RESTOptionsGetter
+	tracker         *storageTracker
+	watchCacheSizes *watchCacheSizes
+	limits          metadataLimits
+}
+
+// GetRESTOptions implements generic.RESTOptionsGetter. Its errors and those of the decorator name the
+// resource, since the registries return them as they are.
+func (g *trackingRESTOptionsGetter) GetRESTOptions(resource schema.GroupResource) (generic.RESTOptions, error) {
+	opts, err := g.delegate.GetRESTOptions(resource)
+	if err != nil {
+		return opts, fmt.Errorf("failed to get the storage options of %s: %w", resource, err)
+	}
+
+	// a registry only stops polling its object count in its destroy func, which is never called, so
+	// the poller is started here to stop along with the storage
+	countMetricPollPeriod := opts.CountMetricPollPeriod
+	opts.CountMetricPollPeriod = 0
+
+	if g.watchCacheSizes.disabled(resource) {
+		opts.Decorator = generic.UndecoratedStorage
+	}
+
+	decorator := opts.Decorator
+	opts.Decorator = func(config *storagebackend.Config, resourcePrefix string, keyFunc func(obj runtime.Object) (string, error), newFunc func() runtime.Object, newListFunc func() runtime.Object, getAttrsFunc storage.AttrFunc, triggerFuncs storage.IndexerFuncs, indexers *cache.Indexers) (storage.Interface, factory.DestroyFunc, error) {
+		crd := g.tracker.counts.crd(resource)
+
+		labelKeys := indexedLabels(crd)
+		if len(labelKeys) > 0 {
+			indexers = withLabelIndexers(indexers, labelKeys)
+		}
+
+		var selectable []string
+		if g.tracker.selectableFields {
+			selectable = selectableFields(crd)
+		}
+
+		if len(selectable) > 0 {
+			// the watch cache matches the fields it computed when the objects came in
+			getAttrsFunc = withSelectableFieldAttrs(getAttrsFunc, selectable)
+			indexers = withSelectableFieldIndexers(indexers, selectable)
+		}
+
+		create := func() (storage.Interface, factory.DestroyFunc, error) {
+			return decorator(config, resourcePrefix, keyFunc, newFunc, newListFunc, getAttrsFunc, triggerFuncs, indexers)
+		}
+
+		var (
+			s       storage.Interface
+			destroy factory.DestroyFunc
+			err     error
+		)
+
+		if gate := g.tracker.etcdGate; gate != nil && !gate.isOpen() {
+			s, destroy = newGatedStorage(resource, gate, create)
+		} else {
+			s, destroy, err = create()
+		}
+
+		if err != nil {
+			return s, destroy, fmt.Errorf("failed to create the storage of %s: %w", resource, err)
+		}
+
+		if destroy == nil {
+			return s, destroy, nil
+		}
+
+		if countMetricPollPeriod > 0 {
+			stopObservingCount := g.tracker.observeCount(s, resourcePrefix, resource, countMetricPollPeriod)
+			destroyStorage := destroy
+			destroy = func() {
+				stopObservingCount()
+				destroyStorage()
+			}
+		}
+
+		if len(labelKeys) > 0 {
+			s = &labelIndexingStorage{Interface: s, keys: labelKeys}
+		}
+
+		if g.tracker.selectableFields {
+			// rejects the selectors on fields added to the CRD since the storage was created
+			s = &selectableFieldStorage{Interface: s, names: selectable}
+		}
+
+		s = &errorLoggingStorage{Interface: s, resource: resource.String()}
+		s = &watchExpiryStorage{Interface: s, transport: config.Transport, compactions: g.tracker.compactions}
+		s = &countingStorage{Interface: s, resource: resource, counts: g.tracker.counts}
+
+		if g.tracker.maxDeleteCollectionObjects > 0 {
+			s = &deleteCollectionLimitingStorage{Interface: s, resource: resource, maxObjects: g.tracker.maxDeleteCollectionObjects}
+		}
+
+		s = &metadataCheckingStorage{Interface: s, resource: resource, limits: g.limits}
+		if resource == apiServicesResource {
+			s = &apiServiceCheckingStorage{Interface: s, apis: g.tracker.apis}
+		}
+		if resource == crdsResource {
+			s = &crdCheckingStorage{Interface: s}
+		}
+
+		s = &creationTimestampStorage{Interface: s, timestamps: g.tracker.timestamps}
+
+		if g.tracker.stampUsers {
+			s = &userStampingStorage{Interface: s}
+		}
+
+		return s, g.tracker.track(destroy), nil
+	}
+
+	return opts, nil
+}
+
+// observeCount periodically updates the etcd_object_counts metric of resource like a registry does,
+// the count of prefix in the quota if there is one, and the count of resource. It returns a function
+// to stop.
+func (t *storageTracker) observeCount(s storage.Interface, prefix string, resource schema.GroupResource, period time.Duration) func() {
+	stopCh := make(chan struct{})
+
+	go func() {
+		wait.JitterUntil(func() {
+			count, err := s.Count(prefix)
+			if err != nil {
+				klog.V(5).Infof("Failed to update storage count metric: %v", err)
+				count = -1
+			} else {
+				if t.quota != nil {
+					t.quota.record(prefix, count)
+				}
+
+				t.counts.record(resource, count)
+			}
+
+			etcd3metrics.UpdateObjectCount(resource.String(), count)
+		}, period, 1.2, true, stopCh)
+
+		// once the last count is recorded
+		if t.quota != nil {
+			t.quota.forget(prefix)
+		}
+
+		t.counts.forget(resource)
+	}()
+
+	return func() { close(stopCh) }
+}
+
+// errorLoggingStorage logs the failures of the storage of resource with the audit ID of the request,
+// so they can be correlated with the request log and the Audit-ID a client got.
+type errorLoggingStorage struct {
+	storage.Interface
+
+	resource string
+}
+
+func (s *errorLoggingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	return s.logError(ctx, "create", key, s.Interface.Create(ctx, key, obj, out, ttl))
+}
+
+func (s *errorLoggingStorage) Delete(ctx context.Context, key string, out runtime.Object, preconditions *storage.Preconditions, validateDeletion storage.ValidateObjectFunc) error {
+	return s.logError(ctx, "delete", key, s.Interface.Delete(ctx, key, out, preconditions, validateDeletion))
+}
+
+func (s *errorLoggingStorage) Get(ctx context.Context, key string, opts storage.GetOptions, objPtr runtime.Object) error {
+	return s.logError(ctx, "get", key, s.Interface.Get(ctx, key, opts, objPtr))
+}
+
+func (s *errorLoggingStorage) GetToList(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	return s.logError(ctx, "get", key, s.Interface.GetToList(ctx, key, opts, listObj))
+}
+
+func (s *errorLoggingStorage) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	return s.logError(ctx, "list", key, s.Interface.List(ctx, key, opts, listObj))
+}
+
+func (s *errorLoggingStorage) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	return s.logError(ctx, "update", key, s.Interface.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, tryUpdate, suggestion...))
+}
+
+func (s *errorLoggingStorage) logError(ctx context.Context, operation, key string, err error) error {
+	if !isStorageFailure(err) {
+		return err
+	}
+
+	auditID, _ := filters.AuditIDFrom(ctx)
+	klog.Errorf("Storage %s of %s %q failed, auditID=%q: %v", operation, s.resource, key, auditID, err)
+
+	return err
+}
+
+// isStorageFailure reports whether err is a failure of the storage rather than an outcome clients
+// expect, like a missing object or a conflict.
+func isStorageFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// the update func of GuaranteedUpdate returns the validation errors of the registry
+	if _, ok := err.(apierrors.APIStatus); ok {
+		return false
+	}
+
+	return !storage.IsNotFound(err) && !storage.IsNodeExist(err) && !storage.IsConflict(err) && !storage.IsInvalidObj(err)
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/etcd"
+	"github.com/thetirefire/badidea/filters"
+	apiextensionsoptions "k8s.io/apiextensions-apiserver/pkg/cmd/server/options"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/registry/generic"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/cacher"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/klog"
+)
+
+func TestStorageTracker(t *testing.T) {
+	tracker := newStorageTracker()
+	destroyed := map[string]int{}
+
+	track := func(name string) func() {
+		return tracker.track(func() { destroyed[name]++ })
+	}
+
+	track("apiservices")
+	destroyWidgets := track("widgets")
+	track("customresourcedefinitions")
+
+	// the storage of a deleted CRD is destroyed early and must not be destroyed again
+	destroyWidgets()
+	tracker.destroy()
+	tracker.destroy()
+
+	expected := map[string]int{"apiservices": 1, "widgets": 1, "customresourcedefinitions": 1}
+	for name, count := range expected {
+		if destroyed[name] != count {
+			t.Errorf("expected %s to be destroyed %d times, got %d", name, count, destroyed[name])
+		}
+	}
+
+	if len(tracker.destroyFuncs) != 0 {
+		t.Errorf("expected no tracked storage, got %d", len(tracker.destroyFuncs))
+	}
+}
+
+func TestTrackingRESTOptionsGetterWatchCacheSizes(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// the storage is never used, but its client has to connect
+	etcdConfig := startEtcd(t, stopCh)
+
+	etcdOptions := genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("/registry", unstructured.UnstructuredJSONScheme))
+	etcdOptions.StorageConfig.Transport.ServerList = []string{etcdConfig.ClientURL}
+	etcdOptions.WatchCacheSizes = []string{"widgets.example.com#0", "apiservices.apiregistration.k8s.io#0", "things.example.com#100"}
+
+	sizes, err := genericoptions.ParseWatchCacheSizes(etcdOptions.WatchCacheSizes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	getters := map[string]generic.RESTOptionsGetter{
+		"crd":     apiextensionsoptions.NewCRDRESTOptionsGetter(*etcdOptions),
+		"generic": &genericoptions.SimpleRestOptionsFactory{Options: *etcdOptions},
+	}
+
+	tests := []struct {
+		name        string
+		getter      string
+		resource    schema.GroupResource
+		defaultSize int
+
+		expectedCache bool
+	}{
+		{
+			name:        "custom resource with the watch cache disabled",
+			getter:      "crd",
+			resource:    schema.GroupResource{Group: "example.com", Resource: "widgets"},
+			defaultSize: 100,
+		},
+		{
+			name:          "custom resource",
+			getter:        "crd",
+			resource:      schema.GroupResource{Group: "example.com", Resource: "gadgets"},
+			defaultSize:   100,
+			expectedCache: true,
+		},
+		{
+			name:        "built-in resource with the watch cache disabled",
+			getter:      "generic",
+			resource:    schema.GroupResource{Group: "apiregistration.k8s.io", Resource: "apiservices"},
+			defaultSize: 100,
+		},
+		{
+			name:          "built-in resource",
+			getter:        "generic",
+			resource:      schema.GroupResource{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"},
+			defaultSize:   100,
+			expectedCache: true,
+		},
+		{
+			name:     "custom resource with a default size of zero",
+			getter:   "crd",
+			resource: schema.GroupResource{Group: "example.com", Resource: "gadgets"},
+		},
+		{
+			name:     "built-in resource with a default size of zero",
+			getter:   "generic",
+			resource: schema.GroupResource{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"},
+		},
+		{
+			name:          "custom resource with a size and a default size of zero",
+			getter:        "crd",
+			resource:      schema.GroupResource{Group: "example.com", Resource: "things"},
+			expectedCache: true,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newStorageTracker()
+			defer tracker.destroy()
+
+			opts, err := tracker.wrap(getters[test.getter], &watchCacheSizes{sizes: sizes, defaultSize: test.defaultSize}, metadataLimits{}).GetRESTOptions(test.resource)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			s, _, err := opts.Decorator(
+				opts.StorageConfig,
+				opts.ResourcePrefix,
+				func(obj runtime.Object) (string, error) { return "", nil },
+				func() runtime.Object { return &unstructured.Unstructured{} },
+				func() runtime.Object { return &unstructured.UnstructuredList{} },
+				storage.DefaultClusterScopedAttr,
+				nil,
+				nil,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// created objects are stamped with their creationTimestamp
+			s = s.(*creationTimestampStorage).Interface
+
+			// CRDs are checked for their versions
+			if checking, ok := s.(*crdCheckingStorage); ok {
+				s = checking.Interface
+			}
+
+			// APIServices are checked against the group versions of the server on top
+			if checking, ok := s.(*apiServiceCheckingStorage); ok {
+				s = checking.Interface
+			}
+
+			_, cached := s.(*metadataCheckingStorage).Interface.(*countingStorage).Interface.(*watchExpiryStorage).Interface.(*errorLoggingStorage).Interface.(*cacher.Cacher)
+			if cached != test.expectedCache {
+				t.Errorf("expected a watch cache %v, got %v", test.expectedCache, cached)
+			}
+		})
+	}
+}
+
+// BenchmarkCustomResourceWatchers opens concurrent watches of a custom resource with and without the
+// watch cache, reporting the watches etcd serves while they are open: one of the watch cache, or one
+// per watcher.
+func BenchmarkCustomResourceWatchers(b *testing.B) {
+	const watchers = 100
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	etcdConfig := startEtcd(b, stopCh)
+
+	etcdOptions := genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("/registry", unstructured.UnstructuredJSONScheme))
+	etcdOptions.StorageConfig.Transport.ServerList = []string{etcdConfig.ClientURL}
+
+	for _, defaultSize := range []int{100, 0} {
+		b.Run(fmt.Sprintf("default watch cache size %d", defaultSize), func(b *testing.B) {
+			// the watch cache serves every watcher from its own watch
+			expected, remaining := watchers, 0
+			if defaultSize > 0 {
+				expected, remaining = 1, 1
+			}
+
+			before := etcdWatchers(b, etcdConfig)
+
+			tracker := newStorageTracker()
+			defer tracker.destroy()
+
+			getter := tracker.wrap(apiextensionsoptions.NewCRDRESTOptionsGetter(*etcdOptions), &watchCacheSizes{defaultSize: defaultSize}, metadataLimits{})
+
+			opts, err := getter.GetRESTOptions(schema.GroupResource{Group: "example.com", Resource: "widgets"})
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+
+			s, _, err := opts.Decorator(
+				opts.StorageConfig,
+				opts.ResourcePrefix,
+				func(obj runtime.Object) (string, error) { return "", nil },
+				func() runtime.Object { return &unstructured.Unstructured{} },
+				func() runtime.Object { return &unstructured.UnstructuredList{} },
+				storage.DefaultClusterScopedAttr,
+				nil,
+				nil,
+			)
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+
+			etcdWatches := 0
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				opened := make([]watch.Interface, watchers)
+
+				for j := range opened {
+					wg.Add(1)
+					go func(j int) {
+						defer wg.Done()
+
+						w, err := s.Watch(context.TODO(), opts.ResourcePrefix, storage.ListOptions{Predicate: storage.Everything})
+						if err != nil {
+							b.Errorf("unexpected error: %v", err)
+							return
+						}
+
+						opened[j] = w
+					}(j)
+				}
+
+				wg.Wait()
+
+				// etcd registers the watches of its clients asynchronously
+				b.StopTimer()
+				_ = wait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+					etcdWatches = etcdWatchers(b, etcdConfig) - before
+					return etcdWatches >= expected, nil
+				})
+
+				for _, w := range opened {
+					if w != nil {
+						w.Stop()
+					}
+				}
+
+				// wait for the watches to close, so the next iteration counts its own
+				_ = wait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+					return etcdWatchers(b, etcdConfig)-before <= remaining, nil
+				})
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(etcdWatches), "etcd-watches")
+		})
+	}
+}
+
+// etcdWatchers returns the number of watches etcd serves, as its metrics report them.
+func etcdWatchers(b *testing.B, c etcd.Config) int {
+	resp, err := http.Get(c.ClientURL + "/metrics")
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), "etcd_debugging_mvcc_watcher_total "); value != scanner.Text() {
+			watchers, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+
+			return int(watchers)
+		}
+	}
+
+	b.Fatalf("etcd reports no watchers: %v", scanner.Err())
+
+	return 0
+}
+
+// startEtcd starts an embedded etcd server on free ports until stopCh is closed.
+func startEtcd(t testing.TB, stopCh <-chan struct{}) etcd.Config {
+	c := newEtcdConfig(t)
+
+	if _, err := etcd.StartEtcdServer(c, stopCh); err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+
+	return c
+}
+
+// newEtcdConfig returns the config of an etcd in a temporary directory on free ports.
+func newEtcdConfig(t testing.TB) etcd.Config {
+	ports := []int{}
+
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+		listener.Close()
+	}
+
+	c := etcd.Config{
+		Dir:       filepath.Join(t.TempDir(), "etcd"),
+		ClientURL: fmt.Sprintf("http://127.0.0.1:%d", ports[0]),
+		PeerURL:   fmt.Sprintf("http://127.0.0.1:%d", ports[1]),
+	}
+
+	return c
+}
+
+// failingStorage fails every create with err.
+type failingStorage struct {
+	storage.Interface
+
+	err error
+}
+
+func (s *failingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	return s.err
+}
+
+func TestErrorLoggingStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+
+		expectedLog bool
+	}{
+		{
+			name:        "etcd failure",
+			err:         errors.New("etcdserver: request timed out"),
+			expectedLog: true,
+		},
+		{
+			name: "existing object",
+			err:  storage.NewKeyExistsError("/widgets/default/gizmo", 0),
+		},
+	}
+
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			_ = flags.Set("logtostderr", "false")
+			klog.SetOutput(out)
+			defer func() { _ = flags.Set("logtostderr", "true") }()
+
+			s := &errorLoggingStorage{Interface: &failingStorage{err: test.err}, resource: "widgets.example.com"}
+
+			// the audit ID reaches the storage in the context of the request
+			handler := filters.WithAuditID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := s.Create(req.Context(), "/widgets/default/gizmo", nil, nil, 0); err != test.err {
+					t.Errorf("expected error %v, got %v", test.err, err)
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/apis/example.com/v1/namespaces/default/widgets", nil)
+			req.Header.Set(auditinternal.HeaderAuditID, "the-audit-id")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			klog.Flush()
+
+			logged := strings.Contains(out.String(), `auditID="the-audit-id"`)
+			if logged != test.expectedLog {
+				t.Errorf("expected a log line with the audit ID %v, got %q", test.expectedLog, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thetirefire/badidea/options"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsapiserver "k8s.io/apiextensions-apiserver/pkg/apiserver"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/component-base/version"
+	"k8s.io/klog"
+	"k8s.io/kube-aggregator/pkg/apis/apiregistration/v1beta1"
+	aggregatorscheme "k8s.io/kube-aggregator/pkg/apiserver/scheme"
+)
+
+// storageVersionsTimeout bounds dialing etcd and reading and writing the storage versions.
+const storageVersionsTimeout = 5 * time.Second
+
+// storageVersionsRecord is the record in etcd of the versions the servers started on it store
+// resources as.
+type storageVersionsRecord struct {
+	// ServerVersion is the version of the server that wrote the record last.
+	ServerVersion string `json:"serverVersion"`
+	// StorageVersions are the group versions the resources are stored as, by resource.group.
+	StorageVersions map[string]string `json:"storageVersions"`
+}
+
+// CheckStorageVersions compares the versions resources are stored as in etcd, as recorded by the
+// servers started on it before, with the versions this server decodes, and records the versions it
+// stores resources as. It fails with a StageError of ErrStorageVersionSkew naming the affected
+// resources if a newer server stored resources this server serves in versions it cannot decode,
+// unless --allow-storage-version-downgrade is set. The records of those resources are kept then, so
+// later starts fail until a newer server is started again. etcd must be reachable.
+func (c *ServerChainConfig) CheckStorageVersions(o options.CompletedServerRunOptions) error {
+	storageConfig := o.Extensions.RecommendedOptions.Etcd.StorageConfig
+	key := path.Join("/", storageConfig.Prefix, "badidea", "storageversions")
+
+	client, err := newEtcdClient(storageConfig.Transport, storageVersionsTimeout)
+	if err != nil {
+		return NewStageError(ErrEtcdUnavailable, err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), storageVersionsTimeout)
+	defer cancel()
+
+	response, err := client.Get(ctx, key)
+	if err != nil {
+		return NewStageError(ErrEtcdUnavailable, fmt.Errorf("failed to read the storage versions: %w", err))
+	}
+
+	recorded := storageVersionsRecord{}
+	if len(response.Kvs) > 0 {
+		if err := json.Unmarshal(response.Kvs[0].Value, &recorded); err != nil {
+			return NewStageError(ErrStorageVersionSkew, fmt.Errorf("failed to decode the storage versions recorded at %s: %w", key, err))
+		}
+	}
+
+	stored := c.storageVersionsOf(o)
+
+	if undecodable := c.undecodableResources(recorded.StorageVersions, stored); len(undecodable) > 0 {
+		if !o.AllowStorageVersionDowngrade {
+			return NewStageError(ErrStorageVersionSkew, fmt.Errorf(
+				"etcd holds resources the server %s stored in versions this server cannot decode: %s; start a newer server, "+
+					"or set --allow-storage-version-downgrade to start anyway", recorded.ServerVersion, strings.Join(undecodable, ", ")))
+		}
+
+		klog.Warningf("Starting with --allow-storage-version-downgrade although the server %s stored resources in versions this server cannot decode: %s",
+			recorded.ServerVersion, strings.Join(undecodable, ", "))
+	}
+
+	// the records of resources this server does not store, or cannot decode, are kept for the
+	// servers that do
+	record := storageVersionsRecord{ServerVersion: version.Get().GitVersion, StorageVersions: map[string]string{}}
+	for resource, storageVersion := range stored {
+		record.StorageVersions[resource.String()] = storageVersion.String()
+	}
+
+	for resource, storageVersion := range recorded.StorageVersions {
+		if _, ok := stored[schema.ParseGroupResource(resource)]; !ok || !c.decodes(storageVersion) {
+			record.StorageVersions[resource] = storageVersion
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return NewStageError(ErrEtcdUnavailable, err)
+	}
+
+	if _, err := client.Put(ctx, key, string(data)); err != nil {
+		return NewStageError(ErrEtcdUnavailable, fmt.Errorf("failed to record the storage versions: %w", err))
+	}
+
+	return nil
+}
+
+// storageVersionsOf returns the group versions the servers of the chain store resources as in etcd:
+// the CustomResourceDefinitions and APIServices, and the resources of the API groups whose storage
+// is encoded by RESTOptionsGetter. Custom resources are stored as the versions their definitions
+// choose.
+func (c *ServerChainConfig) storageVersionsOf(o options.CompletedServerRunOptions) map[schema.GroupResource]schema.GroupVersion {
+	stored := map[schema.GroupResource]schema.GroupVersion{}
+
+	if crdsEnabled(o) {
+		stored[crdsResource] = apiextensionsv1beta1.SchemeGroupVersion
+	}
+
+	if c.Aggregator != nil {
+		stored[apiServicesResource] = v1beta1.SchemeGroupVersion
+	}
+
+	for _, g := range c.apiGroups {
+		for _, resources := range g.info.VersionedResourcesStorageMap {
+			for resource := range resources {
+				if strings.Contains(resource, "/") {
+					continue
+				}
+
+				if storageVersion, ok := c.storageVersions[g.info.PrioritizedVersions[0].Group]; ok {
+					stored[storageVersion.WithResource(resource).GroupResource()] = storageVersion
+				}
+			}
+		}
+	}
+
+	return stored
+}
+
+// undecodableResources describes the resources stored as the versions recorded that this server
+// stores, but cannot decode.
+func (c *ServerChainConfig) undecodableResources(recorded map[string]string, stored map[schema.GroupResource]schema.GroupVersion) []string {
+	undecodable := []string{}
+
+	for resource, storageVersion := range stored {
+		recordedVersion, ok := recorded[resource.String()]
+		if !ok || c.decodes(recordedVersion) {
+			continue
+		}
+
+		undecodable = append(undecodable, fmt.Sprintf("%s stored as %s, which this server stores as %s", resource, recordedVersion, storageVersion))
+	}
+
+	sort.Strings(undecodable)
+
+	return undecodable
+}
+
+// decodes returns whether a scheme of the chain decodes objects of the group version.
+func (c *ServerChainConfig) decodes(groupVersion string) bool {
+	gv, err := schema.ParseGroupVersion(groupVersion)
+	if err != nil {
+		return false
+	}
+
+	schemes := []*runtime.Scheme{apiextensionsapiserver.Scheme, aggregatorscheme.Scheme, c.scheme}
+	for _, g := range c.apiGroups {
+		if g.info.Scheme != nil {
+			schemes = append(schemes, g.info.Scheme)
+		}
+	}
+
+	for _, scheme := range schemes {
+		if scheme.IsVersionRegistered(gv) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+)
+
+func TestCheckStorageVersions(t *testing.T) {
+	stopEtcd := make(chan struct{})
+	defer close(stopEtcd)
+
+	etcdConfig := startEtcd(t, stopEtcd)
+	key := "/registry/badidea/storageversions"
+
+	client, err := newEtcdClient(storagebackend.TransportConfig{ServerList: []string{etcdConfig.ClientURL}}, storageVersionsTimeout)
+	if err != nil {
+		t.Fatalf("failed to dial etcd: %v", err)
+	}
+	defer client.Close()
+
+	check := func(allowDowngrade bool) error {
+		t.Helper()
+
+		o, closeListener := newTestServerRunOptions(t, "")
+		defer closeListener()
+
+		o.InMemoryServingCert = true
+		o.DisableEmbeddedEtcd = true
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{etcdConfig.ClientURL}
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.Prefix = "/registry"
+		o.AllowStorageVersionDowngrade = allowDowngrade
+
+		completed, err := o.Complete()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		config, err := CreateServerChainConfig(completed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return config.CheckStorageVersions(completed)
+	}
+
+	recorded := func() storageVersionsRecord {
+		t.Helper()
+
+		response, err := client.Get(context.TODO(), key)
+		if err != nil || len(response.Kvs) == 0 {
+			t.Fatalf("expected the storage versions to be recorded: %v", err)
+		}
+
+		record := storageVersionsRecord{}
+		if err := json.Unmarshal(response.Kvs[0].Value, &record); err != nil {
+			t.Fatalf("failed to decode the storage versions: %v", err)
+		}
+
+		return record
+	}
+
+	record := func(storageVersions map[string]string) {
+		t.Helper()
+
+		data, _ := json.Marshal(storageVersionsRecord{ServerVersion: "v9.0.0", StorageVersions: storageVersions})
+		if _, err := client.Put(context.TODO(), key, string(data)); err != nil {
+			t.Fatalf("failed to record the storage versions: %v", err)
+		}
+	}
+
+	// the first start records the storage versions
+	if err := check(false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"customresourcedefinitions.apiextensions.k8s.io": "apiextensions.k8s.io/v1beta1",
+		"apiservices.apiregistration.k8s.io":             "apiregistration.k8s.io/v1beta1",
+	}
+	if storageVersions := recorded().StorageVersions; !reflect.DeepEqual(storageVersions, expected) {
+		t.Errorf("expected the storage versions %v, got %v", expected, storageVersions)
+	}
+
+	// a version this server decodes, and resources it does not store, are fine
+	record(map[string]string{
+		"customresourcedefinitions.apiextensions.k8s.io": "apiextensions.k8s.io/v1",
+		"gizmos.example.com":                             "example.com/v2",
+	})
+
+	if err := check(false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if storageVersions := recorded().StorageVersions; storageVersions["gizmos.example.com"] != "example.com/v2" ||
+		storageVersions["customresourcedefinitions.apiextensions.k8s.io"] != "apiextensions.k8s.io/v1beta1" {
+		t.Errorf("expected the record of gizmos to be kept and that of CRDs to be replaced, got %v", storageVersions)
+	}
+
+	// a newer server stored CRDs as a version this server cannot decode
+	record(map[string]string{
+		"customresourcedefinitions.apiextensions.k8s.io": "apiextensions.k8s.io/v2",
+		"apiservices.apiregistration.k8s.io":             "apiregistration.k8s.io/v1",
+	})
+
+	err = check(false)
+	if !errors.Is(err, ErrStorageVersionSkew) {
+		t.Fatalf("expected an error of stage %q, got %v", ErrStorageVersionSkew, err)
+	}
+
+	expectedMessage := "etcd holds resources the server v9.0.0 stored in versions this server cannot decode: " +
+		"customresourcedefinitions.apiextensions.k8s.io stored as apiextensions.k8s.io/v2, which this server stores as apiextensions.k8s.io/v1beta1; " +
+		"start a newer server, or set --allow-storage-version-downgrade to start anyway"
+	if !strings.Contains(err.Error(), expectedMessage) {
+		t.Errorf("expected the error to contain %q, got %q", expectedMessage, err.Error())
+	}
+
+	// the override starts, but keeps the record of the CRDs for the next start
+	if err := check(true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected["customresourcedefinitions.apiextensions.k8s.io"] = "apiextensions.k8s.io/v2"
+	if storageVersions := recorded().StorageVersions; !reflect.DeepEqual(storageVersions, expected) {
+		t.Errorf("expected the storage versions %v, got %v", expected, storageVersions)
+	}
+
+	if err := check(false); !errors.Is(err, ErrStorageVersionSkew) {
+		t.Errorf("expected an error of stage %q after the override, got %v", ErrStorageVersionSkew, err)
+	}
+}
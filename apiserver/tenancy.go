@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/thetirefire/badidea/filters"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsv1informers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// tenantLabel is the label of the CRDs naming the tenant they belong to. Only the members of the
+// group of that name see them.
+const tenantLabel = "badidea.x-k8s.io/tenant"
+
+// errTenantsUnknown fails closed while the CRDs are not known.
+var errTenantsUnknown = errors.New("the tenants of the CustomResourceDefinitions are not known yet")
+
+// crdTenancy confines the CRDs labeled with tenantLabel to the members of their tenant. It authorizes
+// before the authorizer of the chain, denying the requests of other users for the custom resources of
+// those CRDs and for the CRDs themselves, and hides them from the discovery documents and the OpenAPI
+// spec served to other users. Lists and watches of CRDs would reveal them, and so would those of the
+// APIServices the aggregator registers for the CRD groups, so they are denied to every user but
+// system:masters and the loopback clients, which see every CRD. The APIServices of the groups hidden
+// from a user are denied to them by name too. Until the CRDs are known, the requests of other users
+// for any resource are denied.
+type crdTenancy struct {
+	lock   sync.Mutex
+	crds   crdlisters.CustomResourceDefinitionLister
+	synced cache.InformerSynced
+}
+
+var _ authorizer.Authorizer = &crdTenancy{}
+
+// setCRDInformer sets the informer of the CRDs. Without one, the CRDs are not known.
+func (t *crdTenancy) setCRDInformer(informer apiextensionsv1informers.CustomResourceDefinitionInformer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.crds, t.synced = informer.Lister(), informer.Informer().HasSynced
+}
+
+// lister returns the lister of the CRDs once they are known.
+func (t *crdTenancy) lister() (crdlisters.CustomResourceDefinitionLister, error) {
+	t.lock.Lock()
+	crds, synced := t.crds, t.synced
+	t.lock.Unlock()
+
+	if crds == nil || !synced() {
+		return nil, errTenantsUnknown
+	}
+
+	return crds, nil
+}
+
+// Authorize denies the requests of u for the CRDs of other tenants and their custom resources, and
+// has no opinion on the others.
+func (t *crdTenancy) Authorize(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	u := a.GetUser()
+	if !a.IsResourceRequest() || u == nil || seesEveryTenant(u) {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+
+	crds, err := t.lister()
+	if err != nil {
+		return authorizer.DecisionDeny, err.Error(), nil
+	}
+
+	resource := schema.GroupResource{Group: a.GetAPIGroup(), Resource: a.GetResource()}
+	if resource == apiServicesResource {
+		return t.authorizeAPIService(u, a)
+	}
+
+	name := a.GetResource() + "." + a.GetAPIGroup()
+	if resource == crdsResource {
+		if a.GetName() == "" && a.GetVerb() != "create" {
+			return authorizer.DecisionDeny, "CustomResourceDefinitions may only be read by name", nil
+		}
+
+		name = a.GetName()
+	}
+
+	crd, err := crds.Get(name)
+	if apierrors.IsNotFound(err) {
+		return authorizer.DecisionNoOpinion, "", nil
+	} else if err != nil {
+		return authorizer.DecisionDeny, "", err
+	}
+
+	if !inTenant(u, crd) {
+		return authorizer.DecisionDeny, fmt.Sprintf("%s belongs to the tenant %s", crd.Name, crd.Labels[tenantLabel]), nil
+	}
+
+	return authorizer.DecisionNoOpinion, "", nil
+}
+
+// authorizeAPIService denies the requests of u for the APIServices of the CRD groups hidden from u,
+// named <version>.<group>, and the lists and watches of APIServices, which would reveal them.
+func (t *crdTenancy) authorizeAPIService(u user.Info, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	if a.GetName() == "" && a.GetVerb() != "create" {
+		return authorizer.DecisionDeny, "APIServices may only be read by name", nil
+	}
+
+	hidden, err := t.hiddenAPIs(u)
+	if err != nil {
+		return authorizer.DecisionDeny, err.Error(), nil
+	}
+
+	if hidden == nil {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+
+	if versionGroup := strings.SplitN(a.GetName(), ".", 2); len(versionGroup) == 2 && hidden.Groups[versionGroup[1]] {
+		return authorizer.DecisionDeny, fmt.Sprintf("%s belongs to other tenants", a.GetName()), nil
+	}
+
+	return authorizer.DecisionNoOpinion, "", nil
+}
+
+// hiddenAPIs returns the custom resources of the CRDs of other tenants than the ones of u, and their
+// groups if every CRD of a group belongs to other tenants.
+func (t *crdTenancy) hiddenAPIs(u user.Info) (*filters.HiddenAPIs, error) {
+	if seesEveryTenant(u) {
+		return nil, nil
+	}
+
+	crds, err := t.lister()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := crds.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := &filters.HiddenAPIs{Groups: map[string]bool{}, Resources: map[schema.GroupResource]bool{}, Kinds: map[schema.GroupKind]bool{}}
+	visibleGroups := sets.NewString()
+
+	for _, crd := range list {
+		group := crd.Spec.Group
+		if inTenant(u, crd) {
+			visibleGroups.Insert(group)
+			continue
+		}
+
+		hidden.Groups[group] = true
+		hidden.Resources[schema.GroupResource{Group: group, Resource: crd.Spec.Names.Plural}] = true
+		hidden.Kinds[schema.GroupKind{Group: group, Kind: crd.Spec.Names.Kind}] = true
+		hidden.Kinds[schema.GroupKind{Group: group, Kind: crd.Spec.Names.ListKind}] = true
+	}
+
+	if len(hidden.Resources) == 0 {
+		return nil, nil
+	}
+
+	for group := range visibleGroups {
+		delete(hidden.Groups, group)
+	}
+
+	return hidden, nil
+}
+
+// seesEveryTenant returns whether u sees the CRDs of every tenant, like the loopback clients and
+// system:masters.
+func seesEveryTenant(u user.Info) bool {
+	return isPrivilegedUser(u)
+}
+
+// inTenant returns whether u belongs to the tenant of crd, or crd belongs to no tenant.
+func inTenant(u user.Info, crd *apiextensionsv1.CustomResourceDefinition) bool {
+	tenant, ok := crd.Labels[tenantLabel]
+
+	return !ok || sets.NewString(u.GetGroups()...).Has(tenant)
+}
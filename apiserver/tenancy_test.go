@@ -0,0 +1,89 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	crdlisters "k8s.io/apiextensions-apiserver/pkg/client/listers/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCRDTenancyAPIServices(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "widgets.team-a.example.com", Labels: map[string]string{tenantLabel: "team-a"}},
+			Spec:       apiextensionsv1.CustomResourceDefinitionSpec{Group: "team-a.example.com", Names: apiextensionsv1.CustomResourceDefinitionNames{Plural: "widgets", Kind: "Widget"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "gadgets.team-b.example.com", Labels: map[string]string{tenantLabel: "team-b"}},
+			Spec:       apiextensionsv1.CustomResourceDefinitionSpec{Group: "team-b.example.com", Names: apiextensionsv1.CustomResourceDefinitionNames{Plural: "gadgets", Kind: "Gadget"}},
+		},
+	} {
+		if err := indexer.Add(crd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tenancy := &crdTenancy{crds: crdlisters.NewCustomResourceDefinitionLister(indexer), synced: func() bool { return true }}
+
+	alice := &user.DefaultInfo{Name: "alice", Groups: []string{"team-a"}}
+	admin := &user.DefaultInfo{Name: "admin", Groups: []string{user.SystemPrivilegedGroup}}
+
+	tests := []struct {
+		name string
+		user user.Info
+		verb string
+		// apiService is the name of the APIService requested, empty for lists and watches
+		apiService string
+
+		expected authorizer.Decision
+	}{
+		{name: "list", user: alice, verb: "list", expected: authorizer.DecisionDeny},
+		{name: "watch", user: alice, verb: "watch", expected: authorizer.DecisionDeny},
+		{name: "APIService of the tenant", user: alice, verb: "get", apiService: "v1.team-a.example.com", expected: authorizer.DecisionNoOpinion},
+		{name: "APIService of another tenant", user: alice, verb: "get", apiService: "v1.team-b.example.com", expected: authorizer.DecisionDeny},
+		{name: "APIService of no tenant", user: alice, verb: "get", apiService: "v1.apiextensions.k8s.io", expected: authorizer.DecisionNoOpinion},
+		{name: "list by system:masters", user: admin, verb: "list", expected: authorizer.DecisionNoOpinion},
+	}
+
+	for _, test := range tests {
+		decision, reason, err := tenancy.Authorize(context.TODO(), authorizer.AttributesRecord{
+			User:            test.user,
+			Verb:            test.verb,
+			APIGroup:        "apiregistration.k8s.io",
+			APIVersion:      "v1",
+			Resource:        "apiservices",
+			Name:            test.apiService,
+			ResourceRequest: true,
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+
+		if decision != test.expected {
+			t.Errorf("%s: expected decision %v, got %v: %s", test.name, test.expected, decision, reason)
+		}
+	}
+}
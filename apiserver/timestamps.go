@@ -0,0 +1,156 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+)
+
+// clockJumpThreshold is how far the wall clock has to jump backwards against the monotonic clock to
+// be logged and counted. Smaller corrections, like those of NTP, are expected.
+const clockJumpThreshold = time.Second
+
+var clockBackwardJumps = metrics.NewCounter(
+	&metrics.CounterOpts{
+		Name:           "badidea_clock_backward_jumps_total",
+		Help:           "Number of backward jumps of the wall clock by more than a second, noticed when stamping the creationTimestamp of objects.",
+		StabilityLevel: metrics.ALPHA,
+	},
+)
+
+func init() {
+	legacyregistry.MustRegister(clockBackwardJumps)
+}
+
+// serverClock reads the wall clock and the monotonic clock of the server.
+type serverClock interface {
+	// Now returns the time of the wall clock.
+	Now() time.Time
+	// Monotonic returns the time elapsed since a fixed point on the monotonic clock, which does not
+	// jump when the wall clock is set.
+	Monotonic() time.Duration
+}
+
+type realServerClock struct {
+	start time.Time
+}
+
+func (c realServerClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c realServerClock) Monotonic() time.Duration {
+	return time.Since(c.start)
+}
+
+// creationTimestamps stamps new objects with the time of the server, and notices backward jumps of
+// its wall clock, after which new objects are older than the objects created before the jump.
+type creationTimestamps struct {
+	clock     serverClock
+	threshold time.Duration
+
+	lock          sync.Mutex
+	lastWall      time.Time
+	lastMonotonic time.Duration
+}
+
+func newCreationTimestamps() *creationTimestamps {
+	return &creationTimestamps{clock: realServerClock{start: time.Now()}, threshold: clockJumpThreshold}
+}
+
+// now returns the time of the wall clock in UTC, truncated to the seconds creationTimestamps are
+// serialized with, and logs and counts a backward jump since the last call.
+func (t *creationTimestamps) now() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// without its monotonic reading, the wall clock is compared
+	wall, monotonic := t.clock.Now().Round(0), t.clock.Monotonic()
+
+	if !t.lastWall.IsZero() {
+		if jump := (monotonic - t.lastMonotonic) - wall.Sub(t.lastWall); jump > t.threshold {
+			klog.Warningf("The wall clock jumped back by %v, objects created now are stamped older than the ones created before", jump.Round(time.Millisecond))
+			clockBackwardJumps.Inc()
+		}
+	}
+
+	t.lastWall, t.lastMonotonic = wall, monotonic
+
+	return wall.UTC().Truncate(time.Second)
+}
+
+// creationTimestampStorage stamps the objects created through the storage with the time of the
+// server in UTC. It runs after the strategies of the registries, so a strategy of an aggregated or
+// custom resource cannot date objects into the future of the server.
+type creationTimestampStorage struct {
+	storage.Interface
+
+	timestamps *creationTimestamps
+}
+
+func (s *creationTimestampStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetCreationTimestamp(metav1.NewTime(s.timestamps.now()))
+	}
+
+	return s.Interface.Create(ctx, key, obj, out, ttl)
+}
+
+// creationTimestampCheck is the admission control rejecting creates that set the creationTimestamp,
+// which the server sets. It runs before the strategies, which overwrite it silently.
+type creationTimestampCheck struct{}
+
+var _ admission.MutationInterface = creationTimestampCheck{}
+
+// Handles implements admission.Interface.
+func (creationTimestampCheck) Handles(operation admission.Operation) bool {
+	return operation == admission.Create
+}
+
+// Admit implements admission.MutationInterface. It does not mutate the object, it runs before the
+// strategies, unlike validation.
+func (creationTimestampCheck) Admit(ctx context.Context, a admission.Attributes, _ admission.ObjectInterfaces) error {
+	if a.GetSubresource() != "" || a.GetObject() == nil {
+		return nil
+	}
+
+	accessor, err := meta.Accessor(a.GetObject())
+	if err != nil {
+		return nil
+	}
+
+	if creationTimestamp := accessor.GetCreationTimestamp(); creationTimestamp.IsZero() {
+		return nil
+	}
+
+	return apierrors.NewInvalid(a.GetKind().GroupKind(), a.GetName(), field.ErrorList{
+		field.Forbidden(field.NewPath("metadata", "creationTimestamp"), "is set by the server"),
+	})
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// fakeServerClock is a serverClock whose wall clock can be set apart from its monotonic clock.
+type fakeServerClock struct {
+	wall      time.Time
+	monotonic time.Duration
+}
+
+func (c *fakeServerClock) Now() time.Time {
+	return c.wall
+}
+
+func (c *fakeServerClock) Monotonic() time.Duration {
+	return c.monotonic
+}
+
+// step advances the monotonic clock by elapsed and the wall clock by elapsed plus skew.
+func (c *fakeServerClock) step(elapsed, skew time.Duration) {
+	c.monotonic += elapsed
+	c.wall = c.wall.Add(elapsed + skew)
+}
+
+// creatingStorage records the objects created through it.
+type creatingStorage struct {
+	storage.Interface
+
+	created runtime.Object
+}
+
+func (s *creatingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	s.created = obj
+	return nil
+}
+
+func TestCreationTimestamps(t *testing.T) {
+	clock := &fakeServerClock{wall: time.Date(2020, 10, 1, 12, 0, 0, 500000000, time.FixedZone("CEST", 2*60*60))}
+	timestamps := &creationTimestamps{clock: clock, threshold: clockJumpThreshold}
+
+	jumps := func() float64 {
+		t.Helper()
+
+		value, err := testutil.GetCounterMetricValue(clockBackwardJumps.CounterMetric)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return value
+	}
+
+	before := jumps()
+
+	if now, expected := timestamps.now(), time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC); !now.Equal(expected) || now.Location() != time.UTC {
+		t.Errorf("expected the time %v in UTC truncated to seconds, got %v", expected, now)
+	}
+
+	// NTP corrections and forward jumps are fine
+	clock.step(time.Minute, -500*time.Millisecond)
+	timestamps.now()
+	clock.step(time.Minute, time.Hour)
+	timestamps.now()
+
+	if after := jumps(); after != before {
+		t.Errorf("expected no backward jumps, got %v", after-before)
+	}
+
+	clock.step(time.Second, -time.Hour)
+
+	s := &creatingStorage{}
+	widget := &unstructured.Unstructured{}
+	widget.SetCreationTimestamp(metav1.NewTime(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)))
+
+	wrapped := &creationTimestampStorage{Interface: s, timestamps: timestamps}
+	if err := wrapped.Create(context.TODO(), "/widgets/a", widget, &unstructured.Unstructured{}, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stamped := s.created.(*unstructured.Unstructured).GetCreationTimestamp()
+	if expected := clock.wall.UTC().Truncate(time.Second); !stamped.Time.Equal(expected) {
+		t.Errorf("expected the creationTimestamp to be stamped with the server time %v, got %v", expected, stamped)
+	}
+
+	if after := jumps(); after != before+1 {
+		t.Errorf("expected a backward jump, got %v", after-before)
+	}
+}
+
+func TestCreationTimestampCheck(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	gvr := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+
+	admit := func(creationTimestamp metav1.Time, subresource string) error {
+		widget := &unstructured.Unstructured{}
+		widget.SetCreationTimestamp(creationTimestamp)
+
+		a := admission.NewAttributesRecord(widget, nil, gvk, "default", "a", gvr, subresource, admission.Create, &metav1.CreateOptions{}, false, nil)
+
+		return creationTimestampCheck{}.Admit(context.TODO(), a, nil)
+	}
+
+	if err := admit(metav1.Time{}, ""); err != nil {
+		t.Errorf("expected objects without a creationTimestamp to be admitted, got %v", err)
+	}
+
+	if err := admit(metav1.Now(), ""); !apierrors.IsInvalid(err) {
+		t.Errorf("expected objects with a creationTimestamp to be rejected, got %v", err)
+	}
+
+	if err := admit(metav1.Now(), "status"); err != nil {
+		t.Errorf("expected subresources to be admitted, got %v", err)
+	}
+}
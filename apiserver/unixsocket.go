@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+)
+
+// unixSocketAddr is the address unixSocketListener pretends to listen on. The generic apiserver
+// derives the loopback client config and the external address from the host and port of the
+// secure listener.
+var unixSocketAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}
+
+// unixSocketListener is a listener of a unix socket with a TCP address.
+type unixSocketListener struct {
+	net.Listener
+}
+
+func (l unixSocketListener) Addr() net.Addr {
+	return unixSocketAddr
+}
+
+// listenUnixSocket listens on the unix socket at path, replacing a socket left behind by a server
+// that did not shut down cleanly. The socket is removed when the listener is closed.
+func listenUnixSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is no unix socket", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return unixSocketListener{listener}, nil
+}
+
+// UnixSocketDialer returns a dial func of rest.Config connecting to the unix socket at path,
+// whatever the address. The serving certificate generated by badidea is valid for localhost.
+func UnixSocketDialer(path string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+const (
+	// createdByAnnotation names the user who created an object.
+	createdByAnnotation = "badidea.x-k8s.io/created-by"
+	// updatedByAnnotation names the user who last created or updated an object.
+	updatedByAnnotation = "badidea.x-k8s.io/updated-by"
+)
+
+// userStampingStorage stamps the objects created and updated through the storage with the user of
+// the request in createdByAnnotation and updatedByAnnotation, replacing the values clients sent. It
+// runs after the strategies of the registries, for built-in and custom resources alike, since
+// badidea has no admission chain. The writes of the loopback clients, including those of the
+// components of the server, and of requests without a user are left as they are, so the controllers
+// of the server do not show up as the last updater.
+type userStampingStorage struct {
+	storage.Interface
+}
+
+func (s *userStampingStorage) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	if userName, ok := stampingUser(ctx); ok {
+		if accessor, err := meta.Accessor(obj); err == nil {
+			setAnnotation(accessor, createdByAnnotation, userName)
+			setAnnotation(accessor, updatedByAnnotation, userName)
+		}
+	}
+
+	return s.Interface.Create(ctx, key, obj, out, ttl)
+}
+
+func (s *userStampingStorage) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	userName, ok := stampingUser(ctx)
+	if !ok {
+		return s.Interface.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, tryUpdate, suggestion...)
+	}
+
+	stampingTryUpdate := func(input runtime.Object, res storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		// the creator is read before tryUpdate, which may modify input
+		createdBy, created := "", false
+		if accessor, err := meta.Accessor(input); err == nil {
+			createdBy, created = accessor.GetAnnotations()[createdByAnnotation]
+		}
+
+		output, ttl, err := tryUpdate(input, res)
+		if err != nil {
+			return output, ttl, err
+		}
+
+		if accessor, err := meta.Accessor(output); err == nil {
+			if created {
+				setAnnotation(accessor, createdByAnnotation, createdBy)
+			} else {
+				removeAnnotation(accessor, createdByAnnotation)
+			}
+
+			setAnnotation(accessor, updatedByAnnotation, userName)
+		}
+
+		return output, ttl, nil
+	}
+
+	return s.Interface.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, stampingTryUpdate, suggestion...)
+}
+
+// stampingUser returns the name of the user of the request in ctx, unless it is a loopback client or
+// there is none.
+func stampingUser(ctx context.Context) (string, bool) {
+	u, ok := request.UserFrom(ctx)
+	if !ok || u.GetName() == "" || isLoopbackUser(u) {
+		return "", false
+	}
+
+	return u.GetName(), true
+}
+
+func setAnnotation(accessor metav1.Object, key, value string) {
+	annotations := accessor.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[key] = value
+	accessor.SetAnnotations(annotations)
+}
+
+func removeAnnotation(accessor metav1.Object, key string) {
+	annotations := accessor.GetAnnotations()
+	if _, ok := annotations[key]; !ok {
+		return
+	}
+
+	delete(annotations, key)
+	accessor.SetAnnotations(annotations)
+}
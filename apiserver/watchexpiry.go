@@ -0,0 +1,198 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/pkg/transport"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/klog"
+)
+
+const (
+	// compactRevKey is the key the compactor of the apiserver coordinates compactions with. Watching
+	// it from the first revision tells the revision etcd was last compacted at.
+	compactRevKey = "compact_rev_key"
+	// compactedRevisionTimeout bounds looking up the revision etcd was last compacted at.
+	compactedRevisionTimeout = 5 * time.Second
+)
+
+// etcdCompactions looks up the revisions the etcd clusters of the storage were last compacted at,
+// with one client per cluster dialed on first use.
+type etcdCompactions struct {
+	lock    sync.Mutex
+	clients map[string]*clientv3.Client
+}
+
+func newEtcdCompactions() *etcdCompactions {
+	return &etcdCompactions{clients: map[string]*clientv3.Client{}}
+}
+
+// compactedRevision returns the revision the etcd cluster of config was last compacted at, or zero
+// if it was never compacted.
+func (c *etcdCompactions) compactedRevision(ctx context.Context, config storagebackend.TransportConfig) (int64, error) {
+	client, err := c.client(config)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	// a watch of compacted revisions is canceled with the revision of the compaction, any other
+	// watch of the key starts with its first change
+	for response := range client.Watch(ctx, compactRevKey, clientv3.WithRev(1)) {
+		if response.CompactRevision > 0 {
+			return response.CompactRevision, nil
+		}
+
+		if err := response.Err(); err != nil {
+			return 0, err
+		}
+
+		return 0, nil
+	}
+
+	return 0, ctx.Err()
+}
+
+func (c *etcdCompactions) client(config storagebackend.TransportConfig) (*clientv3.Client, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := fmt.Sprintf("%v", config)
+	if client, ok := c.clients[key]; ok {
+		return client, nil
+	}
+
+	client, err := newEtcdClient(config, compactedRevisionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.clients[key] = client
+
+	return client, nil
+}
+
+// newEtcdClient returns a client of the etcd cluster of config, giving up dialing after dialTimeout.
+func newEtcdClient(config storagebackend.TransportConfig, dialTimeout time.Duration) (*clientv3.Client, error) {
+	tlsInfo := transport.TLSInfo{CertFile: config.CertFile, KeyFile: config.KeyFile, TrustedCAFile: config.TrustedCAFile}
+
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// the client only uses TLS without a config for secure connections
+	if config.CertFile == "" && config.KeyFile == "" && config.TrustedCAFile == "" {
+		tlsConfig = nil
+	}
+
+	return clientv3.New(clientv3.Config{Endpoints: config.ServerList, TLS: tlsConfig, DialTimeout: dialTimeout})
+}
+
+// close closes the clients. It must only be called once the storage is destroyed.
+func (c *etcdCompactions) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, client := range c.clients {
+		client.Close()
+		delete(c.clients, key)
+	}
+}
+
+// watchExpiryStorage adds the oldest resourceVersion watches can start at to the 410 Gone errors of
+// watches starting at an older one, so clients can tell whether resuming later would help or they
+// have to relist. The watch cache states the oldest resourceVersion it holds; etcd is asked the
+// revision it was last compacted at.
+type watchExpiryStorage struct {
+	storage.Interface
+
+	transport   storagebackend.TransportConfig
+	compactions *etcdCompactions
+}
+
+func (s *watchExpiryStorage) Watch(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	w, err := s.Interface.Watch(ctx, key, opts)
+	if err != nil {
+		return w, err
+	}
+
+	return watch.Filter(w, s.reportOldestResourceVersion), nil
+}
+
+func (s *watchExpiryStorage) WatchList(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	w, err := s.Interface.WatchList(ctx, key, opts)
+	if err != nil {
+		return w, err
+	}
+
+	return watch.Filter(w, s.reportOldestResourceVersion), nil
+}
+
+func (s *watchExpiryStorage) reportOldestResourceVersion(event watch.Event) (watch.Event, bool) {
+	status, ok := event.Object.(*metav1.Status)
+	if event.Type != watch.Error || !ok || !apierrors.IsResourceExpired(&apierrors.StatusError{ErrStatus: *status}) {
+		return event, true
+	}
+
+	oldest, ok := s.oldestResourceVersion(status.Message)
+	if !ok {
+		return event, true
+	}
+
+	status = status.DeepCopy()
+	status.Message = fmt.Sprintf("%s; the oldest resourceVersion to watch from is %d", status.Message, oldest)
+
+	return watch.Event{Type: watch.Error, Object: status}, true
+}
+
+// oldestResourceVersion returns the oldest resourceVersion watches can start at after they failed
+// with message.
+func (s *watchExpiryStorage) oldestResourceVersion(message string) (int64, bool) {
+	var requested, oldest int64
+	if _, err := fmt.Sscanf(message, "too old resource version: %d (%d)", &requested, &oldest); err == nil {
+		return oldest, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), compactedRevisionTimeout)
+	defer cancel()
+
+	compacted, err := s.compactions.compactedRevision(ctx, s.transport)
+	if err != nil {
+		klog.V(2).Infof("Failed to look up the revision etcd was compacted at: %v", err)
+		return 0, false
+	}
+
+	if compacted == 0 {
+		return 0, false
+	}
+
+	// a watch starting at a resourceVersion watches etcd from the next revision
+	return compacted - 1, true
+}
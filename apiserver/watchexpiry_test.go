@@ -0,0 +1,90 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// erroringWatchStorage starts watches failing with err.
+type erroringWatchStorage struct {
+	storage.Interface
+
+	err *apierrors.StatusError
+}
+
+func (s *erroringWatchStorage) Watch(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	w := watch.NewFakeWithChanSize(1, false)
+	w.Error(&s.err.ErrStatus)
+
+	return w, nil
+}
+
+func TestWatchExpiryStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *apierrors.StatusError
+
+		expectedMessage string
+	}{
+		{
+			name:            "expired in the watch cache",
+			err:             apierrors.NewResourceExpired("too old resource version: 5 (10)"),
+			expectedMessage: "too old resource version: 5 (10); the oldest resourceVersion to watch from is 10",
+		},
+		{
+			name:            "other error",
+			err:             apierrors.NewInternalError(apierrors.NewResourceExpired("too old resource version: 5 (10)")),
+			expectedMessage: "Internal error occurred: too old resource version: 5 (10)",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			s := &watchExpiryStorage{Interface: &erroringWatchStorage{err: test.err}, compactions: newEtcdCompactions()}
+			defer s.compactions.close()
+
+			w, err := s.Watch(context.TODO(), "/widgets", storage.ListOptions{ResourceVersion: "5"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer w.Stop()
+
+			event := <-w.ResultChan()
+
+			status, ok := event.Object.(*metav1.Status)
+			if event.Type != watch.Error || !ok {
+				t.Fatalf("expected an error event, got %#v", event)
+			}
+
+			if status.Message != test.expectedMessage {
+				t.Errorf("expected message %q, got %q", test.expectedMessage, status.Message)
+			}
+
+			if status.Code != test.err.ErrStatus.Code || status.Reason != test.err.ErrStatus.Reason {
+				t.Errorf("expected the status of %v, got %#v", test.err, status)
+			}
+		})
+	}
+}
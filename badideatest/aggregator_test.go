@@ -0,0 +1,274 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badideatest
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/options"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	aggregatorclientset "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+)
+
+func TestStartTestServerDisableAggregator(t *testing.T) {
+	// goroutines of a server started before are still winding down
+	aggregated := StartTestServer(t, WithCRDs(newWidgetCRD()))
+	aggregatedGoroutines := runtime.NumGoroutine()
+	aggregated.TearDownFn()
+
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.DisableAggregator = true
+	}))
+
+	if goroutines := runtime.NumGoroutine(); goroutines >= aggregatedGoroutines {
+		t.Errorf("expected fewer goroutines than the %d with the aggregator, got %d", aggregatedGoroutines, goroutines)
+	}
+
+	if _, err := s.APIRegistrationClient.ApiregistrationV1().APIServices().List(context.TODO(), metav1.ListOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected apiregistration.k8s.io not to exist, got %v", err)
+	}
+
+	groups, err := s.APIExtensionsClient.Discovery().ServerGroups()
+	if err != nil {
+		t.Fatalf("failed to discover groups: %v", err)
+	}
+
+	groupNames := sets.NewString()
+	for _, group := range groups.Groups {
+		groupNames.Insert(group.Name)
+	}
+
+	if expected := sets.NewString("apiextensions.k8s.io", "example.com"); !groupNames.Equal(expected) {
+		t.Errorf("expected groups %v, got %v", expected.List(), groupNames.List())
+	}
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	if _, err := widgets.Create(context.TODO(), newWidget("sprocket"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create widget: %v", err)
+	}
+
+	if _, err := s.RESTMapper.RESTMapping(schema.GroupKind{Group: "example.com", Kind: "Widget"}); err != nil {
+		t.Errorf("expected the CRD in discovery: %v", err)
+	}
+
+	openAPISpec, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/openapi/v2").DoRaw(context.TODO())
+	if err != nil {
+		t.Fatalf("failed to get the OpenAPI spec: %v", err)
+	}
+
+	if !strings.Contains(string(openAPISpec), "/apis/example.com/v1/namespaces/{namespace}/widgets") {
+		t.Error("expected the OpenAPI spec to cover the CRDs")
+	}
+}
+
+func TestStartTestServerRESTMapper(t *testing.T) {
+	s := StartTestServer(t)
+
+	// fill the discovery cache before the CRD exists
+	if _, err := s.RESTMapper.RESTMapping(schema.GroupKind{Group: "apiregistration.k8s.io", Kind: "APIService"}, "v1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := createCRD(s.APIExtensionsClient, newWidgetCRD()); err != nil {
+		t.Fatalf("failed to create CRD: %v", err)
+	}
+
+	// the aggregator discovers the CRD group a moment after it is established
+	var mapping *meta.RESTMapping
+
+	err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		var err error
+		mapping, err = s.RESTMapper.RESTMapping(schema.GroupKind{Group: "example.com", Kind: "Widget"}, "v1")
+
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the mapper to resolve widgets: %v", err)
+	}
+
+	expected := widgetsResource
+	if mapping.Resource != expected || mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		t.Errorf("expected namespaced %v, got %v scoped %v", expected, mapping.Scope.Name(), mapping.Resource)
+	}
+}
+
+func TestStartTestServerDiscoveryInvalidation(t *testing.T) {
+	s := StartTestServer(t, WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.InternalClientDiscoveryTTL = time.Hour
+	}))
+
+	discoveryClient, err := s.Server.DiscoveryClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := discoveryClient.ServerPreferredResources(); err != nil {
+		t.Fatalf("failed to discover the server: %v", err)
+	}
+
+	if _, err := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(context.TODO(), newWidgetCRD(), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create CRD: %v", err)
+	}
+
+	// the cache is far from expiring, the CRD invalidates it
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := discoveryClient.ServerResourcesForGroupVersion("example.com/v1")
+		return err == nil, nil
+	}); err != nil {
+		t.Errorf("expected the resources of the CRD to be discovered: %v", err)
+	}
+}
+
+func TestStartTestServerUnavailableAPIService(t *testing.T) {
+	s := StartTestServer(t)
+
+	apiService := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1.metrics.example.com"},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Service:               &apiregistrationv1.ServiceReference{Namespace: "default", Name: "metrics"},
+			Group:                 "metrics.example.com",
+			Version:               "v1",
+			InsecureSkipTLSVerify: true,
+			GroupPriorityMinimum:  100,
+			VersionPriority:       100,
+		},
+	}
+	if _, err := s.APIRegistrationClient.ApiregistrationV1().APIServices().Create(context.TODO(), apiService, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create APIService: %v", err)
+	}
+
+	widgets := s.DynamicClient.Resource(schema.GroupVersionResource{Group: "metrics.example.com", Version: "v1", Resource: "widgets"})
+
+	// the proxy picks up the APIService a moment after it is created
+	var err error
+
+	_ = wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err = widgets.List(context.TODO(), metav1.ListOptions{})
+
+		return apierrors.IsServiceUnavailable(err), nil
+	})
+
+	statusErr, ok := err.(apierrors.APIStatus)
+	if !ok || !apierrors.IsServiceUnavailable(err) {
+		t.Fatalf("expected a ServiceUnavailable Status, got %v", err)
+	}
+
+	if details := statusErr.Status().Details; details == nil || details.Name != "v1.metrics.example.com" || details.Kind != "APIService" {
+		t.Errorf("expected details of APIService v1.metrics.example.com, got %#v", details)
+	}
+}
+
+func TestStartTestServerLocalAPIServices(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()))
+
+	recorder := &warningRecorder{}
+
+	config := rest.CopyConfig(s.ClientConfig)
+	config.WarningHandler = recorder
+
+	client, err := aggregatorclientset.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	apiServices := client.ApiregistrationV1().APIServices()
+
+	newAPIService := func(gv schema.GroupVersion, groupPriorityMinimum int32) *apiregistrationv1.APIService {
+		return &apiregistrationv1.APIService{
+			ObjectMeta: metav1.ObjectMeta{Name: gv.Version + "." + gv.Group},
+			Spec: apiregistrationv1.APIServiceSpec{
+				Service:               &apiregistrationv1.ServiceReference{Namespace: "default", Name: "shadow"},
+				Group:                 gv.Group,
+				Version:               gv.Version,
+				InsecureSkipTLSVerify: true,
+				GroupPriorityMinimum:  groupPriorityMinimum,
+				VersionPriority:       100,
+			},
+		}
+	}
+
+	// the autoregister controller registers the group versions of the server and the CRDs
+	for _, name := range []string{"v1.apiextensions.k8s.io", "v1.example.com"} {
+		if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			_, err := apiServices.Get(context.TODO(), name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+
+			return err == nil, err
+		}); err != nil {
+			t.Fatalf("expected APIService %s to be registered: %v", name, err)
+		}
+	}
+
+	for _, gv := range []schema.GroupVersion{
+		{Group: "", Version: "v1"},
+		{Group: "apiextensions.k8s.io", Version: "v1"},
+		{Group: "apiregistration.k8s.io", Version: "v1"},
+		{Group: "example.com", Version: "v1"},
+	} {
+		_, err := apiServices.Create(context.TODO(), newAPIService(gv, 100), metav1.CreateOptions{})
+		if !apierrors.IsInvalid(err) || !strings.Contains(err.Error(), "is served by this server") {
+			t.Errorf("expected an APIService for %v to be rejected, got %v", gv, err)
+		}
+	}
+
+	// users cannot point the APIServices of the server elsewhere, but may label them
+	registered, err := apiServices.Get(context.TODO(), "v1.apiextensions.k8s.io", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get APIService: %v", err)
+	}
+
+	redirected := registered.DeepCopy()
+	redirected.Spec = newAPIService(apiextensionsv1.SchemeGroupVersion, 100).Spec
+
+	if _, err := apiServices.Update(context.TODO(), redirected, metav1.UpdateOptions{}); !apierrors.IsInvalid(err) {
+		t.Errorf("expected the APIService to keep its spec, got %v", err)
+	}
+
+	registered.Labels["team"] = "platform"
+
+	if _, err := apiServices.Update(context.TODO(), registered, metav1.UpdateOptions{}); err != nil {
+		t.Errorf("expected the APIService to be labeled: %v", err)
+	}
+
+	// other groups can be registered, with a warning if they would be listed first
+	recorder.reset()
+
+	if _, err := apiServices.Create(context.TODO(), newAPIService(schema.GroupVersion{Group: "metrics.example.io", Version: "v1"}, 20000), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create APIService: %v", err)
+	}
+
+	expectedWarnings := []string{"spec.groupPriorityMinimum: 20000 is higher than the priority of every group served by this server, 18000, so discovery lists the group first"}
+	if warnings := recorder.reset(); !reflect.DeepEqual(warnings, expectedWarnings) {
+		t.Errorf("expected warnings %q, got %q", expectedWarnings, warnings)
+	}
+}
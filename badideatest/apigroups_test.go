@@ -0,0 +1,479 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badideatest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	badideav1alpha1 "github.com/thetirefire/badidea/apis/badidea/v1alpha1"
+	"github.com/thetirefire/badidea/badideatest/examplegroup"
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestStartTestServerAPIGroup(t *testing.T) {
+	s := StartTestServer(t, WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions))
+
+	testExampleGroup(t, s)
+}
+
+func TestStartTestServerAPIGroupChainScheme(t *testing.T) {
+	s := StartTestServer(t,
+		WithScheme(examplegroup.AddToScheme),
+		WithAPIGroup(examplegroup.NewAPIGroupInfoWithoutScheme(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions))
+
+	testExampleGroup(t, s)
+}
+
+func TestStartTestServerDeprecatedAPIGroup(t *testing.T) {
+	dir := t.TempDir()
+	auditLog := filepath.Join(dir, "audit.log")
+	auditPolicy := filepath.Join(dir, "audit-policy.yaml")
+
+	if err := ioutil.WriteFile(auditPolicy, []byte("apiVersion: audit.k8s.io/v1\nkind: Policy\nrules:\n- level: Metadata\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gvr := examplegroup.SchemeGroupVersion.WithResource("gadgets")
+
+	s := StartTestServer(t,
+		WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+		WithDeprecatedResource(gvr, filters.Deprecation{Replacement: examplegroup.GroupName + "/v2 gadgets", RemovedRelease: "v2.0"}),
+		WithServerRunOptions(func(o *options.ServerRunOptions) {
+			o.Extensions.RecommendedOptions.Audit.LogOptions.Path = auditLog
+			o.Extensions.RecommendedOptions.Audit.PolicyFile = auditPolicy
+		}))
+
+	client, recorder := newWarningClient(t, s)
+
+	if _, err := client.Resource(gvr).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		t.Fatalf("failed to list gadgets: %v", err)
+	}
+
+	expectedWarnings := []string{examplegroup.GroupName + "/v1 gadgets is deprecated, unavailable in v2.0; use " + examplegroup.GroupName + "/v2 gadgets"}
+	if warnings := recorder.reset(); !reflect.DeepEqual(warnings, expectedWarnings) {
+		t.Errorf("expected warnings %q, got %q", expectedWarnings, warnings)
+	}
+
+	metrics, err := getMetrics(s)
+	if err != nil {
+		t.Fatalf("failed to get the metrics: %v", err)
+	}
+
+	found := false
+	for _, sample := range metrics["badidea_requested_deprecated_apis"] {
+		labels := sample.Metric
+		found = found || (string(labels["group"]) == gvr.Group && string(labels["version"]) == gvr.Version &&
+			string(labels["resource"]) == gvr.Resource && labels["removed_release"] == "v2.0" && sample.Value == 1)
+	}
+
+	if !found {
+		t.Errorf("expected badidea_requested_deprecated_apis for %v removed in v2.0, got %v", gvr, metrics["badidea_requested_deprecated_apis"])
+	}
+
+	events, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatalf("failed to read the audit log: %v", err)
+	}
+
+	found = false
+	for _, line := range strings.Split(strings.TrimSpace(string(events)), "\n") {
+		event := &auditv1.Event{}
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			t.Fatalf("failed to decode audit event %q: %v", line, err)
+		}
+
+		if event.ObjectRef != nil && event.ObjectRef.Resource == gvr.Resource && event.Stage == auditv1.StageResponseComplete {
+			found = event.Annotations["k8s.io/deprecated"] == "true" && event.Annotations["k8s.io/removed-release"] == "v2.0"
+		}
+	}
+
+	if !found {
+		t.Errorf("expected the audit event of the gadget list to be annotated as deprecated, got %s", events)
+	}
+}
+
+// testExampleGroup exercises the gadgets of examplegroup through the loopback client.
+func testExampleGroup(t *testing.T, s *TestServer) {
+	t.Helper()
+
+	mapping, err := s.RESTMapper.RESTMapping(schema.GroupKind{Group: examplegroup.GroupName, Kind: "Gadget"})
+	if err != nil {
+		t.Fatalf("expected the example group in discovery: %v", err)
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameRoot {
+		t.Errorf("expected gadgets to be cluster-scoped, got %v", mapping.Scope.Name())
+	}
+
+	gadgets := s.DynamicClient.Resource(mapping.Resource)
+
+	gadget := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": examplegroup.SchemeGroupVersion.String(),
+		"kind":       "Gadget",
+		"metadata":   map[string]interface{}{"name": "sprocket", "labels": map[string]interface{}{"app": "test"}},
+		"spec":       map[string]interface{}{"size": int64(1)},
+	}}
+
+	created, err := gadgets.Create(context.TODO(), gadget, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create gadget: %v", err)
+	}
+
+	if _, err := gadgets.Create(context.TODO(), gadget, metav1.CreateOptions{}); !apierrors.IsAlreadyExists(err) {
+		t.Errorf("expected AlreadyExists creating the gadget again, got %v", err)
+	}
+
+	if err := unstructured.SetNestedField(created.Object, int64(2), "spec", "size"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gadgets.Update(context.TODO(), created, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update gadget: %v", err)
+	}
+
+	if _, err := gadgets.Update(context.TODO(), created, metav1.UpdateOptions{}); !apierrors.IsConflict(err) {
+		t.Errorf("expected Conflict updating a stale gadget, got %v", err)
+	}
+
+	list, err := gadgets.List(context.TODO(), metav1.ListOptions{LabelSelector: "app=test"})
+	if err != nil {
+		t.Fatalf("failed to list gadgets: %v", err)
+	}
+
+	if len(list.Items) != 1 {
+		t.Fatalf("expected one gadget, got %d", len(list.Items))
+	}
+
+	if size, _, _ := unstructured.NestedInt64(list.Items[0].Object, "spec", "size"); size != 2 {
+		t.Errorf("expected the updated size 2, got %d", size)
+	}
+
+	if err := gadgets.Delete(context.TODO(), "sprocket", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete gadget: %v", err)
+	}
+
+	if _, err := gadgets.Get(context.TODO(), "sprocket", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected NotFound after deleting the gadget, got %v", err)
+	}
+
+	openAPISpec, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/openapi/v2").DoRaw(context.TODO())
+	if err != nil {
+		t.Fatalf("failed to get the OpenAPI spec: %v", err)
+	}
+
+	if !strings.Contains(string(openAPISpec), `"com.github.thetirefire.badidea.badideatest.examplegroup.Gadget"`) {
+		t.Error("expected the OpenAPI spec to define the example types")
+	}
+}
+
+func TestStartTestServerOpenAPIInfo(t *testing.T) {
+	tests := []struct {
+		name              string
+		disableAggregator bool
+	}{
+		{name: "aggregator"},
+		{name: "without aggregator", disableAggregator: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := StartTestServer(t,
+				WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+				WithServerRunOptions(func(o *options.ServerRunOptions) {
+					o.DisableAggregator = test.disableAggregator
+					o.OpenAPITitle = "Widgets"
+					o.OpenAPIVersion = "v2.1.0"
+					o.OpenAPIDescription = "The widget API"
+					o.OpenAPIContactName = "Widget team"
+					o.OpenAPIContactURL = "https://widgets.example.com"
+					o.OpenAPIContactEmail = "widgets@example.com"
+				}))
+
+			data, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/openapi/v2").DoRaw(context.TODO())
+			if err != nil {
+				t.Fatalf("failed to get the OpenAPI spec: %v", err)
+			}
+
+			openAPISpec := struct {
+				Info        map[string]interface{}     `json:"info"`
+				Definitions map[string]json.RawMessage `json:"definitions"`
+			}{}
+			if err := json.Unmarshal(data, &openAPISpec); err != nil {
+				t.Fatalf("failed to decode the OpenAPI spec: %v", err)
+			}
+
+			expected := map[string]interface{}{
+				"title":       "Widgets",
+				"version":     "v2.1.0",
+				"description": "The widget API",
+				"contact":     map[string]interface{}{"name": "Widget team", "url": "https://widgets.example.com", "email": "widgets@example.com"},
+			}
+			if !reflect.DeepEqual(openAPISpec.Info, expected) {
+				t.Errorf("expected the info %v, got %v", expected, openAPISpec.Info)
+			}
+
+			// the definitions of the servers below the top one are kept
+			if _, ok := openAPISpec.Definitions["com.github.thetirefire.badidea.badideatest.examplegroup.Gadget"]; !ok {
+				t.Error("expected the OpenAPI spec to define the example types")
+			}
+		})
+	}
+}
+
+func TestStartTestServerDisableAggregatorAPIGroup(t *testing.T) {
+	s := StartTestServer(t,
+		WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+		WithServerRunOptions(func(o *options.ServerRunOptions) {
+			o.DisableAggregator = true
+		}))
+
+	testExampleGroup(t, s)
+
+	if _, err := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().List(context.TODO(), metav1.ListOptions{}); err != nil {
+		t.Errorf("expected CRDs to be served below the API groups: %v", err)
+	}
+
+	if _, err := s.RESTMapper.RESTMapping(schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}); err != nil {
+		t.Errorf("expected apiextensions.k8s.io in discovery: %v", err)
+	}
+}
+
+func TestStartTestServerDisableCRDs(t *testing.T) {
+	s := StartTestServer(t,
+		WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+		WithServerRunOptions(func(o *options.ServerRunOptions) {
+			o.DisableCRDs = true
+		}))
+
+	testExampleGroup(t, s)
+
+	result := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/apis/apiextensions.k8s.io").Do(context.TODO())
+
+	var code int
+	if result.StatusCode(&code); code != http.StatusNotFound {
+		t.Errorf("expected /apis/apiextensions.k8s.io to be %d, got %d", http.StatusNotFound, code)
+	}
+
+	if _, err := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().List(context.TODO(), metav1.ListOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected CRDs not to exist, got %v", err)
+	}
+
+	if _, err := s.APIRegistrationClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.apiextensions.k8s.io", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected no APIService for apiextensions.k8s.io, got %v", err)
+	}
+
+	if _, err := s.APIRegistrationClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1."+examplegroup.GroupName, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected an APIService for the example group: %v", err)
+	}
+}
+
+func TestStartTestServerDisableCRDsAndAggregator(t *testing.T) {
+	s := StartTestServer(t,
+		WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+		WithServerRunOptions(func(o *options.ServerRunOptions) {
+			o.DisableCRDs = true
+			o.DisableAggregator = true
+		}))
+
+	testExampleGroup(t, s)
+
+	groups, err := s.APIExtensionsClient.Discovery().ServerGroups()
+	if err != nil {
+		t.Fatalf("failed to discover groups: %v", err)
+	}
+
+	if len(groups.Groups) != 1 || groups.Groups[0].Name != examplegroup.GroupName {
+		t.Errorf("expected only the example group in discovery, got %v", groups.Groups)
+	}
+}
+
+func TestStartTestServerFlowControl(t *testing.T) {
+	flowSchemas := schema.GroupVersionResource{Group: "flowcontrol.apiserver.k8s.io", Version: "v1alpha1", Resource: "flowschemas"}
+	priorityLevels := flowSchemas.GroupVersion().WithResource("prioritylevelconfigurations")
+
+	// the group is disabled by default
+	s := StartTestServer(t)
+
+	if _, err := s.DynamicClient.Resource(flowSchemas).List(context.TODO(), metav1.ListOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the flowcontrol group not to be served, got %v", err)
+	}
+
+	s = StartTestServer(t, WithRuntimeConfig(map[string]string{"flowcontrol.apiserver.k8s.io/v1alpha1": "true"}))
+
+	names := func(gvr schema.GroupVersionResource) sets.String {
+		t.Helper()
+
+		var list *unstructured.UnstructuredList
+
+		// the group may take a moment to show up in the discovery of the aggregator
+		if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			var err error
+
+			list, err = s.DynamicClient.Resource(gvr).List(context.TODO(), metav1.ListOptions{})
+			if apierrors.IsNotFound(err) || apierrors.IsServiceUnavailable(err) {
+				return false, nil
+			}
+
+			return true, err
+		}); err != nil {
+			t.Fatalf("failed to list %s: %v", gvr.Resource, err)
+		}
+
+		result := sets.NewString()
+		for _, item := range list.Items {
+			result.Insert(item.GetName())
+		}
+
+		return result
+	}
+
+	if served := names(flowSchemas); !served.HasAll("exempt", "catch-all", "global-default") {
+		t.Errorf("expected the bootstrap flow schemas, got %v", served.List())
+	}
+
+	if served := names(priorityLevels); !served.HasAll("exempt", "catch-all", "global-default") {
+		t.Errorf("expected the bootstrap priority levels, got %v", served.List())
+	}
+
+	catchAll, err := s.DynamicClient.Resource(flowSchemas).Get(context.TODO(), "catch-all", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the catch-all flow schema: %v", err)
+	}
+
+	if priorityLevel, _, _ := unstructured.NestedString(catchAll.Object, "spec", "priorityLevelConfiguration", "name"); priorityLevel != "catch-all" {
+		t.Errorf("expected the catch-all flow schema to use the catch-all priority level, got %q", priorityLevel)
+	}
+
+	// the objects are read-only
+	flowSchema := &unstructured.Unstructured{}
+	flowSchema.SetAPIVersion(flowSchemas.GroupVersion().String())
+	flowSchema.SetKind("FlowSchema")
+	flowSchema.SetName("mine")
+
+	if _, err := s.DynamicClient.Resource(flowSchemas).Create(context.TODO(), flowSchema, metav1.CreateOptions{}); !apierrors.IsMethodNotSupported(err) {
+		t.Errorf("expected a create to be rejected with a 405, got %v", err)
+	}
+
+	if err := s.DynamicClient.Resource(priorityLevels).Delete(context.TODO(), "catch-all", metav1.DeleteOptions{}); !apierrors.IsMethodNotSupported(err) {
+		t.Errorf("expected a delete to be rejected with a 405, got %v", err)
+	}
+}
+
+func TestStartTestServerRuntimeConfigMetaKeys(t *testing.T) {
+	apiRegistration := "apiregistration.k8s.io/v1"
+	badIdea := badideav1alpha1.SchemeGroupVersion.String()
+	example := examplegroup.SchemeGroupVersion.String()
+
+	tests := []struct {
+		name              string
+		disableAggregator bool
+		runtimeConfig     map[string]string
+
+		expectedGroupVersions sets.String
+	}{
+		{
+			name:                  "all disabled but the aggregator",
+			runtimeConfig:         map[string]string{"api/all": "false", apiRegistration: "true"},
+			expectedGroupVersions: sets.NewString(apiRegistration),
+		},
+		{
+			name:                  "all disabled without the aggregator",
+			disableAggregator:     true,
+			runtimeConfig:         map[string]string{"api/all": "false"},
+			expectedGroupVersions: sets.NewString(),
+		},
+		{
+			name:                  "all disabled but CRDs",
+			disableAggregator:     true,
+			runtimeConfig:         map[string]string{"api/all": "false", "apiextensions.k8s.io/v1": "true"},
+			expectedGroupVersions: sets.NewString("apiextensions.k8s.io/v1"),
+		},
+		{
+			name:                  "beta disabled",
+			runtimeConfig:         map[string]string{"api/beta": "false"},
+			expectedGroupVersions: sets.NewString(apiRegistration, "apiextensions.k8s.io/v1", badIdea, example),
+		},
+		{
+			name:                  "GA disabled",
+			runtimeConfig:         map[string]string{"api/ga": "false", apiRegistration: "true"},
+			expectedGroupVersions: sets.NewString(apiRegistration, "apiregistration.k8s.io/v1beta1", badIdea),
+		},
+		{
+			name:              "alpha enabled",
+			disableAggregator: true,
+			runtimeConfig:     map[string]string{"api/alpha": "true"},
+			expectedGroupVersions: sets.NewString("apiextensions.k8s.io/v1", "apiextensions.k8s.io/v1beta1", badIdea, example,
+				"flowcontrol.apiserver.k8s.io/v1alpha1"),
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			s := StartTestServer(t,
+				WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+				WithFeatureGates(map[string]bool{string(features.BadIdeaInstanceStatus): true}),
+				WithRuntimeConfig(test.runtimeConfig),
+				WithServerRunOptions(func(o *options.ServerRunOptions) {
+					o.DisableAggregator = test.disableAggregator
+				}))
+
+			groupVersions := sets.NewString()
+
+			// the aggregator picks up the groups of the chain from their APIServices
+			if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				groups, err := s.APIExtensionsClient.Discovery().ServerGroups()
+				if err != nil {
+					return false, err
+				}
+
+				groupVersions = sets.NewString()
+				for _, group := range groups.Groups {
+					for _, version := range group.Versions {
+						groupVersions.Insert(version.GroupVersion)
+					}
+				}
+
+				return groupVersions.Equal(test.expectedGroupVersions), nil
+			}); err != nil {
+				t.Errorf("expected group versions %v, got %v", test.expectedGroupVersions.List(), groupVersions.List())
+			}
+
+			if _, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/healthz").DoRaw(context.TODO()); err != nil {
+				t.Errorf("expected the server to be healthy: %v", err)
+			}
+		})
+	}
+}
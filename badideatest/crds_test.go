@@ -0,0 +1,1214 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badideatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/options"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/endpoints/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/component-base/metrics/testutil"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	aggregatorclientset "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+)
+
+func TestStartTestServerStorageMetrics(t *testing.T) {
+	// a CRD of its own, so the metrics of the servers of other tests sharing the registry do not count
+	s := StartTestServer(t, WithCRDs(newExampleCRD("Gadget")), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.CountMetricPollPeriod = 100 * time.Millisecond
+	}))
+
+	gadgets := s.DynamicClient.Resource(schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "gadgets"}).Namespace("default")
+
+	for _, name := range []string{"one", "two"} {
+		createWhenServed(t, gadgets, newExampleObject("Gadget", name))
+	}
+
+	if err := gadgets.Delete(context.TODO(), "two", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete gadget: %v", err)
+	}
+
+	var metrics testutil.Metrics
+
+	// the object count is polled
+	err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		var err error
+
+		metrics, err = getMetrics(s)
+		if err != nil {
+			return false, err
+		}
+
+		counts := testutil.GetMetricValuesForLabel(metrics, "etcd_object_counts", "resource")
+
+		return counts["gadgets.example.com"] == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("expected etcd_object_counts of 1 for gadgets.example.com: %v", err)
+	}
+
+	if err := testutil.ValidateMetrics(metrics, "etcd_request_duration_seconds_count", "operation", "type"); err != nil {
+		t.Errorf("unexpected etcd_request_duration_seconds labels: %v", err)
+	}
+
+	operations := sets.NewString()
+	for _, sample := range metrics["etcd_request_duration_seconds_count"] {
+		if sample.Metric["type"] == "*unstructured.Unstructured" {
+			operations.Insert(string(sample.Metric["operation"]))
+		}
+	}
+
+	if expected := sets.NewString("create", "delete"); !operations.IsSuperset(expected) {
+		t.Errorf("expected etcd_request_duration_seconds for the %v operations on custom resources, got %v", expected.List(), operations.List())
+	}
+}
+
+func TestStartTestServerMetadataChecks(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.MaxAnnotationBytes = 1000
+		o.AnnotationSizeWarningBytes = 500
+	}))
+
+	client, recorder := newWarningClient(t, s)
+
+	widgets := client.Resource(widgetsResource).Namespace("default")
+	waitForServed(t, widgets)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		finalizers  []string
+
+		expectedInvalid  bool
+		expectedWarnings []string
+	}{
+		{
+			name:        "plain",
+			annotations: map[string]string{"note": "small"},
+		},
+		{
+			name:             "large annotations",
+			annotations:      map[string]string{"note": strings.Repeat("x", 600)},
+			expectedWarnings: []string{"metadata.annotations: the annotations total 604 bytes, close to the limit of 1000 bytes"},
+		},
+		{
+			name:            "annotations over the lowered limit",
+			annotations:     map[string]string{"note": strings.Repeat("x", 1000)},
+			expectedInvalid: true,
+		},
+		{
+			name:       "suspicious labels and finalizers",
+			labels:     map[string]string{"App": "gizmo", "app": "gizmo"},
+			finalizers: []string{"example.com/cleanup", "cleanup/widgets"},
+			expectedWarnings: []string{
+				`metadata.finalizers: the prefix of "cleanup/widgets" is no domain name, use a domain you own to avoid clashes with other controllers`,
+				"metadata.labels: the keys App, app differ only by case",
+			},
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			recorder.reset()
+
+			widget := newWidget("")
+			widget.SetGenerateName("widget-")
+			widget.SetAnnotations(test.annotations)
+			widget.SetLabels(test.labels)
+			widget.SetFinalizers(test.finalizers)
+
+			created, err := widgets.Create(context.TODO(), widget, metav1.CreateOptions{})
+			if test.expectedInvalid {
+				if !apierrors.IsInvalid(err) {
+					t.Fatalf("expected an invalid error, got %v", err)
+				}
+
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if warnings := recorder.reset(); !reflect.DeepEqual(warnings, test.expectedWarnings) {
+				t.Errorf("expected warnings %q, got %q", test.expectedWarnings, warnings)
+			}
+
+			if len(test.finalizers) > 0 {
+				// leave nothing behind that blocks the deletion of the widget
+				created.SetFinalizers(nil)
+				if _, err := widgets.Update(context.TODO(), created, metav1.UpdateOptions{}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStartTestServerStorageQuota(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.CountMetricPollPeriod = 100 * time.Millisecond
+		o.MaxStoredObjects = 30
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	createWidget := func(name string) error {
+		_, err := widgets.Create(context.TODO(), newWidget(name), metav1.CreateOptions{})
+
+		return err
+	}
+
+	// the object counts are polled, so the quota is only noticed a moment after it is reached
+	var rejected error
+
+	for i := 0; rejected == nil; i++ {
+		if i == 100 {
+			t.Fatal("expected creates to be rejected past the quota")
+		}
+
+		if err := createWidget(fmt.Sprintf("widget-%d", i)); err != nil {
+			if !apierrors.IsNotFound(err) {
+				rejected = err
+			}
+
+			continue
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var status apierrors.APIStatus
+	if !errors.As(rejected, &status) || status.Status().Code != http.StatusInsufficientStorage || !strings.Contains(status.Status().Message, "its quota is 30 objects") {
+		t.Fatalf("expected a 507 naming the quota, got %v", rejected)
+	}
+
+	result := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(context.TODO())
+	if err := result.Error(); err != nil {
+		t.Fatalf("expected the server to stay ready: %v", err)
+	}
+
+	if warnings := result.Warnings(); len(warnings) == 0 || !strings.Contains(warnings[0].Text, "of its quota of 30 objects") {
+		t.Errorf("expected /readyz to warn about the quota, got %v", warnings)
+	}
+
+	if err := widgets.DeleteCollection(context.TODO(), metav1.DeleteOptions{}, metav1.ListOptions{}); err != nil {
+		t.Fatalf("expected deletes to be served past the quota: %v", err)
+	}
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		err := createWidget("sprocket")
+		if apierrors.ReasonForError(err) == "InsufficientStorage" {
+			return false, nil
+		}
+
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("expected creates to be accepted again once objects are deleted: %v", err)
+	}
+}
+
+func TestStartTestServerCRDObjectLimit(t *testing.T) {
+	crd := newWidgetCRD()
+	crd.Annotations = map[string]string{"badidea.x-k8s.io/max-objects": "3"}
+
+	s := StartTestServer(t, WithCRDs(crd), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.CountMetricPollPeriod = 100 * time.Millisecond
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	createWidget := func(name string) error {
+		_, err := widgets.Create(context.TODO(), newWidget(name), metav1.CreateOptions{})
+
+		return err
+	}
+
+	// the object counts are polled, so the limit is only enforced once the first count is in
+	var (
+		rejected error
+		created  int
+	)
+
+	for i := 0; rejected == nil; i++ {
+		if i == 100 {
+			t.Fatal("expected creates to be rejected past the limit")
+		}
+
+		if err := createWidget(fmt.Sprintf("widget-%d", i)); err != nil {
+			if !apierrors.IsNotFound(err) {
+				rejected = err
+			}
+
+			continue
+		}
+
+		created++
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if !apierrors.IsForbidden(rejected) || !strings.Contains(rejected.Error(), "limits them to 3") {
+		t.Fatalf("expected a 403 naming the limit, got %v", rejected)
+	}
+
+	// the limit is overshot by its slack of one object at most
+	if created < 3 || created > 4 {
+		t.Errorf("expected 3 or 4 widgets to be created, got %d", created)
+	}
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		metrics, err := getMetrics(s)
+		if err != nil {
+			return false, err
+		}
+
+		objects := testutil.GetMetricValuesForLabel(metrics, "badidea_crd_objects", "resource")
+		maxObjects := testutil.GetMetricValuesForLabel(metrics, "badidea_crd_max_objects", "resource")
+
+		return objects["widgets.example.com"] == int64(created) && maxObjects["widgets.example.com"] == 3, nil
+	}); err != nil {
+		t.Errorf("expected badidea_crd_objects of %d and badidea_crd_max_objects of 3 for widgets.example.com: %v", created, err)
+	}
+
+	// raising the limit takes effect at once
+	crds := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions()
+
+	current, err := crds.Get(context.TODO(), crd.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get the CRD: %v", err)
+	}
+
+	current.Annotations["badidea.x-k8s.io/max-objects"] = "10"
+
+	if _, err := crds.Update(context.TODO(), current, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update the CRD: %v", err)
+	}
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		err := createWidget("sprocket")
+		if apierrors.IsForbidden(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("expected creates to be accepted once the limit is raised: %v", err)
+	}
+}
+
+func TestStartTestServerUserAnnotations(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithFeatureGates(map[string]bool{string(features.BadIdeaUserAnnotations): true}))
+
+	gvr := widgetsResource
+
+	widgetsAs := func(userName string) dynamic.ResourceInterface {
+		config := rest.CopyConfig(s.ClientConfig)
+		// without RBAC, only the anonymous user and system:masters are authorized
+		config.Impersonate = rest.ImpersonationConfig{UserName: userName, Groups: []string{"system:masters"}}
+
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return client.Resource(gvr).Namespace("default")
+	}
+
+	expectAnnotations := func(widget *unstructured.Unstructured, createdBy, updatedBy string) {
+		t.Helper()
+
+		annotations := widget.GetAnnotations()
+		if annotations["badidea.x-k8s.io/created-by"] != createdBy || annotations["badidea.x-k8s.io/updated-by"] != updatedBy {
+			t.Errorf("expected the widget to be created by %q and updated by %q, got annotations %v", createdBy, updatedBy, annotations)
+		}
+	}
+
+	// clients cannot spoof the annotations
+	widget := newWidget("sprocket")
+	widget.SetAnnotations(map[string]string{"badidea.x-k8s.io/created-by": "mallory", "badidea.x-k8s.io/updated-by": "mallory"})
+
+	created := createWhenServed(t, widgetsAs("alice"), widget)
+	expectAnnotations(created, "alice", "alice")
+
+	created.SetAnnotations(map[string]string{"badidea.x-k8s.io/created-by": "mallory"})
+
+	updated, err := widgetsAs("bob").Update(context.TODO(), created, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("failed to update widget: %v", err)
+	}
+
+	expectAnnotations(updated, "alice", "bob")
+
+	// the loopback clients leave the annotations alone
+	loopback, err := s.Server.DynamicClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated.SetLabels(map[string]string{"app": "test"})
+
+	updated, err = loopback.Resource(gvr).Namespace("default").Update(context.TODO(), updated, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("failed to update widget: %v", err)
+	}
+
+	expectAnnotations(updated, "alice", "bob")
+}
+
+func TestStartTestServerGarbageCollector(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection = true
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	// createFamily creates a widget and a child widget it owns
+	createFamily := func(name string) {
+		parent, err := widgets.Create(context.TODO(), newWidget(name), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("failed to create widget %s: %v", name, err)
+		}
+
+		child := newOwnedWidget(name+"-child", parent, true)
+		if _, err := widgets.Create(context.TODO(), child, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create widget %s: %v", child.GetName(), err)
+		}
+	}
+
+	deleteWidget := func(name string, propagationPolicy metav1.DeletionPropagation) {
+		if err := widgets.Delete(context.TODO(), name, metav1.DeleteOptions{PropagationPolicy: &propagationPolicy}); err != nil {
+			t.Fatalf("failed to delete widget %s: %v", name, err)
+		}
+	}
+
+	createFamily("background")
+	deleteWidget("background", metav1.DeletePropagationBackground)
+	waitForDeletion(t, widgets, "background")
+	waitForDeletion(t, widgets, "background-child")
+
+	// the owner is only gone once its blocking dependent is
+	createFamily("foreground")
+	deleteWidget("foreground", metav1.DeletePropagationForeground)
+	waitForDeletion(t, widgets, "foreground")
+	waitForDeletion(t, widgets, "foreground-child")
+
+	createFamily("orphan")
+	deleteWidget("orphan", metav1.DeletePropagationOrphan)
+	waitForDeletion(t, widgets, "orphan")
+
+	child, err := widgets.Get(context.TODO(), "orphan-child", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the orphaned widget to be kept: %v", err)
+	}
+
+	if owners := child.GetOwnerReferences(); len(owners) != 0 {
+		t.Errorf("expected the orphaned widget to have no owners, got %v", owners)
+	}
+}
+
+func TestStartTestServerWatchCompaction(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.CompactionInterval = 2 * time.Second
+		o.Extensions.RecommendedOptions.Etcd.WatchCacheSizes = []string{"widgets.example.com#0"}
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	created, err := widgets.Create(context.TODO(), newWidget("gizmo"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create widget: %v", err)
+	}
+
+	// oldestResourceVersion returns the oldest resourceVersion to watch from stated by the error of a
+	// watch starting at resourceVersion, if it expired
+	oldestResourceVersion := func(resourceVersion int64) (int64, bool) {
+		w, err := widgets.Watch(context.TODO(), metav1.ListOptions{ResourceVersion: strconv.FormatInt(resourceVersion, 10)})
+		if err != nil {
+			t.Fatalf("failed to watch widgets: %v", err)
+		}
+		defer w.Stop()
+
+		var event watch.Event
+		select {
+		case event = <-w.ResultChan():
+		case <-time.After(500 * time.Millisecond):
+			return 0, false
+		}
+
+		status, ok := event.Object.(*metav1.Status)
+		if event.Type != watch.Error || !ok || status.Code != http.StatusGone {
+			t.Fatalf("expected the watch to start or fail with 410 Gone, got %#v", event)
+		}
+
+		var oldest int64
+		if i := strings.Index(status.Message, "; "); i < 0 {
+			t.Fatalf("expected the message to state the oldest resourceVersion, got %q", status.Message)
+		} else if _, err := fmt.Sscanf(status.Message[i+2:], "the oldest resourceVersion to watch from is %d", &oldest); err != nil {
+			t.Fatalf("expected the message to state the oldest resourceVersion, got %q", status.Message)
+		}
+
+		return oldest, true
+	}
+
+	first, err := strconv.ParseInt(created.GetResourceVersion(), 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected resourceVersion: %v", err)
+	}
+
+	// the compactor records a revision in its first round and compacts it in the next, every two seconds, so
+	// the oldest resourceVersion is only current for a moment
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		if _, err := widgets.Update(context.TODO(), created, metav1.UpdateOptions{}); err != nil && !apierrors.IsConflict(err) {
+			return false, err
+		}
+
+		oldest, expired := oldestResourceVersion(first)
+		if !expired {
+			return false, nil
+		}
+
+		if _, expired := oldestResourceVersion(oldest - 1); !expired {
+			t.Fatalf("expected a watch from before the oldest resourceVersion %d to expire", oldest)
+		}
+
+		// unless etcd was compacted again meanwhile
+		newer, expired := oldestResourceVersion(oldest)
+		if expired && newer == oldest {
+			t.Fatalf("expected a watch from the oldest resourceVersion %d to start", oldest)
+		}
+
+		return !expired, nil
+	}); err != nil {
+		t.Errorf("expected a watch from the oldest resourceVersion to start: %v", err)
+	}
+}
+
+func TestStartTestServerDryRun(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.MaxAnnotationBytes = 100
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+	waitForServed(t, widgets)
+
+	newAnnotatedWidget := func(name string, annotations map[string]string) *unstructured.Unstructured {
+		widget := newWidget(name)
+		widget.SetAnnotations(annotations)
+
+		return widget
+	}
+
+	dryRun := []string{metav1.DryRunAll}
+
+	// dry-run creates are not persisted
+	if _, err := widgets.Create(context.TODO(), newAnnotatedWidget("phantom", nil), metav1.CreateOptions{DryRun: dryRun}); err != nil {
+		t.Fatalf("failed to dry-run create: %v", err)
+	}
+
+	if _, err := widgets.Get(context.TODO(), "phantom", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the dry-run create not to be persisted, got %v", err)
+	}
+
+	// dry-run deletes leave the object
+	if _, err := widgets.Create(context.TODO(), newAnnotatedWidget("sprocket", nil), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create widget: %v", err)
+	}
+
+	if err := widgets.Delete(context.TODO(), "sprocket", metav1.DeleteOptions{DryRun: dryRun}); err != nil {
+		t.Fatalf("failed to dry-run delete: %v", err)
+	}
+
+	sprocket, err := widgets.Get(context.TODO(), "sprocket", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the widget to remain after a dry-run delete: %v", err)
+	}
+
+	// dry runs are checked like the requests, though they are not written to the storage
+	large := map[string]string{"note": strings.Repeat("x", 200)}
+
+	if _, err := widgets.Create(context.TODO(), newAnnotatedWidget("bloated", large), metav1.CreateOptions{DryRun: dryRun}); !apierrors.IsInvalid(err) {
+		t.Errorf("expected a dry-run create exceeding the annotation limit to be invalid, got %v", err)
+	}
+
+	sprocket.SetAnnotations(large)
+
+	if _, err := widgets.Update(context.TODO(), sprocket, metav1.UpdateOptions{DryRun: dryRun}); !apierrors.IsInvalid(err) {
+		t.Errorf("expected a dry-run update exceeding the annotation limit to be invalid, got %v", err)
+	}
+
+	aggregatorClient, err := aggregatorclientset.NewForConfig(s.ClientConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the core group is reserved, but not registered as an APIService, so there is none to conflict with
+	shadow := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1."},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Service:               &apiregistrationv1.ServiceReference{Namespace: "default", Name: "shadow"},
+			Version:               "v1",
+			InsecureSkipTLSVerify: true,
+			GroupPriorityMinimum:  100,
+			VersionPriority:       100,
+		},
+	}
+
+	_, err = aggregatorClient.ApiregistrationV1().APIServices().Create(context.TODO(), shadow, metav1.CreateOptions{DryRun: dryRun})
+	if !apierrors.IsInvalid(err) || !strings.Contains(err.Error(), "is served by this server") {
+		t.Errorf("expected a dry-run create of an APIService shadowing the server to be rejected, got %v", err)
+	}
+}
+
+func TestStartTestServerCRDVersions(t *testing.T) {
+	s := StartTestServer(t)
+
+	recorder := &warningRecorder{}
+
+	config := rest.CopyConfig(s.ClientConfig)
+	config.WarningHandler = recorder
+
+	client, err := apiextensionsclientset.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	crds := client.ApiextensionsV1().CustomResourceDefinitions()
+
+	// CRDs must serve a version
+	unserved := newWidgetCRD()
+	unserved.Spec.Versions[0].Served = false
+
+	if _, err := crds.Create(context.TODO(), unserved, metav1.CreateOptions{}); !apierrors.IsInvalid(err) {
+		t.Fatalf("expected a CRD serving no version to be invalid, got %v", err)
+	}
+
+	crd := newWidgetCRD()
+	v2 := *crd.Spec.Versions[0].DeepCopy()
+	v2.Name = "v2"
+	v2.Storage = false
+	crd.Spec.Versions = append(crd.Spec.Versions, v2)
+
+	if _, err := crds.Create(context.TODO(), crd, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create CRD: %v", err)
+	}
+
+	if warnings := recorder.reset(); len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+
+	update := func(served map[string]bool, dryRun []string) error {
+		return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			crd, err := crds.Get(context.TODO(), "widgets.example.com", metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			for i := range crd.Spec.Versions {
+				crd.Spec.Versions[i].Served = served[crd.Spec.Versions[i].Name]
+			}
+
+			_, err = crds.Update(context.TODO(), crd, metav1.UpdateOptions{DryRun: dryRun})
+
+			return err
+		})
+	}
+
+	// the last served version cannot be turned off, not even in a dry run
+	if err := update(map[string]bool{}, nil); !apierrors.IsInvalid(err) {
+		t.Errorf("expected a CRD serving no version to be invalid, got %v", err)
+	}
+
+	if err := update(map[string]bool{}, []string{metav1.DryRunAll}); !apierrors.IsInvalid(err) {
+		t.Errorf("expected a dry run of a CRD serving no version to be invalid, got %v", err)
+	}
+
+	// turning off the storage version, which has stored objects, is allowed with warnings
+	if err := update(map[string]bool{"v2": true}, nil); err != nil {
+		t.Fatalf("failed to stop serving v1: %v", err)
+	}
+
+	expectedWarnings := []string{
+		"spec.versions: the storage version v1 is not served, so objects are stored in a version their clients cannot read back",
+		"spec.versions: v1 is no longer served but objects may still be stored in it, migrate them to the storage version and remove it from status.storedVersions before removing the version",
+	}
+	if warnings := recorder.reset(); !reflect.DeepEqual(warnings, expectedWarnings) {
+		t.Errorf("expected the warnings %q, got %q", expectedWarnings, warnings)
+	}
+
+	// versions with stored objects cannot be removed
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		crd, err := crds.Get(context.TODO(), "widgets.example.com", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		crd.Spec.Versions = crd.Spec.Versions[1:]
+		crd.Spec.Versions[0].Storage = true
+
+		_, err = crds.Update(context.TODO(), crd, metav1.UpdateOptions{})
+
+		return err
+	}); !apierrors.IsInvalid(err) {
+		t.Errorf("expected removing a stored version to be invalid, got %v", err)
+	}
+}
+
+func TestStartTestServerDeleteCollectionLimits(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Etcd.DeleteCollectionWorkers = 4
+		o.MaxDeleteCollectionObjects = 20
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	for i := 0; i < 30; i++ {
+		widget := newWidget(fmt.Sprintf("widget-%d", i))
+		widget.SetLabels(map[string]string{"batch": strconv.Itoa(i % 3)})
+
+		if _, err := widgets.Create(context.TODO(), widget, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create widget %d: %v", i, err)
+		}
+	}
+
+	count := func() int {
+		t.Helper()
+
+		list, err := widgets.List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("failed to list widgets: %v", err)
+		}
+
+		return len(list.Items)
+	}
+
+	err := widgets.DeleteCollection(context.TODO(), metav1.DeleteOptions{}, metav1.ListOptions{})
+	if !apierrors.IsRequestEntityTooLargeError(err) {
+		t.Fatalf("expected the deletecollection of 30 widgets to be rejected with a 413, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "would delete more than 20 objects") {
+		t.Errorf("expected the error to state the limit, got %q", err.Error())
+	}
+
+	if remaining := count(); remaining != 30 {
+		t.Fatalf("expected no widget to be deleted, %d are left", remaining)
+	}
+
+	// a page within the limit is deleted by the workers in parallel
+	if err := widgets.DeleteCollection(context.TODO(), metav1.DeleteOptions{}, metav1.ListOptions{Limit: 15}); err != nil {
+		t.Fatalf("failed to delete a page of widgets: %v", err)
+	}
+
+	if remaining := count(); remaining != 15 {
+		t.Errorf("expected 15 widgets to be left, got %d", remaining)
+	}
+
+	if err := widgets.DeleteCollection(context.TODO(), metav1.DeleteOptions{}, metav1.ListOptions{LabelSelector: "batch=0"}); err != nil {
+		t.Fatalf("failed to delete a batch of widgets: %v", err)
+	}
+
+	if err := widgets.DeleteCollection(context.TODO(), metav1.DeleteOptions{}, metav1.ListOptions{}); err != nil {
+		t.Fatalf("failed to delete the rest of the widgets: %v", err)
+	}
+
+	if remaining := count(); remaining != 0 {
+		t.Errorf("expected all widgets to be deleted, %d are left", remaining)
+	}
+
+	data, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/metrics").DoRaw(context.TODO())
+	if err != nil {
+		t.Fatalf("failed to get the metrics: %v", err)
+	}
+
+	// the servers of other tests deleting widgets share the metrics
+	for _, expected := range []string{
+		`badidea_delete_collection_duration_seconds_count{code="413",resource="widgets.example.com"}`,
+		`badidea_delete_collection_duration_seconds_count{code="200",resource="widgets.example.com"}`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected the metric %s", expected)
+		}
+	}
+}
+
+func TestStartTestServerLabelIndexes(t *testing.T) {
+	crd := newWidgetCRD()
+	crd.Annotations = map[string]string{"badidea.x-k8s.io/indexed-labels": "app"}
+
+	s := StartTestServer(t, WithCRDs(crd))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	for i := 0; i < 10; i++ {
+		widget := newWidget(fmt.Sprintf("widget-%d", i))
+		widget.SetLabels(map[string]string{"app": strconv.Itoa(i % 5), "tier": "web"})
+
+		if _, err := widgets.Create(context.TODO(), widget, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create widget %d: %v", i, err)
+		}
+	}
+
+	// lists from the watch cache select through the index of the app label
+	err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		list, err := widgets.List(context.TODO(), metav1.ListOptions{LabelSelector: "app=1,tier=web", ResourceVersion: "0"})
+		if err != nil {
+			return false, err
+		}
+
+		return len(list.Items) == 2, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the 2 widgets of app 1: %v", err)
+	}
+}
+
+func TestStartTestServerSelectableFields(t *testing.T) {
+	crd := newWidgetCRD()
+	crd.Annotations = map[string]string{"badidea.x-k8s.io/selectable-fields": ".spec.color"}
+
+	s := StartTestServer(t, WithCRDs(crd), WithFeatureGates(map[string]bool{string(features.BadIdeaCRDSelectableFields): true}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	newColoredWidget := func(name, color string) *unstructured.Unstructured {
+		widget := newWidget(name)
+		widget.Object["spec"] = map[string]interface{}{"color": color}
+
+		return widget
+	}
+
+	createWhenServed(t, widgets, newColoredWidget("widget-0", "red"))
+
+	for i, color := range []string{"blue", "red", "green"} {
+		if _, err := widgets.Create(context.TODO(), newColoredWidget(fmt.Sprintf("widget-%d", i+1), color), metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create widget %d: %v", i+1, err)
+		}
+	}
+
+	names := func(list *unstructured.UnstructuredList) []string {
+		result := []string{}
+		for _, item := range list.Items {
+			result = append(result, item.GetName())
+		}
+
+		return result
+	}
+
+	// from etcd, and from the watch cache through the index of the field
+	for _, resourceVersion := range []string{"", "0"} {
+		expected := []string{"widget-0", "widget-2"}
+
+		err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			list, err := widgets.List(context.TODO(), metav1.ListOptions{FieldSelector: "spec.color=red", ResourceVersion: resourceVersion})
+			if err != nil {
+				return false, err
+			}
+
+			return reflect.DeepEqual(names(list), expected), nil
+		})
+		if err != nil {
+			t.Errorf("resource version %q: expected the red widgets %v: %v", resourceVersion, expected, err)
+		}
+	}
+
+	list, err := widgets.List(context.TODO(), metav1.ListOptions{FieldSelector: "metadata.name!=widget-2,spec.color!=blue"})
+	if err != nil || !reflect.DeepEqual(names(list), []string{"widget-0", "widget-3"}) {
+		t.Errorf("expected the selector to combine with metadata fields, got %v, %v", list, err)
+	}
+
+	if _, err := widgets.List(context.TODO(), metav1.ListOptions{FieldSelector: "spec.size=3"}); !apierrors.IsBadRequest(err) {
+		t.Errorf("expected a selector on other fields to be rejected, got %v", err)
+	}
+
+	w, err := widgets.Watch(context.TODO(), metav1.ListOptions{FieldSelector: "spec.color=red", ResourceVersion: list.GetResourceVersion()})
+	if err != nil {
+		t.Fatalf("failed to watch the red widgets: %v", err)
+	}
+	defer w.Stop()
+
+	if _, err := widgets.Create(context.TODO(), newColoredWidget("widget-4", "blue"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create widget 4: %v", err)
+	}
+
+	if _, err := widgets.Create(context.TODO(), newColoredWidget("widget-5", "red"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create widget 5: %v", err)
+	}
+
+	// a widget turning blue leaves the selection
+	if _, err := widgets.Patch(context.TODO(), "widget-0", types.MergePatchType, []byte(`{"spec":{"color":"blue"}}`), metav1.PatchOptions{}); err != nil {
+		t.Fatalf("failed to patch widget 0: %v", err)
+	}
+
+	for _, expected := range []struct {
+		eventType watch.EventType
+		name      string
+	}{
+		{watch.Added, "widget-5"},
+		{watch.Deleted, "widget-0"},
+	} {
+		select {
+		case event := <-w.ResultChan():
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok || event.Type != expected.eventType || obj.GetName() != expected.name {
+				t.Fatalf("expected a %s event of %s, got %s %v", expected.eventType, expected.name, event.Type, event.Object)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected a %s event of %s", expected.eventType, expected.name)
+		}
+	}
+}
+
+func TestStartTestServerStorageVersionHash(t *testing.T) {
+	crd := newWidgetCRD()
+	v2 := *crd.Spec.Versions[0].DeepCopy()
+	v2.Name, v2.Storage = "v2", false
+	crd.Spec.Versions = append(crd.Spec.Versions, v2)
+
+	s := StartTestServer(t, WithCRDs(crd))
+
+	storageVersionHashes := func(groupVersion string) map[string]string {
+		t.Helper()
+
+		resources, err := s.APIExtensionsClient.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		if err != nil {
+			t.Fatalf("failed to discover %s: %v", groupVersion, err)
+		}
+
+		hashes := map[string]string{}
+		for _, resource := range resources.APIResources {
+			hashes[resource.Name] = resource.StorageVersionHash
+		}
+
+		return hashes
+	}
+
+	expected := map[string]string{
+		"apiextensions.k8s.io/v1":   discovery.StorageVersionHash("apiextensions.k8s.io", "v1beta1", "CustomResourceDefinition"),
+		"apiregistration.k8s.io/v1": discovery.StorageVersionHash("apiregistration.k8s.io", "v1beta1", "APIService"),
+		"example.com/v1":            discovery.StorageVersionHash("example.com", "v1", "Widget"),
+		"example.com/v2":            discovery.StorageVersionHash("example.com", "v1", "Widget"),
+	}
+
+	for groupVersion, hash := range expected {
+		hashes := storageVersionHashes(groupVersion)
+		for resource, actual := range hashes {
+			if strings.Contains(resource, "/") {
+				continue
+			}
+
+			if actual != hash {
+				t.Errorf("%s %s: expected the storage version hash %q, got %q", groupVersion, resource, hash, actual)
+			}
+		}
+	}
+
+	crds := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions()
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		crd, err := crds.Get(context.TODO(), "widgets.example.com", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		crd.Spec.Versions[0].Storage, crd.Spec.Versions[1].Storage = false, true
+		_, err = crds.Update(context.TODO(), crd, metav1.UpdateOptions{})
+
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to switch the storage version: %v", err)
+	}
+
+	v2Hash := discovery.StorageVersionHash("example.com", "v2", "Widget")
+
+	err = wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return storageVersionHashes("example.com/v1")["widgets"] == v2Hash && storageVersionHashes("example.com/v2")["widgets"] == v2Hash, nil
+	})
+	if err != nil {
+		t.Errorf("expected the storage version hash to change to %q, got %v", v2Hash, storageVersionHashes("example.com/v1"))
+	}
+}
+
+func TestStartTestServerCRDTenancy(t *testing.T) {
+	tests := []struct {
+		name              string
+		disableAggregator bool
+	}{
+		{name: "aggregator"},
+		// the spec of the CRDs is only published without the aggregator
+		{name: "without aggregator", disableAggregator: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			testCRDTenancy(t, test.disableAggregator)
+		})
+	}
+}
+
+func testCRDTenancy(t *testing.T, disableAggregator bool) {
+	widgets := newWidgetCRD()
+	widgets.Labels = map[string]string{"badidea.x-k8s.io/tenant": "team-a"}
+
+	gadgets := newExampleCRD("Gadget")
+	gadgets.Name, gadgets.Spec.Group = "gadgets.team-b.example.com", "team-b.example.com"
+	gadgets.Labels = map[string]string{"badidea.x-k8s.io/tenant": "team-b"}
+
+	s := StartTestServer(t, WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.AuthorizationMode = options.AuthorizationModeAlwaysAllow
+		o.EnableCRDTenancy = true
+		o.DisableAggregator = disableAggregator
+	}))
+
+	// the test client is anonymous, which is not a member of the tenants
+	adminConfig := rest.CopyConfig(s.ClientConfig)
+	adminConfig.Impersonate = rest.ImpersonationConfig{UserName: "admin", Groups: []string{"system:masters"}}
+
+	adminClient, err := apiextensionsclientset.NewForConfig(adminConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, crd := range []*apiextensionsv1.CustomResourceDefinition{widgets, gadgets} {
+		if err := createCRD(adminClient, crd); err != nil {
+			t.Fatalf("failed to create CRD %s: %v", crd.Name, err)
+		}
+	}
+
+	gadgetsResource := schema.GroupVersionResource{Group: "team-b.example.com", Version: "v1", Resource: "gadgets"}
+
+	tenants := []struct {
+		user   string
+		groups []string
+
+		visible schema.GroupVersionResource
+		hidden  schema.GroupVersionResource
+	}{
+		{user: "alice", groups: []string{"team-a"}, visible: widgetsResource, hidden: gadgetsResource},
+		{user: "bob", groups: []string{"team-b"}, visible: gadgetsResource, hidden: widgetsResource},
+	}
+
+	for _, tenant := range tenants {
+		config := rest.CopyConfig(s.ClientConfig)
+		config.Impersonate = rest.ImpersonationConfig{UserName: tenant.user, Groups: tenant.groups}
+
+		client, err := apiextensionsclientset.NewForConfig(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// the CRDs are discovered asynchronously
+		var names sets.String
+		err = wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			groups, err := client.Discovery().ServerGroups()
+			if err != nil {
+				return false, err
+			}
+
+			names = sets.NewString()
+			for _, group := range groups.Groups {
+				names.Insert(group.Name)
+			}
+
+			return names.Has(tenant.visible.Group), nil
+		})
+		if err != nil || names.Has(tenant.hidden.Group) {
+			t.Errorf("%s: expected to see %s but not %s in /apis, got %v: %v", tenant.user, tenant.visible.Group, tenant.hidden.Group, names.List(), err)
+		}
+
+		if _, err := client.Discovery().ServerResourcesForGroupVersion(tenant.hidden.GroupVersion().String()); !apierrors.IsNotFound(err) {
+			t.Errorf("%s: expected the discovery of %s not to be found, got %v", tenant.user, tenant.hidden.GroupVersion(), err)
+		}
+
+		var spec []byte
+		err = wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			spec, err = client.Discovery().RESTClient().Get().AbsPath("/openapi/v2").DoRaw(context.TODO())
+			if err != nil {
+				return false, err
+			}
+
+			return !disableAggregator || strings.Contains(string(spec), "/apis/"+tenant.visible.Group+"/"), nil
+		})
+		if err != nil {
+			t.Errorf("%s: expected the OpenAPI spec to hold the paths of %s, got %v", tenant.user, tenant.visible.Group, err)
+		}
+
+		if strings.Contains(string(spec), "/apis/"+tenant.hidden.Group+"/") {
+			t.Errorf("%s: expected the OpenAPI spec not to hold the paths of %s", tenant.user, tenant.hidden.Group)
+		}
+
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := dynamicClient.Resource(tenant.visible).Namespace("default").List(context.TODO(), metav1.ListOptions{}); err != nil {
+			t.Errorf("%s: expected to list %s, got %v", tenant.user, tenant.visible, err)
+		}
+
+		if _, err := dynamicClient.Resource(tenant.hidden).Namespace("default").List(context.TODO(), metav1.ListOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected listing %s to be forbidden, got %v", tenant.user, tenant.hidden, err)
+		}
+
+		if _, err := dynamicClient.Resource(tenant.hidden).Namespace("default").Get(context.TODO(), "sprocket", metav1.GetOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected getting %s to be forbidden, got %v", tenant.user, tenant.hidden, err)
+		}
+
+		crds := client.ApiextensionsV1().CustomResourceDefinitions()
+		if _, err := crds.Get(context.TODO(), tenant.hidden.Resource+"."+tenant.hidden.Group, metav1.GetOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected getting the CRD of %s to be forbidden, got %v", tenant.user, tenant.hidden, err)
+		}
+
+		if _, err := crds.List(context.TODO(), metav1.ListOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected listing the CRDs to be forbidden, got %v", tenant.user, err)
+		}
+
+		if disableAggregator {
+			continue
+		}
+
+		// the APIServices registered for the CRD groups would reveal the groups of other tenants
+		aggregatorClient, err := aggregatorclientset.NewForConfig(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		apiServices := aggregatorClient.ApiregistrationV1().APIServices()
+		if _, err := apiServices.List(context.TODO(), metav1.ListOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected listing the APIServices to be forbidden, got %v", tenant.user, err)
+		}
+
+		if _, err := apiServices.Get(context.TODO(), tenant.hidden.Version+"."+tenant.hidden.Group, metav1.GetOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("%s: expected getting the APIService of %s to be forbidden, got %v", tenant.user, tenant.hidden.Group, err)
+		}
+
+		if _, err := apiServices.Get(context.TODO(), tenant.visible.Version+"."+tenant.visible.Group, metav1.GetOptions{}); err != nil {
+			t.Errorf("%s: expected to get the APIService of %s, got %v", tenant.user, tenant.visible.Group, err)
+		}
+	}
+
+	groups, err := adminClient.Discovery().ServerGroups()
+	if err != nil {
+		t.Fatalf("failed to discover the groups: %v", err)
+	}
+
+	names := sets.NewString()
+	for _, group := range groups.Groups {
+		names.Insert(group.Name)
+	}
+
+	if !names.HasAll(widgetsResource.Group, gadgetsResource.Group) {
+		t.Errorf("expected system:masters to see every tenant, got %v", names.List())
+	}
+
+	if _, err := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), widgets.Name, metav1.GetOptions{}); !apierrors.IsForbidden(err) {
+		t.Errorf("expected anonymous requests to be forbidden across tenants, got %v", err)
+	}
+}
+
+func TestStartTestServerResponseCompression(t *testing.T) {
+	tests := []struct {
+		name         string
+		uncompressed []string
+
+		expectedEncoding string
+	}{
+		{name: "compression enabled", expectedEncoding: "gzip"},
+		{name: "compression disabled", uncompressed: []string{"sprockets.example.com"}},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			// the aggregator fronts the custom resources, so their responses pass its handler chain
+			s := StartTestServer(t, WithCRDs(newExampleCRD("Sprocket")), WithServerRunOptions(func(o *options.ServerRunOptions) {
+				o.DisableResponseCompressionFor = test.uncompressed
+			}))
+
+			sprockets := s.DynamicClient.Resource(schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "sprockets"}).Namespace("default")
+
+			// the endpoint handlers only compress responses larger than 128 KiB
+			for i := 0; i < 4; i++ {
+				sprocket := newExampleObject("Sprocket", fmt.Sprintf("sprocket-%d", i))
+				sprocket.Object["data"] = strings.Repeat("teeth ", 10000)
+
+				createWhenServed(t, sprockets, sprocket)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, s.ClientConfig.Host+"/apis/example.com/v1/namespaces/default/sprockets", nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// set explicitly, the transport does not decompress the response
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			resp, err := newHTTPClient(t, s).Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if _, err := ioutil.ReadAll(resp.Body); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != test.expectedEncoding {
+				t.Fatalf("expected a 200 with Content-Encoding %q, got %d with %q", test.expectedEncoding, resp.StatusCode, resp.Header.Get("Content-Encoding"))
+			}
+
+			if test.expectedEncoding == "" {
+				return
+			}
+
+			metrics, err := getMetrics(s)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			saved := testutil.GetMetricValuesForLabel(metrics, "badidea_response_compression_saved_bytes_total", "resource")
+			if saved["sprockets.example.com"] <= 0 {
+				t.Errorf("expected badidea_response_compression_saved_bytes_total for sprockets.example.com, got %v", saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package examplegroup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/registry/rest"
+)
+
+const (
+	// LogLines is the number of lines of the log of a gadget.
+	LogLines = 20
+	// LogInterval is the time between the lines of the log of a gadget, so that it streams for a
+	// while like the log of a pod.
+	LogInterval = 100 * time.Millisecond
+)
+
+// LogREST streams the log of gadgets, a long-running request like the log of a pod.
+type LogREST struct {
+	gadgets *REST
+}
+
+var _ rest.Getter = &LogREST{}
+
+func (r *LogREST) New() runtime.Object {
+	return &Gadget{}
+}
+
+func (r *LogREST) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+	if _, err := r.gadgets.Get(ctx, name, options); err != nil {
+		return nil, err
+	}
+
+	return &gadgetLog{name: name}, nil
+}
+
+// gadgetLog is the log of a gadget, streamed a line every LogInterval.
+type gadgetLog struct {
+	metav1.TypeMeta
+
+	name string
+}
+
+var _ rest.ResourceStreamer = &gadgetLog{}
+
+func (l *gadgetLog) DeepCopyObject() runtime.Object {
+	return &gadgetLog{TypeMeta: l.TypeMeta, name: l.name}
+}
+
+// InputStream implements rest.ResourceStreamer.
+func (l *gadgetLog) InputStream(ctx context.Context, apiVersion, acceptHeader string) (io.ReadCloser, bool, string, error) {
+	reader, writer := io.Pipe()
+
+	go func() {
+		for i := 1; i <= LogLines; i++ {
+			if _, err := fmt.Fprintf(writer, "%s: line %d\n", l.name, i); err != nil {
+				return
+			}
+
+			if i < LogLines {
+				select {
+				case <-ctx.Done():
+					writer.CloseWithError(ctx.Err())
+					return
+				case <-time.After(LogInterval):
+				}
+			}
+		}
+
+		writer.Close()
+	}()
+
+	return reader, true, "text/plain", nil
+}
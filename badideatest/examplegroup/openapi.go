@@ -0,0 +1,96 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package examplegroup
+
+import (
+	"github.com/go-openapi/spec"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+const pkg = "github.com/thetirefire/badidea/badideatest/examplegroup."
+
+// GetOpenAPIDefinitions returns the OpenAPI definitions of the types of the example group, written
+// by hand in the shape openapi-gen generates.
+func GetOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
+	return map[string]common.OpenAPIDefinition{
+		pkg + "Gadget": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "Gadget is a cluster-scoped example resource.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kind":       stringProperty("Kind is a string value representing the REST resource this object represents."),
+						"apiVersion": stringProperty("APIVersion defines the versioned schema of this representation of an object."),
+						"metadata": {
+							SchemaProps: spec.SchemaProps{Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta")},
+						},
+						"spec": {
+							SchemaProps: spec.SchemaProps{Ref: ref(pkg + "GadgetSpec")},
+						},
+					},
+				},
+			},
+			Dependencies: []string{"k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta", pkg + "GadgetSpec"},
+		},
+		pkg + "GadgetSpec": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "GadgetSpec is the desired state of a Gadget.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"size": {
+							SchemaProps: spec.SchemaProps{
+								Description: "Size is the size of the gadget.",
+								Type:        []string{"integer"},
+								Format:      "int64",
+							},
+						},
+					},
+				},
+			},
+		},
+		pkg + "GadgetList": {
+			Schema: spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: "GadgetList is a list of Gadgets.",
+					Type:        []string{"object"},
+					Properties: map[string]spec.Schema{
+						"kind":       stringProperty("Kind is a string value representing the REST resource this object represents."),
+						"apiVersion": stringProperty("APIVersion defines the versioned schema of this representation of an object."),
+						"metadata": {
+							SchemaProps: spec.SchemaProps{Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ListMeta")},
+						},
+						"items": {
+							SchemaProps: spec.SchemaProps{
+								Type: []string{"array"},
+								Items: &spec.SchemaOrArray{
+									Schema: &spec.Schema{SchemaProps: spec.SchemaProps{Ref: ref(pkg + "Gadget")}},
+								},
+							},
+						},
+					},
+					Required: []string{"items"},
+				},
+			},
+			Dependencies: []string{"k8s.io/apimachinery/pkg/apis/meta/v1.ListMeta", pkg + "Gadget"},
+		},
+	}
+}
+
+func stringProperty(description string) spec.Schema {
+	return spec.Schema{SchemaProps: spec.SchemaProps{Description: description, Type: []string{"string"}}}
+}
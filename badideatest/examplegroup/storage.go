@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package examplegroup
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/thetirefire/badidea/apiserver"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+)
+
+var gadgetsResource = SchemeGroupVersion.WithResource("gadgets").GroupResource()
+
+var errResourceVersionChanged = errors.New("the object has been modified; please apply your changes to the latest version and try again")
+
+// Priorities are the discovery priorities of the example group.
+var Priorities = map[schema.GroupVersion]apiserver.Priority{
+	SchemeGroupVersion: {Group: 1500, Version: 15},
+}
+
+// NewAPIGroupInfo returns the example group, serving gadgets from memory.
+func NewAPIGroupInfo() genericapiserver.APIGroupInfo {
+	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(GroupName, Scheme, runtime.NewParameterCodec(Scheme), Codecs)
+	apiGroupInfo.VersionedResourcesStorageMap[SchemeGroupVersion.Version] = newStorage()
+
+	return apiGroupInfo
+}
+
+// NewAPIGroupInfoWithoutScheme returns the example group without a scheme, to be served with the
+// scheme of the chain once AddToScheme is registered with it.
+func NewAPIGroupInfoWithoutScheme() genericapiserver.APIGroupInfo {
+	return genericapiserver.APIGroupInfo{
+		PrioritizedVersions: []schema.GroupVersion{SchemeGroupVersion},
+		VersionedResourcesStorageMap: map[string]map[string]rest.Storage{
+			SchemeGroupVersion.Version: newStorage(),
+		},
+	}
+}
+
+// newStorage returns the storage of gadgets and their log.
+func newStorage() map[string]rest.Storage {
+	gadgets := newREST()
+
+	return map[string]rest.Storage{
+		"gadgets":     gadgets,
+		"gadgets/log": &LogREST{gadgets: gadgets},
+	}
+}
+
+// REST stores gadgets in memory.
+type REST struct {
+	rest.TableConvertor
+
+	lock            sync.Mutex
+	gadgets         map[string]*Gadget
+	resourceVersion uint64
+}
+
+var (
+	_ rest.Getter          = &REST{}
+	_ rest.Lister          = &REST{}
+	_ rest.Creater         = &REST{}
+	_ rest.Updater         = &REST{}
+	_ rest.GracefulDeleter = &REST{}
+)
+
+func newREST() *REST {
+	return &REST{
+		TableConvertor: rest.NewDefaultTableConvertor(gadgetsResource),
+		gadgets:        map[string]*Gadget{},
+	}
+}
+
+func (r *REST) New() runtime.Object {
+	return &Gadget{}
+}
+
+func (r *REST) NewList() runtime.Object {
+	return &GadgetList{}
+}
+
+func (r *REST) NamespaceScoped() bool {
+	return false
+}
+
+func (r *REST) Get(ctx context.Context, name string, options *metav1.GetOptions) (runtime.Object, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	gadget, ok := r.gadgets[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(gadgetsResource, name)
+	}
+
+	return gadget.DeepCopy(), nil
+}
+
+func (r *REST) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	selector := labels.Everything()
+	if options != nil && options.LabelSelector != nil {
+		selector = options.LabelSelector
+	}
+
+	list := &GadgetList{ListMeta: metav1.ListMeta{ResourceVersion: strconv.FormatUint(r.resourceVersion, 10)}}
+
+	for _, gadget := range r.gadgets {
+		if selector.Matches(labels.Set(gadget.Labels)) {
+			list.Items = append(list.Items, *gadget.DeepCopy())
+		}
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	return list, nil
+}
+
+func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions) (runtime.Object, error) {
+	gadget := obj.(*Gadget).DeepCopy()
+	if gadget.Name == "" {
+		return nil, apierrors.NewBadRequest("metadata.name is required")
+	}
+
+	if createValidation != nil {
+		if err := createValidation(ctx, gadget); err != nil {
+			return nil, err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.gadgets[gadget.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(gadgetsResource, gadget.Name)
+	}
+
+	gadget.UID = uuid.NewUUID()
+	gadget.CreationTimestamp = metav1.Now()
+	r.store(gadget)
+
+	return gadget.DeepCopy(), nil
+}
+
+func (r *REST) Update(ctx context.Context, name string, objInfo rest.UpdatedObjectInfo, createValidation rest.ValidateObjectFunc, updateValidation rest.ValidateObjectUpdateFunc, forceAllowCreate bool, options *metav1.UpdateOptions) (runtime.Object, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	old, ok := r.gadgets[name]
+	if !ok {
+		return nil, false, apierrors.NewNotFound(gadgetsResource, name)
+	}
+
+	obj, err := objInfo.UpdatedObject(ctx, old.DeepCopy())
+	if err != nil {
+		return nil, false, err
+	}
+
+	gadget := obj.(*Gadget).DeepCopy()
+	if gadget.ResourceVersion != "" && gadget.ResourceVersion != old.ResourceVersion {
+		return nil, false, apierrors.NewConflict(gadgetsResource, name, errResourceVersionChanged)
+	}
+
+	if updateValidation != nil {
+		if err := updateValidation(ctx, gadget, old); err != nil {
+			return nil, false, err
+		}
+	}
+
+	gadget.UID = old.UID
+	gadget.CreationTimestamp = old.CreationTimestamp
+	r.store(gadget)
+
+	return gadget.DeepCopy(), false, nil
+}
+
+func (r *REST) Delete(ctx context.Context, name string, deleteValidation rest.ValidateObjectFunc, options *metav1.DeleteOptions) (runtime.Object, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	gadget, ok := r.gadgets[name]
+	if !ok {
+		return nil, false, apierrors.NewNotFound(gadgetsResource, name)
+	}
+
+	if deleteValidation != nil {
+		if err := deleteValidation(ctx, gadget); err != nil {
+			return nil, false, err
+		}
+	}
+
+	delete(r.gadgets, name)
+
+	return gadget, true, nil
+}
+
+// store saves gadget with the next resource version. The lock has to be held.
+func (r *REST) store(gadget *Gadget) {
+	r.resourceVersion++
+	gadget.ResourceVersion = strconv.FormatUint(r.resourceVersion, 10)
+	r.gadgets[gadget.Name] = gadget
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package examplegroup is a minimal API group implemented in-process, for tests of API groups added
+// with badideatest.WithAPIGroup. It serves cluster-scoped Gadgets from memory, and their log.
+package examplegroup
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+// GroupName is the name of the example group.
+const GroupName = "example.badidea.dev"
+
+// SchemeGroupVersion is the only version of the example group.
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
+
+var (
+	// Scheme holds the types of the example group, as versioned and internal types alike.
+	Scheme = runtime.NewScheme()
+	// Codecs serves the types of Scheme.
+	Codecs = serializer.NewCodecFactory(Scheme)
+)
+
+func init() {
+	if err := AddToScheme(Scheme); err != nil {
+		panic(err)
+	}
+
+	// the options and types the endpoints use whatever the group
+	metav1.AddToGroupVersion(Scheme, schema.GroupVersion{Version: "v1"})
+	unversioned := schema.GroupVersion{Group: "", Version: "v1"}
+	Scheme.AddUnversionedTypes(unversioned, &metav1.Status{}, &metav1.APIVersions{}, &metav1.APIGroupList{}, &metav1.APIGroup{}, &metav1.APIResourceList{})
+}
+
+// AddToScheme registers the types of the example group with scheme, as versioned and internal types.
+func AddToScheme(scheme *runtime.Scheme) error {
+	for _, gv := range []schema.GroupVersion{SchemeGroupVersion, {Group: GroupName, Version: runtime.APIVersionInternal}} {
+		scheme.AddKnownTypes(gv, &Gadget{}, &GadgetList{})
+	}
+
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+
+	return nil
+}
+
+// Gadget is a cluster-scoped example resource.
+type Gadget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GadgetSpec `json:"spec,omitempty"`
+}
+
+// GadgetSpec is the desired state of a Gadget.
+type GadgetSpec struct {
+	// Size is the size of the gadget.
+	Size int64 `json:"size,omitempty"`
+}
+
+// GadgetList is a list of Gadgets.
+type GadgetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Gadget `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *Gadget) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopy copies the Gadget.
+func (in *Gadget) DeepCopy() *Gadget {
+	if in == nil {
+		return nil
+	}
+
+	out := &Gadget{TypeMeta: in.TypeMeta, Spec: in.Spec}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *GadgetList) DeepCopyObject() runtime.Object {
+	if in == nil {
+		return nil
+	}
+
+	out := &GadgetList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+
+	if in.Items != nil {
+		out.Items = make([]Gadget, len(in.Items))
+		for i := range in.Items {
+			out.Items[i] = *in.Items[i].DeepCopy()
+		}
+	}
+
+	return out
+}
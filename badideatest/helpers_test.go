@@ -0,0 +1,245 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badideatest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/etcd"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// widgetsResource is the resource of the CRD of newWidgetCRD.
+var widgetsResource = schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+
+// newWidgetCRD returns the CRD of the widgets of example.com.
+func newWidgetCRD() *apiextensionsv1.CustomResourceDefinition {
+	return newExampleCRD("Widget")
+}
+
+// newExampleCRD returns the CRD of a namespaced kind of example.com/v1 keeping unknown fields. Tests
+// reading the metrics use a kind of their own, as the servers of the tests share the registry.
+func newExampleCRD(kind string) *apiextensionsv1.CustomResourceDefinition {
+	singular := strings.ToLower(kind)
+
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: singular + "s.example.com"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Scope: apiextensionsv1.NamespaceScoped,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   singular + "s",
+				Singular: singular,
+				Kind:     kind,
+				ListKind: kind + "List",
+			},
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{
+					Name:    "v1",
+					Served:  true,
+					Storage: true,
+					Schema: &apiextensionsv1.CustomResourceValidation{
+						OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+							Type:                   "object",
+							XPreserveUnknownFields: func(b bool) *bool { return &b }(true),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// newWidget returns a widget of example.com/v1.
+func newWidget(name string) *unstructured.Unstructured {
+	return newExampleObject("Widget", name)
+}
+
+// newOwnedWidget returns a widget owned by owner, which blocks the deletion of owner in the foreground
+// if blockOwnerDeletion is set.
+func newOwnedWidget(name string, owner *unstructured.Unstructured, blockOwnerDeletion bool) *unstructured.Unstructured {
+	widget := newWidget(name)
+	widget.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion:         owner.GetAPIVersion(),
+		Kind:               owner.GetKind(),
+		Name:               owner.GetName(),
+		UID:                owner.GetUID(),
+		BlockOwnerDeletion: &blockOwnerDeletion,
+	}})
+
+	return widget
+}
+
+// newExampleObject returns an object of a kind of example.com/v1.
+func newExampleObject(kind, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("example.com/v1")
+	obj.SetKind(kind)
+	obj.SetName(name)
+
+	return obj
+}
+
+// createWhenServed creates obj, waiting for the handler of its CRD. CRDs are established before the
+// handler picks them up.
+func createWhenServed(t *testing.T, client dynamic.ResourceInterface, obj *unstructured.Unstructured) *unstructured.Unstructured {
+	t.Helper()
+
+	var created *unstructured.Unstructured
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		var err error
+
+		created, err = client.Create(context.TODO(), obj, metav1.CreateOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("failed to create %s %s: %v", obj.GetKind(), obj.GetName(), err)
+	}
+
+	return created
+}
+
+// waitForServed waits for the handler of a CRD to serve the lists of client.
+func waitForServed(t *testing.T, client dynamic.ResourceInterface) {
+	t.Helper()
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := client.List(context.TODO(), metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+}
+
+// waitForDeletion waits for the object name of client to be gone.
+func waitForDeletion(t *testing.T, client dynamic.ResourceInterface, name string) {
+	t.Helper()
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := client.Get(context.TODO(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+
+		return false, err
+	}); err != nil {
+		t.Errorf("expected %s to be deleted: %v", name, err)
+	}
+}
+
+// newEtcdConfig returns the config of an etcd on free local ports, for the tests running the servers
+// against an etcd of their own.
+func newEtcdConfig(t *testing.T) etcd.Config {
+	ports, err := freePorts(2)
+	if err != nil {
+		t.Fatalf("failed to pick etcd ports: %v", err)
+	}
+
+	return etcd.Config{
+		Dir:       filepath.Join(t.TempDir(), "etcd"),
+		ClientURL: fmt.Sprintf("http://127.0.0.1:%d", ports[0]),
+		PeerURL:   fmt.Sprintf("http://127.0.0.1:%d", ports[1]),
+	}
+}
+
+// newHTTPClient returns a client authenticating like the ClientConfig of s, for the requests the
+// clients of client-go do not make.
+func newHTTPClient(t *testing.T, s *TestServer) *http.Client {
+	transport, err := rest.TransportFor(s.ClientConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// newWarningClient returns a dynamic client of s recording the warnings of its responses.
+func newWarningClient(t *testing.T, s *TestServer) (dynamic.Interface, *warningRecorder) {
+	recorder := &warningRecorder{}
+
+	config := rest.CopyConfig(s.ClientConfig)
+	config.WarningHandler = recorder
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return client, recorder
+}
+
+// getMetrics returns the metrics of s. The servers of the tests share the registry.
+func getMetrics(s *TestServer) (testutil.Metrics, error) {
+	data, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/metrics").DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := testutil.NewMetrics()
+	if err := testutil.ParseMetrics(string(data), &metrics); err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// warningRecorder collects the warnings of the responses of a client.
+type warningRecorder struct {
+	lock     sync.Mutex
+	warnings []string
+}
+
+func (r *warningRecorder) HandleWarningHeader(code int, agent string, text string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.warnings = append(r.warnings, text)
+}
+
+// reset drops the warnings collected so far and returns them.
+func (r *warningRecorder) reset() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	warnings := r.warnings
+	r.warnings = nil
+
+	return warnings
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badideatest
+
+import (
+	"net/http"
+
+	"go.uber.org/goleak"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
+	"k8s.io/apiserver/pkg/server/healthz"
+)
+
+// knownLeaks filters the goroutines a stopped badidea server leaves behind because the libraries
+// offer no way to stop them.
+var knownLeaks = []goleak.Option{
+	// the apiextensions server always creates the queue of its CRD OpenAPI controller, but only runs
+	// the controller, which shuts the queue down, if the server has an OpenAPI config. It has none.
+	goleak.IgnoreTopFunction("k8s.io/client-go/util/workqueue.(*Type).updateUnfinishedWorkLoop"),
+	goleak.IgnoreTopFunction("k8s.io/client-go/util/workqueue.(*delayingType).waitingLoop"),
+	// the etcd client of the etcd health check is never closed and keeps reconnecting
+	goleak.IgnoreTopFunction("google.golang.org/grpc.(*ccBalancerWrapper).watcher"),
+	goleak.IgnoreTopFunction("google.golang.org/grpc.(*addrConn).resetTransport"),
+	// the rotating writer of the audit log is never closed, its goroutine compressing old logs keeps
+	// running
+	goleak.IgnoreTopFunction("gopkg.in/natefinch/lumberjack%2ev2.(*Logger).millRun"),
+	// the watchers of client-go block forever delivering an event decoded while they are stopped, e.g.
+	// by the reflectors of the informers of the server on shutdown
+	goleak.IgnoreTopFunction("k8s.io/apimachinery/pkg/watch.(*StreamWatcher).receive"),
+	// not a leak, it times out reads from the watch cache and exits after three seconds at most
+	goleak.IgnoreTopFunction("k8s.io/apiserver/pkg/storage/cacher.(*watchCache).waitUntilFreshAndBlock.func1"),
+}
+
+// LeakOptions returns goleak options that ignore the goroutines running now and those badidea
+// servers leave behind once stopped. Call it before the first server of the process starts, for
+// example in TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		goleak.VerifyTestMain(m, badideatest.LeakOptions()...)
+//	}
+func LeakOptions() []goleak.Option {
+	// some goroutines are started once per process and never stopped. Start them now, so they are
+	// ignored as current goroutines.
+	genericfilters.WithMaxInFlightLimit(http.NotFoundHandler(), 0, 0, nil)
+	_ = healthz.LogHealthz.Check(nil)
+
+	return append([]goleak.Option{goleak.IgnoreCurrent()}, knownLeaks...)
+}
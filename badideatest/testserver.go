@@ -0,0 +1,394 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package badideatest starts badidea servers in-process for tests.
+package badideatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/apiserver"
+	"github.com/thetirefire/badidea/etcd"
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	"github.com/thetirefire/badidea/restmapping"
+	"github.com/thetirefire/badidea/server"
+	"go.uber.org/goleak"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	aggregatorclientset "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+// TestServer is a badidea server running in the test process.
+type TestServer struct {
+	// ClientConfig connects to the server. Requests are anonymous, which badidea allows everything.
+	ClientConfig *rest.Config
+	// APIExtensionsClient is a client of the apiextensions.k8s.io group.
+	APIExtensionsClient apiextensionsclientset.Interface
+	// APIRegistrationClient is a client of the apiregistration.k8s.io group.
+	APIRegistrationClient aggregatorclientset.Interface
+	// DynamicClient is a client of all resources, including custom resources.
+	DynamicClient dynamic.Interface
+	// RESTMapper maps the kinds and resources of the server, including those of CRDs created later.
+	RESTMapper *restmapping.RESTMapper
+	// Server is the server under test, e.g. for its loopback clients.
+	Server *server.BadIdeaServer
+	// TearDownFn stops the server and etcd. It is registered with t.Cleanup and safe to call again.
+	TearDownFn func()
+}
+
+// Option customizes the test server.
+type Option func(*testServerConfig)
+
+type testServerConfig struct {
+	featureGates  map[string]bool
+	runtimeConfig map[string]string
+	crds          []*apiextensionsv1.CustomResourceDefinition
+	customize     []func(*options.ServerRunOptions)
+	checkLeaks    bool
+	unixSocket    string
+	serverOptions []server.Option
+}
+
+// WithFeatureGates sets badidea feature gates, as with --feature-gates.
+func WithFeatureGates(featureGates map[string]bool) Option {
+	return func(c *testServerConfig) {
+		for name, enabled := range featureGates {
+			c.featureGates[name] = enabled
+		}
+	}
+}
+
+// WithRuntimeConfig enables or disables API group versions of apiextensions.k8s.io,
+// apiregistration.k8s.io and flowcontrol.apiserver.k8s.io, as with --runtime-config.
+func WithRuntimeConfig(runtimeConfig map[string]string) Option {
+	return func(c *testServerConfig) {
+		for key, value := range runtimeConfig {
+			c.runtimeConfig[key] = value
+		}
+	}
+}
+
+// WithCRDs creates the CRDs once the server is ready. StartTestServer returns after they are established.
+func WithCRDs(crds ...*apiextensionsv1.CustomResourceDefinition) Option {
+	return func(c *testServerConfig) {
+		c.crds = append(c.crds, crds...)
+	}
+}
+
+// WithBootstrapManifestsDir server-side applies the manifests in dir, as with --bootstrap-manifests-dir.
+// StartTestServer returns after they are applied and fails the test if some could not be.
+func WithBootstrapManifestsDir(dir string) Option {
+	return WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.BootstrapManifestsDir = dir
+	})
+}
+
+// WithUnixSocket serves on the unix socket at path instead of a TCP port, as with --bind-unix-socket.
+// The clients of the server dial the socket.
+func WithUnixSocket(path string) Option {
+	return func(c *testServerConfig) {
+		c.unixSocket = path
+	}
+}
+
+// WithAPIGroup serves an API group implemented in-process by the storage in apiGroupInfo, like
+// apiserver.ServerChainConfig.WithAPIGroup.
+func WithAPIGroup(apiGroupInfo genericapiserver.APIGroupInfo, priorities map[schema.GroupVersion]apiserver.Priority, openAPIDefinitions common.GetOpenAPIDefinitions) Option {
+	return func(c *testServerConfig) {
+		c.serverOptions = append(c.serverOptions, server.WithAPIGroup(apiGroupInfo, priorities, openAPIDefinitions))
+	}
+}
+
+// WithScheme registers the types of API groups added with WithAPIGroup with the scheme of the chain,
+// like apiserver.ServerChainConfig.AddToScheme.
+func WithScheme(builders ...func(*runtime.Scheme) error) Option {
+	return func(c *testServerConfig) {
+		c.serverOptions = append(c.serverOptions, server.WithScheme(builders...))
+	}
+}
+
+// WithDeprecatedResource marks a resource of an API group added with WithAPIGroup deprecated, like
+// apiserver.ServerChainConfig.WithDeprecatedResource.
+func WithDeprecatedResource(gvr schema.GroupVersionResource, deprecation filters.Deprecation) Option {
+	return func(c *testServerConfig) {
+		c.serverOptions = append(c.serverOptions, server.WithDeprecatedResource(gvr, deprecation))
+	}
+}
+
+// WithServerRunOptions lets fn change the server options before the server starts.
+func WithServerRunOptions(fn func(*options.ServerRunOptions)) Option {
+	return func(c *testServerConfig) {
+		c.customize = append(c.customize, fn)
+	}
+}
+
+// WithLeakCheck fails the test if goroutines started since StartTestServer are still running after
+// the teardown, except for the known leaks of the libraries. It catches goroutines started by the
+// test itself too.
+func WithLeakCheck() Option {
+	return func(c *testServerConfig) {
+		c.checkLeaks = true
+	}
+}
+
+// StartTestServer starts a badidea server with its own etcd in a temporary directory and waits until
+// it is ready. Ports are picked at random, so tests may run servers in parallel. The server is torn
+// down when the test ends.
+func StartTestServer(t testing.TB, opts ...Option) *TestServer {
+	t.Helper()
+
+	c := &testServerConfig{featureGates: map[string]bool{}, runtimeConfig: map[string]string{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	var leakOptions []goleak.Option
+	if c.checkLeaks {
+		leakOptions = LeakOptions()
+	}
+
+	dir := t.TempDir()
+
+	o, err := options.NewServerRunOptions()
+	if err != nil {
+		t.Fatalf("failed to create server options: %v", err)
+	}
+
+	if err := o.FeatureGate.SetFromMap(c.featureGates); err != nil {
+		t.Fatalf("failed to set feature gates: %v", err)
+	}
+
+	for key, value := range c.runtimeConfig {
+		o.Extensions.APIEnablement.RuntimeConfig[key] = value
+	}
+
+	etcdPorts, err := freePorts(2)
+	if err != nil {
+		t.Fatalf("failed to pick etcd ports: %v", err)
+	}
+
+	o.EmbeddedEtcd = etcd.Config{
+		Dir:       filepath.Join(dir, "etcd"),
+		ClientURL: fmt.Sprintf("http://127.0.0.1:%d", etcdPorts[0]),
+		PeerURL:   fmt.Sprintf("http://127.0.0.1:%d", etcdPorts[1]),
+	}
+	o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{o.EmbeddedEtcd.ClientURL}
+
+	clientConfig := &rest.Config{
+		QPS:   -1,
+		Burst: -1,
+	}
+
+	if c.unixSocket != "" {
+		o.BindUnixSocket = c.unixSocket
+		clientConfig.Host = "https://localhost"
+		clientConfig.Dial = apiserver.UnixSocketDialer(c.unixSocket)
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+
+		o.Extensions.RecommendedOptions.SecureServing.Listener = listener
+		clientConfig.Host = "https://" + listener.Addr().String()
+	}
+
+	o.InMemoryServingCert = true
+
+	for _, customize := range c.customize {
+		customize(o)
+	}
+
+	// the unix socket listener is only created with the server
+	closeListener := func() {
+		if listener := o.Extensions.RecommendedOptions.SecureServing.Listener; listener != nil {
+			listener.Close()
+		}
+	}
+
+	completed, err := o.Complete()
+	if err != nil {
+		closeListener()
+		t.Fatalf("failed to complete server options: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+
+	badIdeaServer, err := server.NewBadIdeaServer(completed, stopCh, c.serverOptions...)
+	if err != nil {
+		// stops etcd, if it came up
+		close(stopCh)
+		closeListener()
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- badIdeaServer.Run()
+	}()
+
+	var tearDownOnce sync.Once
+
+	tearDown := func() {
+		tearDownOnce.Do(func() {
+			close(stopCh)
+
+			select {
+			case err := <-errCh:
+				if err != nil {
+					t.Errorf("server failed: %v", err)
+				}
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Errorf("server did not shut down within %v", wait.ForeverTestTimeout)
+				return
+			}
+
+			if c.checkLeaks {
+				if err := goleak.Find(leakOptions...); err != nil {
+					t.Errorf("server leaked goroutines: %v", err)
+				}
+			}
+		})
+	}
+	t.Cleanup(tearDown)
+
+	clientConfig.CAData = badIdeaServer.ServingCA()
+
+	if err := waitForReady(clientConfig, errCh); err != nil {
+		t.Fatalf("server did not become ready: %v", err)
+	}
+
+	s := &TestServer{ClientConfig: clientConfig, RESTMapper: badIdeaServer.RESTMapper(), Server: badIdeaServer, TearDownFn: tearDown}
+
+	s.APIExtensionsClient, err = apiextensionsclientset.NewForConfig(clientConfig)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	s.APIRegistrationClient, err = aggregatorclientset.NewForConfig(clientConfig)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	s.DynamicClient, err = dynamic.NewForConfig(clientConfig)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	for _, crd := range c.crds {
+		if err := createCRD(s.APIExtensionsClient, crd); err != nil {
+			t.Fatalf("failed to create CRD %s: %v", crd.Name, err)
+		}
+	}
+
+	return s
+}
+
+// waitForReady polls /readyz until it succeeds. errCh is the result of the server, in case it fails
+// to start.
+func waitForReady(clientConfig *rest.Config, errCh chan error) error {
+	lastResponse := ""
+
+	err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		select {
+		case err := <-errCh:
+			errCh <- err
+			return false, fmt.Errorf("server exited: %v", err)
+		default:
+		}
+
+		transport, err := rest.TransportFor(clientConfig)
+		if err != nil {
+			return false, err
+		}
+
+		client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+		resp, err := client.Get(clientConfig.Host + "/readyz?verbose")
+		if err != nil {
+			return false, nil
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		lastResponse = string(body)
+
+		return resp.StatusCode == http.StatusOK, nil
+	})
+	if errors.Is(err, wait.ErrWaitTimeout) && lastResponse != "" {
+		return fmt.Errorf("%w, last /readyz response:\n%s", err, lastResponse)
+	}
+
+	return err
+}
+
+// createCRD creates crd and waits until it is established.
+func createCRD(client apiextensionsclientset.Interface, crd *apiextensionsv1.CustomResourceDefinition) error {
+	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().Create(context.TODO(), crd, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	return wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		current, err := client.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), crd.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		for _, condition := range current.Status.Conditions {
+			if condition.Type == apiextensionsv1.Established && condition.Status == apiextensionsv1.ConditionTrue {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+}
+
+// freePorts returns n ports that were free a moment ago.
+func freePorts(n int) ([]int, error) {
+	ports := []int{}
+
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	return ports, nil
+}
@@ -0,0 +1,1058 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package badideatest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	badideav1alpha1 "github.com/thetirefire/badidea/apis/badidea/v1alpha1"
+	"github.com/thetirefire/badidea/badideatest/examplegroup"
+	"github.com/thetirefire/badidea/bootstrap"
+	"github.com/thetirefire/badidea/etcd"
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	"go.uber.org/goleak"
+	"golang.org/x/net/http2"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, LeakOptions()...)
+}
+
+func TestStartTestServer(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithLeakCheck())
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	createWhenServed(t, widgets, newWidget("gizmo"))
+
+	if _, err := widgets.Get(context.TODO(), "gizmo", metav1.GetOptions{}); err != nil {
+		t.Errorf("failed to get widget: %v", err)
+	}
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := s.APIRegistrationClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.example.com", metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}); err != nil {
+		t.Errorf("expected an APIService for the CRD group version: %v", err)
+	}
+}
+
+func TestStartTestServerOptions(t *testing.T) {
+	s := StartTestServer(t,
+		WithFeatureGates(map[string]bool{string(features.BadIdeaCRDAutoRegistration): false}),
+		WithRuntimeConfig(map[string]string{"apiextensions.k8s.io/v1beta1": "false", "apiregistration.k8s.io/v1beta1": "false"}),
+		WithCRDs(newWidgetCRD()),
+	)
+
+	resources, err := s.APIExtensionsClient.Discovery().ServerResourcesForGroupVersion("apiextensions.k8s.io/v1beta1")
+	if err == nil {
+		t.Errorf("expected apiextensions.k8s.io/v1beta1 to be disabled, got %v", resources)
+	}
+
+	resources, err = s.APIRegistrationClient.Discovery().ServerResourcesForGroupVersion("apiregistration.k8s.io/v1beta1")
+	if err == nil {
+		t.Errorf("expected apiregistration.k8s.io/v1beta1 to be disabled, got %v", resources)
+	}
+
+	_, err = s.APIRegistrationClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.example.com", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected no APIService for the CRD group version with CRD auto-registration disabled, got %v", err)
+	}
+}
+
+func TestStartTestServerReadOnlyWorkingDirectory(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	s := StartTestServer(t)
+
+	if _, err := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().List(context.TODO(), metav1.ListOptions{}); err != nil {
+		t.Errorf("failed to list CRDs: %v", err)
+	}
+
+	// the permissions do not stop root, so check that nothing was written either
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, entry := range entries {
+		t.Errorf("unexpected file %s in the working directory", entry.Name())
+	}
+}
+
+func TestStartTestServerBootstrapManifests(t *testing.T) {
+	dir := t.TempDir()
+
+	// the widget comes first, but can only be applied once its CRD is established
+	manifests := map[string]string{
+		"a-widget.yaml": `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gizmo
+  namespace: fixtures
+spec:
+  size: 3
+`,
+		"b-crd.yaml": `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    plural: widgets
+    singular: widget
+    kind: Widget
+    listKind: WidgetList
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+`,
+	}
+
+	for name, content := range manifests {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	s := StartTestServer(t, WithBootstrapManifestsDir(dir))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("fixtures")
+
+	widget, err := widgets.Get(context.TODO(), "gizmo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the widget to be applied: %v", err)
+	}
+
+	if size, _, _ := unstructured.NestedInt64(widget.Object, "spec", "size"); size != 3 {
+		t.Errorf("expected spec.size 3, got %d", size)
+	}
+
+	managers := []string{}
+	for _, entry := range widget.GetManagedFields() {
+		managers = append(managers, entry.Manager)
+	}
+
+	if len(managers) != 1 || managers[0] != bootstrap.FieldManager {
+		t.Errorf("expected the widget to be managed by %s, got %v", bootstrap.FieldManager, managers)
+	}
+}
+
+func TestStartTestServerUnixSocket(t *testing.T) {
+	// the path of a unix socket is limited to about 100 bytes, too short for some temporary directories
+	dir, err := ioutil.TempDir("", "badidea")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "badidea.sock")
+
+	s := StartTestServer(t, WithUnixSocket(socket), WithCRDs(newWidgetCRD()))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	createWhenServed(t, widgets, newWidget("gizmo"))
+
+	list, err := widgets.List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(list.Items) != 1 {
+		t.Errorf("expected to list the widget, got %v, %v", list, err)
+	}
+
+	if err := widgets.Delete(context.TODO(), "gizmo", metav1.DeleteOptions{}); err != nil {
+		t.Errorf("failed to delete widget: %v", err)
+	}
+
+	s.TearDownFn()
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestStartTestServerShutdownDelay(t *testing.T) {
+	s := StartTestServer(t, WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.ShutdownDelayDuration = 3 * time.Second
+	}))
+
+	client := newHTTPClient(t, s)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		s.TearDownFn()
+	}()
+
+	var resp *http.Response
+
+	err := wait.PollImmediate(50*time.Millisecond, 3*time.Second, func() (bool, error) {
+		var err error
+
+		resp, err = client.Get(s.ClientConfig.Host + "/apis")
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		return resp.StatusCode == http.StatusTooManyRequests, nil
+	})
+	if err != nil {
+		t.Fatalf("expected requests to be rejected during the shutdown delay: %v", err)
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("expected Retry-After 1, got %q", retryAfter)
+	}
+
+	<-stopped
+}
+
+func TestStartTestServerHTTP2Limits(t *testing.T) {
+	s := StartTestServer(t, WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.SecureServing.HTTP2MaxStreamsPerConnection = 2
+		o.TCPKeepAlivePeriod = time.Second
+	}))
+
+	tlsConfig, err := rest.TLSConfigFor(s.ClientConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a single connection, on which requests wait for a stream instead of opening another connection
+	h2 := &http2.Transport{TLSClientConfig: tlsConfig, StrictMaxConcurrentStreams: true}
+	defer h2.CloseIdleConnections()
+
+	transport, err := rest.HTTPWrappersForConfig(s.ClientConfig, h2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := &http.Client{Transport: transport}
+
+	watch := func() *http.Response {
+		resp, err := client.Get(s.ClientConfig.Host + "/apis/apiextensions.k8s.io/v1/customresourcedefinitions?watch=true")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected watch to be established, got %s", resp.Status)
+		}
+
+		return resp
+	}
+
+	first := watch()
+	defer first.Body.Close()
+
+	second := watch()
+
+	get := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.ClientConfig.Host+"/healthz", nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	if err := get(time.Second); err == nil {
+		t.Fatal("expected a third stream to wait for one of the watches")
+	}
+
+	second.Body.Close()
+
+	if err := get(wait.ForeverTestTimeout); err != nil {
+		t.Fatalf("expected a stream to be free after closing a watch: %v", err)
+	}
+
+	// the remaining watch outlives several keep-alive periods
+	time.Sleep(4 * time.Second)
+
+	if _, err := s.APIExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(context.TODO(), newWidgetCRD(), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create CRD: %v", err)
+	}
+
+	var event metav1.WatchEvent
+	if err := json.NewDecoder(first.Body).Decode(&event); err != nil {
+		t.Fatalf("expected a watch event: %v", err)
+	}
+
+	if event.Type != "ADDED" {
+		t.Errorf("expected an ADDED event, got %q", event.Type)
+	}
+}
+
+func TestStartTestServerTLS(t *testing.T) {
+	handshake := func(s *TestServer, customize func(*tls.Config)) error {
+		tlsConfig, err := rest.TLSConfigFor(s.ClientConfig)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		customize(tlsConfig)
+
+		conn, err := tls.Dial("tcp", strings.TrimPrefix(s.ClientConfig.Host, "https://"), tlsConfig)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	s := StartTestServer(t, WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.SecureServing.MinTLSVersion = "VersionTLS13"
+	}))
+
+	if err := handshake(s, func(c *tls.Config) { c.MaxVersion = tls.VersionTLS12 }); err == nil {
+		t.Error("expected the handshake with TLS 1.2 to fail")
+	}
+
+	if err := handshake(s, func(c *tls.Config) {}); err != nil {
+		t.Errorf("expected the handshake with TLS 1.3 to succeed: %v", err)
+	}
+
+	s = StartTestServer(t, WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.SecureServing.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	}))
+
+	if err := handshake(s, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	}); err == nil {
+		t.Error("expected the handshake with a suite not offered to fail")
+	}
+
+	if err := handshake(s, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	}); err != nil {
+		t.Errorf("expected the handshake with the offered suite to succeed: %v", err)
+	}
+}
+
+func TestStartTestServerLoopbackClients(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.InternalClientQPS = 1000
+		o.InternalClientBurst = 1000
+	}))
+
+	crds := schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+	dynamicClient, err := s.Server.DynamicClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if again, _ := s.Server.DynamicClient(); again != dynamicClient {
+		t.Error("expected the dynamic client to be shared")
+	}
+
+	list, err := dynamicClient.Resource(crds).List(context.TODO(), metav1.ListOptions{})
+	if err != nil || len(list.Items) != 1 {
+		t.Errorf("expected the dynamic client to list the CRD, got %v: %v", list, err)
+	}
+
+	discoveryClient, err := s.Server.DiscoveryClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if again, _ := s.Server.DiscoveryClient(); again != discoveryClient {
+		t.Error("expected the discovery client to be shared")
+	}
+
+	if _, err := discoveryClient.ServerResourcesForGroupVersion("example.com/v1"); err != nil {
+		t.Errorf("expected the discovery client to discover the CRD: %v", err)
+	}
+
+	metadataClient, err := s.Server.MetadataClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if again, _ := s.Server.MetadataClient(); again != metadataClient {
+		t.Error("expected the metadata client to be shared")
+	}
+
+	crd, err := metadataClient.Resource(crds).Get(context.TODO(), "widgets.example.com", metav1.GetOptions{})
+	if err != nil || crd.UID == "" {
+		t.Errorf("expected the metadata client to get the CRD, got %v: %v", crd, err)
+	}
+
+	config, again := s.Server.LoopbackClientConfig(), s.Server.LoopbackClientConfig()
+	if config == again || config.Transport != again.Transport || config.RateLimiter == nil || config.RateLimiter != again.RateLimiter {
+		t.Errorf("expected copies of the loopback config sharing the transport and rate limiter")
+	}
+}
+
+func TestStartTestServerComponentIdentities(t *testing.T) {
+	dir := t.TempDir()
+	auditLog := filepath.Join(dir, "audit.log")
+	auditPolicy := filepath.Join(dir, "audit-policy.yaml")
+	manifests := filepath.Join(dir, "manifests")
+
+	// the policy of the README, dropping the reads of the components
+	policy := `apiVersion: audit.k8s.io/v1
+kind: Policy
+omitStages: ["RequestReceived"]
+rules:
+- level: None
+  users: ["system:apiserver"]
+  verbs: ["get", "list", "watch"]
+- level: Metadata
+`
+	if err := ioutil.WriteFile(auditPolicy, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(manifests, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server only becomes ready once the manifests are applied, so the CRD is one of them
+	widget := `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gizmo
+  namespace: fixtures
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    plural: widgets
+    singular: widget
+    kind: Widget
+    listKind: WidgetList
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        x-kubernetes-preserve-unknown-fields: true
+`
+	if err := ioutil.WriteFile(filepath.Join(manifests, "widget.yaml"), []byte(widget), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := StartTestServer(t, WithBootstrapManifestsDir(manifests), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.Extensions.RecommendedOptions.Audit.LogOptions.Path = auditLog
+		o.Extensions.RecommendedOptions.Audit.PolicyFile = auditPolicy
+		o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection = true
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("fixtures")
+
+	owner, err := widgets.Get(context.TODO(), "gizmo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the widget to be applied: %v", err)
+	}
+
+	// the garbage collector deletes the dependent of the widget once it is gone
+	if _, err := widgets.Create(context.TODO(), newOwnedWidget("gizmo-part", owner, false), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create widget: %v", err)
+	}
+
+	if err := widgets.Delete(context.TODO(), "gizmo", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete widget: %v", err)
+	}
+
+	expected := []struct {
+		user      string
+		userAgent string
+		verb      string
+		resource  string
+	}{
+		{user: "system:badidea:autoregister", userAgent: "/autoregister", verb: "create", resource: "apiservices"},
+		{user: "system:badidea:bootstrap-manifests", userAgent: bootstrap.FieldManager, verb: "patch", resource: "widgets"},
+		{user: "system:badidea:garbage-collector", userAgent: "/garbage-collector", verb: "delete", resource: "widgets"},
+	}
+
+	var events []*auditv1.Event
+
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		data, err := ioutil.ReadFile(auditLog)
+		if err != nil {
+			return false, err
+		}
+
+		events = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			event := &auditv1.Event{}
+			if err := json.Unmarshal([]byte(line), event); err != nil {
+				return false, fmt.Errorf("failed to decode audit event %q: %w", line, err)
+			}
+
+			events = append(events, event)
+		}
+
+		for _, e := range expected {
+			found := false
+			for _, event := range events {
+				found = found || (event.User.Username == "system:apiserver" && event.ImpersonatedUser != nil && event.ImpersonatedUser.Username == e.user &&
+					strings.HasSuffix(event.UserAgent, e.userAgent) && event.Verb == e.verb && event.ObjectRef != nil && event.ObjectRef.Resource == e.resource)
+			}
+
+			if !found {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	}); err != nil {
+		t.Fatalf("expected audit events of the components %v: %v", expected, err)
+	}
+
+	for _, event := range events {
+		if event.User.Username == "system:apiserver" && (event.Verb == "get" || event.Verb == "list" || event.Verb == "watch") {
+			t.Errorf("expected the reads of the components to be dropped, got %s %s by %v", event.Verb, event.RequestURI, event.ImpersonatedUser)
+		}
+	}
+}
+
+func TestStartTestServerControllerHeartbeats(t *testing.T) {
+	s := StartTestServer(t,
+		WithCRDs(newWidgetCRD()),
+		WithServerRunOptions(func(o *options.ServerRunOptions) {
+			o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection = true
+			o.LivezHeartbeatThreshold = 2 * time.Second
+			o.LivezHeartbeatGracePeriod = 0
+		}))
+
+	// the controllers keep beating long after the threshold
+	time.Sleep(4 * time.Second)
+
+	data, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/livez").Param("verbose", "true").DoRaw(context.TODO())
+	if err != nil {
+		t.Fatalf("expected /livez to pass: %v: %s", err, data)
+	}
+
+	if !strings.Contains(string(data), "[+]controller-heartbeats ok") {
+		t.Errorf("expected /livez to check the heartbeats, got %s", data)
+	}
+}
+
+func TestStartTestServerInstanceStatus(t *testing.T) {
+	gvr := badideav1alpha1.SchemeGroupVersion.WithResource("instances")
+
+	getInstance := func(t *testing.T, client dynamic.Interface) (*badideav1alpha1.Instance, error) {
+		var obj *unstructured.Unstructured
+
+		// the group may take a moment to show up in the discovery of the aggregator
+		err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			var err error
+
+			obj, err = client.Resource(gvr).Get(context.TODO(), badideav1alpha1.InstanceName, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) || apierrors.IsServiceUnavailable(err) {
+				return false, nil
+			}
+
+			return true, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := obj.MarshalJSON()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		instance := &badideav1alpha1.Instance{}
+		if err := json.Unmarshal(data, instance); err != nil {
+			t.Fatalf("failed to decode the instance: %v", err)
+		}
+
+		return instance, nil
+	}
+
+	subsystems := func(instance *badideav1alpha1.Instance) map[string]bool {
+		enabled := map[string]bool{}
+		for _, subsystem := range instance.Status.Subsystems {
+			enabled[subsystem.Name] = subsystem.Enabled
+		}
+
+		return enabled
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		s := StartTestServer(t, WithFeatureGates(map[string]bool{string(features.BadIdeaInstanceStatus): true}))
+
+		instance, err := getInstance(t, s.DynamicClient)
+		if err != nil {
+			t.Fatalf("failed to get the instance: %v", err)
+		}
+
+		expectedFeatures := map[string]bool{
+			string(features.BadIdeaCRDAutoRegistration): true,
+			string(features.BadIdeaCRDSelectableFields): false,
+			string(features.BadIdeaInstanceStatus):      true,
+			string(features.BadIdeaUserAnnotations):     false,
+		}
+		if !reflect.DeepEqual(instance.Status.Features, expectedFeatures) {
+			t.Errorf("expected the features %v, got %v", expectedFeatures, instance.Status.Features)
+		}
+
+		if instance.Status.Etcd != badideav1alpha1.EtcdEmbedded || instance.Status.Versions.Etcd == "" {
+			t.Errorf("expected an embedded etcd with its version, got %q %q", instance.Status.Etcd, instance.Status.Versions.Etcd)
+		}
+
+		if instance.Status.Versions.Go != runtime.Version() || instance.Status.Versions.Kubernetes == "" {
+			t.Errorf("unexpected versions %#v", instance.Status.Versions)
+		}
+
+		if enabled := subsystems(instance); !enabled["aggregator"] || enabled["garbage-collector"] || enabled["bootstrap-manifests"] {
+			t.Errorf("unexpected subsystems %v", enabled)
+		}
+
+		if len(instance.Status.Normalizations) != 0 {
+			t.Errorf("expected no normalizations, got %v", instance.Status.Normalizations)
+		}
+
+		if !instance.Status.Ready {
+			t.Errorf("expected the instance to be ready, got checks %v", instance.Status.ReadyzChecks)
+		}
+
+		checks := sets.NewString()
+		for _, check := range instance.Status.ReadyzChecks {
+			checks.Insert(check.Name)
+		}
+
+		if !checks.Has("etcd") {
+			t.Errorf("expected the etcd readyz check, got %v", checks.List())
+		}
+
+		// only the Instance of the server exists
+		list, err := s.DynamicClient.Resource(gvr).List(context.TODO(), metav1.ListOptions{})
+		if err != nil || len(list.Items) != 1 || list.Items[0].GetName() != badideav1alpha1.InstanceName {
+			t.Errorf("expected a list of the instance, got %v, %v", list, err)
+		}
+
+		if _, err := s.DynamicClient.Resource(gvr).Get(context.TODO(), "other", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected other instances not to be found, got %v", err)
+		}
+
+		// the authorizer gates the instance like any resource
+		config := rest.CopyConfig(s.ClientConfig)
+		config.Impersonate = rest.ImpersonationConfig{UserName: "mallory"}
+
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := client.Resource(gvr).Get(context.TODO(), badideav1alpha1.InstanceName, metav1.GetOptions{}); !apierrors.IsForbidden(err) {
+			t.Errorf("expected an unprivileged user to be forbidden, got %v", err)
+		}
+	})
+
+	t.Run("toggled options", func(t *testing.T) {
+		s := StartTestServer(t,
+			WithFeatureGates(map[string]bool{
+				string(features.BadIdeaInstanceStatus):  true,
+				string(features.BadIdeaUserAnnotations): true,
+			}),
+			WithServerRunOptions(func(o *options.ServerRunOptions) {
+				o.DisableAggregator = true
+				o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection = true
+				o.Extensions.APIEnablement.RuntimeConfig = map[string]string{"badidea.x-k8s.io/v1alpha1": "1"}
+			}))
+
+		instance, err := getInstance(t, s.DynamicClient)
+		if err != nil {
+			t.Fatalf("failed to get the instance: %v", err)
+		}
+
+		if !instance.Status.Features[string(features.BadIdeaUserAnnotations)] {
+			t.Errorf("expected BadIdeaUserAnnotations to be enabled, got %v", instance.Status.Features)
+		}
+
+		if enabled := subsystems(instance); enabled["aggregator"] || !enabled["garbage-collector"] || !enabled["apiextensions"] {
+			t.Errorf("unexpected subsystems %v", enabled)
+		}
+
+		expectedNormalizations := []badideav1alpha1.Normalization{{
+			Flag:   "--runtime-config",
+			From:   "badidea.x-k8s.io/v1alpha1=1",
+			To:     "badidea.x-k8s.io/v1alpha1=true",
+			Reason: "the values are true or false",
+		}}
+		if !reflect.DeepEqual(instance.Status.Normalizations, expectedNormalizations) {
+			t.Errorf("expected the normalizations %v, got %v", expectedNormalizations, instance.Status.Normalizations)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s := StartTestServer(t)
+
+		if _, err := s.DynamicClient.Resource(gvr).Get(context.TODO(), badideav1alpha1.InstanceName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("expected the badidea group not to be served, got %v", err)
+		}
+	})
+}
+
+func TestStartTestServerLongRunningRequests(t *testing.T) {
+	tests := []struct {
+		name              string
+		disableAggregator bool
+	}{
+		{name: "through the aggregator"},
+		{name: "without the aggregator", disableAggregator: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			s := StartTestServer(t,
+				WithCRDs(newWidgetCRD()),
+				WithAPIGroup(examplegroup.NewAPIGroupInfo(), examplegroup.Priorities, examplegroup.GetOpenAPIDefinitions),
+				WithServerRunOptions(func(o *options.ServerRunOptions) {
+					o.RequestTimeout = time.Second
+					o.DisableAggregator = test.disableAggregator
+				}))
+
+			// the log of a gadget streams from the server of the API groups for longer than the timeout
+			gadgets := s.DynamicClient.Resource(examplegroup.SchemeGroupVersion.WithResource("gadgets"))
+
+			gadget := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": examplegroup.SchemeGroupVersion.String(),
+				"kind":       "Gadget",
+				"metadata":   map[string]interface{}{"name": "sprocket"},
+			}}
+			if _, err := gadgets.Create(context.TODO(), gadget, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("failed to create gadget: %v", err)
+			}
+
+			start := time.Now()
+
+			log, err := s.APIExtensionsClient.Discovery().RESTClient().Get().
+				AbsPath("/apis", examplegroup.GroupName, examplegroup.SchemeGroupVersion.Version, "gadgets", "sprocket", "log").
+				DoRaw(context.TODO())
+			if err != nil {
+				t.Fatalf("failed to stream the log: %v", err)
+			}
+
+			if lines := strings.Count(string(log), "\n"); lines != examplegroup.LogLines || time.Since(start) < time.Second {
+				t.Errorf("expected %d lines streamed beyond the timeout, got %d after %v", examplegroup.LogLines, lines, time.Since(start))
+			}
+
+			// watches of custom resources stay open beyond the timeout
+			widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+			w, err := widgets.Watch(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("failed to watch widgets: %v", err)
+			}
+			defer w.Stop()
+
+			time.Sleep(1500 * time.Millisecond)
+
+			if _, err := widgets.Create(context.TODO(), newWidget("gizmo"), metav1.CreateOptions{}); err != nil {
+				t.Fatalf("failed to create widget: %v", err)
+			}
+
+			select {
+			case event, ok := <-w.ResultChan():
+				if !ok || event.Type != watch.Added {
+					t.Errorf("expected the watch to see the widget added, got %v %v", event.Type, ok)
+				}
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Error("timed out waiting for the widget to be added")
+			}
+		})
+	}
+}
+
+func TestStartTestServerLeaderElection(t *testing.T) {
+	etcdConfig := newEtcdConfig(t)
+
+	stopEtcd := make(chan struct{})
+	t.Cleanup(func() { close(stopEtcd) })
+
+	if _, err := etcd.StartEtcdServer(etcdConfig, stopEtcd); err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+
+	// the lease outlives the test, so the second server only takes over once the first resigned
+	replica := WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.DisableEmbeddedEtcd = true
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{etcdConfig.ClientURL}
+		o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection = true
+		o.LeaderElect = true
+		o.LeaderElectLeaseDuration = time.Hour
+	})
+
+	first := StartTestServer(t, WithCRDs(newWidgetCRD()), replica)
+	second := StartTestServer(t, replica)
+
+	widgets := second.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	// collectGarbage deletes a widget and waits for the garbage collector to delete the widget it owns
+	collectGarbage := func(name string) {
+		t.Helper()
+
+		parent, err := widgets.Create(context.TODO(), newWidget(name), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("failed to create widget %s: %v", name, err)
+		}
+
+		if _, err := widgets.Create(context.TODO(), newOwnedWidget(name+"-child", parent, false), metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create widget %s-child: %v", name, err)
+		}
+
+		if err := widgets.Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("failed to delete widget %s: %v", name, err)
+		}
+
+		waitForDeletion(t, widgets, name+"-child")
+	}
+
+	// the first server leads the garbage collector
+	collectGarbage("led-by-first")
+
+	first.TearDownFn()
+
+	collectGarbage("led-by-second")
+}
+
+func TestStartTestServerWithoutWaitingForEtcd(t *testing.T) {
+	etcdConfig := newEtcdConfig(t)
+
+	stopEtcd := make(chan struct{})
+	t.Cleanup(func() { close(stopEtcd) })
+
+	addresses := make(chan string, 1)
+	etcdErr := make(chan error, 1)
+
+	// etcd only comes up once the server serves without being ready
+	go func() {
+		address := <-addresses
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+
+		pollErr := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			resp, err := client.Get("https://" + address + "/readyz?verbose")
+			if err != nil {
+				return false, nil
+			}
+			defer resp.Body.Close()
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode == http.StatusOK {
+				return false, errors.New("the server was ready before etcd came up")
+			}
+
+			return strings.Contains(string(body), "[-]poststarthook/badidea-wait-for-etcd"), nil
+		})
+
+		_, err := etcd.StartEtcdServer(etcdConfig, stopEtcd)
+		if pollErr != nil {
+			err = fmt.Errorf("the server did not serve without etcd: %v", pollErr)
+		}
+
+		etcdErr <- err
+	}()
+
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.DisableEmbeddedEtcd = true
+		o.WaitForEtcd = false
+		o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{etcdConfig.ClientURL}
+
+		addresses <- o.Extensions.RecommendedOptions.SecureServing.Listener.Addr().String()
+	}))
+
+	if err := <-etcdErr; err != nil {
+		t.Fatal(err)
+	}
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+	if _, err := widgets.Create(context.TODO(), newWidget("late"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("failed to create a widget once etcd came up: %v", err)
+	}
+}
+
+func TestStartTestServerClientAttribution(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()), WithServerRunOptions(func(o *options.ServerRunOptions) {
+		o.EnableClientAttribution = true
+		o.ClientAttributionHashUsers = true
+	}))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	for i := 0; i < 3; i++ {
+		if _, err := widgets.List(context.TODO(), metav1.ListOptions{}); err != nil {
+			t.Fatalf("failed to list widgets: %v", err)
+		}
+	}
+
+	data, err := s.APIExtensionsClient.Discovery().RESTClient().Get().AbsPath("/debug/badidea/clients").Param("top", "100").DoRaw(context.TODO())
+	if err != nil {
+		t.Fatalf("failed to get the clients: %v", err)
+	}
+
+	var served struct {
+		Clients []filters.ClientAttribution `json:"clients"`
+	}
+	if err := json.Unmarshal(data, &served); err != nil {
+		t.Fatalf("expected JSON: %v", err)
+	}
+
+	found := false
+	for _, client := range served.Clients {
+		if !strings.HasPrefix(client.User, "sha256:") && client.User != "" {
+			t.Errorf("expected the user to be hashed, got %q", client.User)
+		}
+
+		if client.Resource == "widgets.example.com" && client.Requests >= 3 {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("expected the widget lists to be attributed, got %s", data)
+	}
+}
+
+func TestStartTestServerWritePause(t *testing.T) {
+	s := StartTestServer(t, WithCRDs(newWidgetCRD()))
+
+	widgets := s.DynamicClient.Resource(widgetsResource).Namespace("default")
+
+	createWhenServed(t, widgets, newWidget("gizmo"))
+
+	// only the server and members of system:masters may pause, not the anonymous test client
+	anonymous := s.APIExtensionsClient.Discovery().RESTClient()
+
+	if _, err := anonymous.Post().AbsPath("/debug/badidea/writes").Param("resource", "widgets.example.com").DoRaw(context.TODO()); !apierrors.IsForbidden(err) {
+		t.Fatalf("expected anonymous pauses to be forbidden, got %v", err)
+	}
+
+	loopback, err := apiextensionsclientset.NewForConfig(s.Server.LoopbackClientConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := loopback.Discovery().RESTClient()
+
+	data, err := client.Post().AbsPath("/debug/badidea/writes").Param("resource", "widgets.example.com").Param("wait", "true").DoRaw(context.TODO())
+	if err != nil {
+		t.Fatalf("failed to pause the widgets: %v", err)
+	}
+
+	var status filters.WritePauseStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("expected JSON: %v", err)
+	}
+
+	if _, ok := status.Paused["widgets.example.com"]; !ok || !status.Drained {
+		t.Errorf("expected the widgets to be paused and drained, got %s", data)
+	}
+
+	// the clients of client-go retry a 429 once the pause ends, so the create is posted by hand
+	body, err := json.Marshal(newWidget("gadget"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resp, err := newHTTPClient(t, s).Post(s.ClientConfig.Host+"/apis/example.com/v1/namespaces/default/widgets", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post the widget: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected the create to be rejected with a Retry-After header while paused, got %d", resp.StatusCode)
+	}
+
+	if _, err := widgets.Get(context.TODO(), "gizmo", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected reads to be served while paused, got %v", err)
+	}
+
+	if _, err := client.Delete().AbsPath("/debug/badidea/writes").Param("resource", "widgets.example.com").DoRaw(context.TODO()); err != nil {
+		t.Fatalf("failed to resume the widgets: %v", err)
+	}
+
+	if _, err := widgets.Create(context.TODO(), newWidget("gadget"), metav1.CreateOptions{}); err != nil {
+		t.Errorf("expected the create to be served once resumed, got %v", err)
+	}
+}
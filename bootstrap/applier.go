@@ -0,0 +1,266 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// FieldManager is the field manager of the applied manifests.
+const FieldManager = "badidea-bootstrap"
+
+// retryTimeout bounds how long applying a manifest is retried while its API is not served yet.
+var retryTimeout = time.Minute
+
+var errNotApplied = errors.New("bootstrap manifests not applied yet")
+
+// Applier server-side applies manifests once and reports the outcome as a readyz check.
+type Applier struct {
+	manifests []Manifest
+	mapper    meta.RESTMapper
+
+	lock sync.RWMutex
+	err  error
+}
+
+// NewApplier creates an Applier of manifests mapping their kinds with mapper, which has to pick up
+// the resources of new CRDs, like a restmapping.RESTMapper.
+func NewApplier(manifests []Manifest, mapper meta.RESTMapper) *Applier {
+	return &Applier{manifests: manifests, mapper: mapper, err: errNotApplied}
+}
+
+// Name implements healthz.HealthChecker.
+func (a *Applier) Name() string {
+	return "bootstrap-manifests"
+}
+
+// Check implements healthz.HealthChecker. It fails until all manifests are applied, and with a summary
+// of the failed manifests if some could not be applied.
+func (a *Applier) Check(_ *http.Request) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.err
+}
+
+// Run applies the manifests with config. CustomResourceDefinitions and Namespaces are applied first
+// and the CustomResourceDefinitions have to be established before the other objects are applied.
+// Namespaces are skipped if the server does not serve them. Failures are logged, since /readyz
+// withholds the reason of a failed check.
+func (a *Applier) Run(config *rest.Config, stopCh <-chan struct{}) {
+	err := Apply(config, a.mapper, FieldManager, a.manifests, stopCh)
+
+	select {
+	case <-stopCh:
+		return
+	default:
+	}
+
+	if err != nil {
+		klog.Errorf("Failed to apply bootstrap manifests: %v", err)
+	} else {
+		klog.Infof("Applied %d bootstrap manifests", len(a.manifests))
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.err = err
+}
+
+// Apply applies manifests with config in the phases Run does, with fieldManager as the field manager
+// and user agent. mapper has to pick up the resources of new CRDs. It gives up when stopCh is closed.
+func Apply(config *rest.Config, mapper meta.RESTMapper, fieldManager string, manifests []Manifest, stopCh <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	config = rest.CopyConfig(config)
+	config.UserAgent = fieldManager
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	apiExtensionsClient, err := apiextensionsclientset.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+
+	for _, phase := range phases(manifests) {
+		crds := []string{}
+
+		for _, manifest := range phase {
+			if manifest.Object.GroupVersionKind().GroupKind() == namespaceKind && !servesNamespaces(mapper) {
+				// namespaced objects do not need their namespace to exist without a core API
+				klog.Infof("Skipping bootstrap manifest %v, namespaces are not served", manifest)
+				continue
+			}
+
+			if err := applyManifest(ctx, dynamicClient, mapper, fieldManager, manifest); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", manifest, err))
+				continue
+			}
+
+			if manifest.Object.GroupVersionKind().GroupKind() == customResourceDefinitionKind {
+				crds = append(crds, manifest.Object.GetName())
+			}
+		}
+
+		for _, name := range crds {
+			if err := waitForEstablished(ctx, apiExtensionsClient, name); err != nil {
+				errs = append(errs, fmt.Errorf("customresourcedefinition %s was not established: %w", name, err))
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// applyManifest applies manifest, retrying for up to retryTimeout while its API is not served yet.
+// The aggregator only discovers the apiextensions and CRD groups a moment after it starts.
+func applyManifest(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, fieldManager string, manifest Manifest) error {
+	ctx, cancel := context.WithTimeout(ctx, retryTimeout)
+	defer cancel()
+
+	data, err := manifest.Object.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	gvk := manifest.Object.GroupVersionKind()
+
+	var lastErr error
+
+	err = wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			// no match, or discovery failing while the server comes up
+			lastErr = err
+
+			return false, nil
+		}
+
+		var resource dynamic.ResourceInterface = client.Resource(mapping.Resource)
+
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			namespace := manifest.Object.GetNamespace()
+			if namespace == "" {
+				namespace = metav1.NamespaceDefault
+			}
+
+			resource = client.Resource(mapping.Resource).Namespace(namespace)
+		}
+
+		if gvk.GroupKind() == customResourceDefinitionKind {
+			err = createOrUpdate(ctx, resource, fieldManager, manifest.Object)
+		} else {
+			force := true
+			_, err = resource.Patch(ctx, manifest.Object.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: fieldManager, Force: &force})
+		}
+
+		if apierrors.IsNotFound(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsConflict(err) {
+			// the handler of a new CRD or APIService may take a moment
+			lastErr = err
+
+			return false, nil
+		}
+
+		return err == nil, err
+	}, ctx.Done())
+	if errors.Is(err, wait.ErrWaitTimeout) && lastErr != nil {
+		return lastErr
+	}
+
+	return err
+}
+
+// createOrUpdate creates object, or replaces it if it exists. The apiextensions server has no OpenAPI
+// models to build a field manager from, so CustomResourceDefinitions cannot be applied server-side.
+func createOrUpdate(ctx context.Context, resource dynamic.ResourceInterface, fieldManager string, object *unstructured.Unstructured) error {
+	_, err := resource.Create(ctx, object, metav1.CreateOptions{FieldManager: fieldManager})
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := resource.Get(ctx, object.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	object = object.DeepCopy()
+	object.SetResourceVersion(existing.GetResourceVersion())
+
+	_, err = resource.Update(ctx, object, metav1.UpdateOptions{FieldManager: fieldManager})
+
+	return err
+}
+
+// servesNamespaces reports whether the server serves the core v1 namespaces resource.
+func servesNamespaces(mapper meta.RESTMapper) bool {
+	_, err := mapper.RESTMapping(namespaceKind, "v1")
+
+	return err == nil
+}
+
+func waitForEstablished(ctx context.Context, client apiextensionsclientset.Interface, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, retryTimeout)
+	defer cancel()
+
+	return wait.PollImmediateUntil(100*time.Millisecond, func() (bool, error) {
+		crd, err := client.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		for _, condition := range crd.Status.Conditions {
+			if condition.Type == apiextensionsv1.Established && condition.Status == apiextensionsv1.ConditionTrue {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}, ctx.Done())
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/restmapping"
+	"k8s.io/client-go/rest"
+)
+
+func TestApplierReportsFailures(t *testing.T) {
+	defer func(timeout time.Duration) { retryTimeout = timeout }(retryTimeout)
+	retryTimeout = 100 * time.Millisecond
+
+	// a server without any API groups, so no manifest can be mapped to a resource
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api":
+			w.Write([]byte(`{"kind": "APIVersions", "versions": []}`))
+		case "/apis":
+			w.Write([]byte(`{"kind": "APIGroupList", "apiVersion": "v1", "groups": []}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	manifests, err := LoadManifests(writeManifests(t, map[string]string{"widget.yaml": widget}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	config := &rest.Config{Host: server.URL}
+
+	mapper, err := restmapping.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	applier := NewApplier(manifests, mapper)
+
+	if err := applier.Check(nil); err != errNotApplied {
+		t.Errorf("expected %v before applying, got %v", errNotApplied, err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	applier.Run(config, stopCh)
+
+	err = applier.Check(nil)
+	if err == nil || !strings.Contains(err.Error(), "widget test/gizmo") || !strings.Contains(err.Error(), `no matches for kind "Widget"`) {
+		t.Errorf("expected the failed widget to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bootstrap preloads objects from manifest files into a running server.
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Manifest is an object read from a manifest file.
+type Manifest struct {
+	// Source is the file the object was read from.
+	Source string
+	// Object is the object to apply.
+	Object *unstructured.Unstructured
+}
+
+func (m Manifest) String() string {
+	name := m.Object.GetName()
+	if namespace := m.Object.GetNamespace(); namespace != "" {
+		name = namespace + "/" + name
+	}
+
+	return fmt.Sprintf("%s %s (%s)", strings.ToLower(m.Object.GetKind()), name, m.Source)
+}
+
+var (
+	customResourceDefinitionKind = schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}
+	namespaceKind                = schema.GroupKind{Kind: "Namespace"}
+)
+
+// LoadManifests reads the objects of the .yaml, .yml and .json files in dir, in file name order.
+// Files may hold several YAML documents and List objects, which are flattened.
+func LoadManifests(dir string) ([]Manifest, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []Manifest{}
+
+	for _, file := range files {
+		switch filepath.Ext(file.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+
+		if file.IsDir() {
+			continue
+		}
+
+		fileManifests, err := loadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", file.Name(), err)
+		}
+
+		manifests = append(manifests, fileManifests...)
+	}
+
+	return manifests, nil
+}
+
+func loadFile(path string) ([]Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DecodeManifests(path, f)
+}
+
+// DecodeManifests reads the YAML documents or JSON objects of r, flattening List objects. source
+// names r in the String of the manifests.
+func DecodeManifests(source string, r io.Reader) ([]Manifest, error) {
+	manifests := []Manifest{}
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	for {
+		object := &unstructured.Unstructured{}
+
+		err := decoder.Decode(&object.Object)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// empty documents, e.g. after a trailing separator
+		if len(object.Object) == 0 {
+			continue
+		}
+
+		objects := []*unstructured.Unstructured{object}
+
+		if object.IsList() {
+			objects = nil
+
+			err := object.EachListItem(func(item runtime.Object) error {
+				objects = append(objects, item.(*unstructured.Unstructured))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, object := range objects {
+			if object.GetAPIVersion() == "" || object.GetKind() == "" || object.GetName() == "" {
+				return nil, fmt.Errorf("object without apiVersion, kind or name: %v", object.Object)
+			}
+
+			manifests = append(manifests, Manifest{Source: source, Object: object})
+		}
+	}
+
+	return manifests, nil
+}
+
+// phase returns the phase manifest is applied in. CustomResourceDefinitions and Namespaces go first,
+// so the objects of the second phase can be in them.
+func phase(manifest Manifest) int {
+	switch manifest.Object.GroupVersionKind().GroupKind() {
+	case customResourceDefinitionKind, namespaceKind:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// phases splits manifests into the phases they are applied in, keeping their order otherwise.
+func phases(manifests []Manifest) [][]Manifest {
+	result := [][]Manifest{{}, {}}
+	for _, manifest := range manifests {
+		p := phase(manifest)
+		result[p] = append(result[p], manifest)
+	}
+
+	return result
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const widget = `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gizmo
+  namespace: test
+`
+
+const widgetCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+`
+
+const namespace = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: test
+`
+
+const apiServiceList = `{"apiVersion": "v1", "kind": "List", "items": [
+  {"apiVersion": "apiregistration.k8s.io/v1", "kind": "APIService", "metadata": {"name": "v1.example.org"}},
+  {"apiVersion": "apiregistration.k8s.io/v1", "kind": "APIService", "metadata": {"name": "v2.example.org"}}
+]}`
+
+func writeManifests(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	return dir
+}
+
+func manifestNames(manifests []Manifest) []string {
+	names := []string{}
+	for _, manifest := range manifests {
+		names = append(names, strings.ToLower(manifest.Object.GetKind())+"/"+manifest.Object.GetName())
+	}
+
+	return names
+}
+
+func TestLoadManifests(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         map[string]string
+		expected      []string
+		expectedError string
+	}{
+		{
+			name: "multiple documents and files in name order",
+			files: map[string]string{
+				"b.yaml": widget,
+				"a.yml":  widgetCRD + "---\n" + namespace + "---\n",
+			},
+			expected: []string{"customresourcedefinition/widgets.example.com", "namespace/test", "widget/gizmo"},
+		},
+		{
+			name:     "lists are flattened",
+			files:    map[string]string{"apiservices.json": apiServiceList},
+			expected: []string{"apiservice/v1.example.org", "apiservice/v2.example.org"},
+		},
+		{
+			name:     "other files are ignored",
+			files:    map[string]string{"README.md": "# fixtures", "widget.yaml": widget},
+			expected: []string{"widget/gizmo"},
+		},
+		{
+			name:          "objects need a name",
+			files:         map[string]string{"widget.yaml": "apiVersion: example.com/v1\nkind: Widget\n"},
+			expectedError: "failed to load widget.yaml: object without apiVersion, kind or name",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			manifests, err := LoadManifests(writeManifests(t, test.files))
+			if test.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+					t.Fatalf("expected error %q, got %v", test.expectedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if names := manifestNames(manifests); !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func TestPhases(t *testing.T) {
+	manifests, err := LoadManifests(writeManifests(t, map[string]string{
+		"manifests.yaml": widget + "---\n" + apiServiceList + "\n---\n" + namespace + "---\n" + widgetCRD,
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := phases(manifests)
+
+	expected := [][]string{
+		{"namespace/test", "customresourcedefinition/widgets.example.com"},
+		{"widget/gizmo", "apiservice/v1.example.org", "apiservice/v2.example.org"},
+	}
+
+	if len(result) != len(expected) {
+		t.Fatalf("expected %d phases, got %d", len(expected), len(result))
+	}
+
+	for i := range expected {
+		if names := manifestNames(result[i]); !reflect.DeepEqual(names, expected[i]) {
+			t.Errorf("expected phase %d to be %v, got %v", i, expected[i], names)
+		}
+	}
+}
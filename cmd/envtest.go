@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/klog"
+)
+
+// envtestIgnoredFlags are the kube-apiserver flags passed by controller-runtime envtest that have no
+// badidea equivalent, with the reason ignoring them is fine.
+var envtestIgnoredFlags = map[string]string{
+	"allow-privileged":                 "there are no pods",
+	"authorization-mode":               "envtest asks for RBAC, which badidea does not serve, and its clients are in system:masters",
+	"disable-admission-plugins":        "badidea runs no admission plugins",
+	"enable-admission-plugins":         "badidea runs no admission plugins",
+	"service-account-issuer":           "there are no service accounts",
+	"service-account-key-file":         "there are no service accounts",
+	"service-account-signing-key-file": "there are no service accounts",
+	"service-cluster-ip-range":         "there are no services",
+}
+
+// newEnvtestCommand returns a command that accepts the flags controller-runtime envtest passes to
+// kube-apiserver, so badidea can be used as its KUBEBUILDER_ASSETS apiserver binary. Flags with a
+// badidea equivalent are mapped onto it, the ones in envtestIgnoredFlags are ignored, and unknown
+// flags only cause a warning.
+func newEnvtestCommand(setupSignalHandler func() <-chan struct{}) *cobra.Command {
+	o := options.NewServerRunOptionsWithFeatureGate(globalFeatureGate())
+
+	fs := pflag.NewFlagSet("envtest", pflag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+
+	secureServing := o.Extensions.RecommendedOptions.SecureServing
+	fs.IntVar(&secureServing.BindPort, "secure-port", secureServing.BindPort, "Port to serve HTTPS on.")
+	fs.IPVar(&secureServing.BindAddress, "bind-address", secureServing.BindAddress, "Address to serve HTTPS on.")
+	fs.IPVar(&o.AdvertiseAddress, "advertise-address", o.AdvertiseAddress, ""+
+		"Address the server is reachable at, included in the generated serving certificate.")
+	// envtest clients talk to the insecure port of kube-apiserver, which skips authorization
+	o.InsecureGroups = []string{user.SystemPrivilegedGroup}
+	fs.IntVar(&o.InsecureServing.BindPort, "insecure-port", o.InsecureServing.BindPort, ""+
+		"Port to serve HTTP on, as a member of system:masters. Zero disables it.")
+	fs.IPVar(&o.InsecureServing.BindAddress, "insecure-bind-address", o.InsecureServing.BindAddress, ""+
+		"Loopback address to serve HTTP on.")
+	fs.StringVar(&secureServing.ServerCert.CertDirectory, "cert-dir", secureServing.ServerCert.CertDirectory, ""+
+		"Directory the generated serving certificate is written to, as apiserver.crt and apiserver.key.")
+
+	etcd := o.Extensions.RecommendedOptions.Etcd
+	fs.StringSliceVar(&etcd.StorageConfig.Transport.ServerList, "etcd-servers", etcd.StorageConfig.Transport.ServerList, ""+
+		"etcd servers to use instead of the embedded etcd, comma separated.")
+
+	ignored := map[string]*string{}
+	for name, reason := range envtestIgnoredFlags {
+		ignored[name] = fs.String(name, "", "Ignored, "+reason+".")
+	}
+
+	return &cobra.Command{
+		Use:                "envtest [kube-apiserver flags]",
+		Short:              "Run badidea with the command line controller-runtime envtest passes to kube-apiserver",
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, arg := range args {
+				if name := flagName(arg); name != "" && name != "help" && fs.Lookup(name) == nil {
+					klog.Warningf("Ignoring unknown flag --%s", name)
+				}
+			}
+
+			if err := fs.Parse(args); errors.Is(err, pflag.ErrHelp) {
+				// the flag set printed its usage already
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			fs.Visit(func(flag *pflag.Flag) {
+				if reason, ok := envtestIgnoredFlags[flag.Name]; ok {
+					klog.Infof("Ignoring flag --%s=%s, %s", flag.Name, *ignored[flag.Name], reason)
+				}
+			})
+
+			o.DisableEmbeddedEtcd = fs.Changed("etcd-servers")
+
+			return run(o, setupSignalHandler)
+		},
+	}
+}
+
+// flagName returns the name of the flag in arg, or "" if arg is not a flag.
+func flagName(arg string) string {
+	if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+		return ""
+	}
+
+	return strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/badideatest"
+	"github.com/thetirefire/badidea/etcd"
+	"go.uber.org/goleak"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+)
+
+func TestMain(m *testing.M) {
+	// the flush daemon of the logs is meant to outlive the commands
+	initLogs()
+
+	goleak.VerifyTestMain(m, badideatest.LeakOptions()...)
+}
+
+func TestEnvtestCommand(t *testing.T) {
+	dir := t.TempDir()
+	ports := freePorts(t, 3)
+
+	stopCh := make(chan struct{})
+
+	etcdURL := fmt.Sprintf("http://127.0.0.1:%d", ports[0])
+
+	etcdStopped, err := etcd.StartEtcdServer(etcd.Config{
+		Dir:       filepath.Join(dir, "etcd"),
+		ClientURL: etcdURL,
+		PeerURL:   fmt.Sprintf("http://127.0.0.1:%d", ports[1]),
+	}, stopCh)
+	if err != nil {
+		t.Fatalf("failed to start etcd: %v", err)
+	}
+
+	certDir := filepath.Join(dir, "certs")
+
+	// the command line of controller-runtime v0.6 envtest, plus newer and unknown flags
+	args := []string{
+		"--advertise-address=127.0.0.1",
+		"--etcd-servers=" + etcdURL,
+		"--cert-dir=" + certDir,
+		"--insecure-port=0",
+		"--insecure-bind-address=127.0.0.1",
+		fmt.Sprintf("--secure-port=%d", ports[2]),
+		"--disable-admission-plugins=ServiceAccount",
+		"--service-cluster-ip-range=10.0.0.0/24",
+		"--allow-privileged=true",
+		"--authorization-mode=RBAC",
+		"--service-account-signing-key-file=" + filepath.Join(dir, "sa.key"),
+		"--some-future-flag=value",
+	}
+
+	cmd := newEnvtestCommand(func() <-chan struct{} { return stopCh })
+	cmd.SetArgs(args)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- cmd.Execute()
+	}()
+
+	defer func() {
+		close(stopCh)
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Errorf("command failed: %v", err)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Errorf("command did not return within %v", wait.ForeverTestTimeout)
+		}
+
+		<-etcdStopped
+	}()
+
+	clientConfig := &rest.Config{
+		Host:            fmt.Sprintf("https://127.0.0.1:%d", ports[2]),
+		TLSClientConfig: rest.TLSClientConfig{CAFile: filepath.Join(certDir, "apiserver.crt")},
+	}
+
+	err = wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		select {
+		case err := <-errCh:
+			errCh <- err
+			return false, fmt.Errorf("command exited: %v", err)
+		default:
+		}
+
+		client, err := apiextensionsclientset.NewForConfig(clientConfig)
+		if err != nil {
+			return false, nil
+		}
+
+		// stopping the server before its post-start hooks finished makes them exit the process
+		_, err = client.Discovery().RESTClient().Get().AbsPath("/readyz").DoRaw(context.TODO())
+
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("control plane did not come up: %v", err)
+	}
+
+	client, err := apiextensionsclientset.NewForConfig(clientConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := client.ApiextensionsV1().CustomResourceDefinitions().List(context.TODO(), metav1.ListOptions{}); err != nil {
+		t.Errorf("failed to list CRDs: %v", err)
+	}
+}
+
+func TestFlagName(t *testing.T) {
+	tests := map[string]string{
+		"--secure-port=6443": "secure-port",
+		"--allow-privileged": "allow-privileged",
+		"-v=4":               "v",
+		"10.0.0.0/24":        "",
+		"--":                 "",
+		"-":                  "",
+		"--etcd-servers=a=b": "etcd-servers",
+		"--cert-dir":         "cert-dir",
+	}
+
+	for arg, expected := range tests {
+		if name := flagName(arg); name != expected {
+			t.Errorf("expected flag name %q for %q, got %q", expected, arg, name)
+		}
+	}
+}
+
+// freePorts returns n ports that were free a moment ago.
+func freePorts(t *testing.T, n int) []int {
+	ports := []int{}
+
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer listener.Close()
+
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	return ports
+}
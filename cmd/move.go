@@ -0,0 +1,74 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thetirefire/badidea/move"
+)
+
+// newMoveCommand returns a command moving the objects of a namespace of a running server to another
+// namespace.
+func newMoveCommand() *cobra.Command {
+	o := move.Options{}
+
+	cmd := &cobra.Command{
+		Use:   "move --from NAMESPACE --to NAMESPACE",
+		Short: "Move the objects of a namespace of a server to another namespace",
+		Args:  cobra.NoArgs,
+	}
+
+	clientConfig := clientConfigFlags(cmd.Flags())
+	cmd.Flags().StringVar(&o.From, "from", o.From, "Namespace to move the objects from.")
+	cmd.Flags().StringVar(&o.To, "to", o.To, "Namespace to move the objects to.")
+	cmd.Flags().StringSliceVar(&o.Resources, "resource", o.Resources, ""+
+		"Resources to move, in resource.group form, comma separated or repeated. The objects of all resources are moved if empty.")
+	cmd.Flags().BoolVar(&o.DryRun, "dry-run", o.DryRun, ""+
+		"Only check that the objects can be created in the target namespace, without changing anything.")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return err
+		}
+
+		report, err := move.Move(context.Background(), config, o)
+		if report == nil {
+			return err
+		}
+
+		verb := "moved"
+		if o.DryRun {
+			verb = "would move"
+		}
+
+		for _, object := range report.Moved {
+			fmt.Fprintf(cmd.OutOrStdout(), "%s %s\n", verb, object)
+		}
+
+		for _, skipped := range report.Skipped {
+			fmt.Fprintf(cmd.OutOrStdout(), "skipped %s\n", skipped)
+		}
+
+		return err
+	}
+
+	return cmd
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/thetirefire/badidea/options"
+)
+
+// flagInfo describes a flag of the server for the options command.
+type flagInfo struct {
+	Name      string `json:"name"`
+	Shorthand string `json:"shorthand,omitempty"`
+	Section   string `json:"section"`
+	Type      string `json:"type"`
+	// Default is the default as pflag prints it, like <nil> for an IP without default.
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// newOptionsCommand returns a command printing the flags of the server with the options o, by
+// section, with their defaults as JSON, for tools generating configurations. It has to run before the
+// flags of o are parsed, which they are not for subcommands.
+func newOptionsCommand(o *options.ServerRunOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "options",
+		Short: "Print the flags of the server with their defaults as JSON",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fss := o.Flags()
+			flags := []flagInfo{}
+
+			for _, section := range fss.Order {
+				fss.FlagSets[section].VisitAll(func(f *pflag.Flag) {
+					flags = append(flags, flagInfo{
+						Name:      f.Name,
+						Shorthand: f.Shorthand,
+						Section:   section,
+						Type:      f.Value.Type(),
+						Default:   f.DefValue,
+						Usage:     f.Usage,
+					})
+				})
+			}
+
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			encoder.SetEscapeHTML(false)
+
+			return encoder.Encode(flags)
+		},
+	}
+}
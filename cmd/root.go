@@ -14,36 +14,195 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/thetirefire/badidea/apiserver"
+	"github.com/thetirefire/badidea/features"
+	"github.com/thetirefire/badidea/options"
 	"github.com/thetirefire/badidea/server"
+	"k8s.io/apimachinery/pkg/util/runtime"
 	genericapiserver "k8s.io/apiserver/pkg/server"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/component-base/featuregate"
 	"k8s.io/component-base/logs"
+	"k8s.io/component-base/term"
 	"k8s.io/klog"
 )
 
+// addGlobalFeatureGates guards adding the badidea gates to the global gate, which is closed once
+// the flags of the first command are added.
+var addGlobalFeatureGates sync.Once
+
+// globalFeatureGate returns the global feature gate, adding the badidea gates to it first. The
+// commands share it with the generic apiserver libraries, so that --feature-gates toggles both the
+// inherited and the badidea gates. Embedders importing this package keep the global gate as it is
+// until they create a command.
+func globalFeatureGate() featuregate.MutableFeatureGate {
+	addGlobalFeatureGates.Do(func() {
+		runtime.Must(features.AddFeatureGates(utilfeature.DefaultMutableFeatureGate))
+	})
+
+	return utilfeature.DefaultMutableFeatureGate
+}
+
 func NewRootCommand() *cobra.Command {
-	rootCmd := &cobra.Command{
+	o := options.NewServerRunOptionsWithFeatureGate(globalFeatureGate())
+
+	rootCmd := newServerCommand(o, genericapiserver.SetupSignalHandler)
+
+	rootCmd.AddCommand(newEnvtestCommand(genericapiserver.SetupSignalHandler))
+	rootCmd.AddCommand(newExportCommand())
+	rootCmd.AddCommand(newImportCommand(genericapiserver.SetupSignalHandler))
+	rootCmd.AddCommand(newMoveCommand())
+	rootCmd.AddCommand(newCompletionCommand())
+	rootCmd.AddCommand(newOptionsCommand(o))
+
+	return rootCmd
+}
+
+// newServerCommand returns the command running a badidea server with the options o, which its flags
+// are added to. Its help lists the flags in the sections of o.Flags.
+func newServerCommand(o *options.ServerRunOptions, setupSignalHandler func() <-chan struct{}) *cobra.Command {
+	cmd := &cobra.Command{
 		Use:     "badidea",
 		Short:   "badidea",
 		Version: "0.1",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			logs.InitLogs()
+			// the flags parsed, so a failing server is no usage error, and run logs it
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+
+			return run(o, setupSignalHandler)
+		},
+	}
+
+	fss := o.Flags()
+	addGlobalFlags(fss.FlagSet("global"), cmd.Name())
+
+	for _, name := range fss.Order {
+		cmd.Flags().AddFlagSet(fss.FlagSets[name])
+	}
+
+	// the subcommands inherit the usage and help functions, they keep the default ones
+	defaultUsage, defaultHelp := cmd.UsageFunc(), cmd.HelpFunc()
+
+	cmd.SetUsageFunc(func(c *cobra.Command) error {
+		if c != cmd {
+			return defaultUsage(c)
+		}
+
+		printSectionedUsage(c.OutOrStderr(), c, fss)
+
+		return nil
+	})
+
+	cmd.SetHelpFunc(func(c *cobra.Command, args []string) {
+		if c != cmd {
+			defaultHelp(c, args)
+			return
+		}
+
+		fmt.Fprintf(c.OutOrStdout(), "%s\n\n", c.Short)
+		printSectionedUsage(c.OutOrStdout(), c, fss)
+	})
+
+	return cmd
+}
 
-			// if _, err := logs.GlogSetter("8"); err != nil {
-			// 	klog.Fatal(err)
-			// }
+// addGlobalFlags adds the flags of the command that are not options of the server: the help and
+// version flags cobra would add, and the flags the libraries add to the global flag set.
+func addGlobalFlags(fs *pflag.FlagSet, name string) {
+	fs.BoolP("help", "h", false, "help for "+name)
+	fs.BoolP("version", "v", false, "version for "+name)
+	logs.AddFlags(fs)
+}
 
-			defer logs.FlushLogs()
+// printSectionedUsage prints the usage of cmd with its flags in the sections of fss, wrapped to the
+// width of the terminal.
+func printSectionedUsage(w io.Writer, cmd *cobra.Command, fss cliflag.NamedFlagSets) {
+	fmt.Fprintf(w, "Usage:\n  %s\n", cmd.UseLine())
 
-			stopCh := genericapiserver.SetupSignalHandler()
+	if cmd.HasAvailableSubCommands() {
+		fmt.Fprintf(w, "  %s [command]\n\nAvailable Commands:\n", cmd.CommandPath())
 
-			if err := server.RunBadIdeaServer(stopCh); err != nil {
-				klog.Fatal(err)
+		for _, c := range cmd.Commands() {
+			if c.IsAvailableCommand() {
+				fmt.Fprintf(w, "  %s %s\n", rpad(c.Name(), c.NamePadding()), c.Short)
 			}
+		}
+	}
 
-			return nil
-		},
+	cols, _, _ := term.TerminalSize(w)
+	cliflag.PrintSections(w, fss, cols)
+
+	if cmd.HasAvailableSubCommands() {
+		fmt.Fprintf(w, "\nUse \"%s [command] --help\" for more information about a command.\n", cmd.CommandPath())
 	}
+}
 
-	return rootCmd
+func rpad(s string, padding int) string {
+	return fmt.Sprintf("%-*s", padding, s)
+}
+
+var initLogsOnce sync.Once
+
+// initLogs initializes logging once. Its flush daemon runs for the lifetime of the process.
+func initLogs() {
+	initLogsOnce.Do(logs.InitLogs)
+}
+
+// run runs a badidea server until the channel returned by setupSignalHandler is closed. It logs the
+// error it returns.
+func run(o *options.ServerRunOptions, setupSignalHandler func() <-chan struct{}) error {
+	initLogs()
+
+	// if _, err := logs.GlogSetter("8"); err != nil {
+	// 	klog.Fatal(err)
+	// }
+
+	defer logs.FlushLogs()
+
+	var reason server.ShutdownReason
+
+	completedOptions, err := o.Complete()
+	if err != nil {
+		err = apiserver.NewStageError(apiserver.ErrInvalidOptions, err)
+		reason = server.ShutdownReasonFor(err)
+	} else {
+		reason, err = server.RunBadIdeaServer(completedOptions, setupSignalHandler())
+	}
+
+	if err != nil {
+		klog.Errorf("badidea shut down on %v: %v", reason, err)
+	} else {
+		klog.Infof("badidea shut down: %v", reason)
+	}
+
+	return err
+}
+
+// exitCodes are the exit codes of the reasons a server shuts down for, distinct for restart
+// policies of service managers.
+var exitCodes = map[server.ShutdownReason]int{
+	server.ShutdownStopped:        0,
+	server.ShutdownInvalidConfig:  2,
+	server.ShutdownEtcdFailure:    3,
+	server.ShutdownServingFailure: 4,
+}
+
+// ExitCode returns the exit code of the error a command returned: the code of the shutdown reason
+// for nil and the errors of the stages of the server chain, 1 for other errors like usage errors.
+func ExitCode(err error) int {
+	var stageErr *apiserver.StageError
+	if err != nil && !errors.As(err, &stageErr) {
+		return 1
+	}
+
+	return exitCodes[server.ShutdownReasonFor(err)]
 }
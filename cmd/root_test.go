@@ -0,0 +1,303 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/apiserver"
+	"github.com/thetirefire/badidea/etcd"
+	"github.com/thetirefire/badidea/options"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{
+			name:     "clean shutdown",
+			expected: 0,
+		},
+		{
+			name:     "other error",
+			err:      errors.New("unknown flag"),
+			expected: 1,
+		},
+		{
+			name:     "invalid options",
+			err:      apiserver.NewStageError(apiserver.ErrInvalidOptions, errors.New("invalid --watch-cache-sizes")),
+			expected: 2,
+		},
+		{
+			name:     "invalid serving certificates",
+			err:      apiserver.NewStageError(apiserver.ErrInvalidServingCerts, errors.New("no such file")),
+			expected: 2,
+		},
+		{
+			name:     "storage version downgrade",
+			err:      apiserver.NewStageError(apiserver.ErrStorageVersionSkew, errors.New("customresourcedefinitions.apiextensions.k8s.io")),
+			expected: 2,
+		},
+		{
+			name:     "wrapped etcd failure",
+			err:      fmt.Errorf("failed to start: %w", apiserver.NewStageError(apiserver.ErrEtcdUnavailable, errors.New("timeout"))),
+			expected: 3,
+		},
+		{
+			name:     "serving failure",
+			err:      apiserver.NewStageError(apiserver.ErrServing, errors.New("address already in use")),
+			expected: 4,
+		},
+		{
+			name:     "first stage recorded",
+			err:      apiserver.NewStageError(apiserver.ErrAggregatorServer, apiserver.NewStageError(apiserver.ErrEtcdUnavailable, errors.New("timeout"))),
+			expected: 3,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			if code := ExitCode(test.err); code != test.expected {
+				t.Errorf("expected exit code %d, got %d", test.expected, code)
+			}
+		})
+	}
+}
+
+func TestServerCommandExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// etcdRunning starts an etcd on the ports of the embedded etcd, which dies on start
+		etcdRunning bool
+
+		expected int
+		// expectedOutput is whether cobra prints the error, which run logs otherwise
+		expectedOutput bool
+	}{
+		{
+			name:           "unknown flag",
+			args:           []string{"--no-such-flag"},
+			expected:       1,
+			expectedOutput: true,
+		},
+		{
+			name:     "invalid flag",
+			args:     []string{"--max-stored-objects=-1"},
+			expected: 2,
+		},
+		{
+			name:        "etcd failure",
+			etcdRunning: true,
+			expected:    3,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ports := freePorts(t, 2)
+
+			etcdConfig := etcd.Config{
+				Dir:       filepath.Join(dir, "etcd"),
+				ClientURL: fmt.Sprintf("http://127.0.0.1:%d", ports[0]),
+				PeerURL:   fmt.Sprintf("http://127.0.0.1:%d", ports[1]),
+			}
+
+			if test.etcdRunning {
+				etcdStopCh := make(chan struct{})
+
+				etcdStopped, err := etcd.StartEtcdServer(etcd.Config{
+					Dir:       filepath.Join(dir, "running-etcd"),
+					ClientURL: etcdConfig.ClientURL,
+					PeerURL:   etcdConfig.PeerURL,
+				}, etcdStopCh)
+				if err != nil {
+					t.Fatalf("failed to start etcd: %v", err)
+				}
+
+				defer func() {
+					// the etcd health check of the storage polls until it reached etcd once
+					err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+						stacks := make([]byte, 1<<20)
+						stacks = stacks[:runtime.Stack(stacks, true)]
+
+						return !bytes.Contains(stacks, []byte("factory.newETCD3HealthCheck")), nil
+					})
+					if err != nil {
+						t.Errorf("the etcd health check did not reach etcd: %v", err)
+					}
+
+					close(etcdStopCh)
+					<-etcdStopped
+				}()
+			}
+
+			o, err := options.NewServerRunOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o.EmbeddedEtcd = etcdConfig
+			o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{etcdConfig.ClientURL}
+			o.InMemoryServingCert = true
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			o.Extensions.RecommendedOptions.SecureServing.Listener = listener
+
+			stopCh := make(chan struct{})
+
+			cmd := newServerCommand(o, func() <-chan struct{} { return stopCh })
+			var out bytes.Buffer
+
+			cmd.SetArgs(test.args)
+			cmd.SetOut(&out)
+			cmd.SetErr(&out)
+
+			err = cmd.Execute()
+			close(stopCh)
+
+			if code := ExitCode(err); code != test.expected {
+				t.Errorf("expected exit code %d, got %d: %v", test.expected, code, err)
+			}
+
+			if (out.Len() > 0) != test.expectedOutput {
+				t.Errorf("expected output %v, got %q", test.expectedOutput, out.String())
+			}
+		})
+	}
+}
+
+func TestServerCommandHelp(t *testing.T) {
+	var out bytes.Buffer
+
+	cmd := NewRootCommand()
+	cmd.SetArgs([]string{"--help"})
+	cmd.SetOut(&out)
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	help := out.String()
+
+	for _, section := range []string{"Serving", "Etcd", "Authentication", "Authorization", "Admission", "Logging", "Global"} {
+		if !strings.Contains(help, "\n"+section+" flags:\n") {
+			t.Errorf("expected the help to have a section of %s flags:\n%s", section, help)
+		}
+	}
+
+	for _, expected := range []string{"--bind-address", "--wait-for-etcd", "--feature-gates", "--help", "Available Commands:", "completion"} {
+		if !strings.Contains(help, expected) {
+			t.Errorf("expected the help to contain %q", expected)
+		}
+	}
+
+	// the subcommands keep the help of cobra
+	out.Reset()
+
+	cmd = NewRootCommand()
+	cmd.SetArgs([]string{"move", "--help"})
+	cmd.SetOut(&out)
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if help := out.String(); !strings.Contains(help, "--from") || strings.Contains(help, "Serving flags:") {
+		t.Errorf("expected the help of the move command, got:\n%s", help)
+	}
+}
+
+func TestCompletionCommand(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		var out bytes.Buffer
+
+		cmd := NewRootCommand()
+		cmd.SetArgs([]string{"completion", shell})
+		cmd.SetOut(&out)
+
+		if err := cmd.Execute(); err != nil {
+			t.Errorf("failed to generate the %s completion: %v", shell, err)
+			continue
+		}
+
+		if !strings.Contains(out.String(), "badidea") {
+			t.Errorf("expected a %s completion script for badidea, got:\n%s", shell, out.String())
+		}
+	}
+
+	cmd := NewRootCommand()
+	cmd.SetArgs([]string{"completion", "tcsh"})
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+
+	if err := cmd.Execute(); err == nil {
+		t.Errorf("expected an unsupported shell to be rejected")
+	}
+}
+
+func TestOptionsCommand(t *testing.T) {
+	var out bytes.Buffer
+
+	cmd := NewRootCommand()
+	cmd.SetArgs([]string{"options"})
+	cmd.SetOut(&out)
+
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var flags []flagInfo
+	if err := json.Unmarshal(out.Bytes(), &flags); err != nil {
+		t.Fatalf("expected JSON: %v", err)
+	}
+
+	found := map[string]flagInfo{}
+	for _, f := range flags {
+		found[f.Name] = f
+	}
+
+	expected := flagInfo{Name: "request-timeout", Section: "serving", Type: "duration", Default: "1m0s"}
+	if f := found[expected.Name]; f.Section != expected.Section || f.Type != expected.Type || f.Default != expected.Default || f.Usage == "" {
+		t.Errorf("expected %+v, got %+v", expected, f)
+	}
+
+	if _, ok := found["wait-for-etcd"]; !ok || len(flags) != len(found) {
+		t.Errorf("expected every flag once, got %d flags", len(flags))
+	}
+}
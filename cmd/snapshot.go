@@ -0,0 +1,123 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/thetirefire/badidea/snapshot"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// clientConfigFlags binds the kubeconfig, cluster and user flags of kubectl to fs.
+func clientConfigFlags(fs *pflag.FlagSet) clientcmd.ClientConfig {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	fs.StringVar(&loadingRules.ExplicitPath, "kubeconfig", "", "Path to the kubeconfig file of the server.")
+
+	// the namespace flags of kubectl make no sense here, snapshots span all namespaces and moves two
+	flags := clientcmd.RecommendedConfigOverrideFlags("")
+	overrides := &clientcmd.ConfigOverrides{}
+	clientcmd.BindAuthInfoFlags(&overrides.AuthInfo, fs, flags.AuthOverrideFlags)
+	clientcmd.BindClusterFlags(&overrides.ClusterInfo, fs, flags.ClusterOverrideFlags)
+	flags.CurrentContext.BindStringFlag(fs, &overrides.CurrentContext)
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+}
+
+func addSnapshotFlags(fs *pflag.FlagSet, o *snapshot.Options) {
+	fs.StringSliceVar(&o.IncludeGroups, "include-groups", o.IncludeGroups, ""+
+		"API groups to include, comma separated. All groups are included if empty.")
+	fs.StringSliceVar(&o.ExcludeGroups, "exclude-groups", o.ExcludeGroups, ""+
+		"API groups to leave out, comma separated.")
+}
+
+// newExportCommand returns a command writing the objects of a running server to an archive.
+func newExportCommand() *cobra.Command {
+	o := snapshot.Options{}
+	output := "-"
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write all objects served by a server to a gzipped tar archive of manifests",
+		Args:  cobra.NoArgs,
+	}
+
+	clientConfig := clientConfigFlags(cmd.Flags())
+	addSnapshotFlags(cmd.Flags(), &o)
+	cmd.Flags().BoolVar(&o.KeepManagedFields, "keep-managed-fields", o.KeepManagedFields, ""+
+		"Keep metadata.managedFields in the exported objects.")
+	cmd.Flags().StringVarP(&output, "output", "o", output, "File to write the archive to, - for standard output.")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return err
+		}
+
+		var w io.Writer = os.Stdout
+
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			w = f
+		}
+
+		return snapshot.Export(context.Background(), config, w, o)
+	}
+
+	return cmd
+}
+
+// newImportCommand returns a command applying the objects of an archive written by export to a
+// running server.
+func newImportCommand(setupSignalHandler func() <-chan struct{}) *cobra.Command {
+	o := snapshot.Options{}
+
+	cmd := &cobra.Command{
+		Use:   "import ARCHIVE",
+		Short: "Apply the objects of an archive written by export to a server",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	clientConfig := clientConfigFlags(cmd.Flags())
+	addSnapshotFlags(cmd.Flags(), &o)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return snapshot.Import(config, f, o, setupSignalHandler())
+	}
+
+	return cmd
+}
@@ -18,6 +18,7 @@ package crdregistration
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -52,7 +53,16 @@ type crdRegistrationController struct {
 
 	syncHandler func(groupVersion schema.GroupVersion) error
 
-	syncedInitialSet chan struct{}
+	syncedInitialSet     chan struct{}
+	syncedInitialSetOnce sync.Once
+
+	// heartbeat is called every heartbeatPeriod by a worker, if it is not nil.
+	heartbeat       func()
+	heartbeatPeriod time.Duration
+
+	// startOnce guards the parts of Run that must only happen once, so Run can be called again
+	// after a panic.
+	startOnce sync.Once
 
 	// queue is where incoming work is placed to de-dup and to allow "easy" rate limited requeues on errors
 	// this is actually keyed by a groupVersion
@@ -103,10 +113,21 @@ func NewCRDRegistrationController(crdinformer crdinformers.CustomResourceDefinit
 	return c
 }
 
-func (c *crdRegistrationController) Run(threadiness int, stopCh <-chan struct{}) {
+// heartbeatKey is queued every heartbeat period, so the heartbeats show that the workers still
+// process the queue.
+type heartbeatKey struct{}
+
+// SetHeartbeat makes a worker call heartbeat every period once Run started the workers. It must be
+// called before Run.
+func (c *crdRegistrationController) SetHeartbeat(period time.Duration, heartbeat func()) {
+	c.heartbeat = heartbeat
+	c.heartbeatPeriod = period
+}
+
+// Run processes the initial set of CRDs and starts the workers with goWorker, which has to run the
+// worker in a new goroutine. It is safe to call Run again if a previous call panicked.
+func (c *crdRegistrationController) Run(threadiness int, stopCh <-chan struct{}, goWorker func(worker func())) {
 	defer utilruntime.HandleCrash()
-	// make sure the work queue is shutdown which will trigger workers to end
-	defer c.queue.ShutDown()
 
 	klog.Infof("Starting crd-autoregister controller")
 	defer klog.Infof("Shutting down crd-autoregister controller")
@@ -128,14 +149,28 @@ func (c *crdRegistrationController) Run(threadiness int, stopCh <-chan struct{})
 			}
 		}
 	}
-	close(c.syncedInitialSet)
+	c.syncedInitialSetOnce.Do(func() { close(c.syncedInitialSet) })
+
+	c.startOnce.Do(func() {
+		// make sure the work queue is shutdown which will trigger workers to end
+		go func() {
+			<-stopCh
+			c.queue.ShutDown()
+		}()
+
+		// start up your worker threads based on threadiness.  Some controllers have multiple kinds of workers
+		for i := 0; i < threadiness; i++ {
+			// runWorker will loop until "something bad" happens.  The .Until will then rekick the worker
+			// after one second. A panic leaves the .Until for goWorker to handle.
+			goWorker(func() {
+				wait.Until(c.runWorker, time.Second, stopCh)
+			})
+		}
 
-	// start up your worker threads based on threadiness.  Some controllers have multiple kinds of workers
-	for i := 0; i < threadiness; i++ {
-		// runWorker will loop until "something bad" happens.  The .Until will then rekick the worker
-		// after one second
-		go wait.Until(c.runWorker, time.Second, stopCh)
-	}
+		if c.heartbeat != nil {
+			go wait.Until(func() { c.queue.Add(heartbeatKey{}) }, c.heartbeatPeriod, stopCh)
+		}
+	})
 
 	// wait until we're told to stop
 	<-stopCh
@@ -163,6 +198,13 @@ func (c *crdRegistrationController) processNextWorkItem() bool {
 	// you always have to indicate to the queue that you've completed a piece of work
 	defer c.queue.Done(key)
 
+	if _, ok := key.(heartbeatKey); ok {
+		c.heartbeat()
+		c.queue.Forget(key)
+
+		return true
+	}
+
 	// do your work on the key.  This method will contains your "do stuff" logic
 	err := c.syncHandler(key.(schema.GroupVersion))
 	if err == nil {
@@ -0,0 +1,735 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package garbagecollector deletes the objects whose owners are gone, in place of the garbage
+// collector of the kube-controller-manager, which badidea does not run.
+package garbagecollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// objectReference identifies an object watched by the garbage collector.
+type objectReference struct {
+	resource  schema.GroupVersionResource
+	namespace string
+	name      string
+	uid       types.UID
+}
+
+func (r objectReference) String() string {
+	if r.namespace == "" {
+		return fmt.Sprintf("%s %s (%s)", r.resource, r.name, r.uid)
+	}
+
+	return fmt.Sprintf("%s %s/%s (%s)", r.resource, r.namespace, r.name, r.uid)
+}
+
+// monitor watches the metadata of the objects of one resource.
+type monitor struct {
+	informer cache.SharedIndexInformer
+	stopCh   chan struct{}
+}
+
+// GarbageCollector watches the metadata of every resource that can be listed, watched and deleted,
+// and implements the propagation policies of deletes:
+//
+//   - dependents are deleted in the background once none of their owners exist anymore,
+//   - the dependents of owners deleted in the foreground are deleted in the foreground, and the
+//     foregroundDeletion finalizer of the owner is removed once the dependents blocking its deletion
+//     are gone,
+//   - the references of dependents to owners deleted with the orphan policy are removed, and then the
+//     orphan finalizer of the owner.
+//
+// Unlike the garbage collector of the kube-controller-manager, it keeps no graph of owners that were
+// not observed. Owners are looked up with the API, so objects are only deleted once the server
+// confirms their owners are gone.
+type GarbageCollector struct {
+	metadataClient  metadata.Interface
+	discoveryClient discovery.CachedDiscoveryInterface
+	restMapper      meta.RESTMapper
+	resyncPeriod    time.Duration
+
+	// queue holds the UIDs of the objects to check.
+	queue    workqueue.RateLimitingInterface
+	resyncCh chan struct{}
+
+	// heartbeat is called every heartbeatPeriod by a worker, if it is not nil.
+	heartbeat       func()
+	heartbeatPeriod time.Duration
+
+	lock     sync.Mutex
+	monitors map[schema.GroupVersionResource]*monitor
+	// objects are the references of the objects watched, by UID.
+	objects map[types.UID]objectReference
+	// dependents are the UIDs of the dependents of the owners, by owner UID.
+	dependents map[types.UID]map[types.UID]bool
+}
+
+// New returns a garbage collector of the objects of the server of the clients. restMapper maps the
+// kinds of owner references to resources. If it has a Reset method, it is reset before a kind without
+// a match is considered gone. The resources to watch are discovered every resyncPeriod
+// with the information cached by discoveryClient, which has to expire it, and after the changes of the
+// informers passed to ResyncOn with fresh information.
+func New(metadataClient metadata.Interface, discoveryClient discovery.CachedDiscoveryInterface, restMapper meta.RESTMapper, resyncPeriod time.Duration) *GarbageCollector {
+	return &GarbageCollector{
+		metadataClient:  metadataClient,
+		discoveryClient: discoveryClient,
+		restMapper:      restMapper,
+		resyncPeriod:    resyncPeriod,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "garbage_collector"),
+		resyncCh:        make(chan struct{}, 1),
+		monitors:        map[schema.GroupVersionResource]*monitor{},
+		objects:         map[types.UID]objectReference{},
+		dependents:      map[types.UID]map[types.UID]bool{},
+	}
+}
+
+// heartbeatKey is queued every heartbeat period, so the heartbeats show that the workers still
+// process the queue.
+type heartbeatKey struct{}
+
+// SetHeartbeat makes a worker call heartbeat every period while the garbage collector runs. It must be
+// called before Run.
+func (gc *GarbageCollector) SetHeartbeat(period time.Duration, heartbeat func()) {
+	gc.heartbeat = heartbeat
+	gc.heartbeatPeriod = period
+}
+
+// ResyncOn discovers the resources to watch again whenever an object of informer is added, updated
+// or deleted, e.g. a CustomResourceDefinition becoming established.
+func (gc *GarbageCollector) ResyncOn(informer cache.SharedInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { gc.Resync() },
+		UpdateFunc: func(oldObj, newObj interface{}) { gc.Resync() },
+		DeleteFunc: func(obj interface{}) { gc.Resync() },
+	})
+}
+
+// Resync discovers the resources to watch again with fresh information, once the garbage collector
+// runs.
+func (gc *GarbageCollector) Resync() {
+	select {
+	case gc.resyncCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches the resources and runs workers until stopCh is closed. It must only be called once.
+func (gc *GarbageCollector) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer gc.queue.ShutDown()
+
+	klog.Infof("Starting garbage collector")
+	defer klog.Infof("Shutting down garbage collector")
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(gc.resyncPeriod)
+		defer ticker.Stop()
+
+		// periodic resyncs rely on the discovery client to drop stale information
+		invalidate := true
+
+		for {
+			gc.resync(invalidate)
+
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				invalidate = false
+			case <-gc.resyncCh:
+				invalidate = true
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(gc.runWorker, time.Second, stopCh)
+	}
+
+	if gc.heartbeat != nil {
+		go wait.Until(func() { gc.queue.Add(heartbeatKey{}) }, gc.heartbeatPeriod, stopCh)
+	}
+
+	<-stopCh
+	wg.Wait()
+
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	for resource, m := range gc.monitors {
+		close(m.stopCh)
+		delete(gc.monitors, resource)
+	}
+}
+
+// resync starts monitors for the resources that can be listed, watched and deleted, and stops those
+// of the resources that are gone. Groups failing discovery keep their monitors. The discovery
+// information is invalidated first if invalidate is set.
+func (gc *GarbageCollector) resync(invalidate bool) {
+	if invalidate {
+		gc.discoveryClient.Invalidate()
+	}
+
+	resources, err := deletableResources(gc.discoveryClient)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to discover the resources to collect garbage of: %w", err))
+	}
+
+	failed := map[schema.GroupVersion]bool{}
+	if groupErr, ok := err.(*discovery.ErrGroupDiscoveryFailed); ok {
+		for gv := range groupErr.Groups {
+			failed[gv] = true
+		}
+	} else if err != nil && len(resources) == 0 {
+		return
+	}
+
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	for resource, m := range gc.monitors {
+		if resources[resource] || failed[resource.GroupVersion()] {
+			continue
+		}
+
+		klog.V(2).Infof("Garbage collector stops watching %s", resource)
+		close(m.stopCh)
+		delete(gc.monitors, resource)
+
+		// the objects of the resource are not watched anymore, like if they were deleted
+		for _, obj := range m.informer.GetStore().List() {
+			gc.objectDeleted(obj)
+		}
+	}
+
+	for resource := range resources {
+		if _, ok := gc.monitors[resource]; ok {
+			continue
+		}
+
+		klog.V(2).Infof("Garbage collector starts watching %s", resource)
+		gc.monitors[resource] = gc.newMonitor(resource)
+	}
+}
+
+// deletableResources returns the preferred versions of the resources that can be listed, watched
+// and deleted. The error of groups failing discovery is returned along with the other resources.
+func deletableResources(discoveryClient discovery.DiscoveryInterface) (map[schema.GroupVersionResource]bool, error) {
+	lists, discoveryErr := discoveryClient.ServerPreferredResources()
+
+	deletable := discovery.FilteredBy(discovery.SupportsAllVerbs{Verbs: []string{"delete", "list", "watch"}}, lists)
+
+	gvrs, err := discovery.GroupVersionResources(deletable)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := map[schema.GroupVersionResource]bool{}
+	for gvr := range gvrs {
+		resources[gvr] = true
+	}
+
+	return resources, discoveryErr
+}
+
+// newMonitor starts watching resource. The lock has to be held.
+func (gc *GarbageCollector) newMonitor(resource schema.GroupVersionResource) *monitor {
+	informer := metadatainformer.NewFilteredMetadataInformer(gc.metadataClient, resource, metav1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			gc.lock.Lock()
+			defer gc.lock.Unlock()
+
+			gc.objectChanged(resource, nil, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			gc.lock.Lock()
+			defer gc.lock.Unlock()
+
+			gc.objectChanged(resource, oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			gc.lock.Lock()
+			defer gc.lock.Unlock()
+
+			gc.objectDeleted(obj)
+		},
+	})
+
+	m := &monitor{informer: informer, stopCh: make(chan struct{})}
+	go informer.Run(m.stopCh)
+
+	return m
+}
+
+// objectChanged indexes the owners of obj, replacing old if it is not nil, and queues obj if it has
+// owners or waits for its dependents. The lock has to be held.
+func (gc *GarbageCollector) objectChanged(resource schema.GroupVersionResource, old, obj interface{}) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	if old != nil {
+		if oldAccessor, err := meta.Accessor(old); err == nil {
+			gc.unindexOwners(oldAccessor)
+		}
+	}
+
+	gc.objects[accessor.GetUID()] = objectReference{resource: resource, namespace: accessor.GetNamespace(), name: accessor.GetName(), uid: accessor.GetUID()}
+
+	for _, owner := range accessor.GetOwnerReferences() {
+		if gc.dependents[owner.UID] == nil {
+			gc.dependents[owner.UID] = map[types.UID]bool{}
+		}
+
+		gc.dependents[owner.UID][accessor.GetUID()] = true
+	}
+
+	if len(accessor.GetOwnerReferences()) > 0 || accessor.GetDeletionTimestamp() != nil {
+		gc.queue.Add(accessor.GetUID())
+	}
+}
+
+// objectDeleted forgets obj, and queues its dependents, whose owner is gone, and its owners, which
+// may wait for it to be gone. The lock has to be held.
+func (gc *GarbageCollector) objectDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	gc.unindexOwners(accessor)
+	delete(gc.objects, accessor.GetUID())
+
+	for dependent := range gc.dependents[accessor.GetUID()] {
+		gc.queue.Add(dependent)
+	}
+
+	for _, owner := range accessor.GetOwnerReferences() {
+		gc.queue.Add(owner.UID)
+	}
+}
+
+// unindexOwners removes obj from the dependents of its owners. The lock has to be held.
+func (gc *GarbageCollector) unindexOwners(obj metav1.Object) {
+	for _, owner := range obj.GetOwnerReferences() {
+		delete(gc.dependents[owner.UID], obj.GetUID())
+
+		if len(gc.dependents[owner.UID]) == 0 {
+			delete(gc.dependents, owner.UID)
+		}
+	}
+}
+
+func (gc *GarbageCollector) runWorker() {
+	for gc.processNextWorkItem() {
+	}
+}
+
+// processNextWorkItem checks the object of the next UID off the queue. It returns false when it is
+// time to quit.
+func (gc *GarbageCollector) processNextWorkItem() bool {
+	key, quit := gc.queue.Get()
+	if quit {
+		return false
+	}
+	defer gc.queue.Done(key)
+
+	// heartbeats do not wait for the monitors, they show that the workers are not wedged
+	if _, ok := key.(heartbeatKey); ok {
+		gc.heartbeat()
+		gc.queue.Forget(key)
+
+		return true
+	}
+
+	// the dependents of an owner are only known once every resource is listed
+	if !gc.synced() {
+		gc.queue.AddAfter(key, 100*time.Millisecond)
+		return true
+	}
+
+	if err := gc.sync(key.(types.UID)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("garbage collection of %v failed: %w", key, err))
+		gc.queue.AddRateLimited(key)
+
+		return true
+	}
+
+	gc.queue.Forget(key)
+
+	return true
+}
+
+// synced returns whether every monitor listed its resource.
+func (gc *GarbageCollector) synced() bool {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	for _, m := range gc.monitors {
+		if !m.informer.HasSynced() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sync handles the object of uid: it processes the finalizers of the garbage collector if it is being
+// deleted, and checks its owners otherwise.
+func (gc *GarbageCollector) sync(uid types.UID) error {
+	ref, obj, ok := gc.get(uid)
+	if !ok {
+		return nil
+	}
+
+	if obj.GetDeletionTimestamp() != nil {
+		switch {
+		case hasFinalizer(obj, metav1.FinalizerOrphanDependents):
+			return gc.orphanDependents(ref, obj)
+		case hasFinalizer(obj, metav1.FinalizerDeleteDependents):
+			return gc.deleteDependents(ref, obj)
+		}
+	}
+
+	if len(obj.GetOwnerReferences()) > 0 {
+		return gc.checkOwners(ref, obj)
+	}
+
+	return nil
+}
+
+// get returns the reference and the cached metadata of the object of uid.
+func (gc *GarbageCollector) get(uid types.UID) (objectReference, metav1.Object, bool) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	ref, ok := gc.objects[uid]
+	if !ok {
+		return ref, nil, false
+	}
+
+	m, ok := gc.monitors[ref.resource]
+	if !ok {
+		return ref, nil, false
+	}
+
+	key := ref.name
+	if ref.namespace != "" {
+		key = ref.namespace + "/" + ref.name
+	}
+
+	item, exists, err := m.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return ref, nil, false
+	}
+
+	obj, err := meta.Accessor(item)
+	if err != nil || obj.GetUID() != uid {
+		return ref, nil, false
+	}
+
+	return ref, obj, true
+}
+
+// ownerState is the state of an owner of a dependent.
+type ownerState int
+
+const (
+	ownerAbsent ownerState = iota
+	ownerDeletingDependents
+	ownerPresent
+	// ownerInvalid is the state of namespaced owners of cluster-scoped dependents, which cannot be
+	// looked up.
+	ownerInvalid
+)
+
+// checkOwners deletes obj if none of its owners exist anymore, in the foreground if one of them is
+// deleted in the foreground. If some owners still exist, the references to those that are gone are
+// removed. Dependents with an invalid owner reference are left alone.
+func (gc *GarbageCollector) checkOwners(ref objectReference, obj metav1.Object) error {
+	var absent, deletingDependents, present []metav1.OwnerReference
+
+	for _, owner := range obj.GetOwnerReferences() {
+		state, err := gc.ownerState(ref, owner)
+		if err != nil {
+			return err
+		}
+
+		switch state {
+		case ownerInvalid:
+			klog.Warningf("Skipping %s: its owner %s %s is namespaced, it cannot be the owner of a cluster-scoped object", ref, owner.Kind, owner.Name)
+			return nil
+		case ownerAbsent:
+			absent = append(absent, owner)
+		case ownerDeletingDependents:
+			deletingDependents = append(deletingDependents, owner)
+		default:
+			present = append(present, owner)
+		}
+	}
+
+	switch {
+	case len(present) > 0 && len(absent) > 0:
+		klog.V(2).Infof("Removing the references of %s to its deleted owners", ref)
+		return gc.removeOwnerReferences(ref, obj, absent)
+	case len(present) > 0:
+		return nil
+	case len(deletingDependents) > 0:
+		if obj.GetDeletionTimestamp() != nil {
+			return nil
+		}
+
+		klog.V(2).Infof("Deleting %s in the foreground, its owners are deleted in the foreground", ref)
+		return gc.delete(ref, metav1.DeletePropagationForeground)
+	default:
+		if obj.GetDeletionTimestamp() != nil {
+			return nil
+		}
+
+		klog.V(2).Infof("Deleting %s, its owners are gone", ref)
+		return gc.delete(ref, metav1.DeletePropagationBackground)
+	}
+}
+
+// ownerState looks up owner, an owner of the object of ref, with the API. Owners of a kind the server
+// does not serve anymore are absent.
+func (gc *GarbageCollector) ownerState(ref objectReference, owner metav1.OwnerReference) (ownerState, error) {
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return ownerAbsent, err
+	}
+
+	mapping, err := gc.restMapper.RESTMapping(gv.WithKind(owner.Kind).GroupKind(), gv.Version)
+	if meta.IsNoMatchError(err) {
+		// the kind may be gone, or missing from stale discovery information
+		if resettable, ok := gc.restMapper.(interface{ Reset() }); ok {
+			resettable.Reset()
+		}
+
+		mapping, err = gc.restMapper.RESTMapping(gv.WithKind(owner.Kind).GroupKind(), gv.Version)
+		if meta.IsNoMatchError(err) {
+			klog.V(2).Infof("The owner %s %s of %s is absent, the server does not serve its kind", owner.Kind, owner.Name, ref)
+			return ownerAbsent, nil
+		}
+	}
+
+	if err != nil {
+		return ownerAbsent, err
+	}
+
+	// owners are in the namespace of their dependents, or cluster-scoped
+	namespace := ""
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if ref.namespace == "" {
+			return ownerInvalid, nil
+		}
+
+		namespace = ref.namespace
+	}
+
+	found, err := gc.metadataClient.Resource(mapping.Resource).Namespace(namespace).Get(context.TODO(), owner.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return ownerAbsent, nil
+	case err != nil:
+		return ownerAbsent, err
+	case found.UID != owner.UID:
+		return ownerAbsent, nil
+	case found.DeletionTimestamp != nil && hasFinalizer(found, metav1.FinalizerDeleteDependents):
+		return ownerDeletingDependents, nil
+	default:
+		return ownerPresent, nil
+	}
+}
+
+// orphanDependents removes the references to obj, an owner deleted with the orphan propagation
+// policy, from its dependents, and then its orphan finalizer.
+func (gc *GarbageCollector) orphanDependents(ref objectReference, obj metav1.Object) error {
+	for _, dependent := range gc.dependentsOf(obj.GetUID()) {
+		dependentRef, dependentObj, ok := gc.get(dependent)
+		if !ok {
+			continue
+		}
+
+		owners := []metav1.OwnerReference{}
+		for _, owner := range dependentObj.GetOwnerReferences() {
+			if owner.UID == obj.GetUID() {
+				owners = append(owners, owner)
+			}
+		}
+
+		if err := gc.removeOwnerReferences(dependentRef, dependentObj, owners); err != nil {
+			return err
+		}
+	}
+
+	klog.V(2).Infof("Orphaned the dependents of %s", ref)
+
+	return gc.removeFinalizer(ref, obj, metav1.FinalizerOrphanDependents)
+}
+
+// deleteDependents deletes the dependents of obj, an owner deleted in the foreground, and removes
+// its foregroundDeletion finalizer once the dependents blocking its deletion are gone.
+func (gc *GarbageCollector) deleteDependents(ref objectReference, obj metav1.Object) error {
+	blocking := 0
+
+	for _, dependent := range gc.dependentsOf(obj.GetUID()) {
+		dependentRef, dependentObj, ok := gc.get(dependent)
+		if !ok {
+			continue
+		}
+
+		for _, owner := range dependentObj.GetOwnerReferences() {
+			if owner.UID == obj.GetUID() && owner.BlockOwnerDeletion != nil && *owner.BlockOwnerDeletion {
+				blocking++
+			}
+		}
+
+		if dependentObj.GetDeletionTimestamp() == nil {
+			klog.V(2).Infof("Deleting %s in the foreground, its owner %s is deleted in the foreground", dependentRef, ref)
+
+			if err := gc.delete(dependentRef, metav1.DeletePropagationForeground); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the owner is queued again as its dependents are deleted
+	if blocking > 0 {
+		return nil
+	}
+
+	klog.V(2).Infof("Deleted the dependents of %s", ref)
+
+	return gc.removeFinalizer(ref, obj, metav1.FinalizerDeleteDependents)
+}
+
+// dependentsOf returns the UIDs of the dependents of the owner of uid.
+func (gc *GarbageCollector) dependentsOf(uid types.UID) []types.UID {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	dependents := []types.UID{}
+	for dependent := range gc.dependents[uid] {
+		dependents = append(dependents, dependent)
+	}
+
+	return dependents
+}
+
+// delete deletes the object of ref, unless it was replaced by an object of the same name.
+func (gc *GarbageCollector) delete(ref objectReference, propagationPolicy metav1.DeletionPropagation) error {
+	err := gc.metadataClient.Resource(ref.resource).Namespace(ref.namespace).Delete(context.TODO(), ref.name, metav1.DeleteOptions{
+		Preconditions:     &metav1.Preconditions{UID: &ref.uid},
+		PropagationPolicy: &propagationPolicy,
+	})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+
+	return err
+}
+
+// removeOwnerReferences removes owners from the owner references of obj.
+func (gc *GarbageCollector) removeOwnerReferences(ref objectReference, obj metav1.Object, owners []metav1.OwnerReference) error {
+	removed := map[types.UID]bool{}
+	for _, owner := range owners {
+		removed[owner.UID] = true
+	}
+
+	remaining := []metav1.OwnerReference{}
+	for _, owner := range obj.GetOwnerReferences() {
+		if !removed[owner.UID] {
+			remaining = append(remaining, owner)
+		}
+	}
+
+	return gc.patchMetadata(ref, obj, map[string]interface{}{"ownerReferences": remaining})
+}
+
+// removeFinalizer removes finalizer from obj.
+func (gc *GarbageCollector) removeFinalizer(ref objectReference, obj metav1.Object, finalizer string) error {
+	remaining := []string{}
+	for _, f := range obj.GetFinalizers() {
+		if f != finalizer {
+			remaining = append(remaining, f)
+		}
+	}
+
+	return gc.patchMetadata(ref, obj, map[string]interface{}{"finalizers": remaining})
+}
+
+// patchMetadata merges metadata into the metadata of obj. The patch fails if obj changed since it
+// was observed, so it is retried with the current object.
+func (gc *GarbageCollector) patchMetadata(ref objectReference, obj metav1.Object, metadata map[string]interface{}) error {
+	metadata["uid"] = obj.GetUID()
+	metadata["resourceVersion"] = obj.GetResourceVersion()
+
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+
+	_, err = gc.metadataClient.Resource(ref.resource).Namespace(ref.namespace).Patch(context.TODO(), ref.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func hasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollector
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestDependentsIndex(t *testing.T) {
+	gc := New(nil, nil, nil, 0)
+	defer gc.queue.ShutDown()
+
+	widgets := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+
+	newObject := func(name string, owners ...types.UID) *metav1.PartialObjectMetadata {
+		obj := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)}}
+		for _, owner := range owners {
+			obj.OwnerReferences = append(obj.OwnerReferences, metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Widget", Name: string(owner), UID: owner})
+		}
+
+		return obj
+	}
+
+	drain := func() []types.UID {
+		uids := []types.UID{}
+		for gc.queue.Len() > 0 {
+			key, _ := gc.queue.Get()
+			gc.queue.Done(key)
+			uids = append(uids, key.(types.UID))
+		}
+
+		return uids
+	}
+
+	// objects without owners are not checked
+	gc.objectChanged(widgets, nil, newObject("parent"))
+
+	if uids := drain(); len(uids) != 0 {
+		t.Errorf("expected no objects to be queued, got %v", uids)
+	}
+
+	child := newObject("child", "parent")
+	gc.objectChanged(widgets, nil, child)
+
+	if uids := drain(); len(uids) != 1 || uids[0] != "child" {
+		t.Errorf("expected the child to be queued, got %v", uids)
+	}
+
+	if !gc.dependents["parent"]["child"] {
+		t.Errorf("expected the child to be a dependent of the parent, got %v", gc.dependents)
+	}
+
+	// deleting the owner queues its dependents
+	gc.objectDeleted(cache.DeletedFinalStateUnknown{Key: "default/parent", Obj: newObject("parent")})
+
+	if uids := drain(); len(uids) != 1 || uids[0] != "child" {
+		t.Errorf("expected the child to be queued, got %v", uids)
+	}
+
+	// removing the reference to the owner forgets the dependent
+	gc.objectChanged(widgets, child, newObject("child", "other"))
+	drain()
+
+	if _, ok := gc.dependents["parent"]; ok {
+		t.Errorf("expected the parent to have no dependents, got %v", gc.dependents)
+	}
+
+	// deleting the dependent queues its owners, which may wait for it
+	gc.objectDeleted(newObject("child", "other"))
+
+	if uids := drain(); len(uids) != 1 || uids[0] != "other" {
+		t.Errorf("expected the owner to be queued, got %v", uids)
+	}
+
+	if len(gc.dependents) != 0 || len(gc.objects) != 0 {
+		t.Errorf("expected all objects to be forgotten, got %v and %v", gc.dependents, gc.objects)
+	}
+}
+
+// resettableRESTMapper counts its resets.
+type resettableRESTMapper struct {
+	meta.RESTMapper
+	resets int
+}
+
+func (m *resettableRESTMapper) Reset() {
+	m.resets++
+}
+
+func TestCheckOwners(t *testing.T) {
+	widgets := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	gadgets := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "gadgets"}
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{widgets.GroupVersion()})
+	mapper.Add(widgets.GroupVersion().WithKind("Widget"), meta.RESTScopeNamespace)
+	mapper.Add(gadgets.GroupVersion().WithKind("Gadget"), meta.RESTScopeRoot)
+
+	parent := &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "example.com/v1", Kind: "Widget"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "parent", UID: "parent"},
+	}
+
+	tests := []struct {
+		name  string
+		ref   objectReference
+		owner metav1.OwnerReference
+
+		expectedDelete bool
+		expectedResets int
+	}{
+		{
+			name:  "present owner",
+			ref:   objectReference{resource: widgets, namespace: "default", name: "child", uid: "child"},
+			owner: metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Widget", Name: "parent", UID: "parent"},
+		},
+		{
+			name:           "absent owner",
+			ref:            objectReference{resource: widgets, namespace: "default", name: "child", uid: "child"},
+			owner:          metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Widget", Name: "other", UID: "other"},
+			expectedDelete: true,
+		},
+		{
+			name:           "owner of a kind that is gone",
+			ref:            objectReference{resource: widgets, namespace: "default", name: "child", uid: "child"},
+			owner:          metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Sprocket", Name: "parent", UID: "parent"},
+			expectedDelete: true,
+			expectedResets: 1,
+		},
+		{
+			name:  "namespaced owner of a cluster-scoped dependent",
+			ref:   objectReference{resource: gadgets, name: "machine", uid: "machine"},
+			owner: metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Widget", Name: "parent", UID: "parent"},
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			if err := metav1.AddMetaToScheme(scheme); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			client := fake.NewSimpleMetadataClient(scheme, parent.DeepCopy())
+			restMapper := &resettableRESTMapper{RESTMapper: mapper}
+
+			gc := New(client, nil, restMapper, 0)
+			defer gc.queue.ShutDown()
+
+			obj := &metav1.ObjectMeta{Namespace: test.ref.namespace, Name: test.ref.name, UID: test.ref.uid, OwnerReferences: []metav1.OwnerReference{test.owner}}
+			if err := gc.checkOwners(test.ref, obj); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			deleted := false
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "delete" {
+					deleted = true
+				}
+			}
+
+			if deleted != test.expectedDelete {
+				t.Errorf("expected the dependent to be deleted %v, got %v: %v", test.expectedDelete, deleted, client.Actions())
+			}
+
+			if restMapper.resets != test.expectedResets {
+				t.Errorf("expected %d resets of the RESTMapper, got %d", test.expectedResets, restMapper.resets)
+			}
+		})
+	}
+}
@@ -14,6 +14,7 @@ limitations under the License.
 package etcd
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"time"
@@ -22,29 +23,62 @@ import (
 	"k8s.io/klog"
 )
 
-// RunBadIdeaServer starts a new BadIdeaServer.
+// Config configures the embedded etcd server.
+type Config struct {
+	// Dir is the data directory.
+	Dir string
+	// ClientURL is the URL etcd serves clients on.
+	ClientURL string
+	// PeerURL is the URL etcd serves peers on. Nobody joins, but etcd needs it anyway.
+	PeerURL string
+}
+
+// DefaultConfig is the configuration of the etcd server of the badidea command. The sockets are
+// relative to the working directory, so only one such server can run per directory.
+func DefaultConfig() Config {
+	return Config{
+		Dir:       "default.etcd",
+		ClientURL: "unix://etcd-socket:2379",
+		PeerURL:   "unix://etcd-socket:2380",
+	}
+}
+
+// RunEtcdServer starts an etcd server with the default configuration.
 func RunEtcdServer(stopCh <-chan struct{}) error {
-	embed.DefaultInitialAdvertisePeerURLs = "unix://etcd-socket:2380"
-	embed.DefaultAdvertiseClientURLs = "unix://etcd-socket:2379"
+	_, err := StartEtcdServer(DefaultConfig(), stopCh)
+
+	return err
+}
 
-	peerURL, err := url.Parse(embed.DefaultInitialAdvertisePeerURLs)
+// StartEtcdServer starts an etcd server and waits until it is ready. The server stops when stopCh is
+// closed, and the returned channel is closed once it has. If etcd exits before, the channel receives
+// the error it exited with before it is closed.
+func StartEtcdServer(c Config, stopCh <-chan struct{}) (<-chan error, error) {
+	peerURL, err := url.Parse(c.PeerURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	clientURL, err := url.Parse(embed.DefaultAdvertiseClientURLs)
+	clientURL, err := url.Parse(c.ClientURL)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := prepareSockets(clientURL, peerURL); err != nil {
+		return nil, err
 	}
 
 	cfg := embed.NewConfig()
-	cfg.Dir = "default.etcd"
+	cfg.Dir = c.Dir
 	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
 	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
 
 	e, err := embed.StartEtcd(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	select {
@@ -53,20 +87,29 @@ func RunEtcdServer(stopCh <-chan struct{}) error {
 	case <-time.After(time.Minute):
 		e.Server.Stop() // trigger a shutdown
 		e.Close()
-		return fmt.Errorf("server took too long to start")
+		return nil, fmt.Errorf("server took too long to start")
 	}
 
+	stopped := make(chan error, 1)
+
 	go func() {
+		defer close(stopped)
+
 		select {
 		case <-stopCh:
 			klog.Info("Stopping etcd Server")
 			e.Server.Stop()
 			e.Close()
 		case err := <-e.Err():
-			klog.Fatalf("etcd exited: %v", err)
+			klog.Errorf("etcd exited: %v", err)
+			e.Close()
+			stopped <- err
+		case <-e.Server.StopNotify():
+			klog.Error("etcd Server stopped")
 			e.Close()
+			stopped <- errors.New("etcd server stopped")
 		}
 	}()
 
-	return nil
+	return stopped, nil
 }
@@ -0,0 +1,174 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package etcd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// socketDialTimeout bounds dialing a unix socket to tell whether anything listens on it.
+const socketDialTimeout = time.Second
+
+// The conditions of a unix socket etcd is served on. A SocketError of a condition matches its error
+// with errors.Is.
+var (
+	// ErrSocketNotCreated is a socket that does not exist yet.
+	ErrSocketNotCreated = errors.New("not created yet")
+	// ErrSocketStale is a socket nothing listens on, left behind by an etcd that did not shut down
+	// cleanly.
+	ErrSocketStale = errors.New("nothing is listening, the socket is stale")
+	// ErrSocketPermissionDenied is a socket the user of the process may not connect to, e.g. one owned
+	// by another user.
+	ErrSocketPermissionDenied = errors.New("permission denied")
+	// ErrNoSocket is a file at the path of a socket that is no unix socket.
+	ErrNoSocket = errors.New("no unix socket")
+)
+
+// SocketError is a unix socket etcd is served on that cannot be connected to.
+type SocketError struct {
+	// Path is the path of the socket.
+	Path string
+	// Condition is the condition of the socket, e.g. ErrSocketStale.
+	Condition error
+	// Err is the error the condition was told from, if any.
+	Err error
+}
+
+func (e *SocketError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("etcd socket %s: %v", e.Path, e.Condition)
+	}
+
+	return fmt.Sprintf("etcd socket %s: %v: %v", e.Path, e.Condition, e.Err)
+}
+
+// Unwrap returns the condition of the socket.
+func (e *SocketError) Unwrap() error {
+	return e.Condition
+}
+
+// dialSocket connects to the unix socket at path.
+var dialSocket = func(path string) (net.Conn, error) {
+	return net.DialTimeout("unix", path, socketDialTimeout)
+}
+
+// CheckSocket checks the unix socket at path etcd is served on. It returns nil if something accepts
+// connections on it, and a SocketError of ErrSocketNotCreated, ErrSocketStale,
+// ErrSocketPermissionDenied or ErrNoSocket otherwise.
+func CheckSocket(path string) error {
+	info, err := os.Lstat(path)
+
+	switch {
+	case os.IsNotExist(err):
+		return &SocketError{Path: path, Condition: ErrSocketNotCreated}
+	case os.IsPermission(err):
+		return &SocketError{Path: path, Condition: ErrSocketPermissionDenied, Err: err}
+	case err != nil:
+		return &SocketError{Path: path, Condition: ErrSocketNotCreated, Err: err}
+	case info.Mode()&os.ModeSocket == 0:
+		return &SocketError{Path: path, Condition: ErrNoSocket, Err: fmt.Errorf("the file has mode %v", info.Mode())}
+	}
+
+	conn, err := dialSocket(path)
+
+	switch {
+	case err == nil:
+		conn.Close()
+		return nil
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return &SocketError{Path: path, Condition: ErrSocketPermissionDenied, Err: fmt.Errorf("the socket has mode %v", info.Mode())}
+	case errors.Is(err, syscall.ENOENT):
+		return &SocketError{Path: path, Condition: ErrSocketNotCreated}
+	default:
+		return &SocketError{Path: path, Condition: ErrSocketStale, Err: err}
+	}
+}
+
+// socketPath returns the path of the socket of a unix URL, and false for other URLs.
+func socketPath(u *url.URL) (string, bool) {
+	if u.Scheme != "unix" && u.Scheme != "unixs" {
+		return "", false
+	}
+
+	return u.Host + u.Path, true
+}
+
+// prepareSockets checks the unix sockets of urls before the embedded etcd listens on them. Stale
+// sockets are removed, etcd would replace sockets something listens on, like another etcd started
+// in the same directory.
+func prepareSockets(urls ...*url.URL) error {
+	for _, u := range urls {
+		path, ok := socketPath(u)
+		if !ok {
+			continue
+		}
+
+		err := CheckSocket(path)
+
+		switch {
+		case err == nil:
+			return fmt.Errorf("etcd socket %s: something is listening already, e.g. another etcd in the same directory", path)
+		case errors.Is(err, ErrSocketNotCreated):
+		case errors.Is(err, ErrSocketStale):
+			klog.Warningf("Removing the stale etcd socket %s, nothing is listening on it", path)
+
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove the stale etcd socket %s: %w", path, err)
+			}
+		default:
+			klog.Errorf("Cannot serve etcd on its socket: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckServers checks the unix sockets of the external etcd servers, so a socket that cannot become
+// reachable fails the startup right away, naming the condition, instead of the storage retrying it.
+// Sockets not created yet are logged only, the etcd servers may be coming up.
+func CheckServers(servers []string) error {
+	for _, server := range servers {
+		u, err := url.Parse(server)
+		if err != nil {
+			continue
+		}
+
+		path, ok := socketPath(u)
+		if !ok {
+			continue
+		}
+
+		err = CheckSocket(path)
+
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrSocketNotCreated):
+			klog.Warningf("Waiting for etcd: %v", err)
+		default:
+			klog.Errorf("Cannot connect to etcd: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
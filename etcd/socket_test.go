@@ -0,0 +1,150 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package etcd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// listen listens on a unix socket at path, which is left behind when the listener is closed.
+func listen(t *testing.T, path string) *net.UnixListener {
+	t.Helper()
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", path, err)
+	}
+
+	listener.SetUnlinkOnClose(false)
+	t.Cleanup(func() { listener.Close() })
+
+	return listener
+}
+
+func TestCheckSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	live := filepath.Join(dir, "live")
+	listen(t, live)
+
+	stale := filepath.Join(dir, "stale")
+	listen(t, stale).Close()
+
+	denied := filepath.Join(dir, "denied")
+	listen(t, denied)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// root connects to sockets of any mode, so the refusal of the kernel is faked
+	dial := dialSocket
+	dialSocket = func(path string) (net.Conn, error) {
+		if path == denied {
+			return nil, &net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.EACCES)}
+		}
+
+		return dial(path)
+	}
+	defer func() { dialSocket = dial }()
+
+	tests := []struct {
+		name string
+		path string
+
+		expectedCondition error
+	}{
+		{name: "listening", path: live},
+		{name: "not created", path: filepath.Join(dir, "missing"), expectedCondition: ErrSocketNotCreated},
+		{name: "stale", path: stale, expectedCondition: ErrSocketStale},
+		{name: "permission denied", path: denied, expectedCondition: ErrSocketPermissionDenied},
+		{name: "no socket", path: file, expectedCondition: ErrNoSocket},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckSocket(test.path)
+			if test.expectedCondition == nil {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, test.expectedCondition) {
+				t.Fatalf("expected %q, got %v", test.expectedCondition, err)
+			}
+
+			if !strings.Contains(err.Error(), test.path) {
+				t.Errorf("expected the error to name %s, got %q", test.path, err.Error())
+			}
+		})
+	}
+}
+
+func TestPrepareSockets(t *testing.T) {
+	dir := t.TempDir()
+
+	stale := filepath.Join(dir, "stale")
+	listen(t, stale).Close()
+
+	if err := prepareSockets(&url.URL{Scheme: "unix", Host: stale}, &url.URL{Scheme: "unix", Host: filepath.Join(dir, "missing")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale socket to be removed, got %v", err)
+	}
+
+	live := filepath.Join(dir, "live")
+	listen(t, live)
+
+	if err := prepareSockets(&url.URL{Scheme: "unix", Host: live}); err == nil {
+		t.Error("expected a socket something listens on to be refused")
+	}
+
+	if _, err := os.Lstat(live); err != nil {
+		t.Errorf("expected the live socket to be kept, got %v", err)
+	}
+}
+
+func TestCheckServers(t *testing.T) {
+	dir := t.TempDir()
+
+	stale := filepath.Join(dir, "stale")
+	listen(t, stale).Close()
+
+	if err := CheckServers([]string{"http://127.0.0.1:2379", "unix://" + filepath.Join(dir, "missing")}); err != nil {
+		t.Errorf("expected servers that may still come up to pass, got %v", err)
+	}
+
+	if err := CheckServers([]string{"unix://" + stale}); !errors.Is(err, ErrSocketStale) {
+		t.Errorf("expected %q, got %v", ErrSocketStale, err)
+	}
+
+	if _, err := os.Lstat(stale); err != nil {
+		t.Errorf("expected the socket of an external etcd to be kept, got %v", err)
+	}
+}
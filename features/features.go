@@ -0,0 +1,122 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/component-base/featuregate"
+)
+
+const (
+	// Every badidea feature gate should be prefixed with BadIdea and follow this template:
+	//
+	// // alpha: v0.1
+	// //
+	// // BadIdeaMyFeature does something.
+	// BadIdeaMyFeature featuregate.Feature = "BadIdeaMyFeature"
+
+	// beta: v0.1
+	//
+	// BadIdeaCRDAutoRegistration registers an APIService with the aggregator for every served
+	// CustomResourceDefinition group version, so CRD groups show up in aggregated discovery.
+	BadIdeaCRDAutoRegistration featuregate.Feature = "BadIdeaCRDAutoRegistration"
+
+	// alpha: v0.1
+	//
+	// BadIdeaUserAnnotations stamps the objects created and updated by users with the
+	// badidea.x-k8s.io/created-by and badidea.x-k8s.io/updated-by annotations, naming the user.
+	BadIdeaUserAnnotations featuregate.Feature = "BadIdeaUserAnnotations"
+
+	// alpha: v0.1
+	//
+	// BadIdeaInstanceStatus serves the badidea.x-k8s.io group, whose Instance describes the features,
+	// component versions, etcd mode, subsystems and readiness of the server.
+	BadIdeaInstanceStatus featuregate.Feature = "BadIdeaInstanceStatus"
+
+	// alpha: v0.1
+	//
+	// BadIdeaCRDSelectableFields lets field selectors of lists and watches select the fields of custom
+	// resources their CRD lists in the badidea.x-k8s.io/selectable-fields annotation.
+	BadIdeaCRDSelectableFields featuregate.Feature = "BadIdeaCRDSelectableFields"
+)
+
+// defaultBadIdeaFeatureGates consists of all known badidea-specific feature keys.
+// To add a new feature, define a key for it above and add it here.
+var defaultBadIdeaFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	BadIdeaCRDAutoRegistration: {Default: true, PreRelease: featuregate.Beta},
+	BadIdeaUserAnnotations:     {Default: false, PreRelease: featuregate.Alpha},
+	BadIdeaInstanceStatus:      {Default: false, PreRelease: featuregate.Alpha},
+	BadIdeaCRDSelectableFields: {Default: false, PreRelease: featuregate.Alpha},
+}
+
+// AddFeatureGates adds the badidea feature gates to gate. Embedders should pass a gate scoped to a
+// single server instance; only the standalone command registers them on the global gate.
+func AddFeatureGates(gate featuregate.MutableFeatureGate) error {
+	return gate.Add(defaultBadIdeaFeatureGates)
+}
+
+// Enabled returns whether each badidea feature is enabled in gate, which has to know them.
+func Enabled(gate featuregate.FeatureGate) map[featuregate.Feature]bool {
+	enabled := map[featuregate.Feature]bool{}
+
+	for feature := range defaultBadIdeaFeatureGates {
+		enabled[feature] = gate.Enabled(feature)
+	}
+
+	return enabled
+}
+
+// AddFlag adds the --feature-gates flag for gate to fs. Unlike the stock flag, setting an
+// unrecognized gate fails with an error that lists the gates the server knows about.
+func AddFlag(gate featuregate.MutableFeatureGate, fs *pflag.FlagSet) {
+	gate.AddFlag(fs)
+
+	flag := fs.Lookup("feature-gates")
+	flag.Value = &featureGatesValue{Value: flag.Value, gate: gate}
+}
+
+// featureGatesValue decorates the feature gate flag value with a friendlier error.
+type featureGatesValue struct {
+	pflag.Value
+	gate featuregate.MutableFeatureGate
+}
+
+func (v *featureGatesValue) Set(value string) error {
+	err := v.Value.Set(value)
+	if err == nil || !strings.HasPrefix(err.Error(), "unrecognized feature gate") {
+		return err
+	}
+
+	return fmt.Errorf("%w (known feature gates: %s)", err, strings.Join(knownFeatureNames(v.gate), ", "))
+}
+
+// knownFeatureNames returns the sorted names of the settable features of gate.
+func knownFeatureNames(gate featuregate.MutableFeatureGate) []string {
+	names := []string{}
+
+	for _, known := range gate.KnownFeatures() {
+		names = append(names, strings.SplitN(known, "=", 2)[0])
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package features
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"k8s.io/component-base/featuregate"
+)
+
+func TestFeatureGatesFlag(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+
+		expectedEnabled bool
+		expectedErr     string
+	}{
+		{
+			name:            "default",
+			expectedEnabled: true,
+		},
+		{
+			name:            "disable badidea gate",
+			value:           "BadIdeaCRDAutoRegistration=false",
+			expectedEnabled: false,
+		},
+		{
+			name:        "unknown gate",
+			value:       "BadIdeaCRDAutoRegistraton=false",
+			expectedErr: "known feature gates: AllAlpha, AllBeta, BadIdeaCRDAutoRegistration, BadIdeaCRDSelectableFields, BadIdeaInstanceStatus, BadIdeaUserAnnotations",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			gate := featuregate.NewFeatureGate()
+			if err := AddFeatureGates(gate); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			AddFlag(gate, fs)
+
+			args := []string{}
+			if test.value != "" {
+				args = append(args, "--feature-gates="+test.value)
+			}
+
+			err := fs.Parse(args)
+			if test.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", test.expectedErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if enabled := gate.Enabled(BadIdeaCRDAutoRegistration); enabled != test.expectedEnabled {
+				t.Errorf("expected %s=%t, got %t", BadIdeaCRDAutoRegistration, test.expectedEnabled, enabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+)
+
+// maxProxyErrorBytes is how much of a plain text error is kept for the message of the Status.
+const maxProxyErrorBytes = 1024
+
+// apiContentTypes are the media types of responses that clients decode as API objects.
+var apiContentTypes = map[string]bool{
+	runtime.ContentTypeJSON:     true,
+	runtime.ContentTypeYAML:     true,
+	runtime.ContentTypeProtobuf: true,
+}
+
+// WithAPIServiceErrorStatus turns the plain text errors of the aggregator proxy into Status objects
+// with reason ServiceUnavailable naming the APIService in their details, so clients can handle them
+// like other API errors. The proxy writes them when it cannot resolve the service of an APIService,
+// cannot connect to it, e.g. for TLS failures, or the backend answers with a server error that is
+// no API object itself. Responses of API group versions with a content type of API objects are
+// passed on unchanged.
+func WithAPIServiceErrorStatus(handler http.Handler, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := apiServiceName(req.URL.Path)
+		if name == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		rw := &apiServiceErrorWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(rw, req)
+
+		if !rw.failed {
+			return
+		}
+
+		message := strings.TrimSpace(string(rw.body))
+		if message == "" {
+			message = http.StatusText(rw.status)
+		}
+
+		err := apierrors.NewServiceUnavailable(fmt.Sprintf("the APIService %s failed to serve the request: %s", name, message))
+		err.ErrStatus.Details = &metav1.StatusDetails{Name: name, Group: "apiregistration.k8s.io", Kind: "APIService"}
+
+		// the headers of the plain text error, possibly copied from the backend, do not describe the Status
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Encoding")
+		responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+	})
+}
+
+// apiServiceName returns the name of the APIService serving path, or "" if path belongs to no API
+// group version.
+func apiServiceName(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		return parts[1] + "."
+	case len(parts) >= 3 && parts[0] == "apis":
+		return parts[2] + "." + parts[1]
+	}
+
+	return ""
+}
+
+// apiServiceErrorWriter holds back server errors that are no API objects.
+type apiServiceErrorWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	// failed is set when the response is held back
+	failed bool
+	status int
+	body   []byte
+}
+
+func (w *apiServiceErrorWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if code >= http.StatusInternalServerError && !isAPIContentType(w.Header().Get("Content-Type")) {
+		w.failed = true
+		w.status = code
+
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *apiServiceErrorWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.failed {
+		if remaining := maxProxyErrorBytes - len(w.body); remaining > 0 {
+			if len(b) < remaining {
+				remaining = len(b)
+			}
+			w.body = append(w.body, b[:remaining]...)
+		}
+
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *apiServiceErrorWriter) Flush() {
+	if w.failed {
+		return
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *apiServiceErrorWriter) CloseNotify() <-chan bool {
+	//nolint:staticcheck // the generic apiserver filters still rely on http.CloseNotifier
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *apiServiceErrorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func isAPIContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && apiContentTypes[mediaType]
+}
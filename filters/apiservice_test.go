@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithAPIServiceErrorStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		backend http.HandlerFunc
+
+		expectedCode    int
+		expectedBody    string
+		expectedMessage string
+		expectedName    string
+	}{
+		{
+			name: "resolver failure",
+			path: "/apis/metrics.example.com/v1/widgets",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				// what the proxy writes when the service of the APIService cannot be resolved
+				http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			},
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedMessage: "the APIService v1.metrics.example.com failed to serve the request: service unavailable",
+			expectedName:    "v1.metrics.example.com",
+		},
+		{
+			name: "TLS failure",
+			path: "/apis/metrics.example.com/v1",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				// what the proxy writes when it cannot connect to the backend
+				http.Error(w, "x509: certificate signed by unknown authority", http.StatusServiceUnavailable)
+			},
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedMessage: "the APIService v1.metrics.example.com failed to serve the request: x509: certificate signed by unknown authority",
+			expectedName:    "v1.metrics.example.com",
+		},
+		{
+			name: "backend 502",
+			path: "/apis/metrics.example.com/v1beta1/namespaces/default/widgets",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Length", "22")
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte("<html>Bad Gateway</html>"))
+			},
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedMessage: "the APIService v1beta1.metrics.example.com failed to serve the request: <html>Bad Gateway</html>",
+			expectedName:    "v1beta1.metrics.example.com",
+		},
+		{
+			name: "core group",
+			path: "/api/v1/pods",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedMessage: "the APIService v1. failed to serve the request: Internal Server Error",
+			expectedName:    "v1.",
+		},
+		{
+			name: "backend Status",
+			path: "/apis/metrics.example.com/v1/widgets",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				responsewriters.ErrorNegotiated(apierrors.NewInternalError(http.ErrAbortHandler), scheme.Codecs, metav1.SchemeGroupVersion, w, req)
+			},
+			expectedCode:    http.StatusInternalServerError,
+			expectedMessage: "Internal error occurred: net/http: abort Handler",
+		},
+		{
+			name: "success",
+			path: "/apis/metrics.example.com/v1/widgets",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("ok"))
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: "ok",
+		},
+		{
+			name: "no API group version",
+			path: "/healthz",
+			backend: func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "unhealthy", http.StatusInternalServerError)
+			},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "unhealthy\n",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			WithAPIServiceErrorStatus(test.backend, scheme.Codecs).ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if w.Code != test.expectedCode {
+				t.Errorf("expected code %d, got %d", test.expectedCode, w.Code)
+			}
+
+			if test.expectedMessage == "" {
+				if w.Body.String() != test.expectedBody {
+					t.Errorf("expected body %q, got %q", test.expectedBody, w.Body.String())
+				}
+
+				return
+			}
+
+			if contentType := w.Header().Get("Content-Type"); contentType != runtime.ContentTypeJSON {
+				t.Errorf("expected content type %s, got %s", runtime.ContentTypeJSON, contentType)
+			}
+
+			status := &metav1.Status{}
+			if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+				t.Fatalf("expected a Status body, got %q: %v", w.Body.String(), err)
+			}
+
+			if status.Message != test.expectedMessage {
+				t.Errorf("expected message %q, got %q", test.expectedMessage, status.Message)
+			}
+
+			if test.expectedName == "" {
+				return
+			}
+
+			if status.Reason != metav1.StatusReasonServiceUnavailable {
+				t.Errorf("expected reason %s, got %s", metav1.StatusReasonServiceUnavailable, status.Reason)
+			}
+
+			if status.Details == nil || status.Details.Name != test.expectedName || status.Details.Kind != "APIService" {
+				t.Errorf("expected details of APIService %s, got %#v", test.expectedName, status.Details)
+			}
+		})
+	}
+}
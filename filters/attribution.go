@@ -0,0 +1,257 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// maxAttributedUserAgentLength is the length user agents are truncated to in the attribution.
+	maxAttributedUserAgentLength = 128
+	// attributionMetricsPeriod is how often the metrics of the top clients are updated at most.
+	attributionMetricsPeriod = 10 * time.Second
+)
+
+var (
+	clientRequests = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "badidea_top_client_requests",
+			Help:           "Number of requests of the clients generating the most requests, broken out by user, user agent and resource.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"user", "user_agent", "resource"},
+	)
+	clientRequestSeconds = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "badidea_top_client_request_seconds",
+			Help:           "Total latency of the requests of the clients generating the most requests, broken out by user, user agent and resource.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"user", "user_agent", "resource"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(clientRequests)
+	legacyregistry.MustRegister(clientRequestSeconds)
+}
+
+// ClientAttribution is the load of a client on a resource.
+type ClientAttribution struct {
+	// User is the name of the user, or its hash if usernames are hashed.
+	User string `json:"user"`
+	// UserAgent is the user agent, truncated.
+	UserAgent string `json:"userAgent"`
+	// Resource is the resource.group requested, or "non-resource" for other paths.
+	Resource string `json:"resource"`
+	// Requests is the number of requests. Clients that replaced another one in a full table inherit
+	// its requests, so it is an upper bound.
+	Requests int64 `json:"requests"`
+	// LatencySeconds is the total latency of the requests.
+	LatencySeconds float64 `json:"latencySeconds"`
+}
+
+type attributionKey struct {
+	user      string
+	userAgent string
+	resource  string
+}
+
+// RequestAttribution aggregates the requests by user, user agent and resource, in a table of at most
+// maxClients entries. Once it is full, a new client replaces the one with the fewest requests,
+// inheriting its count, so the clients generating the most load stay in the table however many
+// there are.
+type RequestAttribution struct {
+	maxClients int
+	top        int
+	hashUsers  bool
+
+	lock        sync.Mutex
+	clients     map[attributionKey]*ClientAttribution
+	published   map[attributionKey]bool
+	nextPublish time.Time
+}
+
+// NewRequestAttribution returns the attribution of up to maxClients clients, whose top clients are
+// served and published as metrics. Usernames are replaced by their SHA-256 hash if hashUsers is set.
+func NewRequestAttribution(maxClients, top int, hashUsers bool) *RequestAttribution {
+	return &RequestAttribution{
+		maxClients: maxClients,
+		top:        top,
+		hashUsers:  hashUsers,
+		clients:    map[attributionKey]*ClientAttribution{},
+		published:  map[attributionKey]bool{},
+	}
+}
+
+// WithRequestAttribution records the requests in attribution, unless it is nil. The filter expects the
+// RequestInfo and the user in the request context.
+func WithRequestAttribution(handler http.Handler, attribution *RequestAttribution) http.Handler {
+	if attribution == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		handler.ServeHTTP(w, req)
+
+		key := attributionKey{resource: "non-resource", userAgent: req.UserAgent()}
+
+		if user, ok := request.UserFrom(req.Context()); ok {
+			key.user = attribution.userName(user.GetName())
+		}
+
+		if info, ok := request.RequestInfoFrom(req.Context()); ok && info.IsResourceRequest {
+			key.resource = schema.GroupResource{Group: info.APIGroup, Resource: info.Resource}.String()
+		}
+
+		if len(key.userAgent) > maxAttributedUserAgentLength {
+			key.userAgent = key.userAgent[:maxAttributedUserAgentLength]
+		}
+
+		attribution.record(key, time.Since(start))
+	})
+}
+
+// userName returns the name the user is attributed to.
+func (a *RequestAttribution) userName(name string) string {
+	if !a.hashUsers {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+func (a *RequestAttribution) record(key attributionKey, latency time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	client, ok := a.clients[key]
+	if !ok {
+		client = &ClientAttribution{User: key.user, UserAgent: key.userAgent, Resource: key.resource}
+
+		if len(a.clients) >= a.maxClients {
+			var fewest *attributionKey
+
+			for k, c := range a.clients {
+				if fewest == nil || c.Requests < a.clients[*fewest].Requests {
+					k := k
+					fewest = &k
+				}
+			}
+
+			client.Requests = a.clients[*fewest].Requests
+			delete(a.clients, *fewest)
+		}
+
+		a.clients[key] = client
+	}
+
+	client.Requests++
+	client.LatencySeconds += latency.Seconds()
+
+	if now := time.Now(); now.After(a.nextPublish) {
+		a.publish()
+		a.nextPublish = now.Add(attributionMetricsPeriod)
+	}
+}
+
+// Top returns the n clients with the most requests, or the top clients the attribution was created
+// with if n is not positive.
+func (a *RequestAttribution) Top(n int) []ClientAttribution {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.topClients(n)
+}
+
+func (a *RequestAttribution) topClients(n int) []ClientAttribution {
+	if n <= 0 {
+		n = a.top
+	}
+
+	top := make([]ClientAttribution, 0, len(a.clients))
+	for _, client := range a.clients {
+		top = append(top, *client)
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Requests != top[j].Requests {
+			return top[i].Requests > top[j].Requests
+		}
+
+		return top[i].LatencySeconds > top[j].LatencySeconds
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// publish sets the metrics of the top clients, and deletes those of the clients that dropped out.
+func (a *RequestAttribution) publish() {
+	published := map[attributionKey]bool{}
+
+	for _, client := range a.topClients(a.top) {
+		key := attributionKey{user: client.User, userAgent: client.UserAgent, resource: client.Resource}
+		published[key] = true
+
+		clientRequests.WithLabelValues(key.user, key.userAgent, key.resource).Set(float64(client.Requests))
+		clientRequestSeconds.WithLabelValues(key.user, key.userAgent, key.resource).Set(client.LatencySeconds)
+	}
+
+	for key := range a.published {
+		if !published[key] {
+			clientRequests.DeleteLabelValues(key.user, key.userAgent, key.resource)
+			clientRequestSeconds.DeleteLabelValues(key.user, key.userAgent, key.resource)
+		}
+	}
+
+	a.published = published
+}
+
+// ServeHTTP serves the top clients as JSON, the number of which the top query parameter overrides,
+// and updates their metrics.
+func (a *RequestAttribution) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n, _ := strconv.Atoi(req.URL.Query().Get("top"))
+
+	a.lock.Lock()
+	a.publish()
+	top := a.topClients(n)
+	a.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"clients": top})
+}
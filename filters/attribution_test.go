@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestWithRequestAttribution(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	send := func(handler http.Handler, name, userAgent, path string, n int) {
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("User-Agent", userAgent)
+
+			info, err := resolver.NewRequestInfo(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := request.WithRequestInfo(req.Context(), info)
+			ctx = request.WithUser(ctx, &user.DefaultInfo{Name: name})
+			handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		}
+	}
+
+	summary := func(clients []ClientAttribution) []string {
+		var lines []string
+		for _, c := range clients {
+			lines = append(lines, strings.Join([]string{c.User, c.UserAgent, c.Resource}, " "))
+		}
+
+		return lines
+	}
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	t.Run("top clients", func(t *testing.T) {
+		attribution := NewRequestAttribution(10, 2, false)
+		handler := WithRequestAttribution(apiHandler, attribution)
+
+		send(handler, "alice", "kubectl", "/apis/example.com/v1/namespaces/default/widgets", 5)
+		send(handler, "bob", "controller", "/apis/example.com/v1/widgets", 3)
+		send(handler, "bob", "controller", "/api/v1/namespaces/default/configmaps", 7)
+		send(handler, "bob", "controller", "/healthz", 1)
+
+		expected := []string{"bob controller configmaps", "alice kubectl widgets.example.com"}
+		if got := summary(attribution.Top(0)); strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("expected the top clients %v, got %v", expected, got)
+		}
+
+		if top := attribution.Top(4); len(top) != 4 || top[3].Resource != "non-resource" || top[3].Requests != 1 {
+			t.Errorf("expected the non-resource request last, got %#v", top)
+		}
+
+		w := httptest.NewRecorder()
+		attribution.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/badidea/clients?top=3", nil))
+
+		var served struct {
+			Clients []ClientAttribution `json:"clients"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+			t.Fatalf("expected JSON: %v", err)
+		}
+
+		expected = []string{"bob controller configmaps", "alice kubectl widgets.example.com", "bob controller widgets.example.com"}
+		if got := summary(served.Clients); strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("expected the served clients %v, got %v", expected, got)
+		}
+
+		if served.Clients[0].Requests != 7 || served.Clients[1].Requests != 5 || served.Clients[2].Requests != 3 {
+			t.Errorf("unexpected request counts %#v", served.Clients)
+		}
+	})
+
+	t.Run("hashed users", func(t *testing.T) {
+		attribution := NewRequestAttribution(10, 2, true)
+		handler := WithRequestAttribution(apiHandler, attribution)
+
+		send(handler, "alice", "kubectl", "/apis/example.com/v1/widgets", 2)
+		send(handler, "bob", "kubectl", "/apis/example.com/v1/widgets", 1)
+
+		top := attribution.Top(0)
+		if len(top) != 2 || top[0].User == top[1].User {
+			t.Fatalf("expected two distinct users, got %#v", top)
+		}
+
+		for _, c := range top {
+			if !strings.HasPrefix(c.User, "sha256:") || strings.Contains(c.User, "alice") || strings.Contains(c.User, "bob") {
+				t.Errorf("expected a hashed user, got %q", c.User)
+			}
+		}
+
+		if top[0].User != attribution.userName("alice") {
+			t.Errorf("expected the hash of alice first, got %q", top[0].User)
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		attribution := NewRequestAttribution(2, 2, false)
+		handler := WithRequestAttribution(apiHandler, attribution)
+
+		send(handler, "alice", "kubectl", "/apis/example.com/v1/widgets", 5)
+		send(handler, "bob", "kubectl", "/apis/example.com/v1/widgets", 2)
+		send(handler, "carol", strings.Repeat("x", 500), "/apis/example.com/v1/widgets", 1)
+
+		top := attribution.Top(10)
+		if len(top) != 2 {
+			t.Fatalf("expected 2 clients, got %#v", top)
+		}
+
+		// carol replaced bob, inheriting the requests of bob
+		if top[0].User != "alice" || top[0].Requests != 5 || top[1].User != "carol" || top[1].Requests != 3 {
+			t.Errorf("unexpected clients %#v", top)
+		}
+
+		if len(top[1].UserAgent) != maxAttributedUserAgentLength {
+			t.Errorf("expected the user agent truncated to %d bytes, got %d", maxAttributedUserAgentLength, len(top[1].UserAgent))
+		}
+	})
+}
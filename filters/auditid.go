@@ -0,0 +1,56 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"context"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+)
+
+type auditIDKeyType int
+
+// auditIDKey is the context key of the audit ID of a request.
+const auditIDKey auditIDKeyType = iota
+
+// WithAuditID makes sure every request has an audit ID. A client-provided Audit-ID header is kept,
+// otherwise a new ID is generated and set on the request, so the audit filter records the same ID.
+// The ID is returned in the Audit-ID response header and is available from AuditIDFrom.
+func WithAuditID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auditID := req.Header.Get(auditinternal.HeaderAuditID)
+		if auditID == "" {
+			auditID = string(uuid.NewUUID())
+
+			req = req.Clone(req.Context())
+			req.Header.Set(auditinternal.HeaderAuditID, auditID)
+		}
+
+		w.Header().Set(auditinternal.HeaderAuditID, auditID)
+
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), auditIDKey, auditID)))
+	})
+}
+
+// AuditIDFrom returns the audit ID of the request the context belongs to.
+func AuditIDFrom(ctx context.Context) (string, bool) {
+	auditID, ok := ctx.Value(auditIDKey).(string)
+
+	return auditID, ok
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+func TestWithAuditID(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientAuditID string
+	}{
+		{
+			name: "generated audit ID",
+		},
+		{
+			name:          "client-provided audit ID",
+			clientAuditID: "b0b4a8f6-6b7f-4a6d-8f2b-6f1f2b6c1e3a",
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			klog.LogToStderr(false)
+			klog.SetOutput(out)
+			defer klog.LogToStderr(true)
+
+			var requestHeader, contextAuditID string
+
+			inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				requestHeader = req.Header.Get("Audit-ID")
+				contextAuditID, _ = AuditIDFrom(req.Context())
+			})
+
+			handler := WithRequestLogging(inner, nil, true, time.Minute)
+			handler = WithAuditID(handler)
+
+			req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+			if test.clientAuditID != "" {
+				req.Header.Set("Audit-ID", test.clientAuditID)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			klog.Flush()
+
+			responseHeader := w.Header().Get("Audit-ID")
+			if responseHeader == "" {
+				t.Fatalf("expected an Audit-ID response header")
+			}
+
+			if test.clientAuditID != "" && responseHeader != test.clientAuditID {
+				t.Errorf("expected the client audit ID %q, got %q", test.clientAuditID, responseHeader)
+			}
+
+			if requestHeader != responseHeader || contextAuditID != responseHeader {
+				t.Errorf("expected request header %q and context %q to match the response header %q", requestHeader, contextAuditID, responseHeader)
+			}
+
+			if !strings.Contains(out.String(), `auditID="`+responseHeader+`"`) {
+				t.Errorf("expected the request log to contain the audit ID %q, got %q", responseHeader, out.String())
+			}
+		})
+	}
+}
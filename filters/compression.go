@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var compressionSavedBytes = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Name:           "badidea_response_compression_saved_bytes_total",
+		Help:           "Counter of the bytes gzip compression saved on get and list responses, broken out by resource.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"resource"},
+)
+
+func init() {
+	legacyregistry.MustRegister(compressionSavedBytes)
+}
+
+// WithoutResponseCompression disables response compression for requests to the given resources by
+// dropping the Accept-Encoding header before the endpoint handlers see it. The filter expects the
+// RequestInfo in the request context.
+func WithoutResponseCompression(handler http.Handler, resources []schema.GroupResource) http.Handler {
+	if len(resources) == 0 {
+		return handler
+	}
+
+	disabled := map[schema.GroupResource]bool{}
+	for _, resource := range resources {
+		disabled[resource] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || !disabled[schema.GroupResource{Group: info.APIGroup, Resource: info.Resource}] {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		req = req.Clone(req.Context())
+		req.Header.Del("Accept-Encoding")
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// WithResponseCompressionMetrics counts the bytes gzip compression saved on the responses of get and
+// list requests in the badidea_response_compression_saved_bytes_total metric, by resource.group. The
+// endpoint handlers compress the responses, so the filter decompresses what they write to measure
+// them. It only does so for requests accepting gzip, and responses large enough to be compressed.
+// The filter expects the RequestInfo in the request context.
+func WithResponseCompressionMetrics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || (info.Verb != "get" && info.Verb != "list") ||
+			!strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		rw := &compressionMeasuringWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(rw, req)
+
+		if uncompressed := rw.close(); uncompressed > rw.compressed {
+			resource := schema.GroupResource{Group: info.APIGroup, Resource: info.Resource}.String()
+			compressionSavedBytes.WithLabelValues(resource).Add(float64(uncompressed - rw.compressed))
+		}
+	})
+}
+
+// compressionMeasuringWriter measures gzip compressed responses before and after compression.
+type compressionMeasuringWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	// pipe feeds the compressed response to the goroutine decompressing it, if it is compressed
+	pipe       *io.PipeWriter
+	compressed int64
+	// uncompressed receives the size of the decompressed response
+	uncompressed chan int64
+}
+
+func (w *compressionMeasuringWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		reader, writer := io.Pipe()
+		w.pipe = writer
+		w.uncompressed = make(chan int64, 1)
+
+		go func() {
+			var n int64
+			if zr, err := gzip.NewReader(reader); err == nil {
+				n, _ = io.Copy(ioutil.Discard, zr)
+			}
+			// what is left of a corrupt response must not block the writes
+			_, _ = io.Copy(ioutil.Discard, reader)
+			w.uncompressed <- n
+		}()
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressionMeasuringWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	if w.pipe != nil {
+		w.compressed += int64(n)
+		_, _ = w.pipe.Write(b[:n])
+	}
+
+	return n, err
+}
+
+func (w *compressionMeasuringWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close returns the size of the decompressed response, zero if it was not compressed.
+func (w *compressionMeasuringWriter) close() int64 {
+	if w.pipe == nil {
+		return 0
+	}
+
+	_ = w.pipe.Close()
+
+	return <-w.uncompressed
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestWithoutResponseCompression(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+
+		expectedAcceptEncoding string
+	}{
+		{
+			name: "compression disabled",
+			path: "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		},
+		{
+			name: "compression kept",
+			path: "/apis/apiregistration.k8s.io/v1/apiservices",
+
+			expectedAcceptEncoding: "gzip",
+		},
+		{
+			name: "non-resource request",
+			path: "/openapi/v2",
+
+			expectedAcceptEncoding: "gzip",
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			acceptEncoding := ""
+			inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				acceptEncoding = req.Header.Get("Accept-Encoding")
+			})
+
+			handler := WithoutResponseCompression(inner, []schema.GroupResource{{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"}})
+			handler = genericapifilters.WithRequestInfo(handler, resolver)
+
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if acceptEncoding != test.expectedAcceptEncoding {
+				t.Errorf("expected Accept-Encoding %q, got %q", test.expectedAcceptEncoding, acceptEncoding)
+			}
+		})
+	}
+}
+
+func TestWithResponseCompressionMetrics(t *testing.T) {
+	body := []byte(strings.Repeat(`{"kind":"Namespace","apiVersion":"v1"}`, 1000))
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(body); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		// encoding is the Content-Encoding of the response, gzip for the compressed body
+		encoding string
+		response []byte
+
+		expectedSaved float64
+	}{
+		{
+			name:           "compressed list",
+			acceptEncoding: "gzip",
+			encoding:       "gzip",
+			response:       compressed.Bytes(),
+
+			expectedSaved: float64(len(body) - compressed.Len()),
+		},
+		{
+			name:           "identity list",
+			acceptEncoding: "gzip",
+			response:       body,
+		},
+		{
+			name:     "gzip not accepted",
+			encoding: "gzip",
+			response: compressed.Bytes(),
+		},
+		{
+			name:           "corrupt response",
+			acceptEncoding: "gzip",
+			encoding:       "gzip",
+			response:       body,
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if test.encoding != "" {
+					w.Header().Set("Content-Encoding", test.encoding)
+				}
+				_, _ = w.Write(test.response)
+			})
+
+			handler := WithResponseCompressionMetrics(inner)
+			handler = genericapifilters.WithRequestInfo(handler, resolver)
+
+			before, err := testutil.GetCounterMetricValue(compressionSavedBytes.WithLabelValues("namespaces"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			after, err := testutil.GetCounterMetricValue(compressionSavedBytes.WithLabelValues("namespaces"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if saved := after - before; saved != test.expectedSaved {
+				t.Errorf("expected %v bytes saved, got %v", test.expectedSaved, saved)
+			}
+
+			if !bytes.Equal(w.Body.Bytes(), test.response) {
+				t.Errorf("expected the response to be passed through unchanged")
+			}
+		})
+	}
+}
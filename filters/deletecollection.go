@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var deleteCollectionDuration = metrics.NewHistogramVec(
+	&metrics.HistogramOpts{
+		Name:           "badidea_delete_collection_duration_seconds",
+		Help:           "Duration of deletecollection requests in seconds, broken out by resource and response code.",
+		Buckets:        []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"resource", "code"},
+)
+
+func init() {
+	legacyregistry.MustRegister(deleteCollectionDuration)
+}
+
+// WithDeleteCollectionMetrics observes the duration of deletecollection requests in the
+// badidea_delete_collection_duration_seconds metric, by resource.group and response code. The filter
+// expects the RequestInfo in the request context.
+func WithDeleteCollectionMetrics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || info.Verb != "deletecollection" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		rw := &loggingResponseWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(rw, req)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		resource := schema.GroupResource{Group: info.APIGroup, Resource: info.Resource}.String()
+		deleteCollectionDuration.WithLabelValues(resource, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
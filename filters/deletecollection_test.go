@@ -0,0 +1,77 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestWithDeleteCollectionMetrics(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	// every request takes 10ms, so the sums of the durations tell the requests were observed
+	handler := WithDeleteCollectionMetrics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+
+		if req.URL.Query().Get("labelSelector") == "" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	serve := func(method, path string) {
+		req := httptest.NewRequest(method, path, nil)
+
+		info, err := resolver.NewRequestInfo(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(request.WithRequestInfo(req.Context(), info)))
+	}
+
+	serve(http.MethodDelete, "/apis/metrics.example.com/v1/namespaces/default/gadgets")
+	serve(http.MethodDelete, "/apis/metrics.example.com/v1/namespaces/default/gadgets?labelSelector=a%3Db")
+	serve(http.MethodDelete, "/apis/metrics.example.com/v1/namespaces/default/gadgets?labelSelector=a%3Dc")
+	serve(http.MethodDelete, "/apis/metrics.example.com/v1/namespaces/default/gadgets/sprocket")
+	serve(http.MethodGet, "/apis/metrics.example.com/v1/namespaces/default/gadgets")
+
+	for code, expected := range map[string]int{"200": 2, "413": 1} {
+		observer, err := deleteCollectionDuration.GetMetricWithLabelValues("gadgets.metrics.example.com", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum, err := testutil.GetHistogramMetricValue(observer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sum < float64(expected)*0.01 {
+			t.Errorf("expected %d deletecollection requests answered with %s, got a total duration of %vs", expected, code, sum)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/warning"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// deprecatedAnnotationKey is the audit annotation set to "true" on requests for deprecated
+	// resources, like the one of the apiserver library.
+	deprecatedAnnotationKey = "k8s.io/deprecated"
+	// removedReleaseAnnotationKey is the audit annotation set to the release removing a deprecated
+	// resource.
+	removedReleaseAnnotationKey = "k8s.io/removed-release"
+
+	// deprecationLogPeriod is how often a request of one client for a deprecated resource is logged.
+	deprecationLogPeriod = 24 * time.Hour
+)
+
+var requestedDeprecatedAPIs = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Name:           "badidea_requested_deprecated_apis",
+		Help:           "Gauge of deprecated APIs that have been requested, broken out by API group, version, resource, subresource, and removed_release.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"group", "version", "resource", "subresource", "removed_release"},
+)
+
+func init() {
+	legacyregistry.MustRegister(requestedDeprecatedAPIs)
+}
+
+// Deprecation is the deprecation of a resource.
+type Deprecation struct {
+	// Replacement is the resource to use instead, e.g. "badidea.x-k8s.io/v1 widgets".
+	Replacement string
+	// RemovedRelease is the release removing the resource, if it is planned.
+	RemovedRelease string
+}
+
+// WithDeprecationWarnings tracks the requests for the deprecated resources: it adds a Warning header
+// naming the replacement and the release removing the resource, annotates the audit event, sets the
+// badidea_requested_deprecated_apis metric, and logs the request once a day per user, user agent and
+// resource. Clients whose user agent starts with one of suppressedUserAgents opt out of all warnings,
+// including the ones added further down the chain, but their requests are still tracked. The filter
+// expects the RequestInfo, the user, the audit annotations and the warning recorder in the request
+// context.
+func WithDeprecationWarnings(handler http.Handler, deprecated map[schema.GroupVersionResource]Deprecation, suppressedUserAgents []string) http.Handler {
+	if len(deprecated) == 0 && len(suppressedUserAgents) == 0 {
+		return handler
+	}
+
+	log := &deprecationLog{now: time.Now}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		suppressed := hasAnyPrefix(req.UserAgent(), suppressedUserAgents)
+		if suppressed {
+			ctx = warning.WithWarningRecorder(ctx, discardingRecorder{})
+			req = req.WithContext(ctx)
+		}
+
+		info, ok := request.RequestInfoFrom(ctx)
+		if ok && info.IsResourceRequest {
+			gvr := schema.GroupVersionResource{Group: info.APIGroup, Version: info.APIVersion, Resource: info.Resource}
+			if deprecation, found := deprecated[gvr]; found {
+				requestedDeprecatedAPIs.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource, info.Subresource, deprecation.RemovedRelease).Set(1)
+
+				audit.AddAuditAnnotation(ctx, deprecatedAnnotationKey, "true")
+				if deprecation.RemovedRelease != "" {
+					audit.AddAuditAnnotation(ctx, removedReleaseAnnotationKey, deprecation.RemovedRelease)
+				}
+
+				if !suppressed {
+					warning.AddWarning(ctx, "", deprecation.message(gvr))
+				}
+
+				userName := ""
+				if u, ok := request.UserFrom(ctx); ok {
+					userName = u.GetName()
+				}
+
+				if log.first(fmt.Sprintf("%s\x00%s\x00%s", userName, req.UserAgent(), gvr)) {
+					klog.Infof("%s %s by user %q with user agent %q: %s", info.Verb, req.URL.Path, userName, req.UserAgent(), deprecation.message(gvr))
+				}
+			}
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// message returns the warning of a request for gvr.
+func (d Deprecation) message(gvr schema.GroupVersionResource) string {
+	message := fmt.Sprintf("%s %s is deprecated", gvr.GroupVersion(), gvr.Resource)
+	if d.RemovedRelease != "" {
+		message += fmt.Sprintf(", unavailable in %s", d.RemovedRelease)
+	}
+
+	if d.Replacement != "" {
+		message += fmt.Sprintf("; use %s", d.Replacement)
+	}
+
+	return message
+}
+
+// deprecationLog records the clients whose requests for deprecated resources were logged in the
+// current period of deprecationLogPeriod.
+type deprecationLog struct {
+	now func() time.Time
+
+	lock        sync.Mutex
+	periodStart time.Time
+	logged      sets.String
+}
+
+// first returns whether key is seen for the first time in the current period.
+func (l *deprecationLog) first(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now := l.now(); l.logged == nil || now.Sub(l.periodStart) >= deprecationLogPeriod {
+		l.periodStart = now
+		l.logged = sets.NewString()
+	}
+
+	if l.logged.Has(key) {
+		return false
+	}
+
+	l.logged.Insert(key)
+
+	return true
+}
+
+// discardingRecorder drops every warning it is given.
+type discardingRecorder struct{}
+
+func (discardingRecorder) AddWarning(agent, text string) {}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/warning"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestWithDeprecationWarnings(t *testing.T) {
+	deprecated := map[schema.GroupVersionResource]Deprecation{
+		{Group: "badidea.x-k8s.io", Version: "v1alpha1", Resource: "widgets"}: {Replacement: "badidea.x-k8s.io/v1 widgets"},
+		{Group: "badidea.x-k8s.io", Version: "v1alpha1", Resource: "gizmos"}:  {Replacement: "badidea.x-k8s.io/v1 gizmos", RemovedRelease: "v2.0"},
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		userAgent string
+
+		expectedWarnings    []string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name: "deprecated resource",
+			path: "/apis/badidea.x-k8s.io/v1alpha1/widgets",
+
+			expectedWarnings: []string{
+				`299 - "badidea.x-k8s.io/v1alpha1 widgets is deprecated; use badidea.x-k8s.io/v1 widgets"`,
+				`299 - "inner warning"`,
+			},
+			expectedAnnotations: map[string]string{"k8s.io/deprecated": "true"},
+		},
+		{
+			name: "deprecated resource with a removal release",
+			path: "/apis/badidea.x-k8s.io/v1alpha1/gizmos",
+
+			expectedWarnings: []string{
+				`299 - "badidea.x-k8s.io/v1alpha1 gizmos is deprecated, unavailable in v2.0; use badidea.x-k8s.io/v1 gizmos"`,
+				`299 - "inner warning"`,
+			},
+			expectedAnnotations: map[string]string{"k8s.io/deprecated": "true", "k8s.io/removed-release": "v2.0"},
+		},
+		{
+			name: "current resource",
+			path: "/apis/badidea.x-k8s.io/v1/widgets",
+
+			expectedWarnings: []string{`299 - "inner warning"`},
+		},
+		{
+			name: "discovery request",
+			path: "/apis/badidea.x-k8s.io/v1alpha1",
+
+			expectedWarnings: []string{`299 - "inner warning"`},
+		},
+		{
+			name:      "suppressed user agent",
+			path:      "/apis/badidea.x-k8s.io/v1alpha1/widgets",
+			userAgent: "legacy-tool/1.0",
+
+			expectedAnnotations: map[string]string{"k8s.io/deprecated": "true"},
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			// the inner handler stands in for the endpoint installer adding its own warnings
+			inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				warning.AddWarning(req.Context(), "", "inner warning")
+			})
+
+			handler := WithDeprecationWarnings(inner, deprecated, []string{"legacy-tool/"})
+			handler = genericapifilters.WithRequestInfo(handler, resolver)
+			handler = genericapifilters.WithWarningRecorder(handler)
+
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			req.Header.Set("User-Agent", test.userAgent)
+
+			event := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req.WithContext(request.WithAuditEvent(req.Context(), event)))
+
+			if warnings := w.Header()["Warning"]; !reflect.DeepEqual(test.expectedWarnings, warnings) {
+				t.Errorf("expected warnings %v, got %v", test.expectedWarnings, warnings)
+			}
+
+			if !reflect.DeepEqual(test.expectedAnnotations, event.Annotations) {
+				t.Errorf("expected audit annotations %v, got %v", test.expectedAnnotations, event.Annotations)
+			}
+		})
+	}
+}
+
+func TestRequestedDeprecatedAPIsMetric(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "badidea.x-k8s.io", Version: "v1alpha1", Resource: "doohickeys"}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	handler := WithDeprecationWarnings(http.NotFoundHandler(), map[schema.GroupVersionResource]Deprecation{gvr: {RemovedRelease: "v2.0"}}, []string{"legacy-tool/"})
+	handler = genericapifilters.WithRequestInfo(handler, resolver)
+
+	// suppressing the warnings does not stop the tracking
+	req := httptest.NewRequest(http.MethodGet, "/apis/badidea.x-k8s.io/v1alpha1/namespaces/default/doohickeys/sprocket/status", nil)
+	req.Header.Set("User-Agent", "legacy-tool/1.0")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	value, err := testutil.GetGaugeMetricValue(requestedDeprecatedAPIs.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource, "status", "v2.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != 1 {
+		t.Errorf("expected badidea_requested_deprecated_apis to be 1, got %v", value)
+	}
+}
+
+func TestDeprecationLog(t *testing.T) {
+	now := time.Unix(0, 0)
+	log := &deprecationLog{now: func() time.Time { return now }}
+
+	if !log.first("alice") || !log.first("bob") {
+		t.Fatal("expected the first requests of every client to be logged")
+	}
+
+	now = now.Add(deprecationLogPeriod - time.Second)
+
+	if log.first("alice") {
+		t.Error("expected a client to be logged once per period")
+	}
+
+	now = now.Add(time.Second)
+
+	if !log.first("alice") {
+		t.Error("expected a client to be logged again in the next period")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// discoveryCacheControl makes clients and proxies revalidate the discovery documents with their
+// ETag, as they change whenever CRDs and APIServices do.
+const discoveryCacheControl = "no-cache, private"
+
+// WithDiscoveryETags sets a strong ETag, the hash of the body, on the discovery documents below /api
+// and /apis, and answers GETs whose If-None-Match matches it with a 304 without a body, so clients
+// polling discovery, like kubectl, only download it when it changed. Every discovery handler of the
+// chain, including the ones of aggregated servers, is covered by buffering their responses. The
+// OpenAPI handlers set ETags of their own. The filter expects the RequestInfo in the request context.
+func WithDiscoveryETags(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isDiscoveryRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		rw := &bufferingResponseWriter{header: http.Header{}, status: http.StatusOK}
+		handler.ServeHTTP(rw, req)
+
+		for key, values := range rw.header {
+			w.Header()[key] = values
+		}
+
+		if rw.status != http.StatusOK {
+			w.WriteHeader(rw.status)
+			_, _ = w.Write(rw.body.Bytes())
+
+			return
+		}
+
+		sum := sha256.Sum256(rw.body.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", discoveryCacheControl)
+
+		if etagMatches(req.Header.Get("If-None-Match"), etag) {
+			// a 304 has no body, the headers describing it would be wrong
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(rw.body.Bytes())
+	})
+}
+
+func isDiscoveryRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if info, ok := request.RequestInfoFrom(req.Context()); !ok || info.IsResourceRequest {
+		return false
+	}
+
+	for _, path := range []string{"/api", "/apis"} {
+		if req.URL.Path == path || strings.HasPrefix(req.URL.Path, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// etagMatches returns whether the If-None-Match header ifNoneMatch matches etag, comparing weakly
+// as RFC 7232 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bufferingResponseWriter holds a response until it is complete.
+type bufferingResponseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *bufferingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.status, w.wroteHeader = status, true
+}
+
+func (w *bufferingResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+
+	return w.body.Write(data)
+}
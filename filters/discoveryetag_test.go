@@ -0,0 +1,109 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestWithDiscoveryETags(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	document := `{"kind":"APIGroupList"}`
+
+	handler := WithDiscoveryETags(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/apis/missing.example.com" {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(document))
+	}))
+
+	serve := func(method, path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		info, err := resolver.NewRequestInfo(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(request.WithRequestInfo(req.Context(), info)))
+
+		return w
+	}
+
+	w := serve(http.MethodGet, "/apis", "")
+	etag := w.Header().Get("ETag")
+
+	if w.Code != http.StatusOK || w.Body.String() != document || etag == "" {
+		t.Fatalf("expected the document with an ETag, got %d %q with ETag %q", w.Code, w.Body.String(), etag)
+	}
+
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-cache, private" {
+		t.Errorf("expected Cache-Control no-cache, private, got %q", cacheControl)
+	}
+
+	if again := serve(http.MethodGet, "/apis", "").Header().Get("ETag"); again != etag {
+		t.Errorf("expected a stable ETag %s, got %s", etag, again)
+	}
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		if w := serve(http.MethodGet, "/apis", ifNoneMatch); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match %s: expected a 304 without body, got %d %q", ifNoneMatch, w.Code, w.Body.String())
+		}
+	}
+
+	if w := serve(http.MethodGet, "/apis", `"other"`); w.Code != http.StatusOK || w.Body.String() != document {
+		t.Errorf("expected the document for another ETag, got %d %q", w.Code, w.Body.String())
+	}
+
+	for _, path := range []string{"/api", "/api/v1", "/apis/example.com", "/apis/example.com/v1"} {
+		if w := serve(http.MethodGet, path, etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s: expected a 304, got %d", path, w.Code)
+		}
+	}
+
+	document = `{"kind":"APIGroupList","groups":[{"name":"example.com"}]}`
+
+	if w := serve(http.MethodGet, "/apis", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("expected a changed document with a new ETag, got %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+
+	if w := serve(http.MethodGet, "/apis/missing.example.com", "*"); w.Code != http.StatusNotFound || w.Header().Get("ETag") != "" {
+		t.Errorf("expected a 404 without ETag, got %d with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	for _, path := range []string{"/apis/example.com/v1/widgets", "/healthz", "/openapi/v2"} {
+		if w := serve(http.MethodGet, path, "*"); w.Code != http.StatusOK || w.Header().Get("ETag") != "" {
+			t.Errorf("%s: expected no ETag, got %d with ETag %q", path, w.Code, w.Header().Get("ETag"))
+		}
+	}
+}
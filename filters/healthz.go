@@ -0,0 +1,48 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+)
+
+// WithHealthCheckExclusions excludes checks from the health endpoints as if every client asked for
+// it with the exclude query parameter. exclusions maps a health endpoint path, e.g. /readyz, to the
+// names of the checks to exclude from it.
+func WithHealthCheckExclusions(handler http.Handler, exclusions map[string][]string) http.Handler {
+	if len(exclusions) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		excluded, found := exclusions[req.URL.Path]
+		if !found || len(excluded) == 0 {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		query := req.URL.Query()
+		for _, name := range excluded {
+			query.Add("exclude", name)
+		}
+
+		req = req.Clone(req.Context())
+		req.URL.RawQuery = query.Encode()
+
+		handler.ServeHTTP(w, req)
+	})
+}
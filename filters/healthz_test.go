@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/server/healthz"
+)
+
+func TestWithHealthCheckExclusions(t *testing.T) {
+	failing := healthz.NamedCheck("autoregister-completion", func(r *http.Request) error {
+		return fmt.Errorf("missing APIService")
+	})
+
+	tests := []struct {
+		name string
+		path string
+
+		expectedCode  int
+		expectedLines []string
+	}{
+		{
+			name: "excluded from readyz",
+			path: "/readyz?verbose=1",
+
+			expectedCode:  http.StatusOK,
+			expectedLines: []string{"[+]ping ok", "[+]autoregister-completion excluded: ok", "healthz check passed"},
+		},
+		{
+			name: "not excluded from livez",
+			path: "/livez?verbose=1",
+
+			expectedCode:  http.StatusInternalServerError,
+			expectedLines: []string{"[+]ping ok", "[-]autoregister-completion failed: reason withheld", "healthz check failed"},
+		},
+		{
+			name: "client exclusions are kept",
+			path: "/livez?verbose=1&exclude=autoregister-completion",
+
+			expectedCode:  http.StatusOK,
+			expectedLines: []string{"[+]autoregister-completion excluded: ok"},
+		},
+	}
+
+	mux := http.NewServeMux()
+	healthz.InstallReadyzHandler(mux, healthz.PingHealthz, failing)
+	healthz.InstallLivezHandler(mux, healthz.PingHealthz, failing)
+	handler := WithHealthCheckExclusions(mux, map[string][]string{"/readyz": {"autoregister-completion"}})
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if w.Code != test.expectedCode {
+				t.Errorf("expected code %d, got %d", test.expectedCode, w.Code)
+			}
+
+			for _, expected := range test.expectedLines {
+				if !strings.Contains(w.Body.String(), expected) {
+					t.Errorf("expected body to contain %q, got %q", expected, w.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// openAPIPath is the path of the OpenAPI spec.
+const openAPIPath = "/openapi/v2"
+
+// HiddenAPIs are the API groups and resources hidden from a user.
+type HiddenAPIs struct {
+	// Groups are the API groups hidden as a whole.
+	Groups map[string]bool
+	// Resources are the hidden resources, whose subresources are hidden too.
+	Resources map[schema.GroupResource]bool
+	// Kinds are the kinds of the hidden resources, including their list kinds, whose OpenAPI
+	// definitions are hidden.
+	Kinds map[schema.GroupKind]bool
+}
+
+// WithHiddenAPIs hides APIs from the discovery documents and the OpenAPI spec served to a user:
+// hidden groups are left out of /apis and their documents are not found, and hidden resources are
+// left out of the resource lists, and their paths and definitions out of the spec. hiddenFor returns
+// the APIs hidden from a user, nil if there are none. If it fails, the request is answered with a 503,
+// so nothing is revealed. Filtered documents are served as JSON without compression, and the spec
+// without its ETag, which describes the whole spec. The filter only hides the APIs, their requests
+// have to be denied by the authorizer. It expects the RequestInfo and the user in the request context,
+// and has to run before WithDiscoveryETags to tag the filtered documents.
+func WithHiddenAPIs(handler http.Handler, hiddenFor func(user.Info) (*HiddenAPIs, error), s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		discovery := isDiscoveryRequest(req) && strings.HasPrefix(req.URL.Path, "/apis")
+		openAPI := req.URL.Path == openAPIPath && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+		if !discovery && !openAPI {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		u, ok := request.UserFrom(req.Context())
+		if !ok {
+			responsewriters.InternalError(w, req, fmt.Errorf("no user found for request"))
+			return
+		}
+
+		hidden, err := hiddenFor(u)
+		if err != nil {
+			responsewriters.ErrorNegotiated(apierrors.NewServiceUnavailable(err.Error()), s, schema.GroupVersion{}, w, req)
+			return
+		}
+
+		if hidden == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		// /apis/<group> and /apis/<group>/<version>
+		if segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/"); discovery && len(segments) > 1 && hidden.Groups[segments[1]] {
+			http.NotFound(w, req)
+			return
+		}
+
+		// the documents are decoded as JSON, and clients decode them by their Content-Type
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept", "application/json")
+		req.Header.Del("Accept-Encoding")
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+
+		rw := &bufferingResponseWriter{header: http.Header{}, status: http.StatusOK}
+		handler.ServeHTTP(rw, req)
+
+		body := rw.body.Bytes()
+		if rw.status == http.StatusOK && req.Method == http.MethodGet {
+			if discovery {
+				body, err = hideFromDiscovery(body, hidden)
+			} else {
+				body, err = hideFromOpenAPI(body, hidden)
+			}
+
+			if err != nil {
+				responsewriters.InternalError(w, req, err)
+				return
+			}
+		}
+
+		for key, values := range rw.header {
+			w.Header()[key] = values
+		}
+
+		w.Header().Del("ETag")
+		w.Header().Del("Last-Modified")
+		if rw.status == http.StatusOK && req.Method == http.MethodGet {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+
+		w.WriteHeader(rw.status)
+		_, _ = w.Write(body)
+	})
+}
+
+// hideFromDiscovery removes the hidden APIs from the discovery document of /apis, /apis/<group> or
+// /apis/<group>/<version>.
+func hideFromDiscovery(body []byte, hidden *HiddenAPIs) ([]byte, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, fmt.Errorf("failed to decode the discovery document: %w", err)
+	}
+
+	switch typeMeta.Kind {
+	case "APIGroupList":
+		groups := &metav1.APIGroupList{}
+		if err := json.Unmarshal(body, groups); err != nil {
+			return nil, fmt.Errorf("failed to decode the discovery document: %w", err)
+		}
+
+		visible := groups.Groups[:0]
+		for _, group := range groups.Groups {
+			if !hidden.Groups[group.Name] {
+				visible = append(visible, group)
+			}
+		}
+
+		groups.Groups = visible
+
+		return json.Marshal(groups)
+	case "APIResourceList":
+		resources := &metav1.APIResourceList{}
+		if err := json.Unmarshal(body, resources); err != nil {
+			return nil, fmt.Errorf("failed to decode the discovery document: %w", err)
+		}
+
+		gv, err := schema.ParseGroupVersion(resources.GroupVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the discovery document: %w", err)
+		}
+
+		visible := resources.APIResources[:0]
+		for _, resource := range resources.APIResources {
+			name := strings.SplitN(resource.Name, "/", 2)[0]
+			if !hidden.Resources[gv.WithResource(name).GroupResource()] {
+				visible = append(visible, resource)
+			}
+		}
+
+		resources.APIResources = visible
+
+		return json.Marshal(resources)
+	default:
+		// an APIGroup, whose group is not hidden
+		return body, nil
+	}
+}
+
+// hideFromOpenAPI removes the paths of the hidden APIs and the definitions of their kinds from the
+// OpenAPI spec.
+func hideFromOpenAPI(body []byte, hidden *HiddenAPIs) ([]byte, error) {
+	var spec map[string]json.RawMessage
+	if err := json.Unmarshal(body, &spec); err != nil {
+		return nil, fmt.Errorf("failed to decode the OpenAPI spec: %w", err)
+	}
+
+	var paths map[string]json.RawMessage
+	if err := json.Unmarshal(spec["paths"], &paths); err != nil && spec["paths"] != nil {
+		return nil, fmt.Errorf("failed to decode the paths of the OpenAPI spec: %w", err)
+	}
+
+	for path := range paths {
+		if isHiddenPath(path, hidden) {
+			delete(paths, path)
+		}
+	}
+
+	var definitions map[string]json.RawMessage
+	if err := json.Unmarshal(spec["definitions"], &definitions); err != nil && spec["definitions"] != nil {
+		return nil, fmt.Errorf("failed to decode the definitions of the OpenAPI spec: %w", err)
+	}
+
+	for name, definition := range definitions {
+		var extensions struct {
+			GroupVersionKinds []metav1.GroupVersionKind `json:"x-kubernetes-group-version-kind"`
+		}
+		if err := json.Unmarshal(definition, &extensions); err != nil {
+			return nil, fmt.Errorf("failed to decode the definition %s of the OpenAPI spec: %w", name, err)
+		}
+
+		for _, gvk := range extensions.GroupVersionKinds {
+			if hidden.Groups[gvk.Group] || hidden.Kinds[schema.GroupKind{Group: gvk.Group, Kind: gvk.Kind}] {
+				delete(definitions, name)
+			}
+		}
+	}
+
+	var err error
+	if paths != nil {
+		if spec["paths"], err = json.Marshal(paths); err != nil {
+			return nil, err
+		}
+	}
+
+	if definitions != nil {
+		if spec["definitions"], err = json.Marshal(definitions); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(spec)
+}
+
+// isHiddenPath returns whether the OpenAPI path belongs to a hidden group or resource, e.g.
+// /apis/example.com/v1/namespaces/{namespace}/widgets/{name}.
+func isHiddenPath(path string, hidden *HiddenAPIs) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 || segments[0] != "apis" {
+		return false
+	}
+
+	group := segments[1]
+	if hidden.Groups[group] {
+		return true
+	}
+
+	if len(segments) < 4 {
+		return false
+	}
+
+	// the segments after /apis/<group>/<version>
+	segments = segments[3:]
+	if segments[0] == "watch" {
+		segments = segments[1:]
+	}
+
+	if len(segments) > 2 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+
+	return len(segments) > 0 && hidden.Resources[schema.GroupResource{Group: group, Resource: segments[0]}]
+}
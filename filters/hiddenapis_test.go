@@ -0,0 +1,198 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithHiddenAPIs(t *testing.T) {
+	documents := map[string]interface{}{
+		"/apis": &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+			Groups:   []metav1.APIGroup{{Name: "example.com"}, {Name: "team-a.example.com"}, {Name: "team-b.example.com"}},
+		},
+		"/apis/team-a.example.com": &metav1.APIGroup{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"},
+			Name:     "team-a.example.com",
+		},
+		"/apis/example.com/v1": &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "example.com/v1",
+			APIResources: []metav1.APIResource{{Name: "gadgets"}, {Name: "gadgets/status"}, {Name: "widgets"}, {Name: "widgets/status"}},
+		},
+		"/openapi/v2": map[string]interface{}{
+			"swagger": "2.0",
+			"paths": map[string]interface{}{
+				"/apis/example.com/v1/namespaces/{namespace}/gadgets":        map[string]interface{}{},
+				"/apis/example.com/v1/namespaces/{namespace}/widgets":        map[string]interface{}{},
+				"/apis/example.com/v1/namespaces/{namespace}/widgets/{name}": map[string]interface{}{},
+				"/apis/example.com/v1/watch/widgets":                         map[string]interface{}{},
+				"/apis/team-b.example.com/v1/sprockets":                      map[string]interface{}{},
+				"/version/":                                                  map[string]interface{}{},
+			},
+			"definitions": map[string]interface{}{
+				"com.example.v1.Gadget":                       map[string]interface{}{"x-kubernetes-group-version-kind": []metav1.GroupVersionKind{{Group: "example.com", Version: "v1", Kind: "Gadget"}}},
+				"com.example.v1.Widget":                       map[string]interface{}{"x-kubernetes-group-version-kind": []metav1.GroupVersionKind{{Group: "example.com", Version: "v1", Kind: "Widget"}}},
+				"com.example.v1.WidgetList":                   map[string]interface{}{"x-kubernetes-group-version-kind": []metav1.GroupVersionKind{{Group: "example.com", Version: "v1", Kind: "WidgetList"}}},
+				"com.example.team-b.v1.Sprocket":              map[string]interface{}{"x-kubernetes-group-version-kind": []metav1.GroupVersionKind{{Group: "team-b.example.com", Version: "v1", Kind: "Sprocket"}}},
+				"io.k8s.apimachinery.pkg.apis.meta.v1.Status": map[string]interface{}{},
+			},
+		},
+	}
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		document, ok := documents[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		if u, _ := request.UserFrom(req.Context()); u.GetName() != "admin" && (req.Header.Get("Accept") != "application/json" || req.Header.Get("If-None-Match") != "") {
+			t.Errorf("expected a JSON request without preconditions, got %v", req.Header)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"whole"`)
+		_ = json.NewEncoder(w).Encode(document)
+	})
+
+	hidden := &HiddenAPIs{
+		Groups:    map[string]bool{"team-b.example.com": true},
+		Resources: map[schema.GroupResource]bool{{Group: "example.com", Resource: "widgets"}: true, {Group: "team-b.example.com", Resource: "sprockets"}: true},
+		Kinds:     map[schema.GroupKind]bool{{Group: "example.com", Kind: "Widget"}: true, {Group: "example.com", Kind: "WidgetList"}: true},
+	}
+
+	var hiddenErr error
+	handler := WithHiddenAPIs(apiHandler, func(u user.Info) (*HiddenAPIs, error) {
+		if u.GetName() == "admin" {
+			return nil, nil
+		}
+
+		return hidden, hiddenErr
+	}, scheme.Codecs)
+
+	serve := func(userName, path string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", "application/vnd.kubernetes.protobuf, application/json")
+		req.Header.Set("If-None-Match", `"whole"`)
+
+		ctx := request.WithRequestInfo(req.Context(), &request.RequestInfo{Path: path})
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: userName})
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+
+		return w
+	}
+
+	decode := func(w *httptest.ResponseRecorder, into interface{}) {
+		t.Helper()
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), into); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	groups := &metav1.APIGroupList{}
+	decode(serve("alice", "/apis"), groups)
+
+	var groupNames []string
+	for _, group := range groups.Groups {
+		groupNames = append(groupNames, group.Name)
+	}
+
+	if expected := []string{"example.com", "team-a.example.com"}; !reflect.DeepEqual(groupNames, expected) {
+		t.Errorf("expected the groups %v, got %v", expected, groupNames)
+	}
+
+	resources := &metav1.APIResourceList{}
+	decode(serve("alice", "/apis/example.com/v1"), resources)
+
+	var resourceNames []string
+	for _, resource := range resources.APIResources {
+		resourceNames = append(resourceNames, resource.Name)
+	}
+
+	if expected := []string{"gadgets", "gadgets/status"}; !reflect.DeepEqual(resourceNames, expected) {
+		t.Errorf("expected the resources %v, got %v", expected, resourceNames)
+	}
+
+	group := &metav1.APIGroup{}
+	decode(serve("alice", "/apis/team-a.example.com"), group)
+
+	if group.Name != "team-a.example.com" {
+		t.Errorf("expected the group team-a.example.com, got %#v", group)
+	}
+
+	for _, path := range []string{"/apis/team-b.example.com", "/apis/team-b.example.com/v1"} {
+		if w := serve("alice", path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+
+	spec := struct {
+		Paths       map[string]json.RawMessage `json:"paths"`
+		Definitions map[string]json.RawMessage `json:"definitions"`
+	}{}
+	w := serve("alice", "/openapi/v2")
+	decode(w, &spec)
+
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("expected no ETag of the filtered spec, got %s", etag)
+	}
+
+	if paths, expected := sets.StringKeySet(spec.Paths).List(), []string{"/apis/example.com/v1/namespaces/{namespace}/gadgets", "/version/"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected the paths %v, got %v", expected, paths)
+	}
+
+	if definitions, expected := sets.StringKeySet(spec.Definitions).List(), []string{"com.example.v1.Gadget", "io.k8s.apimachinery.pkg.apis.meta.v1.Status"}; !reflect.DeepEqual(definitions, expected) {
+		t.Errorf("expected the definitions %v, got %v", expected, definitions)
+	}
+
+	all := &metav1.APIGroupList{}
+	decode(serve("admin", "/apis"), all)
+
+	if len(all.Groups) != 3 {
+		t.Errorf("expected every group to be served to users without hidden APIs, got %v", all.Groups)
+	}
+
+	hiddenErr = errors.New("not known yet")
+	for _, path := range []string{"/apis", "/apis/example.com/v1", "/openapi/v2"} {
+		if w := serve("alice", path); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503 while the hidden APIs are unknown, got %d", path, w.Code)
+		}
+	}
+}
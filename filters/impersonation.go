@@ -0,0 +1,143 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// ImpersonateUIDHeader is the header of the UID of an impersonated user, which the impersonation of
+// the apiserver library does not know yet.
+const ImpersonateUIDHeader = "Impersonate-Uid"
+
+type impersonatedUIDKeyType int
+
+// impersonatedUIDKey is the context key of the authorized UID to impersonate.
+const impersonatedUIDKey impersonatedUIDKeyType = iota
+
+// WithImpersonation serves requests with impersonation headers as the impersonated user, like the
+// impersonation of the apiserver library, which checks that the requester may use the impersonate
+// verb on the users, groups, serviceaccounts and userextras impersonated. It adds the impersonation
+// of UIDs, which requires the impersonate verb on the uids resource of authentication.k8s.io, and
+// rejects the impersonation of groups, extras or a UID without a user with a 400 instead of a 500.
+// The impersonated user is the user of the request context, which the authorization, admission and
+// audit of the request see.
+func WithImpersonation(handler http.Handler, a authorizer.Authorizer, s runtime.NegotiatedSerializer) http.Handler {
+	impersonation := genericapifilters.WithImpersonation(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		if uid, ok := ctx.Value(impersonatedUIDKey).(string); ok {
+			if impersonated, ok := request.UserFrom(ctx); ok {
+				ctx = request.WithUser(ctx, &user.DefaultInfo{
+					Name:   impersonated.GetName(),
+					UID:    uid,
+					Groups: impersonated.GetGroups(),
+					Extra:  impersonated.GetExtra(),
+				})
+			}
+
+			if event := request.AuditEventFrom(ctx); event != nil && event.ImpersonatedUser != nil {
+				event.ImpersonatedUser.UID = uid
+			}
+
+			req = req.WithContext(ctx)
+		}
+
+		handler.ServeHTTP(w, req)
+	}), a, s)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(authenticationv1.ImpersonateUserHeader) == "" {
+			if impersonated := impersonationWithoutUser(req.Header); impersonated != "" {
+				err := apierrors.NewBadRequest(fmt.Sprintf("requested the impersonation of %s without impersonating a user", impersonated))
+				responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+
+				return
+			}
+		}
+
+		uid := req.Header.Get(ImpersonateUIDHeader)
+		if uid == "" {
+			impersonation.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+
+		requester, ok := request.UserFrom(ctx)
+		if !ok {
+			responsewriters.InternalError(w, req, fmt.Errorf("no user found for request"))
+			return
+		}
+
+		attributes := &authorizer.AttributesRecord{
+			User:            requester,
+			Verb:            "impersonate",
+			APIGroup:        authenticationv1.SchemeGroupVersion.Group,
+			APIVersion:      authenticationv1.SchemeGroupVersion.Version,
+			Resource:        "uids",
+			Name:            uid,
+			ResourceRequest: true,
+		}
+
+		if decision, reason, err := a.Authorize(ctx, attributes); err != nil || decision != authorizer.DecisionAllow {
+			responsewriters.Forbidden(ctx, attributes, w, req, reason, s)
+			return
+		}
+
+		req = req.Clone(context.WithValue(ctx, impersonatedUIDKey, uid))
+		req.Header.Del(ImpersonateUIDHeader)
+
+		impersonation.ServeHTTP(w, req)
+	})
+}
+
+// impersonationWithoutUser returns what headers without an Impersonate-User header request to
+// impersonate, or "" if nothing.
+func impersonationWithoutUser(header http.Header) string {
+	var impersonated []string
+
+	if len(header[authenticationv1.ImpersonateGroupHeader]) > 0 {
+		impersonated = append(impersonated, "groups")
+	}
+
+	for name := range header {
+		if strings.HasPrefix(name, authenticationv1.ImpersonateUserExtraHeaderPrefix) {
+			impersonated = append(impersonated, "extras")
+			break
+		}
+	}
+
+	if header.Get(ImpersonateUIDHeader) != "" {
+		impersonated = append(impersonated, "a UID")
+	}
+
+	return strings.Join(impersonated, " and ")
+}
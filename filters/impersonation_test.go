@@ -0,0 +1,179 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// impersonationAuthorizer allows alice to impersonate anything, except the UID forbidden-uid.
+type impersonationAuthorizer struct{}
+
+func (impersonationAuthorizer) Authorize(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	if a.GetUser().GetName() != "alice" || a.GetVerb() != "impersonate" {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+
+	if a.GetResource() == "uids" && (a.GetAPIGroup() != "authentication.k8s.io" || a.GetName() == "forbidden-uid") {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+
+	return authorizer.DecisionAllow, "", nil
+}
+
+func TestWithImpersonation(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorizer authorizer.Authorizer
+		headers    map[string][]string
+
+		expectedCode int
+		expectedUser *user.DefaultInfo
+	}{
+		{
+			name:         "no impersonation",
+			authorizer:   authorizerfactory.NewAlwaysDenyAuthorizer(),
+			expectedCode: http.StatusOK,
+			expectedUser: &user.DefaultInfo{Name: "alice", Groups: []string{"system:authenticated"}},
+		},
+		{
+			name:         "user allowed",
+			authorizer:   authorizerfactory.NewAlwaysAllowAuthorizer(),
+			headers:      map[string][]string{"Impersonate-User": {"bob"}},
+			expectedCode: http.StatusOK,
+			expectedUser: &user.DefaultInfo{Name: "bob", Groups: []string{"system:authenticated"}, Extra: map[string][]string{}},
+		},
+		{
+			name:         "user denied",
+			authorizer:   authorizerfactory.NewAlwaysDenyAuthorizer(),
+			headers:      map[string][]string{"Impersonate-User": {"bob"}},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "groups and extras",
+			authorizer:   impersonationAuthorizer{},
+			headers:      map[string][]string{"Impersonate-User": {"bob"}, "Impersonate-Group": {"devs", "ops"}, "Impersonate-Extra-Scopes": {"view"}},
+			expectedCode: http.StatusOK,
+			expectedUser: &user.DefaultInfo{Name: "bob", Groups: []string{"devs", "ops", "system:authenticated"}, Extra: map[string][]string{"scopes": {"view"}}},
+		},
+		{
+			name:         "service account",
+			authorizer:   impersonationAuthorizer{},
+			headers:      map[string][]string{"Impersonate-User": {"system:serviceaccount:default:builder"}},
+			expectedCode: http.StatusOK,
+			expectedUser: &user.DefaultInfo{Name: "system:serviceaccount:default:builder", Groups: []string{"system:serviceaccounts", "system:serviceaccounts:default", "system:authenticated"}, Extra: map[string][]string{}},
+		},
+		{
+			name:         "UID",
+			authorizer:   impersonationAuthorizer{},
+			headers:      map[string][]string{"Impersonate-User": {"bob"}, "Impersonate-Uid": {"1234"}},
+			expectedCode: http.StatusOK,
+			expectedUser: &user.DefaultInfo{Name: "bob", UID: "1234", Groups: []string{"system:authenticated"}, Extra: map[string][]string{}},
+		},
+		{
+			name:         "UID denied",
+			authorizer:   impersonationAuthorizer{},
+			headers:      map[string][]string{"Impersonate-User": {"bob"}, "Impersonate-Uid": {"forbidden-uid"}},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "UID denied by AlwaysDeny",
+			authorizer:   authorizerfactory.NewAlwaysDenyAuthorizer(),
+			headers:      map[string][]string{"Impersonate-User": {"bob"}, "Impersonate-Uid": {"1234"}},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "groups without user",
+			authorizer:   authorizerfactory.NewAlwaysAllowAuthorizer(),
+			headers:      map[string][]string{"Impersonate-Group": {"devs"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "UID without user",
+			authorizer:   authorizerfactory.NewAlwaysAllowAuthorizer(),
+			headers:      map[string][]string{"Impersonate-Uid": {"1234"}},
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				served     user.Info
+				uidHeaders []string
+			)
+
+			handler := WithImpersonation(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				served, _ = request.UserFrom(req.Context())
+				uidHeaders = req.Header.Values("Impersonate-Uid")
+			}), test.authorizer, scheme.Codecs)
+
+			req := httptest.NewRequest(http.MethodGet, "/apis/example.com/v1/widgets", nil)
+			for name, values := range test.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+
+			event := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+			ctx := request.WithUser(req.Context(), &user.DefaultInfo{Name: "alice", Groups: []string{"system:authenticated"}})
+			ctx = request.WithAuditEvent(ctx, event)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req.WithContext(ctx))
+
+			if w.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d: %s", test.expectedCode, w.Code, w.Body.String())
+			}
+
+			if test.expectedCode != http.StatusOK {
+				if test.expectedCode == http.StatusBadRequest && !strings.Contains(w.Body.String(), "without impersonating a user") {
+					t.Errorf("expected the message to state the missing user, got %s", w.Body.String())
+				}
+
+				return
+			}
+
+			if !reflect.DeepEqual(served, test.expectedUser) {
+				t.Errorf("expected the user %#v, got %#v", test.expectedUser, served)
+			}
+
+			if len(uidHeaders) > 0 {
+				t.Errorf("expected the Impersonate-Uid header to be removed, got %v", uidHeaders)
+			}
+
+			if _, impersonated := test.headers["Impersonate-User"]; impersonated {
+				if event.ImpersonatedUser == nil || event.ImpersonatedUser.Username != test.expectedUser.Name || event.ImpersonatedUser.UID != test.expectedUser.UID {
+					t.Errorf("expected the audit event to record the impersonated user %s, got %#v", test.expectedUser.Name, event.ImpersonatedUser)
+				}
+			}
+		})
+	}
+}
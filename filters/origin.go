@@ -0,0 +1,65 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// originInternal labels requests of the loopback clients of the server itself.
+	originInternal = "internal"
+	// originExternal labels all other requests.
+	originExternal = "external"
+)
+
+var requestsByOrigin = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Name:           "badidea_requests_total",
+		Help:           "Counter of authenticated requests, broken down by whether they came from the server's own loopback clients.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"origin"},
+)
+
+func init() {
+	legacyregistry.MustRegister(requestsByOrigin)
+}
+
+// WithRequestOrigin counts requests in badidea_requests_total by origin. It has to run after
+// authentication. Internal requests are made as system:apiserver, which is in system:masters and so
+// is exempt from the max-in-flight limits already.
+func WithRequestOrigin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestsByOrigin.WithLabelValues(requestOrigin(req)).Inc()
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func requestOrigin(req *http.Request) string {
+	if u, ok := request.UserFrom(req.Context()); ok && u.GetName() == user.APIServerUser {
+		return originInternal
+	}
+
+	return originExternal
+}
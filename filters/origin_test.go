@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestWithRequestOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   user.Info
+		origin string
+	}{
+		{
+			name:   "loopback client",
+			user:   &user.DefaultInfo{Name: user.APIServerUser, Groups: []string{user.SystemPrivilegedGroup}},
+			origin: originInternal,
+		},
+		{
+			name:   "other member of system:masters",
+			user:   &user.DefaultInfo{Name: "admin", Groups: []string{user.SystemPrivilegedGroup}},
+			origin: originExternal,
+		},
+		{
+			name:   "anonymous",
+			user:   &user.DefaultInfo{Name: user.Anonymous, Groups: []string{user.AllUnauthenticated}},
+			origin: originExternal,
+		},
+		{
+			name:   "no user",
+			origin: originExternal,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			before, err := testutil.GetCounterMetricValue(requestsByOrigin.WithLabelValues(test.origin))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			handler := WithRequestOrigin(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+			if test.user != nil {
+				req = req.WithContext(request.WithUser(req.Context(), test.user))
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			after, err := testutil.GetCounterMetricValue(requestsByOrigin.WithLabelValues(test.origin))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if after-before != 1 {
+				t.Errorf("expected one more %s request, got %v", test.origin, after-before)
+			}
+		})
+	}
+}
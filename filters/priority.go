@@ -0,0 +1,75 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"strings"
+
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// priorityPaths are the health checks and discovery documents, whose prefixes are served with
+// priority too. Non-resource requests below /api/ and /apis/ are discovery documents.
+var priorityPaths = []string{"/healthz", "/livez", "/readyz", "/version", "/api", "/apis"}
+
+// WithPriority serves the GETs of the health checks and discovery documents with priorityHandler,
+// which skips the max-in-flight limits handler enforces, so that probes and clients discovering the
+// server do not queue behind expensive requests when it is saturated. At most maxInFlight of them are
+// served with priority at a time, further ones are served by handler like any other request. A
+// maxInFlight of zero disables the priority. It has to run after the request info is resolved.
+func WithPriority(handler, priorityHandler http.Handler, maxInFlight int) http.Handler {
+	if maxInFlight <= 0 {
+		return handler
+	}
+
+	inFlight := make(chan struct{}, maxInFlight)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isPriorityRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+
+			priorityHandler.ServeHTTP(w, req)
+		default:
+			handler.ServeHTTP(w, req)
+		}
+	})
+}
+
+func isPriorityRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if info, ok := request.RequestInfoFrom(req.Context()); !ok || info.IsResourceRequest {
+		return false
+	}
+
+	for _, path := range priorityPaths {
+		if req.URL.Path == path || strings.HasPrefix(req.URL.Path, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestWithPriority(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	newRequest := func(method, path string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+
+		info, err := resolver.NewRequestInfo(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return req.WithContext(request.WithRequestInfo(req.Context(), info))
+	}
+
+	tests := []struct {
+		method string
+		path   string
+
+		expectedPriority bool
+	}{
+		{method: http.MethodGet, path: "/readyz", expectedPriority: true},
+		{method: http.MethodGet, path: "/livez/etcd", expectedPriority: true},
+		{method: http.MethodGet, path: "/healthz", expectedPriority: true},
+		{method: http.MethodGet, path: "/version", expectedPriority: true},
+		{method: http.MethodGet, path: "/api", expectedPriority: true},
+		{method: http.MethodGet, path: "/api/v1", expectedPriority: true},
+		{method: http.MethodGet, path: "/apis", expectedPriority: true},
+		{method: http.MethodGet, path: "/apis/example.com", expectedPriority: true},
+		{method: http.MethodHead, path: "/apis/example.com/v1", expectedPriority: true},
+		{method: http.MethodGet, path: "/apis/example.com/v1/widgets"},
+		{method: http.MethodGet, path: "/api/v1/namespaces/default/configmaps"},
+		{method: http.MethodPost, path: "/apis/example.com/v1/widgets"},
+		{method: http.MethodGet, path: "/openapi/v2"},
+		{method: http.MethodGet, path: "/metrics"},
+		{method: http.MethodGet, path: "/apiserver"},
+	}
+
+	for _, test := range tests {
+		var prioritized bool
+
+		handler := WithPriority(
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { prioritized = true }),
+			1)
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(test.method, test.path))
+
+		if prioritized != test.expectedPriority {
+			t.Errorf("%s %s: expected priority %v, got %v", test.method, test.path, test.expectedPriority, prioritized)
+		}
+	}
+
+	// once the budget is used up, priority requests are served like any other
+	unblock := make(chan struct{})
+	blocked := make(chan struct{})
+	served := ""
+
+	handler := WithPriority(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { served = "limited" }),
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/readyz" {
+				close(blocked)
+				<-unblock
+			}
+			served = "priority"
+		}),
+		1)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, "/readyz"))
+	}()
+	<-blocked
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, "/apis"))
+
+	if served != "limited" {
+		t.Errorf("expected a request over the budget to be limited, got %s", served)
+	}
+
+	close(unblock)
+	<-done
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, "/apis"))
+
+	if served != "priority" {
+		t.Errorf("expected the budget to be released, got %s", served)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// jsonMediaTypes are the JSON media types of the bodies of create, update and patch requests.
+	jsonMediaTypes = sets.NewString("application/json", "application/json-patch+json", "application/merge-patch+json", "application/strategic-merge-patch+json")
+	// yamlMediaTypes are the YAML media types of the bodies of create, update and patch requests.
+	yamlMediaTypes = sets.NewString("application/yaml", "application/apply-patch+yaml")
+)
+
+// RequestBodyLimits are the limits of the bodies of create, update and patch requests. Zero disables a
+// limit.
+type RequestBodyLimits struct {
+	// MaxBytes is the limit of the size of bodies.
+	MaxBytes int64
+	// MaxJSONPatchOperations is the limit of the operations of JSON patches.
+	MaxJSONPatchOperations int
+	// MaxNestingDepth is the limit of the nesting of the objects and arrays of JSON and YAML bodies.
+	MaxNestingDepth int
+}
+
+// WithRequestBodyLimits rejects create, update and patch requests whose body exceeds limits, with a
+// 413 for the size and a 400 otherwise, whose message states the limit and the actual value. Bodies
+// are only read into memory, up to MaxBytes, to check their operations and nesting. The endpoint
+// handlers limit the size of bodies without a Content-Length too, stating the limit only. It has to
+// run after the request info is resolved.
+func WithRequestBodyLimits(handler http.Handler, limits RequestBodyLimits, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || !storingVerbs.Has(info.Verb) || req.Body == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		if limits.MaxBytes > 0 && req.ContentLength > limits.MaxBytes {
+			err := apierrors.NewRequestEntityTooLargeError(fmt.Sprintf("the request body of %d bytes exceeds the limit of %d bytes", req.ContentLength, limits.MaxBytes))
+			responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+
+			return
+		}
+
+		// the endpoint handlers decode bodies without a Content-Type as JSON, as the dynamic client sends them
+		mediaType := "application/json"
+		if contentType := req.Header.Get("Content-Type"); contentType != "" {
+			mediaType, _, _ = mime.ParseMediaType(contentType)
+		}
+
+		checkOperations := limits.MaxJSONPatchOperations > 0 && mediaType == "application/json-patch+json"
+		checkDepth := limits.MaxNestingDepth > 0 && (jsonMediaTypes.Has(mediaType) || yamlMediaTypes.Has(mediaType))
+		if !checkOperations && !checkDepth {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := readBody(req.Body, limits.MaxBytes)
+		if err != nil {
+			responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+			return
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if checkOperations {
+			// malformed patches are left to the patch handler to reject
+			var operations []json.RawMessage
+			if err := json.Unmarshal(body, &operations); err == nil && len(operations) > limits.MaxJSONPatchOperations {
+				err := apierrors.NewBadRequest(fmt.Sprintf("the JSON patch has %d operations, the limit is %d", len(operations), limits.MaxJSONPatchOperations))
+				responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+
+				return
+			}
+		}
+
+		if checkDepth {
+			document := body
+			if yamlMediaTypes.Has(mediaType) {
+				// malformed YAML is left to the endpoint handlers to reject
+				if document, err = yaml.YAMLToJSON(body); err != nil {
+					document = nil
+				}
+			}
+
+			if depth := nestingDepth(document); depth > limits.MaxNestingDepth {
+				err := apierrors.NewBadRequest(fmt.Sprintf("the request body is nested %d levels deep, the limit is %d", depth, limits.MaxNestingDepth))
+				responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// readBody reads body, returning a 413 if it is larger than maxBytes, unless that is zero. The rest
+// of a larger body is read to state its size.
+func readBody(body io.Reader, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, apierrors.NewBadRequest(fmt.Sprintf("failed to read the request body: %v", err))
+		}
+
+		return data, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("failed to read the request body: %v", err))
+	}
+
+	if int64(len(data)) > maxBytes {
+		rest, _ := io.Copy(ioutil.Discard, body)
+
+		return nil, apierrors.NewRequestEntityTooLargeError(fmt.Sprintf("the request body of %d bytes exceeds the limit of %d bytes", int64(len(data))+rest, maxBytes))
+	}
+
+	return data, nil
+}
+
+// nestingDepth returns the deepest nesting of the objects and arrays of the JSON document.
+func nestingDepth(document []byte) int {
+	depth, maxDepth := 0, 0
+	inString, escaped := false, false
+
+	for _, c := range document {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+
+	return maxDepth
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// chunked hides the length of a body, like a chunked upload.
+type chunked struct {
+	*strings.Reader
+}
+
+func TestWithRequestBodyLimits(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat(`{"a":`, depth) + "1" + strings.Repeat("}", depth)
+	}
+
+	limits := RequestBodyLimits{MaxBytes: 100, MaxJSONPatchOperations: 2, MaxNestingDepth: 3}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		chunked     bool
+
+		expectedCode    int
+		expectedMessage string
+	}{
+		{
+			name:         "create below the limits",
+			method:       http.MethodPost,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			contentType:  "application/json",
+			body:         nested(3),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:            "create too large",
+			method:          http.MethodPost,
+			path:            "/apis/example.com/v1/namespaces/default/widgets",
+			contentType:     "application/json",
+			body:            strings.Repeat(" ", 101),
+			expectedCode:    http.StatusRequestEntityTooLarge,
+			expectedMessage: "Request entity too large: the request body of 101 bytes exceeds the limit of 100 bytes",
+		},
+		{
+			name:            "chunked update too large",
+			method:          http.MethodPut,
+			path:            "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			contentType:     "application/json",
+			body:            strings.Repeat(" ", 150),
+			chunked:         true,
+			expectedCode:    http.StatusRequestEntityTooLarge,
+			expectedMessage: "Request entity too large: the request body of 150 bytes exceeds the limit of 100 bytes",
+		},
+		{
+			name:            "create nested too deep",
+			method:          http.MethodPost,
+			path:            "/apis/example.com/v1/namespaces/default/widgets",
+			contentType:     "application/json",
+			body:            nested(4),
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "the request body is nested 4 levels deep, the limit is 3",
+		},
+		{
+			name:            "create nested too deep without Content-Type",
+			method:          http.MethodPost,
+			path:            "/apis/example.com/v1/namespaces/default/widgets",
+			body:            nested(4),
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "the request body is nested 4 levels deep, the limit is 3",
+		},
+		{
+			name:         "brackets in strings",
+			method:       http.MethodPost,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			contentType:  "application/json; charset=utf-8",
+			body:         `{"a":"{{{[[[\"{{{"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:            "YAML nested too deep",
+			method:          http.MethodPatch,
+			path:            "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			contentType:     "application/apply-patch+yaml",
+			body:            "a:\n  b:\n    c:\n      d: 1\n",
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "the request body is nested 4 levels deep, the limit is 3",
+		},
+		{
+			name:            "JSON patch with too many operations",
+			method:          http.MethodPatch,
+			path:            "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			contentType:     "application/json-patch+json",
+			body:            `[{"op":"remove","path":"/a"},{"op":"remove","path":"/b"},{"op":"remove","path":"/c"}]`,
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "the JSON patch has 3 operations, the limit is 2",
+		},
+		{
+			name:         "malformed JSON patch",
+			method:       http.MethodPatch,
+			path:         "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			contentType:  "application/json-patch+json",
+			body:         `[{"op":`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "protobuf",
+			method:       http.MethodPost,
+			path:         "/api/v1/namespaces/default/configmaps",
+			contentType:  "application/vnd.kubernetes.protobuf",
+			body:         nested(4),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "non-resource request",
+			method:       http.MethodPost,
+			path:         "/webhook",
+			contentType:  "application/json",
+			body:         nested(4),
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			var received string
+
+			apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				received = string(body)
+			})
+			handler := WithRequestBodyLimits(apiHandler, limits, scheme.Codecs)
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.chunked {
+				req = httptest.NewRequest(test.method, test.path, chunked{strings.NewReader(test.body)})
+			}
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+
+			info, err := resolver.NewRequestInfo(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req.WithContext(request.WithRequestInfo(req.Context(), info)))
+
+			if w.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d: %s", test.expectedCode, w.Code, w.Body.String())
+			}
+
+			if test.expectedCode == http.StatusOK {
+				if received != test.body {
+					t.Errorf("expected the handler to receive the body %q, got %q", test.body, received)
+				}
+
+				return
+			}
+
+			status := &metav1.Status{}
+			if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+				t.Fatalf("expected a Status: %v", err)
+			}
+
+			if status.Code != int32(test.expectedCode) || status.Message != test.expectedMessage {
+				t.Errorf("unexpected status %#v", status)
+			}
+		})
+	}
+}
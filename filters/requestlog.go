@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+)
+
+// WithRequestLogging logs one line per request with its latency, user, verb, resource, response
+// code and audit ID. Every request is logged when enabled is set. Requests slower than
+// slowRequestThreshold are logged as a warning even when enabled is not set; long-running requests
+// are exempt from the threshold and are logged when they terminate, including the number of writes
+// to the response (at least one per watch event). The filter expects the RequestInfo and the user
+// in the request context.
+func WithRequestLogging(handler http.Handler, longRunningFunc request.LongRunningRequestCheck, enabled bool, slowRequestThreshold time.Duration) http.Handler {
+	if !enabled && slowRequestThreshold <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := &loggingResponseWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(rw, req)
+
+		latency := time.Since(start)
+		line := requestLogLine(req, rw, latency)
+
+		info, ok := request.RequestInfoFrom(req.Context())
+		if ok && longRunningFunc != nil && longRunningFunc(req, info) {
+			if enabled {
+				klog.Infof("%s writes=%d", line, rw.writes)
+			}
+
+			return
+		}
+
+		switch {
+		case slowRequestThreshold > 0 && latency > slowRequestThreshold:
+			klog.Warningf("Slow request (threshold %v): %s", slowRequestThreshold, line)
+		case enabled:
+			klog.Info(line)
+		}
+	})
+}
+
+func requestLogLine(req *http.Request, rw *loggingResponseWriter, latency time.Duration) string {
+	verb, resource, username := "", "", ""
+	auditID, _ := AuditIDFrom(req.Context())
+
+	if info, ok := request.RequestInfoFrom(req.Context()); ok {
+		verb = info.Verb
+		resource = info.Resource
+
+		if info.Subresource != "" {
+			resource += "/" + info.Subresource
+		}
+	}
+
+	if user, ok := request.UserFrom(req.Context()); ok {
+		username = user.GetName()
+	}
+
+	status := rw.status
+	if status == 0 && !rw.hijacked {
+		status = http.StatusOK
+	}
+
+	return fmt.Sprintf("%q %d latency=%v user=%q verb=%q resource=%q userAgent=%q srcIP=%q auditID=%q",
+		req.Method+" "+req.URL.RequestURI()+" "+req.Proto, status, latency, username, verb, resource, req.UserAgent(), req.RemoteAddr, auditID)
+}
+
+// loggingResponseWriter records the response code and counts the writes of a request.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+
+	status   int
+	writes   int
+	hijacked bool
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	w.writes++
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *loggingResponseWriter) CloseNotify() <-chan bool {
+	//nolint:staticcheck // the generic apiserver filters still rely on http.CloseNotifier
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
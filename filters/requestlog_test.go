@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
+	"k8s.io/klog/v2"
+)
+
+func TestWithRequestLogging(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		enabled bool
+		delay   time.Duration
+		events  int
+
+		expectedLines []string
+	}{
+		{
+			name:    "fast request",
+			path:    "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+			enabled: true,
+
+			expectedLines: []string{`I`, `"GET /apis/apiextensions.k8s.io/v1/customresourcedefinitions HTTP/1.1" 200`, `user="bad"`, `verb="list"`, `resource="customresourcedefinitions"`},
+		},
+		{
+			name: "fast request with logging disabled",
+			path: "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+		},
+		{
+			name:  "slow request with logging disabled",
+			path:  "/apis/apiextensions.k8s.io/v1/customresourcedefinitions",
+			delay: 20 * time.Millisecond,
+
+			expectedLines: []string{`W`, `Slow request (threshold 10ms)`, `verb="list"`},
+		},
+		{
+			name:    "watch",
+			path:    "/apis/apiextensions.k8s.io/v1/customresourcedefinitions?watch=true",
+			enabled: true,
+			delay:   20 * time.Millisecond,
+			events:  3,
+
+			expectedLines: []string{`I`, `verb="watch"`, `writes=3`},
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	longRunningFunc := genericfilters.BasicLongRunningRequestCheck(sets.NewString("watch"), sets.NewString())
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			klog.LogToStderr(false)
+			klog.SetOutput(out)
+			defer klog.LogToStderr(true)
+
+			inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				time.Sleep(test.delay)
+				for i := 0; i < test.events; i++ {
+					fmt.Fprintf(w, "event %d\n", i)
+				}
+			})
+
+			handler := WithRequestLogging(inner, longRunningFunc, test.enabled, 10*time.Millisecond)
+			handler = withUser(handler, &user.DefaultInfo{Name: "bad"})
+			handler = genericapifilters.WithRequestInfo(handler, resolver)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.path, nil))
+			klog.Flush()
+
+			logged := out.String()
+			if len(test.expectedLines) == 0 {
+				if logged != "" {
+					t.Errorf("expected no log output, got %q", logged)
+				}
+
+				return
+			}
+
+			if !strings.HasPrefix(logged, test.expectedLines[0]) {
+				t.Errorf("expected log severity %s, got %q", test.expectedLines[0], logged)
+			}
+
+			for _, expected := range test.expectedLines[1:] {
+				if !strings.Contains(logged, expected) {
+					t.Errorf("expected log output to contain %q, got %q", expected, logged)
+				}
+			}
+		})
+	}
+}
+
+func withUser(handler http.Handler, u user.Info) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req.WithContext(request.WithUser(req.Context(), u)))
+	})
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// WithReservedUserNames rejects with a 403 the requests of users whose name starts with prefix, as
+// authenticated, and the requests impersonating such users unless mayImpersonate returns true for the
+// requester, like the loopback client. The names are left to the server, which trusts them. It has to
+// run after the authentication and before the impersonation.
+func WithReservedUserNames(handler http.Handler, prefix string, mayImpersonate func(user.Info) bool, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requester, ok := request.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		var err error
+
+		if strings.HasPrefix(requester.GetName(), prefix) {
+			err = apierrors.NewForbidden(schema.GroupResource{}, "", fmt.Errorf("user names starting with %q are reserved for the components of the server, got %q", prefix, requester.GetName()))
+		} else if impersonated := req.Header.Get(authenticationv1.ImpersonateUserHeader); strings.HasPrefix(impersonated, prefix) && !mayImpersonate(requester) {
+			err = apierrors.NewForbidden(schema.GroupResource{}, "", fmt.Errorf("users with names starting with %q are only impersonated by the server, %q may not impersonate %q", prefix, requester.GetName(), impersonated))
+		}
+
+		if err != nil {
+			responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithReservedUserNames(t *testing.T) {
+	handler := WithReservedUserNames(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		"system:badidea:",
+		func(u user.Info) bool { return u.GetName() == user.APIServerUser },
+		scheme.Codecs)
+
+	tests := []struct {
+		name         string
+		user         string
+		impersonated string
+		expectedCode int
+	}{
+		{name: "user", user: "alice", expectedCode: http.StatusOK},
+		{name: "reserved user", user: "system:badidea:garbage-collector", expectedCode: http.StatusForbidden},
+		{name: "impersonating a user", user: "alice", impersonated: "bob", expectedCode: http.StatusOK},
+		{name: "impersonating a reserved user", user: "alice", impersonated: "system:badidea:garbage-collector", expectedCode: http.StatusForbidden},
+		{name: "loopback impersonating a reserved user", user: user.APIServerUser, impersonated: "system:badidea:garbage-collector", expectedCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/apis", nil)
+			req = req.WithContext(request.WithUser(req.Context(), &user.DefaultInfo{Name: test.user}))
+
+			if test.impersonated != "" {
+				req.Header.Set(authenticationv1.ImpersonateUserHeader, test.impersonated)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedCode {
+				t.Errorf("expected %d, got %d: %s", test.expectedCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// retryAfterSeconds is the delay clients are told to wait before retrying a rejected request.
+const retryAfterSeconds = 1
+
+// retryAfterExemptPaths are served while the server starts up or shuts down, so that probes and
+// scrapers can tell what is going on.
+var retryAfterExemptPaths = []string{"/healthz", "/livez", "/readyz", "/metrics"}
+
+// readinessInterval is the interval at which the readyz checks are evaluated until they passed once.
+const readinessInterval = time.Second
+
+// Readiness caches whether the server is shutting down and whether it is ready, for WithRetryAfter.
+// The server is ready once every readyz check passed once. Until then the checks are evaluated in the
+// background at an interval, not for every request.
+type Readiness struct {
+	shuttingDown int32
+	ready        int32
+	interval     time.Duration
+
+	once    sync.Once
+	lock    sync.Mutex
+	pending []string
+}
+
+// NewReadiness returns a Readiness of a server that is neither ready nor shutting down.
+func NewReadiness() *Readiness {
+	return &Readiness{interval: readinessInterval}
+}
+
+// ShutDown marks the server as shutting down. The server calls it once its stop channel is closed,
+// at the start of the shutdown delay, when its shutdown readyz check starts failing.
+func (r *Readiness) ShutDown() {
+	atomic.StoreInt32(&r.shuttingDown, 1)
+}
+
+// ShuttingDown returns whether ShutDown was called.
+func (r *Readiness) ShuttingDown() bool {
+	return atomic.LoadInt32(&r.shuttingDown) == 1
+}
+
+// Ready returns whether every check of readyz passed once, with the failed checks of the last
+// evaluation if not. The first call evaluates the checks, then they are evaluated in the background
+// until they pass or the server shuts down.
+func (r *Readiness) Ready(readyz http.Handler) (bool, []string) {
+	if atomic.LoadInt32(&r.ready) == 1 {
+		return true, nil
+	}
+
+	r.once.Do(func() {
+		if r.probe(readyz) {
+			return
+		}
+
+		go func() {
+			_ = wait.PollInfinite(r.interval, func() (bool, error) {
+				return r.ShuttingDown() || r.probe(readyz), nil
+			})
+		}()
+	})
+
+	if atomic.LoadInt32(&r.ready) == 1 {
+		return true, nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return false, r.pending
+}
+
+// probe evaluates the checks of readyz and records the result.
+func (r *Readiness) probe(readyz http.Handler) bool {
+	failed, pending := probeReadyz(readyz, "/readyz?verbose")
+	if !failed {
+		atomic.StoreInt32(&r.ready, 1)
+		return true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pending = pending
+
+	return false
+}
+
+// WithRetryAfter rejects requests while the server starts up or shuts down, telling clients when to
+// retry. readyz serves the /readyz endpoints of the server, readiness caches their result. Once the
+// server is shutting down, new requests get a 429 and their connection is closed, while requests in
+// flight drain. Before that, until every readyz check passed once, requests get a 503 naming the
+// pending checks. Health checks, metrics and the requests of the loopback clients are exempt. It has
+// to run after authentication.
+func WithRetryAfter(handler, readyz http.Handler, readiness *Readiness, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isRetryAfterExempt(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		if readiness.ShuttingDown() {
+			w.Header().Set("Connection", "close")
+			responsewriters.ErrorNegotiated(apierrors.NewTooManyRequests("the server is shutting down", retryAfterSeconds), s, schema.GroupVersion{}, w, req)
+
+			return
+		}
+
+		if ready, pending := readiness.Ready(readyz); !ready {
+			err := apierrors.NewServiceUnavailable(fmt.Sprintf("the server is starting up, pending readyz checks: %s", strings.Join(pending, ", ")))
+			err.ErrStatus.Details = &metav1.StatusDetails{RetryAfterSeconds: retryAfterSeconds}
+			responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func isRetryAfterExempt(req *http.Request) bool {
+	if u, ok := request.UserFrom(req.Context()); ok && u.GetName() == user.APIServerUser {
+		return true
+	}
+
+	for _, path := range retryAfterExemptPaths {
+		if req.URL.Path == path || strings.HasPrefix(req.URL.Path, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeReadyz requests path of readyz and reports whether it failed, with the names of the failed
+// checks if the output is verbose.
+func probeReadyz(readyz http.Handler, path string) (bool, []string) {
+	w := httptest.NewRecorder()
+	readyz.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+	if w.Code != http.StatusInternalServerError {
+		// ok, or a check the server does not have
+		return false, nil
+	}
+
+	failed := []string{}
+
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		// verbose output lists failed checks as "[-]name failed: reason withheld"
+		if line := scanner.Text(); strings.HasPrefix(line, "[-]") {
+			failed = append(failed, strings.SplitN(strings.TrimPrefix(line, "[-]"), " ", 2)[0])
+		}
+	}
+
+	return true, failed
+}
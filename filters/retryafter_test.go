@@ -0,0 +1,198 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithRetryAfter(t *testing.T) {
+	var registered int32
+
+	mux := http.NewServeMux()
+	healthz.InstallReadyzHandler(mux,
+		healthz.PingHealthz,
+		healthz.NamedCheck("autoregister-completion", func(r *http.Request) error {
+			if atomic.LoadInt32(&registered) == 0 {
+				return errors.New("missing APIService")
+			}
+			return nil
+		}),
+	)
+
+	readiness := NewReadiness()
+	readiness.interval = 50 * time.Millisecond
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	handler := WithRetryAfter(apiHandler, mux, readiness, scheme.Codecs)
+
+	tests := []struct {
+		name       string
+		registered bool
+		shutDown   bool
+		path       string
+		user       string
+		// wait serves the request until it gets the expected code, for the background readyz checks
+		wait bool
+
+		expectedCode    int
+		expectedMessage string
+	}{
+		{
+			name:            "starting up",
+			path:            "/apis",
+			expectedCode:    http.StatusServiceUnavailable,
+			expectedMessage: "the server is starting up, pending readyz checks: autoregister-completion",
+		},
+		{
+			name:         "health check while starting up",
+			path:         "/readyz",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "loopback client while starting up",
+			path:         "/apis",
+			user:         user.APIServerUser,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "ready",
+			registered:   true,
+			path:         "/apis",
+			wait:         true,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "failing check after startup",
+			path:         "/apis",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:            "shutting down",
+			shutDown:        true,
+			path:            "/apis",
+			expectedCode:    http.StatusTooManyRequests,
+			expectedMessage: "the server is shutting down",
+		},
+		{
+			name:         "metrics while shutting down",
+			path:         "/metrics",
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	serve := func(path, userName string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if userName != "" {
+			req = req.WithContext(request.WithUser(req.Context(), &user.DefaultInfo{Name: userName}))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	// the cases run in order, the server is ready once every check passed
+	for _, test := range tests {
+		if test.registered {
+			atomic.StoreInt32(&registered, 1)
+		} else {
+			atomic.StoreInt32(&registered, 0)
+		}
+
+		if test.shutDown {
+			readiness.ShutDown()
+		}
+
+		w := serve(test.path, test.user)
+
+		if test.wait {
+			_ = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				w = serve(test.path, test.user)
+				return w.Code == test.expectedCode, nil
+			})
+		}
+
+		if w.Code != test.expectedCode {
+			t.Errorf("%s: expected code %d, got %d", test.name, test.expectedCode, w.Code)
+		}
+
+		if test.expectedCode == http.StatusTooManyRequests && w.Header().Get("Connection") != "close" {
+			t.Errorf("%s: expected the connection to be closed", test.name)
+		}
+
+		if test.expectedMessage == "" {
+			continue
+		}
+
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+			t.Errorf("%s: expected Retry-After 1, got %q", test.name, retryAfter)
+		}
+
+		status := &metav1.Status{}
+		if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+			t.Errorf("%s: expected a Status body, got %q: %v", test.name, w.Body.String(), err)
+		} else if !strings.Contains(status.Message, test.expectedMessage) {
+			t.Errorf("%s: expected message %q, got %q", test.name, test.expectedMessage, status.Message)
+		}
+	}
+}
+
+func TestReadinessEvaluatesChecksInTheBackground(t *testing.T) {
+	var checked int32
+
+	mux := http.NewServeMux()
+	healthz.InstallReadyzHandler(mux, healthz.NamedCheck("autoregister-completion", func(r *http.Request) error {
+		atomic.AddInt32(&checked, 1)
+		return errors.New("missing APIService")
+	}))
+
+	readiness := NewReadiness()
+	readiness.interval = time.Hour
+	defer readiness.ShutDown()
+
+	handler := WithRetryAfter(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), mux, readiness, scheme.Codecs)
+
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apis", nil))
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected the requests to be rejected while starting up, got %d", w.Code)
+		}
+	}
+
+	// the first request evaluated the checks, the others got the cached result
+	if checked := atomic.LoadInt32(&checked); checked != 1 {
+		t.Errorf("expected the readyz checks to be evaluated once, got %d", checked)
+	}
+}
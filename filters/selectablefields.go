@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"context"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+type selectableFieldsKeyType int
+
+// selectableFieldsKey is the context key of the field selector on selectable fields of a request.
+const selectableFieldsKey selectableFieldsKeyType = iota
+
+// WithSelectableFields moves the requirements of the field selectors of list, watch and
+// deletecollection requests on the fields selectable returns for their resource out of the
+// fieldSelector parameter, into the context, where SelectableFieldSelectorFrom returns them for the
+// storage to match. The endpoint handlers of custom resources reject field selectors on anything but
+// metadata.name and metadata.namespace. Malformed selectors are left to the endpoint handlers to
+// reject. It has to run after the request info is resolved.
+func WithSelectableFields(handler http.Handler, selectable func(schema.GroupResource) []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || info.Subresource != "" || !selectingVerbs.Has(info.Verb) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		query := req.URL.Query()
+		if query.Get("fieldSelector") == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		names := sets.NewString(selectable(schema.GroupResource{Group: info.APIGroup, Resource: info.Resource})...)
+		if names.Len() == 0 {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		moved, rest, ok := splitFieldSelector(query.Get("fieldSelector"), names)
+		if !ok || moved.Empty() {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		if rest.Empty() {
+			query.Del("fieldSelector")
+		} else {
+			query.Set("fieldSelector", rest.String())
+		}
+
+		req = req.Clone(context.WithValue(req.Context(), selectableFieldsKey, moved))
+		req.URL.RawQuery = query.Encode()
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// SelectableFieldSelectorFrom returns the field selector on selectable fields WithSelectableFields
+// moved out of the request the context belongs to.
+func SelectableFieldSelectorFrom(ctx context.Context) (fields.Selector, bool) {
+	selector, ok := ctx.Value(selectableFieldsKey).(fields.Selector)
+
+	return selector, ok
+}
+
+// splitFieldSelector splits the requirements of selector on the fields in names from the rest. It
+// returns false if selector is malformed.
+func splitFieldSelector(selector string, names sets.String) (fields.Selector, fields.Selector, bool) {
+	parsed, err := fields.ParseSelector(selector)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	var moved, rest []fields.Selector
+
+	for _, requirement := range parsed.Requirements() {
+		term := fields.OneTermEqualSelector(requirement.Field, requirement.Value)
+		if requirement.Operator == selection.NotEquals {
+			term = fields.OneTermNotEqualSelector(requirement.Field, requirement.Value)
+		}
+
+		if names.Has(requirement.Field) {
+			moved = append(moved, term)
+		} else {
+			rest = append(rest, term)
+		}
+	}
+
+	return fields.AndSelectors(moved...), fields.AndSelectors(rest...), true
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestWithSelectableFields(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	selectable := func(resource schema.GroupResource) []string {
+		if resource == (schema.GroupResource{Group: "example.com", Resource: "widgets"}) {
+			return []string{"spec.color", "spec.size"}
+		}
+
+		return nil
+	}
+
+	var (
+		query    url.Values
+		selector fields.Selector
+		moved    bool
+	)
+
+	handler := WithSelectableFields(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.Query()
+		selector, moved = SelectableFieldSelectorFrom(req.Context())
+	}), selectable)
+
+	tests := []struct {
+		name string
+		path string
+
+		expectedSelector string
+		expectedMoved    string
+	}{
+		{
+			name:             "selectable fields",
+			path:             "/apis/example.com/v1/namespaces/default/widgets?fieldSelector=spec.color%3Dred,spec.size!%3D3",
+			expectedSelector: "",
+			expectedMoved:    "spec.color=red,spec.size!=3",
+		},
+		{
+			name:             "selectable and metadata fields",
+			path:             "/apis/example.com/v1/widgets?watch=true&fieldSelector=metadata.name%3Da,spec.color%3D%3Dred",
+			expectedSelector: "metadata.name=a",
+			expectedMoved:    "spec.color=red",
+		},
+		{
+			name:             "no selectable fields",
+			path:             "/apis/example.com/v1/namespaces/default/widgets?fieldSelector=metadata.name%3Da",
+			expectedSelector: "metadata.name=a",
+		},
+		{
+			name:             "resource without selectable fields",
+			path:             "/apis/example.com/v1/namespaces/default/gadgets?fieldSelector=spec.color%3Dred",
+			expectedSelector: "spec.color=red",
+		},
+		{
+			name:             "get",
+			path:             "/apis/example.com/v1/namespaces/default/widgets/a?fieldSelector=spec.color%3Dred",
+			expectedSelector: "spec.color=red",
+		},
+		{
+			name:             "malformed selector",
+			path:             "/apis/example.com/v1/namespaces/default/widgets?fieldSelector=spec.color",
+			expectedSelector: "spec.color",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			query, selector, moved = nil, nil, false
+
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+
+			info, err := resolver.NewRequestInfo(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(request.WithRequestInfo(req.Context(), info)))
+
+			if got := query.Get("fieldSelector"); got != test.expectedSelector {
+				t.Errorf("expected the field selector %q, got %q", test.expectedSelector, got)
+			}
+
+			if test.expectedMoved == "" {
+				if moved {
+					t.Errorf("expected no selector to be moved, got %q", selector)
+				}
+
+				return
+			}
+
+			if !moved || selector.String() != test.expectedMoved {
+				t.Errorf("expected the selector %q to be moved, got %v", test.expectedMoved, selector)
+			}
+		})
+	}
+}
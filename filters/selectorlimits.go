@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"fmt"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// selectingVerbs are the verbs whose label selector is matched against every object of a collection.
+var selectingVerbs = sets.NewString("list", "watch", "deletecollection")
+
+// LabelSelectorLimits are the limits of the label selectors of list, watch and deletecollection
+// requests. Zero disables a limit.
+type LabelSelectorLimits struct {
+	// MaxRequirements is the limit of the requirements of a selector.
+	MaxRequirements int
+	// MaxValues is the limit of the values of a set-based requirement, like in or notin.
+	MaxValues int
+}
+
+// WithLabelSelectorLimits rejects list, watch and deletecollection requests whose label selector
+// exceeds limits with a 400, whose message states the limit, the actual value and how to select
+// otherwise. Every object of the collection is matched against every requirement of the selector, so
+// selectors with many requirements or large value sets pin a CPU on large collections. Malformed
+// selectors are left to the endpoint handlers to reject. It has to run after the request info is
+// resolved.
+func WithLabelSelectorLimits(handler http.Handler, limits LabelSelectorLimits, s runtime.NegotiatedSerializer) http.Handler {
+	if limits.MaxRequirements <= 0 && limits.MaxValues <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || !selectingVerbs.Has(info.Verb) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		if err := checkLabelSelector(req.URL.Query().Get("labelSelector"), limits); err != nil {
+			responsewriters.ErrorNegotiated(err, s, schema.GroupVersion{}, w, req)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// checkLabelSelector returns a 400 if selector exceeds limits.
+func checkLabelSelector(selector string, limits LabelSelectorLimits) error {
+	if selector == "" {
+		return nil
+	}
+
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil
+	}
+
+	requirements, _ := parsed.Requirements()
+
+	if limits.MaxRequirements > 0 && len(requirements) > limits.MaxRequirements {
+		return apierrors.NewBadRequest(fmt.Sprintf("the label selector has %d requirements, the limit is %d: select with fewer requirements and filter the rest on the client", len(requirements), limits.MaxRequirements))
+	}
+
+	if limits.MaxValues <= 0 {
+		return nil
+	}
+
+	for _, requirement := range requirements {
+		if values := requirement.Values(); values.Len() > limits.MaxValues {
+			return apierrors.NewBadRequest(fmt.Sprintf("the requirement of the label selector on %q has %d values, the limit is %d: split the request into several with fewer values, or label the objects to select them by one value", requirement.Key(), values.Len(), limits.MaxValues))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithLabelSelectorLimits(t *testing.T) {
+	requirements := func(n int) string {
+		var selector []string
+		for i := 0; i < n; i++ {
+			selector = append(selector, fmt.Sprintf("label-%d", i))
+		}
+
+		return strings.Join(selector, ",")
+	}
+
+	values := func(n int) string {
+		var values []string
+		for i := 0; i < n; i++ {
+			values = append(values, fmt.Sprintf("value-%d", i))
+		}
+
+		return "tier in (" + strings.Join(values, ",") + ")"
+	}
+
+	limits := LabelSelectorLimits{MaxRequirements: 3, MaxValues: 4}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		selector string
+
+		expectedCode    int
+		expectedMessage string
+	}{
+		{
+			name:         "list within the limits",
+			method:       http.MethodGet,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			selector:     requirements(2) + "," + values(4),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:            "list with too many requirements",
+			method:          http.MethodGet,
+			path:            "/apis/example.com/v1/namespaces/default/widgets",
+			selector:        requirements(4),
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "the label selector has 4 requirements, the limit is 3: select with fewer requirements and filter the rest on the client",
+		},
+		{
+			name:            "watch with too many values",
+			method:          http.MethodGet,
+			path:            "/apis/example.com/v1/widgets?watch=true",
+			selector:        values(5),
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: `the requirement of the label selector on "tier" has 5 values, the limit is 4: split the request into several with fewer values, or label the objects to select them by one value`,
+		},
+		{
+			name:            "deletecollection with too many values",
+			method:          http.MethodDelete,
+			path:            "/apis/example.com/v1/namespaces/default/widgets",
+			selector:        "tier notin (a,b,c,d,e)",
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: `the requirement of the label selector on "tier" has 5 values, the limit is 4: split the request into several with fewer values, or label the objects to select them by one value`,
+		},
+		{
+			name:         "malformed selector",
+			method:       http.MethodGet,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			selector:     "tier in (",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "get",
+			method:       http.MethodGet,
+			path:         "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			selector:     requirements(4),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "non-resource request",
+			method:       http.MethodGet,
+			path:         "/apis",
+			selector:     requirements(4),
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	handler := WithLabelSelectorLimits(apiHandler, limits, scheme.Codecs)
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			path := test.path
+			if strings.Contains(path, "?") {
+				path += "&"
+			} else {
+				path += "?"
+			}
+
+			req := httptest.NewRequest(test.method, path+"labelSelector="+url.QueryEscape(test.selector), nil)
+
+			info, err := resolver.NewRequestInfo(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req.WithContext(request.WithRequestInfo(req.Context(), info)))
+
+			if w.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d: %s", test.expectedCode, w.Code, w.Body.String())
+			}
+
+			if test.expectedCode == http.StatusOK {
+				return
+			}
+
+			status := &metav1.Status{}
+			if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+				t.Fatalf("expected a Status: %v", err)
+			}
+
+			if status.Code != int32(test.expectedCode) || status.Message != test.expectedMessage {
+				t.Errorf("unexpected status %#v", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// statusReasonInsufficientStorage is the reason of the Status of requests rejected by WithStorageQuota.
+const statusReasonInsufficientStorage metav1.StatusReason = "InsufficientStorage"
+
+// storingVerbs are the verbs of the requests that can store more objects.
+var storingVerbs = sets.NewString("create", "update", "patch")
+
+var storageQuotaRejections = metrics.NewCounter(
+	&metrics.CounterOpts{
+		Name:           "badidea_storage_quota_rejected_requests_total",
+		Help:           "Counter of requests rejected because the objects stored in etcd exceed --max-stored-objects.",
+		StabilityLevel: metrics.ALPHA,
+	},
+)
+
+func init() {
+	legacyregistry.MustRegister(storageQuotaRejections)
+}
+
+// WithStorageQuota rejects the requests creating, updating or patching objects with a 507 while
+// exceeded returns an error, whose message is returned to the client. Deletes make room and pass, as
+// do the requests of the loopback clients, whose controllers keep the server working. It has to run
+// after authentication.
+func WithStorageQuota(handler http.Handler, exceeded func() error, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || !storingVerbs.Has(info.Verb) || requestOrigin(req) == originInternal {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		if err := exceeded(); err != nil {
+			storageQuotaRejections.Inc()
+			responsewriters.ErrorNegotiated(newInsufficientStorage(err.Error()), s, schema.GroupVersion{}, w, req)
+
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func newInsufficientStorage(message string) *apierrors.StatusError {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusInsufficientStorage,
+		Reason:  statusReasonInsufficientStorage,
+		Message: message,
+	}}
+}
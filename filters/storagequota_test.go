@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithStorageQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		exceeded bool
+		method   string
+		path     string
+		user     string
+
+		expectedCode int
+	}{
+		{
+			name:         "create below the quota",
+			method:       http.MethodPost,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "create above the quota",
+			exceeded:     true,
+			method:       http.MethodPost,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			expectedCode: http.StatusInsufficientStorage,
+		},
+		{
+			name:         "update above the quota",
+			exceeded:     true,
+			method:       http.MethodPut,
+			path:         "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			expectedCode: http.StatusInsufficientStorage,
+		},
+		{
+			name:         "patch of a status above the quota",
+			exceeded:     true,
+			method:       http.MethodPatch,
+			path:         "/apis/example.com/v1/namespaces/default/widgets/sprocket/status",
+			expectedCode: http.StatusInsufficientStorage,
+		},
+		{
+			name:         "delete above the quota",
+			exceeded:     true,
+			method:       http.MethodDelete,
+			path:         "/apis/example.com/v1/namespaces/default/widgets/sprocket",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "delete collection above the quota",
+			exceeded:     true,
+			method:       http.MethodDelete,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "list above the quota",
+			exceeded:     true,
+			method:       http.MethodGet,
+			path:         "/apis/example.com/v1/namespaces/default/widgets",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "loopback client above the quota",
+			exceeded:     true,
+			method:       http.MethodPut,
+			path:         "/apis/apiregistration.k8s.io/v1/apiservices/v1.example.com/status",
+			user:         user.APIServerUser,
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			exceeded := func() error {
+				if test.exceeded {
+					return errors.New("the server stores 12 objects, its quota is 10 objects")
+				}
+				return nil
+			}
+
+			apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+			handler := WithStorageQuota(apiHandler, exceeded, scheme.Codecs)
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+
+			info, err := resolver.NewRequestInfo(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := request.WithRequestInfo(req.Context(), info)
+			if test.user != "" {
+				ctx = request.WithUser(ctx, &user.DefaultInfo{Name: test.user})
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req.WithContext(ctx))
+
+			if w.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d: %s", test.expectedCode, w.Code, w.Body.String())
+			}
+
+			if test.expectedCode != http.StatusInsufficientStorage {
+				return
+			}
+
+			status := &metav1.Status{}
+			if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+				t.Fatalf("expected a Status: %v", err)
+			}
+
+			if status.Reason != statusReasonInsufficientStorage || status.Message != "the server stores 12 objects, its quota is 10 objects" {
+				t.Errorf("unexpected status %#v", status)
+			}
+		})
+	}
+}
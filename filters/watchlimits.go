@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// watchRetryAfterSeconds is the delay clients over a watch limit are told to wait before retrying.
+// Watches are closed rarely, so retrying right away would only be rejected again.
+const watchRetryAfterSeconds = 10
+
+var activeWatches = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Name:           "badidea_active_watches",
+		Help:           "Number of watches open, broken out by user.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"user"},
+)
+
+func init() {
+	legacyregistry.MustRegister(activeWatches)
+}
+
+// WatchLimits are the limits of the watches open at a time. Zero disables a limit.
+type WatchLimits struct {
+	// MaxPerUser is the limit of the watches of a user.
+	MaxPerUser int
+	// MaxPerNamespace is the limit of the watches of a namespace, by all users.
+	MaxPerNamespace int
+}
+
+// WithWatchLimits rejects watches exceeding limits with a 429 stating the limit and when to retry,
+// and tracks the watches open in the badidea_active_watches metric. The watches of users for which
+// exempt returns true are tracked but neither limited nor counted against the limits of their
+// namespace. It has to run after the request info is resolved and the user is authenticated and
+// impersonated.
+func WithWatchLimits(handler http.Handler, limits WatchLimits, exempt func(user.Info) bool, s runtime.NegotiatedSerializer) http.Handler {
+	watches := &watchCounts{limits: limits, users: map[string]int{}, namespaces: map[string]int{}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || info.Verb != "watch" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		u, ok := request.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		enforce := !exempt(u)
+
+		namespace := info.Namespace
+		if !enforce {
+			namespace = ""
+		}
+
+		if message := watches.open(u.GetName(), namespace, enforce); message != "" {
+			responsewriters.ErrorNegotiated(apierrors.NewTooManyRequests(message, watchRetryAfterSeconds), s, schema.GroupVersion{}, w, req)
+			return
+		}
+		defer watches.close(u.GetName(), namespace)
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// watchCounts counts the open watches by user and namespace.
+type watchCounts struct {
+	limits WatchLimits
+
+	lock       sync.Mutex
+	users      map[string]int
+	namespaces map[string]int
+}
+
+// open counts a watch of userName in namespace, unless that is "", and returns "" if it is within
+// the limits or they are not enforced. Otherwise it returns why the watch is rejected, without
+// counting it.
+func (c *watchCounts) open(userName, namespace string, enforce bool) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if enforce {
+		if max := c.limits.MaxPerUser; max > 0 && c.users[userName] >= max {
+			return fmt.Sprintf("user %q has %d watches open, the limit is %d", userName, c.users[userName], max)
+		}
+
+		if max := c.limits.MaxPerNamespace; max > 0 && namespace != "" && c.namespaces[namespace] >= max {
+			return fmt.Sprintf("namespace %q has %d watches open, the limit is %d", namespace, c.namespaces[namespace], max)
+		}
+	}
+
+	c.users[userName]++
+	activeWatches.WithLabelValues(userName).Set(float64(c.users[userName]))
+
+	if namespace != "" {
+		c.namespaces[namespace]++
+	}
+
+	return ""
+}
+
+// close uncounts a watch counted by open. The metric of users without watches is dropped.
+func (c *watchCounts) close(userName, namespace string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.users[userName]--
+	if c.users[userName] == 0 {
+		delete(c.users, userName)
+		activeWatches.Delete(map[string]string{"user": userName})
+	} else {
+		activeWatches.WithLabelValues(userName).Set(float64(c.users[userName]))
+	}
+
+	if namespace != "" {
+		c.namespaces[namespace]--
+		if c.namespaces[namespace] == 0 {
+			delete(c.namespaces, namespace)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestWithWatchLimits(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	// the watches are held open until their channel is closed
+	var lock sync.Mutex
+	watching := make(chan struct{})
+	release := map[string]chan struct{}{}
+
+	handler := WithWatchLimits(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			done, ok := release[req.URL.Query().Get("id")]
+			lock.Unlock()
+
+			if ok {
+				watching <- struct{}{}
+				<-done
+			}
+		}),
+		WatchLimits{MaxPerUser: 2, MaxPerNamespace: 3},
+		func(u user.Info) bool { return u.GetName() == user.APIServerUser },
+		scheme.Codecs)
+
+	serve := func(userName, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+
+		info, err := resolver.NewRequestInfo(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := request.WithRequestInfo(req.Context(), info)
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: userName})
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+
+		return w
+	}
+
+	done := make(chan struct{})
+	open := func(userName, path, id string) {
+		lock.Lock()
+		release[id] = make(chan struct{})
+		lock.Unlock()
+
+		go func() {
+			serve(userName, path+"?watch=true&id="+id)
+			done <- struct{}{}
+		}()
+		<-watching
+	}
+	closeWatch := func(id string) {
+		close(release[id])
+		<-done
+	}
+
+	expectRejected := func(userName, path, expectedMessage string) {
+		t.Helper()
+
+		w := serve(userName, path+"?watch=true")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+			t.Fatalf("expected a 429 with Retry-After, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+		}
+
+		status := &metav1.Status{}
+		if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+			t.Fatalf("expected a Status: %v", err)
+		}
+
+		if status.Message != expectedMessage {
+			t.Errorf("expected the message %q, got %q", expectedMessage, status.Message)
+		}
+	}
+
+	widgets := "/apis/example.com/v1/namespaces/default/widgets"
+
+	open("alice", widgets, "alice-1")
+	open("alice", "/apis/example.com/v1/gadgets", "alice-2")
+
+	if value, err := testutil.GetGaugeMetricValue(activeWatches.WithLabelValues("alice")); err != nil || value != 2 {
+		t.Errorf("expected 2 active watches of alice, got %v, %v", value, err)
+	}
+
+	expectRejected("alice", widgets, `user "alice" has 2 watches open, the limit is 2`)
+
+	// other requests are not limited
+	if w := serve("alice", widgets); w.Code != http.StatusOK {
+		t.Errorf("expected a list to be served, got %d", w.Code)
+	}
+
+	// the loopback user is exempt and does not count against the namespace
+	open(user.APIServerUser, widgets, "loopback-1")
+	open(user.APIServerUser, widgets, "loopback-2")
+	open(user.APIServerUser, widgets, "loopback-3")
+
+	open("bob", widgets, "bob-1")
+	open("bob", widgets, "bob-2")
+	expectRejected("carol", widgets, `namespace "default" has 3 watches open, the limit is 3`)
+
+	// closed watches are released
+	closeWatch("alice-1")
+	open("alice", "/apis/example.com/v1/namespaces/other/widgets", "alice-3")
+	open("carol", widgets, "carol-1")
+
+	for _, id := range []string{"alice-2", "alice-3", "loopback-1", "loopback-2", "loopback-3", "bob-1", "bob-2", "carol-1"} {
+		closeWatch(id)
+	}
+
+	for _, userName := range []string{"alice", "bob", "carol", user.APIServerUser} {
+		if activeWatches.Delete(map[string]string{"user": userName}) {
+			t.Errorf("expected the metric of %s to be dropped once its watches are closed", userName)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// allResources is the resource the pauses of all resources are reported as.
+const allResources = "*"
+
+// mutatingVerbs are the verbs of the requests that write to the storage.
+var mutatingVerbs = sets.NewString("create", "update", "patch", "delete", "deletecollection")
+
+var mutatingRequestsInFlight = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Name:           "badidea_inflight_mutating_requests",
+		Help:           "Number of mutating requests in flight, broken out by resource.",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"resource"},
+)
+
+func init() {
+	legacyregistry.MustRegister(mutatingRequestsInFlight)
+}
+
+// WritePauseStatus is the state of the writes served as JSON.
+type WritePauseStatus struct {
+	// Paused are the times the pauses end, by resource.group, or "*" for all resources.
+	Paused map[string]time.Time `json:"paused"`
+	// InFlight are the mutating requests in flight, by resource.group.
+	InFlight map[string]int `json:"inFlight"`
+	// Drained is whether no mutating request of the paused resources is in flight.
+	Drained bool `json:"drained"`
+}
+
+// WritePause tracks the mutating requests in flight by resource and pauses new ones, for a resource
+// or all of them, so that backups can wait for the writes in flight to finish. Pauses end on their
+// own after at most maxPause, so a backup that crashed does not leave the server read-only.
+type WritePause struct {
+	maxPause time.Duration
+	// mayPause returns whether a user may pause and resume the writes through ServeHTTP.
+	mayPause func(user.Info) bool
+
+	lock     sync.Mutex
+	inFlight map[schema.GroupResource]int
+	// paused are the times the pauses end, with the empty resource for all resources.
+	paused map[schema.GroupResource]time.Time
+	// finished is closed and replaced whenever a mutating request finishes.
+	finished chan struct{}
+}
+
+// NewWritePause returns a WritePause ending pauses after at most maxPause. Its handler only lets the
+// users for which mayPause returns true pause and resume the writes.
+func NewWritePause(maxPause time.Duration, mayPause func(user.Info) bool) *WritePause {
+	return &WritePause{
+		maxPause: maxPause,
+		mayPause: mayPause,
+		inFlight: map[schema.GroupResource]int{},
+		paused:   map[schema.GroupResource]time.Time{},
+		finished: make(chan struct{}),
+	}
+}
+
+// WithWritePause counts the mutating requests in flight in pause, and rejects new ones for paused
+// resources with a 429 telling clients to retry once the pause ends. The requests of users for which
+// isExempt returns true, like the loopback clients, are counted but never paused, so the components of
+// the server keep their leases. The filter expects the RequestInfo and the user in the request
+// context.
+func WithWritePause(handler http.Handler, pause *WritePause, isExempt func(user.Info) bool, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !info.IsResourceRequest || !mutatingVerbs.Has(info.Verb) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		resource := schema.GroupResource{Group: info.APIGroup, Resource: info.Resource}
+
+		u, ok := request.UserFrom(req.Context())
+		exempt := ok && isExempt(u)
+
+		if !pause.start(resource, exempt) {
+			retryAfter := pause.retryAfter(resource)
+			responsewriters.ErrorNegotiated(
+				apierrors.NewTooManyRequests(fmt.Sprintf("writes of %s are paused", resource), retryAfter),
+				s, schema.GroupVersion{Group: info.APIGroup, Version: info.APIVersion}, w, req)
+
+			return
+		}
+		defer pause.finish(resource)
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// start counts a mutating request of resource in flight unless resource is paused and the request is
+// not exempt.
+func (p *WritePause) start(resource schema.GroupResource, exempt bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !exempt && p.isPaused(resource, time.Now()) {
+		return false
+	}
+
+	p.inFlight[resource]++
+	mutatingRequestsInFlight.WithLabelValues(resource.String()).Inc()
+
+	return true
+}
+
+func (p *WritePause) finish(resource schema.GroupResource) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.inFlight[resource]--; p.inFlight[resource] == 0 {
+		delete(p.inFlight, resource)
+	}
+
+	mutatingRequestsInFlight.WithLabelValues(resource.String()).Dec()
+
+	close(p.finished)
+	p.finished = make(chan struct{})
+}
+
+// isPaused returns whether resource, or all resources, are paused at now. The lock must be held.
+func (p *WritePause) isPaused(resource schema.GroupResource, now time.Time) bool {
+	return now.Before(p.paused[resource]) || now.Before(p.paused[schema.GroupResource{}])
+}
+
+// retryAfter returns the seconds until the pauses of resource end.
+func (p *WritePause) retryAfter(resource schema.GroupResource) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	end := p.paused[resource]
+	if all := p.paused[schema.GroupResource{}]; all.After(end) {
+		end = all
+	}
+
+	seconds := int(math.Ceil(time.Until(end).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return seconds
+}
+
+// Pause rejects new mutating requests of resource, or of all resources if it is empty, for duration,
+// at most the maximum pause. A zero duration pauses for the maximum.
+func (p *WritePause) Pause(resource schema.GroupResource, duration time.Duration) {
+	if duration <= 0 || duration > p.maxPause {
+		duration = p.maxPause
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.paused[resource] = time.Now().Add(duration)
+}
+
+// Resume ends the pause of resource, or the pause of all resources if it is empty. The pauses of
+// other resources go on.
+func (p *WritePause) Resume(resource schema.GroupResource) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.paused, resource)
+}
+
+// status returns the status and a channel closed once the next mutating request finishes.
+func (p *WritePause) status() (WritePauseStatus, <-chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	status := WritePauseStatus{Paused: map[string]time.Time{}, InFlight: map[string]int{}, Drained: true}
+
+	for resource, end := range p.paused {
+		if !now.Before(end) {
+			delete(p.paused, resource)
+			continue
+		}
+
+		name := resource.String()
+		if resource.Empty() {
+			name = allResources
+		}
+
+		status.Paused[name] = end
+	}
+
+	for resource, n := range p.inFlight {
+		status.InFlight[resource.String()] = n
+
+		if p.isPaused(resource, now) {
+			status.Drained = false
+		}
+	}
+
+	return status, p.finished
+}
+
+// ServeHTTP serves the pauses and the mutating requests in flight as JSON. POST pauses the resource of
+// the resource query parameter, in resource.group form, or all resources without one, for the
+// duration parameter, or the maximum pause. It is not named timeout, which clients set to the timeout
+// of their requests. With wait=true it answers once no mutating request of the paused resources is in
+// flight, or the request times out. DELETE ends the pause of the resource parameter, or the pause of
+// all resources. POST and DELETE are forbidden to the users mayPause rejects, as the authorizer allows
+// every user the paths of the server outside of its APIs.
+func (p *WritePause) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	resource := schema.ParseGroupResource(query.Get("resource"))
+
+	if req.Method == http.MethodPost || req.Method == http.MethodDelete {
+		if u, ok := request.UserFrom(req.Context()); !ok || !p.mayPause(u) {
+			http.Error(w, "only the server and members of system:masters may pause and resume writes", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var duration time.Duration
+		if value := query.Get("duration"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		p.Pause(resource, duration)
+	case http.MethodDelete:
+		p.Resume(resource)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	status, finished := p.status()
+
+	for req.Method == http.MethodPost && query.Get("wait") == "true" && !status.Drained {
+		select {
+		case <-req.Context().Done():
+			http.Error(w, "timed out waiting for the writes in flight to finish", http.StatusGatewayTimeout)
+			return
+		case <-finished:
+		case <-time.After(time.Second):
+			// the pause may have ended
+		}
+
+		status, finished = p.status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filters
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestWithWritePause(t *testing.T) {
+	resolver := &request.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	pause := NewWritePause(time.Minute, func(u user.Info) bool { return u.GetName() == "admin" })
+
+	// requests with the block parameter are held until release is closed
+	writing := make(chan struct{})
+	release := make(chan struct{})
+
+	handler := WithWritePause(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("block") == "true" {
+				writing <- struct{}{}
+				<-release
+			}
+		}),
+		pause,
+		func(u user.Info) bool { return u.GetName() == user.APIServerUser },
+		scheme.Codecs)
+
+	serve := func(userName, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+
+		info, err := resolver.NewRequestInfo(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := request.WithRequestInfo(req.Context(), info)
+		ctx = request.WithUser(ctx, &user.DefaultInfo{Name: userName})
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+
+		return w
+	}
+
+	// status serves the request as userName, or without a user if it is empty
+	status := func(userName, method, query string) (WritePauseStatus, int) {
+		req := httptest.NewRequest(method, "/debug/badidea/writes"+query, nil)
+		if userName != "" {
+			req = req.WithContext(request.WithUser(req.Context(), &user.DefaultInfo{Name: userName}))
+		}
+
+		w := httptest.NewRecorder()
+		pause.ServeHTTP(w, req)
+
+		var status WritePauseStatus
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		return status, w.Code
+	}
+
+	widgets := "/apis/example.com/v1/namespaces/default/widgets"
+
+	written := make(chan int)
+	go func() {
+		written <- serve("alice", http.MethodPost, widgets+"?block=true").Code
+	}()
+	<-writing
+
+	if s, _ := status("admin", http.MethodGet, ""); s.InFlight["widgets.example.com"] != 1 || len(s.Paused) != 0 {
+		t.Errorf("expected a widget write in flight and no pauses, got %+v", s)
+	}
+
+	type response struct {
+		status WritePauseStatus
+		code   int
+	}
+
+	for _, userName := range []string{"alice", ""} {
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			if _, code := status(userName, method, "?resource=widgets.example.com"); code != http.StatusForbidden {
+				t.Errorf("expected %s by %q to be forbidden, got %d", method, userName, code)
+			}
+		}
+	}
+
+	if s, code := status("alice", http.MethodGet, ""); code != http.StatusOK || len(s.Paused) != 0 {
+		t.Errorf("expected the status to be served to anyone and nothing to be paused, got %d: %+v", code, s)
+	}
+
+	paused := make(chan response)
+	go func() {
+		s, code := status("admin", http.MethodPost, "?resource=widgets.example.com&wait=true")
+		paused <- response{s, code}
+	}()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		s, _ := status("admin", http.MethodGet, "")
+		return len(s.Paused) == 1, nil
+	}); err != nil {
+		t.Fatalf("expected the widgets to be paused")
+	}
+
+	select {
+	case r := <-paused:
+		t.Fatalf("expected the pause to wait for the widget write in flight, got %+v", r)
+	default:
+	}
+
+	w := serve("alice", http.MethodDelete, widgets+"/a")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a paused write to be rejected with a Retry-After header, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := serve("alice", http.MethodGet, widgets); w.Code != http.StatusOK {
+		t.Errorf("expected reads to be served while paused, got %d", w.Code)
+	}
+
+	if w := serve("alice", http.MethodPost, "/apis/example.com/v1/namespaces/default/gadgets"); w.Code != http.StatusOK {
+		t.Errorf("expected writes of other resources to be served, got %d", w.Code)
+	}
+
+	if w := serve(user.APIServerUser, http.MethodPut, widgets+"/a"); w.Code != http.StatusOK {
+		t.Errorf("expected writes of exempt users to be served, got %d", w.Code)
+	}
+
+	close(release)
+
+	if code := <-written; code != http.StatusOK {
+		t.Errorf("expected the write in flight to finish, got %d", code)
+	}
+
+	select {
+	case r := <-paused:
+		if r.code != http.StatusOK || !r.status.Drained || len(r.status.InFlight) != 0 {
+			t.Errorf("expected the pause to answer drained, got %d: %+v", r.code, r)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected the pause to answer once the write in flight finished")
+	}
+
+	if _, code := status("admin", http.MethodDelete, "?resource=widgets.example.com"); code != http.StatusOK {
+		t.Errorf("expected the pause to be resumed, got %d", code)
+	}
+
+	if w := serve("alice", http.MethodPost, widgets); w.Code != http.StatusOK {
+		t.Errorf("expected writes to be served once resumed, got %d", w.Code)
+	}
+
+	// pausing all resources, and the pause ending on its own
+	pause.Pause(schema.GroupResource{}, 100*time.Millisecond)
+
+	if w := serve("alice", http.MethodPatch, "/apis/example.com/v1/namespaces/default/gadgets/a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected writes of all resources to be paused, got %d", w.Code)
+	}
+
+	if s, _ := status("admin", http.MethodGet, ""); !s.Paused[allResources].After(time.Now()) {
+		t.Errorf("expected all resources to be paused, got %+v", s)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if w := serve("alice", http.MethodPatch, "/apis/example.com/v1/namespaces/default/gadgets/a"); w.Code != http.StatusOK {
+		t.Errorf("expected the pause to end on its own, got %d", w.Code)
+	}
+
+	if _, code := status("admin", http.MethodPost, "?duration=soon"); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid duration to be rejected, got %d", code)
+	}
+
+	if _, code := status("admin", http.MethodPut, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected PUT not to be allowed, got %d", code)
+	}
+}
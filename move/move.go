@@ -0,0 +1,484 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package move moves the objects of a namespace to another namespace through the API of a server,
+// keeping the owner references between them.
+package move
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/thetirefire/badidea/pagination"
+	"github.com/thetirefire/badidea/restmapping"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// customResourceDefinitions is the resource of the CustomResourceDefinitions.
+var customResourceDefinitions = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// serverPopulatedFields are the metadata fields the server sets, which are not copied.
+var serverPopulatedFields = []string{"uid", "resourceVersion", "selfLink", "creationTimestamp", "generation", "managedFields", "deletionTimestamp", "deletionGracePeriodSeconds"}
+
+// Options select the objects of a move.
+type Options struct {
+	// From is the namespace the objects are moved from.
+	From string
+	// To is the namespace the objects are moved to.
+	To string
+	// Resources limits the move to these resources, in resource.group form. Empty moves the objects
+	// of all resources.
+	Resources []string
+	// DryRun only checks that the objects can be created in To, without changing anything.
+	DryRun bool
+}
+
+// Object is an object of a move.
+type Object struct {
+	Resource schema.GroupResource
+	Name     string
+}
+
+func (o Object) String() string {
+	return o.Resource.String() + "/" + o.Name
+}
+
+// Skipped is a resource, or an object if Name is set, that is not moved.
+type Skipped struct {
+	Object
+
+	Reason string
+}
+
+func (s Skipped) String() string {
+	if s.Name == "" {
+		return fmt.Sprintf("%s: %s", s.Resource, s.Reason)
+	}
+
+	return fmt.Sprintf("%s: %s", s.Object, s.Reason)
+}
+
+// Report is the outcome of a move.
+type Report struct {
+	// Moved are the objects moved, or that a dry run would move, in the order they are created,
+	// owners before their dependents.
+	Moved []Object
+	// Skipped are the resources and objects that are not moved, with the reason.
+	Skipped []Skipped
+}
+
+// movedResource is a resource whose objects are moved.
+type movedResource struct {
+	schema.GroupVersionResource
+
+	hasStatus bool
+}
+
+// movedObject is an object of From and target, its copy for To.
+type movedObject struct {
+	resource movedResource
+	original *unstructured.Unstructured
+	target   *unstructured.Unstructured
+	// owners are the indexes of the moved objects owning the object.
+	owners []int
+}
+
+// Move moves the objects of o.From to o.To on the server of config. The objects are created in To
+// first, owners before their dependents whose owner references are pointed at the new owners, and
+// the originals are only deleted once all of them were created. The creates are tried as a dry run
+// first, so a conflict with an object of To fails the move before anything changed, and the copies
+// created so far are deleted again if a create fails anyway. The originals are deleted orphaning
+// their dependents, so objects that are not moved are not collected with their owners.
+//
+// Resources that cannot be listed, created and deleted are skipped, and so are custom resources
+// converted by a webhook, which might not round-trip their objects. Objects being deleted are
+// skipped, and so are objects owned by an object of their namespace that is not moved, which the
+// garbage collector would delete in To.
+func Move(ctx context.Context, config *rest.Config, o Options) (*Report, error) {
+	if o.From == "" || o.To == "" || o.From == o.To {
+		return nil, fmt.Errorf("the namespaces to move from and to must be set and differ, got %q and %q", o.From, o.To)
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mapper, err := restmapping.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+
+	resources, err := movedResources(ctx, discoveryClient, dynamicClient, o, report)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := listObjects(ctx, dynamicClient, resources, o, report)
+	if err != nil {
+		return nil, err
+	}
+
+	objects = linkOwners(objects, mapper, report)
+
+	ordered, err := ownersFirst(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range ordered {
+		report.Moved = append(report.Moved, Object{Resource: object.resource.GroupResource(), Name: object.original.GetName()})
+	}
+
+	if _, err := create(ctx, dynamicClient, ordered, o.To, true); err != nil {
+		return nil, err
+	}
+
+	if o.DryRun {
+		return report, nil
+	}
+
+	created, err := create(ctx, dynamicClient, ordered, o.To, false)
+	if err != nil {
+		// the originals are left as they were
+		for i := len(created) - 1; i >= 0; i-- {
+			_ = deleteObject(ctx, dynamicClient, ordered[i].resource, created[i])
+		}
+
+		return nil, err
+	}
+
+	var errs []error
+
+	// dependents go first, so the originals of owners do not take them along
+	for i := len(ordered) - 1; i >= 0; i-- {
+		if err := deleteObject(ctx, dynamicClient, ordered[i].resource, ordered[i].original); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %s in %s, it was moved to %s: %w", report.Moved[i], o.From, o.To, err))
+		}
+	}
+
+	return report, utilerrors.NewAggregate(errs)
+}
+
+// movedResources returns the namespaced resources of the preferred versions of the server whose
+// objects are moved, adding the skipped ones to report.
+func movedResources(ctx context.Context, discoveryClient discovery.DiscoveryInterface, dynamicClient dynamic.Interface, o Options, report *Report) ([]movedResource, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	webhookConverted, err := webhookConvertedResources(ctx, dynamicClient)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := sets.NewString(o.Resources...)
+	found := sets.NewString()
+	resources := []movedResource{}
+
+	for _, group := range groups.Groups {
+		resourceList, err := discoveryClient.ServerResourcesForGroupVersion(group.PreferredVersion.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		names := sets.NewString()
+		for _, resource := range resourceList.APIResources {
+			names.Insert(resource.Name)
+		}
+
+		for _, resource := range resourceList.APIResources {
+			groupResource := gv.WithResource(resource.Name).GroupResource()
+			if strings.Contains(resource.Name, "/") || !resource.Namespaced || (selected.Len() > 0 && !selected.Has(groupResource.String())) {
+				continue
+			}
+
+			found.Insert(groupResource.String())
+
+			switch {
+			case !sets.NewString(resource.Verbs...).HasAll("list", "create", "delete"):
+				report.Skipped = append(report.Skipped, Skipped{Object: Object{Resource: groupResource}, Reason: "its objects cannot be listed, created and deleted"})
+			case webhookConverted.Has(groupResource.String()):
+				report.Skipped = append(report.Skipped, Skipped{Object: Object{Resource: groupResource}, Reason: "it is converted by a webhook, which might not round-trip its objects"})
+			default:
+				resources = append(resources, movedResource{GroupVersionResource: gv.WithResource(resource.Name), hasStatus: names.Has(resource.Name + "/status")})
+			}
+		}
+	}
+
+	if missing := selected.Difference(found); missing.Len() > 0 {
+		return nil, fmt.Errorf("the server serves no namespaced resources %s", strings.Join(missing.List(), ", "))
+	}
+
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].GroupResource().String() < resources[j].GroupResource().String()
+	})
+
+	return resources, nil
+}
+
+// webhookConvertedResources returns the custom resources converted by a webhook. Servers without
+// CustomResourceDefinitions have none.
+func webhookConvertedResources(ctx context.Context, dynamicClient dynamic.Interface) (sets.String, error) {
+	resources := sets.String{}
+
+	err := pagination.Walk(ctx, pagination.DynamicList(dynamicClient.Resource(customResourceDefinitions)), pagination.Options{}, func(obj runtime.Object) error {
+		crd, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return fmt.Errorf("unexpected object %T", obj)
+		}
+
+		if strategy, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "strategy"); strategy == "Webhook" {
+			resources.Insert(crd.GetName())
+		}
+
+		return nil
+	})
+	if apierrors.IsNotFound(err) {
+		return resources, nil
+	}
+
+	return resources, err
+}
+
+// listObjects lists the objects of resources in o.From, adding the skipped ones to report.
+func listObjects(ctx context.Context, dynamicClient dynamic.Interface, resources []movedResource, o Options, report *Report) ([]*movedObject, error) {
+	objects := []*movedObject{}
+
+	for _, resource := range resources {
+		resource := resource
+
+		err := pagination.Walk(ctx, pagination.DynamicList(dynamicClient.Resource(resource.GroupVersionResource).Namespace(o.From)), pagination.Options{}, func(obj runtime.Object) error {
+			original, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("unexpected object %T", obj)
+			}
+
+			if original.GetDeletionTimestamp() != nil {
+				report.Skipped = append(report.Skipped, Skipped{Object: Object{Resource: resource.GroupResource(), Name: original.GetName()}, Reason: "it is being deleted"})
+				return nil
+			}
+
+			target := original.DeepCopy()
+			for _, field := range serverPopulatedFields {
+				unstructured.RemoveNestedField(target.Object, "metadata", field)
+			}
+			target.SetNamespace(o.To)
+
+			objects = append(objects, &movedObject{resource: resource, original: original, target: target})
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in %s: %w", resource.GroupResource(), o.From, err)
+		}
+	}
+
+	return objects, nil
+}
+
+// linkOwners links the objects to their moved owners and returns the objects to move. Objects owned
+// by an object of their namespace that is not moved are skipped, and so are their dependents, until
+// no more objects are skipped.
+func linkOwners(objects []*movedObject, mapper meta.RESTMapper, report *Report) []*movedObject {
+	for {
+		byUID := map[types.UID]int{}
+		for i, object := range objects {
+			byUID[object.original.GetUID()] = i
+		}
+
+		kept := []*movedObject{}
+
+		for _, object := range objects {
+			object.owners = nil
+			reason := ""
+
+			for _, owner := range object.original.GetOwnerReferences() {
+				if i, ok := byUID[owner.UID]; ok {
+					object.owners = append(object.owners, i)
+					continue
+				}
+
+				gv, err := schema.ParseGroupVersion(owner.APIVersion)
+				if err != nil {
+					reason = fmt.Sprintf("its owner %s %s has an invalid apiVersion", owner.Kind, owner.Name)
+					break
+				}
+
+				// cluster-scoped owners are owners in every namespace
+				mapping, err := mapper.RESTMapping(gv.WithKind(owner.Kind).GroupKind(), gv.Version)
+				if err != nil {
+					reason = fmt.Sprintf("the scope of its owner %s %s is unknown: %v", owner.Kind, owner.Name, err)
+					break
+				}
+
+				if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+					reason = fmt.Sprintf("its owner %s %s is not moved", owner.Kind, owner.Name)
+					break
+				}
+			}
+
+			if reason != "" {
+				report.Skipped = append(report.Skipped, Skipped{Object: Object{Resource: object.resource.GroupResource(), Name: object.original.GetName()}, Reason: reason})
+				continue
+			}
+
+			kept = append(kept, object)
+		}
+
+		if len(kept) == len(objects) {
+			return objects
+		}
+
+		objects = kept
+	}
+}
+
+// ownersFirst returns the objects ordered so owners come before their dependents.
+func ownersFirst(objects []*movedObject) ([]*movedObject, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make([]int, len(objects))
+	ordered := make([]*movedObject, 0, len(objects))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("the owner references of %s %s form a cycle", objects[i].original.GetKind(), objects[i].original.GetName())
+		}
+
+		state[i] = visiting
+
+		for _, owner := range objects[i].owners {
+			if err := visit(owner); err != nil {
+				return err
+			}
+		}
+
+		state[i] = visited
+		ordered = append(ordered, objects[i])
+
+		return nil
+	}
+
+	for i := range objects {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// create creates the copies of the ordered objects in namespace, pointing their owner references at
+// the copies of their owners, and returns the created copies. Dry runs try every create and fail with
+// all the errors, others stop at the first.
+func create(ctx context.Context, dynamicClient dynamic.Interface, ordered []*movedObject, namespace string, dryRun bool) ([]*unstructured.Unstructured, error) {
+	createOptions := metav1.CreateOptions{}
+	if dryRun {
+		createOptions.DryRun = []string{metav1.DryRunAll}
+	}
+
+	// the UIDs of the copies by the UIDs of the originals
+	uids := map[types.UID]types.UID{}
+	created := []*unstructured.Unstructured{}
+
+	var errs []error
+
+	for _, object := range ordered {
+		target := object.target.DeepCopy()
+
+		references := target.GetOwnerReferences()
+		for i := range references {
+			if uid, ok := uids[references[i].UID]; ok {
+				references[i].UID = uid
+			}
+		}
+		target.SetOwnerReferences(references)
+
+		client := dynamicClient.Resource(object.resource.GroupVersionResource).Namespace(namespace)
+
+		result, err := client.Create(ctx, target, createOptions)
+		if err != nil {
+			err = fmt.Errorf("failed to create %s in %s: %w", Object{Resource: object.resource.GroupResource(), Name: target.GetName()}, namespace, err)
+			if !dryRun {
+				return created, err
+			}
+
+			errs = append(errs, err)
+
+			continue
+		}
+
+		uids[object.original.GetUID()] = result.GetUID()
+		created = append(created, result)
+
+		// the status subresource ignores the status of creates
+		if status, ok := object.original.Object["status"]; ok && object.resource.hasStatus && !dryRun {
+			result.Object["status"] = status
+
+			if _, err := client.UpdateStatus(ctx, result, metav1.UpdateOptions{}); err != nil {
+				return created, fmt.Errorf("failed to copy the status of %s to %s: %w", Object{Resource: object.resource.GroupResource(), Name: target.GetName()}, namespace, err)
+			}
+		}
+	}
+
+	return created, utilerrors.NewAggregate(errs)
+}
+
+// deleteObject deletes object, unless it was replaced meanwhile, orphaning its dependents.
+func deleteObject(ctx context.Context, dynamicClient dynamic.Interface, resource movedResource, object *unstructured.Unstructured) error {
+	uid := object.GetUID()
+	orphan := metav1.DeletePropagationOrphan
+
+	return dynamicClient.Resource(resource.GroupVersionResource).Namespace(object.GetNamespace()).Delete(ctx, object.GetName(), metav1.DeleteOptions{
+		Preconditions:     &metav1.Preconditions{UID: &uid},
+		PropagationPolicy: &orphan,
+	})
+}
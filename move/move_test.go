@@ -0,0 +1,228 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package move
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/thetirefire/badidea/badideatest"
+	"go.uber.org/goleak"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, badideatest.LeakOptions()...)
+}
+
+var (
+	widgetsResource = schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	gadgetsResource = schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "gadgets"}
+)
+
+func newCRD(plural, kind string) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: plural + ".example.com"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Scope: apiextensionsv1.NamespaceScoped,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   plural,
+				Singular: strings.ToLower(kind),
+				Kind:     kind,
+				ListKind: kind + "List",
+			},
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{
+					Name:    "v1",
+					Served:  true,
+					Storage: true,
+					Schema: &apiextensionsv1.CustomResourceValidation{
+						OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+							Type:                   "object",
+							XPreserveUnknownFields: func(b bool) *bool { return &b }(true),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// createObject creates the object of kind named name in namespace, owned by owners.
+func createObject(t *testing.T, client dynamic.Interface, resource schema.GroupVersionResource, kind, namespace, name string, owners ...*unstructured.Unstructured) *unstructured.Unstructured {
+	t.Helper()
+
+	object := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"size": int64(len(name))}}}
+	object.SetAPIVersion("example.com/v1")
+	object.SetKind(kind)
+	object.SetName(name)
+	object.SetLabels(map[string]string{"app": "shop"})
+
+	references := []metav1.OwnerReference{}
+	for _, owner := range owners {
+		references = append(references, metav1.OwnerReference{APIVersion: owner.GetAPIVersion(), Kind: owner.GetKind(), Name: owner.GetName(), UID: owner.GetUID()})
+	}
+	object.SetOwnerReferences(references)
+
+	created, err := client.Resource(resource).Namespace(namespace).Create(context.TODO(), object, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", name, err)
+	}
+
+	return created
+}
+
+// objects returns the objects of resource in namespace by name.
+func objects(t *testing.T, client dynamic.Interface, resource schema.GroupVersionResource, namespace string) map[string]*unstructured.Unstructured {
+	t.Helper()
+
+	list, err := client.Resource(resource).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list %s: %v", resource, err)
+	}
+
+	result := map[string]*unstructured.Unstructured{}
+	for i := range list.Items {
+		result[list.Items[i].GetName()] = &list.Items[i]
+	}
+
+	return result
+}
+
+func names(objects map[string]*unstructured.Unstructured) []string {
+	result := []string{}
+	for name := range objects {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func TestMove(t *testing.T) {
+	s := badideatest.StartTestServer(t, badideatest.WithCRDs(newCRD("widgets", "Widget"), newCRD("gadgets", "Gadget")))
+
+	client := s.DynamicClient
+
+	root := createObject(t, client, widgetsResource, "Widget", "shop-a", "root")
+	child := createObject(t, client, widgetsResource, "Widget", "shop-a", "child", root)
+	createObject(t, client, widgetsResource, "Widget", "shop-a", "grandchild", child)
+	createObject(t, client, widgetsResource, "Widget", "shop-a", "loose")
+	gadget := createObject(t, client, gadgetsResource, "Gadget", "shop-a", "gadget")
+	createObject(t, client, widgetsResource, "Widget", "shop-a", "gadget-part", gadget)
+
+	o := Options{From: "shop-a", To: "shop-b", Resources: []string{"widgets.example.com"}}
+
+	expectedSkipped := []Skipped{{Object: Object{Resource: widgetsResource.GroupResource(), Name: "gadget-part"}, Reason: "its owner Gadget gadget is not moved"}}
+
+	// a dry run changes nothing
+	o.DryRun = true
+
+	report, err := Move(context.TODO(), s.ClientConfig, o)
+	if err != nil {
+		t.Fatalf("failed to dry-run the move: %v", err)
+	}
+
+	if !reflect.DeepEqual(report.Skipped, expectedSkipped) {
+		t.Errorf("expected to skip %v, got %v", expectedSkipped, report.Skipped)
+	}
+
+	if moved := objects(t, client, widgetsResource, "shop-b"); len(moved) > 0 {
+		t.Errorf("expected a dry run not to create objects, got %v", names(moved))
+	}
+
+	// a conflict fails the move before anything changed
+	createObject(t, client, widgetsResource, "Widget", "shop-b", "loose")
+	o.DryRun = false
+
+	if _, err := Move(context.TODO(), s.ClientConfig, o); err == nil || !strings.Contains(err.Error(), "widgets.example.com/loose") {
+		t.Errorf("expected the move to fail on the conflict with loose, got %v", err)
+	}
+
+	if moved := names(objects(t, client, widgetsResource, "shop-b")); !reflect.DeepEqual(moved, []string{"loose"}) {
+		t.Errorf("expected a failed move not to create objects, got %v", moved)
+	}
+
+	if left := names(objects(t, client, widgetsResource, "shop-a")); len(left) != 5 {
+		t.Errorf("expected a failed move not to delete objects, got %v", left)
+	}
+
+	if err := client.Resource(widgetsResource).Namespace("shop-b").Delete(context.TODO(), "loose", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete the conflicting widget: %v", err)
+	}
+
+	report, err = Move(context.TODO(), s.ClientConfig, o)
+	if err != nil {
+		t.Fatalf("failed to move: %v", err)
+	}
+
+	order := map[string]int{}
+	for i, object := range report.Moved {
+		order[object.Name] = i
+	}
+
+	if len(report.Moved) != 4 || order["root"] > order["child"] || order["child"] > order["grandchild"] {
+		t.Errorf("expected root, child and grandchild to be moved in this order along with loose, got %v", report.Moved)
+	}
+
+	moved := objects(t, client, widgetsResource, "shop-b")
+	if expected := []string{"child", "grandchild", "loose", "root"}; !reflect.DeepEqual(names(moved), expected) {
+		t.Fatalf("expected %v in shop-b, got %v", expected, names(moved))
+	}
+
+	if left := names(objects(t, client, widgetsResource, "shop-a")); !reflect.DeepEqual(left, []string{"gadget-part"}) {
+		t.Errorf("expected only gadget-part to be left in shop-a, got %v", left)
+	}
+
+	for name, owner := range map[string]string{"child": "root", "grandchild": "child"} {
+		references := moved[name].GetOwnerReferences()
+		if len(references) != 1 || references[0].Name != owner || references[0].UID != moved[owner].GetUID() {
+			t.Errorf("expected %s to be owned by the moved %s %s, got %v", name, owner, moved[owner].GetUID(), references)
+		}
+	}
+
+	if moved["root"].GetUID() == root.GetUID() || moved["root"].GetLabels()["app"] != "shop" || !reflect.DeepEqual(moved["root"].Object["spec"], root.Object["spec"]) {
+		t.Errorf("expected a copy of root with a new UID, got %v", moved["root"].Object)
+	}
+
+	if _, err := client.Resource(gadgetsResource).Namespace("shop-a").Get(context.TODO(), "gadget", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the gadget not to be moved: %v", err)
+	}
+}
+
+func TestMoveInvalid(t *testing.T) {
+	s := badideatest.StartTestServer(t, badideatest.WithCRDs(newCRD("widgets", "Widget")))
+
+	for _, o := range []Options{
+		{From: "shop-a", To: "shop-a"},
+		{From: "shop-a"},
+		{From: "shop-a", To: "shop-b", Resources: []string{"gadgets.example.com"}},
+	} {
+		if _, err := Move(context.TODO(), s.ClientConfig, o); err == nil {
+			t.Errorf("%+v: expected an error", o)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateAPI = flag.Bool("update-api", false, "update testdata/api.txt with the exported API of the package")
+
+// TestAPI fails on every change of the exported API of the package, which the compatibility policy
+// of the package doc covers.
+func TestAPI(t *testing.T) {
+	api, err := exportedAPI(".")
+	if err != nil {
+		t.Fatalf("failed to read the exported API: %v", err)
+	}
+
+	golden := filepath.Join("testdata", "api.txt")
+
+	if *updateAPI {
+		if err := ioutil.WriteFile(golden, []byte(api), 0644); err != nil {
+			t.Fatalf("failed to update %s: %v", golden, err)
+		}
+
+		return
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", golden, err)
+	}
+
+	if api != string(expected) {
+		t.Errorf("the exported API changed, check it against the compatibility policy and run go test ./options -update-api:\n%s", lineDiff(string(expected), api))
+	}
+}
+
+// exportedAPI returns the exported constants, variables, types, struct fields, functions and methods of
+// the package in dir, one per line and sorted. The fields of embedded structs of the package count as
+// fields of the embedding struct, as they are promoted.
+func exportedAPI(dir string) (string, error) {
+	fset := token.NewFileSet()
+
+	packages, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool { return !strings.HasSuffix(info.Name(), "_test.go") }, 0)
+	if err != nil {
+		return "", err
+	}
+
+	structs := map[string]*ast.StructType{}
+	var decls []ast.Decl
+
+	for _, pkg := range packages {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				decls = append(decls, decl)
+
+				if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+					for _, spec := range decl.Specs {
+						if structType, ok := spec.(*ast.TypeSpec).Type.(*ast.StructType); ok {
+							structs[spec.(*ast.TypeSpec).Name.Name] = structType
+						}
+					}
+				}
+			}
+		}
+	}
+
+	format := func(node interface{}) string {
+		var buf bytes.Buffer
+		_ = printer.Fprint(&buf, fset, node)
+
+		return buf.String()
+	}
+
+	var lines []string
+
+	var addFields func(typeName string, structType *ast.StructType)
+	addFields = func(typeName string, structType *ast.StructType) {
+		for _, field := range structType.Fields.List {
+			if len(field.Names) == 0 {
+				embedded := strings.TrimPrefix(format(field.Type), "*")
+				if ast.IsExported(embedded) {
+					lines = append(lines, fmt.Sprintf("field %s.%s", typeName, embedded))
+				}
+
+				if structType, ok := structs[embedded]; ok {
+					addFields(typeName, structType)
+				}
+
+				continue
+			}
+
+			for _, name := range field.Names {
+				if name.IsExported() {
+					lines = append(lines, fmt.Sprintf("field %s.%s %s", typeName, name.Name, format(field.Type)))
+				}
+			}
+		}
+	}
+
+	for _, decl := range decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if !decl.Name.IsExported() {
+				continue
+			}
+
+			if decl.Recv != nil && !ast.IsExported(strings.TrimPrefix(format(decl.Recv.List[0].Type), "*")) {
+				continue
+			}
+
+			lines = append(lines, format(&ast.FuncDecl{Recv: decl.Recv, Name: decl.Name, Type: decl.Type}))
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					for i, name := range spec.Names {
+						if !name.IsExported() {
+							continue
+						}
+
+						line := fmt.Sprintf("%s %s", decl.Tok, name.Name)
+						if spec.Type != nil {
+							line += " " + format(spec.Type)
+						}
+						if decl.Tok == token.CONST && i < len(spec.Values) {
+							line += " = " + format(spec.Values[i])
+						}
+
+						lines = append(lines, line)
+					}
+				case *ast.TypeSpec:
+					if !spec.Name.IsExported() {
+						continue
+					}
+
+					if structType, ok := spec.Type.(*ast.StructType); ok {
+						lines = append(lines, fmt.Sprintf("type %s struct", spec.Name.Name))
+						addFields(spec.Name.Name, structType)
+
+						continue
+					}
+
+					lines = append(lines, fmt.Sprintf("type %s %s", spec.Name.Name, format(spec.Type)))
+				}
+			}
+		}
+	}
+
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// lineDiff lists the lines only in expected with a -, and the ones only in actual with a +.
+func lineDiff(expected, actual string) string {
+	count := map[string]int{}
+	for _, line := range strings.Split(expected, "\n") {
+		count[line]--
+	}
+	for _, line := range strings.Split(actual, "\n") {
+		count[line]++
+	}
+
+	var diff []string
+	for line, n := range count {
+		switch {
+		case n < 0:
+			diff = append(diff, "- "+line)
+		case n > 0:
+			diff = append(diff, "+ "+line)
+		}
+	}
+
+	sort.Strings(diff)
+
+	return strings.Join(diff, "\n")
+}
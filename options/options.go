@@ -0,0 +1,1108 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package options holds the options of a badidea server, for the badidea command and for programs
+// that embed badidea servers.
+//
+// The exported API of the package is stable: identifiers are added, but not removed, renamed or
+// changed in type before they were deprecated for a release, and defaults keep their meaning.
+// TestAPI compares the exported API with testdata/api.txt, so every change of it shows up in
+// review; run go test ./options -update-api to accept one.
+package options
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/thetirefire/badidea/etcd"
+	"github.com/thetirefire/badidea/features"
+	apiextensionsserveroptions "k8s.io/apiextensions-apiserver/pkg/cmd/server/options"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/component-base/featuregate"
+)
+
+// AnnotationBytesLimit is the limit of apimachinery on the total size of the annotations of an object.
+const AnnotationBytesLimit = 256 * (1 << 10)
+
+const (
+	// AuthorizationModeDelegating authorizes the requests for every non-resource path, of anonymous
+	// users and of system:masters, and asks the webhook of the RemoteKubeConfigFile of the
+	// authorization options of Extensions about the others, denying them without one.
+	AuthorizationModeDelegating = "Delegating"
+	// AuthorizationModeAlwaysAllow authorizes every request.
+	AuthorizationModeAlwaysAllow = "AlwaysAllow"
+	// AuthorizationModeAlwaysDeny authorizes the requests of system:masters only, which the internal
+	// clients of the server belong to.
+	AuthorizationModeAlwaysDeny = "AlwaysDeny"
+)
+
+// http2CipherSuites are the cipher suites of which HTTP/2 requires one.
+var http2CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+
+// ServerRunOptions runs a badidea server.
+type ServerRunOptions struct {
+	// Extensions holds the options of the apiextensions server. The generic configuration of the
+	// aggregator is derived from the same options.
+	Extensions *apiextensionsserveroptions.CustomResourceDefinitionsServerOptions
+
+	// EmbeddedEtcd configures the etcd server started in-process. The storage of the servers has to
+	// point at its client URL.
+	EmbeddedEtcd etcd.Config
+	// DisableEmbeddedEtcd uses the etcd servers of the storage options instead of starting one.
+	DisableEmbeddedEtcd bool
+
+	// FeatureGate holds the badidea feature gates of this server instance.
+	FeatureGate featuregate.MutableFeatureGate
+
+	// DeprecatedResources maps deprecated resources to a hint naming their replacement. Requests
+	// against them get a Warning header and are tracked by metric, audit annotation and log, like the
+	// ones of resources deprecated with apiserver.ServerChainConfig.WithDeprecatedResource. Resources
+	// with prerelease lifecycle information do not need an entry, the endpoint installer already warns
+	// about them (e.g. apiextensions.k8s.io/v1beta1), and neither do deprecated CRD versions.
+	DeprecatedResources map[schema.GroupVersionResource]string
+	// SuppressDeprecationWarningsUserAgents lists the user agent prefixes of clients that do not
+	// want Warning headers for deprecated APIs.
+	SuppressDeprecationWarningsUserAgents []string
+
+	// EnableRequestLogging logs every request served.
+	EnableRequestLogging bool
+	// SlowRequestThreshold logs requests slower than this as warnings, even when request logging is
+	// disabled. Zero disables the threshold.
+	SlowRequestThreshold time.Duration
+	// EnableClientAttribution aggregates the requests and their latency by user, user agent and
+	// resource, served at /debug/badidea/clients and as metrics of the top clients.
+	EnableClientAttribution bool
+	// ClientAttributionMaxClients is the number of clients the attribution keeps track of.
+	ClientAttributionMaxClients int
+	// ClientAttributionTop is the number of top clients served and published as metrics.
+	ClientAttributionTop int
+	// ClientAttributionHashUsers replaces the usernames of the attribution by their hash.
+	ClientAttributionHashUsers bool
+	// RequestTimeout is how long a request may take before it is answered with a 504. Long-running
+	// requests, like watches, the proxy verb and the streaming subresources, are exempt.
+	RequestTimeout time.Duration
+	// MaxWritePause is the longest the writes of a resource can be paused through
+	// /debug/badidea/writes. Pauses end on their own after it.
+	MaxWritePause time.Duration
+
+	// ShutdownDelayDuration delays closing the listener on shutdown. Meanwhile /readyz fails, new
+	// requests are rejected with a Retry-After header and requests in flight drain.
+	ShutdownDelayDuration time.Duration
+
+	// CorsAllowedOrigins lists regular expressions of the origins browsers may make cross-origin
+	// requests from. CORS is disabled if it is empty.
+	CorsAllowedOrigins []string
+
+	// ReadyzExclude lists the checks excluded from /readyz.
+	ReadyzExclude []string
+	// LivezExclude lists the checks excluded from /livez.
+	LivezExclude []string
+	// LivezHeartbeatThreshold fails /livez once a controller of the server sent no heartbeat for
+	// longer. Zero disables the heartbeats.
+	LivezHeartbeatThreshold time.Duration
+	// LivezHeartbeatGracePeriod is the time controllers have for their first heartbeat, if it is longer
+	// than LivezHeartbeatThreshold.
+	LivezHeartbeatGracePeriod time.Duration
+
+	// LeaderElect runs the controllers of the server only while it leads them, for replicas sharing
+	// etcd.
+	LeaderElect bool
+	// LeaderElectLeaseDuration is how long the replicas wait for a leader that stopped renewing its
+	// lease before taking over.
+	LeaderElectLeaseDuration time.Duration
+
+	// EtcdProbeInterval is how often the round-trip time of etcd is probed with a linearized read.
+	// Zero disables the probes.
+	EtcdProbeInterval time.Duration
+	// EtcdProbeSummaryPeriod is how often the round-trip times of the probes are summarized in the log.
+	EtcdProbeSummaryPeriod time.Duration
+	// EtcdProbeWarningThreshold is the 99th percentile of the round-trip times of a summary period
+	// above which the summary is logged as a warning.
+	EtcdProbeWarningThreshold time.Duration
+
+	// WaitForEtcd creates the servers only once the etcd servers of the storage options answer, without
+	// an embedded etcd. Otherwise the servers are created right away and become ready once etcd
+	// answers.
+	WaitForEtcd bool
+	// EtcdWaitTimeout is how long the server waits for the etcd servers of the storage options to answer
+	// when starting with WaitForEtcd.
+	EtcdWaitTimeout time.Duration
+
+	// DisableResponseCompressionFor lists the resources, in resource.group form, whose responses are
+	// never compressed.
+	DisableResponseCompressionFor []string
+
+	// InternalClientQPS is the QPS of the loopback clients used by the controllers of the server. Zero
+	// keeps the client-go default.
+	InternalClientQPS float32
+	// InternalClientBurst is the burst of the loopback clients used by the controllers of the server.
+	// Zero keeps the client-go default.
+	InternalClientBurst int
+	// InternalClientDiscoveryTTL is the time the loopback clients cache discovery information for at
+	// most. They drop it when CRDs or APIServices change anyway. Zero caches it until then.
+	InternalClientDiscoveryTTL time.Duration
+
+	// DisableOpenAPI skips building and serving the OpenAPI spec.
+	DisableOpenAPI bool
+	// OpenAPITitle is the title of the OpenAPI spec, which clients generated from it are named after.
+	OpenAPITitle string
+	// OpenAPIVersion is the version of the OpenAPI spec. Empty means the version of the server.
+	OpenAPIVersion string
+	// OpenAPIDescription is the description of the OpenAPI spec.
+	OpenAPIDescription string
+	// OpenAPIContactName, OpenAPIContactURL and OpenAPIContactEmail are the contact of the OpenAPI
+	// spec. It is left out if they are all empty.
+	OpenAPIContactName  string
+	OpenAPIContactURL   string
+	OpenAPIContactEmail string
+
+	// DisableAggregator leaves the aggregator out of the chain, so there are no APIServices and the
+	// server below the aggregator serves requests and discovery itself.
+	DisableAggregator bool
+
+	// DisableCRDs leaves the apiextensions server out of the chain, so there are no CRDs and the
+	// apiextensions.k8s.io group is not served.
+	DisableCRDs bool
+
+	// InMemoryServingCert keeps the generated self-signed serving certificate in memory instead of
+	// writing it to the cert directory. Clients get the CA from the server.
+	InMemoryServingCert bool
+
+	// BootstrapManifestsDir holds manifests that are server-side applied once the server is up.
+	BootstrapManifestsDir string
+
+	// RestartPanickedHooks restarts goroutines of post-start hooks that panicked instead of crashing.
+	RestartPanickedHooks bool
+
+	// MaxAnnotationBytes lowers the limit on the total size of the annotations of an object below
+	// AnnotationBytesLimit. Zero keeps AnnotationBytesLimit.
+	MaxAnnotationBytes int
+	// AnnotationSizeWarningBytes returns a warning for objects whose annotations total more bytes.
+	// Zero disables the warning.
+	AnnotationSizeWarningBytes int
+
+	// MaxStoredObjects rejects writes other than deletes once as many objects are stored in etcd, as
+	// counted by the object count poller. Zero means no quota.
+	MaxStoredObjects int64
+
+	// MaxDeleteCollectionObjects rejects deletecollection requests that would delete more objects.
+	// Zero means no limit.
+	MaxDeleteCollectionObjects int
+
+	// MaxRequestBodyBytes is the limit of the size of the bodies of create, update and patch requests,
+	// and of the bytes JSON patches may copy. Zero keeps the limits of the endpoint handlers.
+	MaxRequestBodyBytes int64
+	// MaxJSONPatchOperations is the limit of the operations of JSON patches. Zero means no limit.
+	MaxJSONPatchOperations int
+	// MaxRequestNestingDepth is the limit of the nesting of the objects and arrays of JSON and YAML
+	// request bodies. Zero means no limit.
+	MaxRequestNestingDepth int
+
+	// MaxLabelSelectorRequirements is the limit of the requirements of the label selectors of list,
+	// watch and deletecollection requests. Zero means no limit.
+	MaxLabelSelectorRequirements int
+	// MaxLabelSelectorValues is the limit of the values of a set-based requirement of those label
+	// selectors. Zero means no limit.
+	MaxLabelSelectorValues int
+
+	// AdvertiseAddress is the IP address the server is reachable at, included in the generated serving
+	// certificate. If nil, it defaults to the bind address, or to 127.0.0.1 if the server binds to all
+	// addresses.
+	AdvertiseAddress net.IP
+	// ExternalHostname is the host name in the URLs the server generates, e.g. in the OpenAPI spec and
+	// discovery, and is included in the generated serving certificate. If empty, it defaults to the
+	// advertise address.
+	ExternalHostname string
+
+	// BindUnixSocket serves on the unix socket at this path instead of a TCP port. Clients have to
+	// dial the socket whatever the address, e.g. with apiserver.UnixSocketDialer.
+	BindUnixSocket string
+
+	// MaxPriorityRequestsInFlight limits the GETs of the health checks and discovery documents served
+	// without waiting for the max-in-flight limits. Further ones are limited like any other request.
+	// Zero serves them like any other request.
+	MaxPriorityRequestsInFlight int
+
+	// MaxWatchesPerUser limits the watches a user has open at a time. Further watches are rejected
+	// with a 429. The loopback clients are exempt. Zero means no limit.
+	MaxWatchesPerUser int
+	// MaxWatchesPerNamespace limits the watches open in a namespace at a time, by all users but the
+	// loopback clients. Zero means no limit.
+	MaxWatchesPerNamespace int
+
+	// MaxConnections limits the connections open on the secure listener. Further connections wait to
+	// be accepted until others are closed. Zero means no limit.
+	MaxConnections int
+	// TCPKeepAlivePeriod is the period of the TCP keep-alive probes of connections to the secure
+	// port. Zero disables keep-alive probes.
+	TCPKeepAlivePeriod time.Duration
+
+	// AuthorizationMode is how the requests are authorized, one of the AuthorizationMode constants.
+	// Impersonation is authorized alike.
+	AuthorizationMode string
+	// EnableCRDTenancy confines the CRDs labeled badidea.x-k8s.io/tenant to the members of the group
+	// named by the label: other users are denied their custom resources and do not see them in
+	// discovery and the OpenAPI spec. system:masters sees every tenant.
+	EnableCRDTenancy bool
+
+	// InsecureServing serves the handler chain of the server over plain HTTP on a loopback address, for
+	// debugging tools that cannot be given the CA. It is disabled unless BindPort is set.
+	InsecureServing *genericoptions.DeprecatedInsecureServingOptions
+	// InsecureUser is the user requests on the insecure port are authenticated as. They are still
+	// authorized.
+	InsecureUser string
+	// InsecureGroups are the groups of InsecureUser.
+	InsecureGroups []string
+
+	// AllowUnknownRuntimeConfig ignores --runtime-config keys naming no group version served by
+	// the server instead of failing, for configurations shared with newer servers.
+	AllowUnknownRuntimeConfig bool
+	// AllowStorageVersionDowngrade starts the server although etcd holds objects a newer server
+	// stored in versions this one cannot decode.
+	AllowStorageVersionDowngrade bool
+	// AllowResourceConfigMismatch logs the group versions a server of the chain installed against its
+	// resource config, or did not install although it enables them, instead of failing.
+	AllowResourceConfigMismatch bool
+	// StrictConfig fails Complete instead of normalizing the values set by the user, see
+	// Normalization.
+	StrictConfig bool
+}
+
+// Normalization is a change Complete made to a value set by the user, like the rounding of a
+// duration. The server logs the normalizations at startup and reports them in its Instance.
+type Normalization struct {
+	// Flag is the flag whose value was changed, like --runtime-config.
+	Flag string
+	// From is the value set by the user.
+	From string
+	// To is the value the server uses, empty if it ignores the value.
+	To string
+	// Reason is why the value was changed.
+	Reason string
+}
+
+func (n Normalization) String() string {
+	if n.To == "" {
+		return fmt.Sprintf("%s %q is ignored: %s", n.Flag, n.From, n.Reason)
+	}
+
+	return fmt.Sprintf("%s %q is used as %q: %s", n.Flag, n.From, n.To, n.Reason)
+}
+
+// CompletedServerRunOptions is a private wrapper that enforces a call of Complete() before the
+// options can be used to create a server.
+type CompletedServerRunOptions struct {
+	*completedServerRunOptions
+}
+
+type completedServerRunOptions struct {
+	*ServerRunOptions
+
+	// UncompressedResources is the parsed form of DisableResponseCompressionFor.
+	UncompressedResources []schema.GroupResource
+	// Normalizations are the changes Complete made to the values set by the user.
+	Normalizations []Normalization
+}
+
+// NewServerRunOptions creates a new ServerRunOptions with default values and a feature gate of
+// its own, so several servers with different gates can live in one process.
+func NewServerRunOptions() (*ServerRunOptions, error) {
+	featureGate := featuregate.NewFeatureGate()
+	if err := features.AddFeatureGates(featureGate); err != nil {
+		return nil, err
+	}
+
+	return NewServerRunOptionsWithFeatureGate(featureGate), nil
+}
+
+// NewServerRunOptionsWithFeatureGate creates a new ServerRunOptions with default values using
+// featureGate, which must already know the badidea feature gates.
+func NewServerRunOptionsWithFeatureGate(featureGate featuregate.MutableFeatureGate) *ServerRunOptions {
+	o := &ServerRunOptions{
+		Extensions:   apiextensionsserveroptions.NewCustomResourceDefinitionsServerOptions(os.Stdout, os.Stderr),
+		EmbeddedEtcd: etcd.DefaultConfig(),
+		FeatureGate:  featureGate,
+
+		RequestTimeout: time.Minute,
+		MaxWritePause:  5 * time.Minute,
+
+		ClientAttributionMaxClients: 1000,
+		ClientAttributionTop:        10,
+
+		AnnotationSizeWarningBytes: AnnotationBytesLimit / 2,
+
+		InsecureServing: &genericoptions.DeprecatedInsecureServingOptions{
+			BindAddress: net.ParseIP("127.0.0.1"),
+			BindNetwork: "tcp",
+		},
+		AuthorizationMode: AuthorizationModeDelegating,
+
+		InsecureUser: "system:unsecured",
+
+		InternalClientDiscoveryTTL: time.Minute,
+
+		LivezHeartbeatGracePeriod: 5 * time.Minute,
+
+		LeaderElectLeaseDuration: 15 * time.Second,
+
+		EtcdProbeInterval:         10 * time.Second,
+		EtcdProbeSummaryPeriod:    5 * time.Minute,
+		EtcdProbeWarningThreshold: 100 * time.Millisecond,
+
+		OpenAPITitle: "BadIdea",
+
+		WaitForEtcd:     true,
+		EtcdWaitTimeout: time.Minute,
+
+		MaxPriorityRequestsInFlight: 10,
+		TCPKeepAlivePeriod:          3 * time.Minute,
+	}
+
+	o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList = []string{o.EmbeddedEtcd.ClientURL}
+	// without a garbage collector, the finalizers of foreground and orphan deletes would never be removed
+	o.Extensions.RecommendedOptions.Etcd.EnableGarbageCollection = false
+	o.Extensions.RecommendedOptions.SecureServing.BindPort = 6443
+	o.Extensions.RecommendedOptions.Authentication.RemoteKubeConfigFileOptional = true
+	o.Extensions.RecommendedOptions.Authorization.RemoteKubeConfigFileOptional = true
+	o.Extensions.RecommendedOptions.Authorization.AlwaysAllowPaths = []string{"*"}
+	o.Extensions.RecommendedOptions.Authorization.AlwaysAllowGroups = []string{"system:unauthenticated"}
+	o.Extensions.RecommendedOptions.CoreAPI = nil
+	o.Extensions.RecommendedOptions.Admission = nil
+
+	return o
+}
+
+// Flags returns the flags of the badidea server in named sections, for help grouped by them.
+func (o *ServerRunOptions) Flags() cliflag.NamedFlagSets {
+	fss := cliflag.NamedFlagSets{}
+
+	o.addServingFlags(fss.FlagSet("serving"))
+	o.addEtcdFlags(fss.FlagSet("etcd"))
+	o.addAuthenticationFlags(fss.FlagSet("authentication"))
+	o.addAuthorizationFlags(fss.FlagSet("authorization"))
+	o.addAdmissionFlags(fss.FlagSet("admission"))
+	o.addLimitFlags(fss.FlagSet("limits"))
+	o.addLoggingFlags(fss.FlagSet("logging"))
+	o.addHealthFlags(fss.FlagSet("health"))
+	o.addAPIFlags(fss.FlagSet("APIs"))
+	o.addLeaderElectionFlags(fss.FlagSet("leader election"))
+	o.addInternalClientFlags(fss.FlagSet("internal clients"))
+	features.AddFlag(o.FeatureGate, fss.FlagSet("feature gates"))
+
+	return fss
+}
+
+// AddFlags adds flags for the badidea server to the specified FlagSet.
+func (o *ServerRunOptions) AddFlags(fs *pflag.FlagSet) {
+	fss := o.Flags()
+	for _, name := range fss.Order {
+		fs.AddFlagSet(fss.FlagSets[name])
+	}
+}
+
+// addServingFlags adds the flags of the listeners and of serving requests.
+func (o *ServerRunOptions) addServingFlags(fs *pflag.FlagSet) {
+	secureServing := o.Extensions.RecommendedOptions.SecureServing
+
+	fs.IPVar(&secureServing.BindAddress, "bind-address", secureServing.BindAddress, ""+
+		"IP address to serve HTTPS on. Use 0.0.0.0 or :: to serve on all IPv4, or all IPv4 and IPv6 addresses.")
+
+	fs.IPVar(&o.AdvertiseAddress, "advertise-address", o.AdvertiseAddress, ""+
+		"IP address the server is reachable at from other machines, included in the generated serving certificate. "+
+		"Defaults to --bind-address, or to 127.0.0.1 if it is unspecified.")
+
+	fs.StringVar(&o.ExternalHostname, "external-hostname", o.ExternalHostname, ""+
+		"Host name or IP address used in the URLs the server generates, included in the generated serving certificate. "+
+		"Defaults to --advertise-address. A certificate generated earlier in --cert-dir is reused as is, delete it to "+
+		"generate one for new addresses.")
+
+	fs.StringVar(&o.BindUnixSocket, "bind-unix-socket", o.BindUnixSocket, ""+
+		"Path of a unix socket to serve HTTPS on instead of --bind-address and --secure-port. A socket left behind at the path "+
+		"is replaced, and the socket is removed on shutdown. The generated serving certificate is valid for localhost.")
+
+	fs.IntVar(&secureServing.HTTP2MaxStreamsPerConnection, "http2-max-streams-per-connection", secureServing.HTTP2MaxStreamsPerConnection, ""+
+		"Limit of concurrent HTTP/2 streams, like watches, per client connection. Clients open further connections for more streams. "+
+		"Zero means the default of 250.")
+
+	fs.StringVar(&secureServing.MinTLSVersion, "tls-min-version", secureServing.MinTLSVersion, ""+
+		"Minimum TLS version clients have to connect with, one of "+strings.Join(cliflag.TLSPossibleVersions(), ", ")+". "+
+		"Defaults to VersionTLS12.")
+
+	fs.StringSliceVar(&secureServing.CipherSuites, "tls-cipher-suites", secureServing.CipherSuites, ""+
+		"List of cipher suites offered to clients of TLS 1.2 and older, comma separated. The suites of TLS 1.3 cannot be "+
+		"configured, so the list has no effect with --tls-min-version=VersionTLS13. HTTP/2 requires "+
+		strings.Join(http2CipherSuites, " or ")+". Defaults to the suites of Go. "+
+		"Possible values: "+strings.Join(cliflag.TLSCipherPossibleValues(), ", ")+".")
+
+	fs.IntVar(&o.MaxConnections, "max-connections", o.MaxConnections, ""+
+		"Limit of connections open on the secure port. Further connections wait to be accepted until others are closed. "+
+		"Zero means no limit.")
+
+	fs.DurationVar(&o.TCPKeepAlivePeriod, "tcp-keepalive-period", o.TCPKeepAlivePeriod, ""+
+		"Period of TCP keep-alive probes detecting dead clients on the secure port, e.g. behind idle watches. Zero disables "+
+		"keep-alive probes.")
+
+	fs.IntVar(&o.InsecureServing.BindPort, "insecure-bind-port", o.InsecureServing.BindPort, ""+
+		"Port to serve the API on over plain HTTP, for debugging tools that cannot be given the CA of the server. Requests are "+
+		"not authenticated but served as --insecure-user, and authorized like any other. Zero disables the insecure port.")
+
+	fs.IPVar(&o.InsecureServing.BindAddress, "insecure-bind-address", o.InsecureServing.BindAddress, ""+
+		"Loopback address to serve --insecure-bind-port on. Other addresses are rejected.")
+
+	fs.DurationVar(&o.RequestTimeout, "request-timeout", o.RequestTimeout, ""+
+		"Time a request may take before it is answered with a 504. Watches, requests with the proxy verb and the attach, exec, "+
+		"log, portforward and proxy subresources of aggregated servers are long-running and exempt.")
+
+	fs.DurationVar(&o.ShutdownDelayDuration, "shutdown-delay-duration", o.ShutdownDelayDuration, ""+
+		"Time to keep serving after a shutdown signal before closing the listener. Meanwhile /readyz fails, new requests "+
+		"are rejected with 429 and a Retry-After header, and requests in flight drain.")
+
+	fs.StringSliceVar(&o.CorsAllowedOrigins, "cors-allowed-origins", o.CorsAllowedOrigins, ""+
+		"List of allowed origins for CORS, comma separated. An allowed origin is a regular expression matched anywhere in the "+
+		"Origin header, anchor it like ^https://dashboard\\.example\\.com$ to match a single origin. If this list is empty "+
+		"CORS is disabled.")
+
+	fs.StringSliceVar(&o.DisableResponseCompressionFor, "disable-response-compression-for", o.DisableResponseCompressionFor, ""+
+		"List of resources, in resource.group form, whose responses are never gzip compressed, for example "+
+		"customresourcedefinitions.apiextensions.k8s.io. Compressing large lists can be slower than sending them over fast local links. "+
+		"badidea_response_compression_saved_bytes_total counts the bytes compression saves by resource.")
+
+	fs.BoolVar(&o.InMemoryServingCert, "in-memory-serving-cert", o.InMemoryServingCert, ""+
+		"Keep the generated self-signed serving certificate in memory instead of writing it to --cert-dir, "+
+		"for read-only filesystems. A new certificate is generated on every start. Ignored if --tls-cert-file is set.")
+}
+
+// addEtcdFlags adds the flags of etcd and of the storage in it.
+func (o *ServerRunOptions) addEtcdFlags(fs *pflag.FlagSet) {
+	etcd := o.Extensions.RecommendedOptions.Etcd
+
+	fs.BoolVar(&etcd.EnableWatchCache, "watch-cache", etcd.EnableWatchCache, ""+
+		"Enable the watch cache for CustomResourceDefinitions, APIServices and custom resources.")
+
+	fs.BoolVar(&etcd.EnableGarbageCollection, "enable-garbage-collector", etcd.EnableGarbageCollection, ""+
+		"Run the garbage collector, deleting the custom resources and other objects whose owners are gone, and honoring the "+
+		"foreground and orphan propagation policies of deletes. Without it those policies delete objects in the background "+
+		"and dependents are left behind.")
+
+	fs.IntVar(&etcd.DefaultWatchCacheSize, "default-watch-cache-size", etcd.DefaultWatchCacheSize, ""+
+		"Default watch cache size. If zero, the watch cache is disabled for the resources without a size in "+
+		"--watch-cache-sizes, including all custom resources. Watch caches grow dynamically, so other sizes have no effect.")
+
+	fs.StringSliceVar(&etcd.WatchCacheSizes, "watch-cache-sizes", etcd.WatchCacheSizes, ""+
+		"Watch cache size settings for some resources, comma separated. The individual setting format is resource[.group]#size, "+
+		"for example customresourcedefinitions.apiextensions.k8s.io#0 or widgets.example.com#0 for a custom resource. Watch caches "+
+		"grow dynamically, so only a size of zero, which disables the cache for the resource, has an effect.")
+
+	fs.DurationVar(&etcd.StorageConfig.CompactionInterval, "etcd-compaction-interval", etcd.StorageConfig.CompactionInterval, ""+
+		"Interval of the compactions of etcd. Watches resumed from a resourceVersion older than the previous compaction fail "+
+		"with 410 Gone and clients relist, so a longer interval keeps watches of resources without a watch cache resumable "+
+		"for longer, at the cost of etcd keeping more history. Resources with a watch cache keep a history of about 75 "+
+		"seconds of changes at most. Zero disables compaction.")
+
+	fs.DurationVar(&o.EtcdProbeInterval, "etcd-probe-interval", o.EtcdProbeInterval, ""+
+		"Interval of the linearized reads the round-trip time of etcd is probed with, exported as the "+
+		"badidea_etcd_probe_duration_seconds histogram. Zero disables the probes.")
+
+	fs.DurationVar(&o.EtcdProbeSummaryPeriod, "etcd-probe-summary-period", o.EtcdProbeSummaryPeriod, ""+
+		"Period the round-trip times of the etcd probes are summarized in the log for.")
+
+	fs.DurationVar(&o.EtcdProbeWarningThreshold, "etcd-probe-warning-threshold", o.EtcdProbeWarningThreshold, ""+
+		"Log the summary of the etcd probes as a warning if their 99th percentile exceeds this, or any probe failed. "+
+		"Reads of the embedded etcd take well below a millisecond, slower ones point at stalls of its disk.")
+
+	fs.BoolVar(&o.WaitForEtcd, "wait-for-etcd", o.WaitForEtcd, ""+
+		"Wait for the etcd servers of --etcd-servers to answer before starting to serve, and exit if they do not within "+
+		"--etcd-wait-timeout. If false, the server starts serving right away, and /readyz fails and requests for stored "+
+		"resources are answered with a 503 until etcd answers. The embedded etcd is always waited for.")
+
+	fs.DurationVar(&o.EtcdWaitTimeout, "etcd-wait-timeout", o.EtcdWaitTimeout, ""+
+		"Time to wait for the etcd servers of --etcd-servers to answer when starting with --wait-for-etcd. They are "+
+		"retried with an exponential, jittered backoff.")
+
+	fs.IntVar(&etcd.DeleteCollectionWorkers, "delete-collection-workers", etcd.DeleteCollectionWorkers, ""+
+		"Number of objects a deletecollection request deletes in parallel. More workers delete large collections faster, "+
+		"at the expense of the etcd load of other requests.")
+
+	fs.BoolVar(&o.AllowStorageVersionDowngrade, "allow-storage-version-downgrade", o.AllowStorageVersionDowngrade, ""+
+		"Start although a newer server stored resources in etcd in versions this server cannot decode, instead of failing "+
+		"to start. Reading the affected objects fails until a newer server is started again.")
+}
+
+// addAuthenticationFlags adds the flags authenticating the requests of the insecure port.
+func (o *ServerRunOptions) addAuthenticationFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.InsecureUser, "insecure-user", o.InsecureUser, ""+
+		"User requests on --insecure-bind-port are served as.")
+
+	fs.StringSliceVar(&o.InsecureGroups, "insecure-groups", o.InsecureGroups, ""+
+		"Groups of --insecure-user. Without groups only non-resource paths like /healthz are authorized, "+
+		"system:masters authorizes everything.")
+}
+
+// addAuthorizationFlags adds the flags authorizing requests.
+func (o *ServerRunOptions) addAuthorizationFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.AuthorizationMode, "authorization-mode", o.AuthorizationMode, ""+
+		"How requests are authorized, including the impersonation of users, groups, service accounts and UIDs with the "+
+		"impersonate verb: Delegating authorizes every non-resource path, anonymous requests and system:masters, and denies "+
+		"the others unless an embedding program configured an authorization webhook. AlwaysAllow authorizes every request. "+
+		"AlwaysDeny authorizes system:masters only.")
+
+	fs.BoolVar(&o.EnableCRDTenancy, "enable-crd-tenancy", o.EnableCRDTenancy, ""+
+		"Confine the CustomResourceDefinitions labeled badidea.x-k8s.io/tenant to the users in the group named by the label, "+
+		"whatever the --authorization-mode. Other users are denied the CRDs and their custom resources, and do not see them "+
+		"in discovery and the OpenAPI spec. Only system:masters may list and watch CRDs, as lists would reveal the other "+
+		"tenants.")
+}
+
+// addAdmissionFlags adds the flags of the checks admitting objects.
+func (o *ServerRunOptions) addAdmissionFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&o.MaxAnnotationBytes, "max-annotation-bytes", o.MaxAnnotationBytes, ""+
+		"Reject objects whose annotations total more bytes, lowering the limit of 262144 bytes. Objects stored before "+
+		"the limit was lowered can still be updated as long as their annotations do not grow. Zero keeps the default limit.")
+
+	fs.IntVar(&o.AnnotationSizeWarningBytes, "annotation-size-warning-bytes", o.AnnotationSizeWarningBytes, ""+
+		"Return a warning for objects whose annotations total more bytes. Zero disables the warning.")
+}
+
+// addLimitFlags adds the flags limiting requests and the objects stored.
+func (o *ServerRunOptions) addLimitFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&o.MaxPriorityRequestsInFlight, "max-priority-requests-inflight", o.MaxPriorityRequestsInFlight, ""+
+		"Number of GETs of /healthz, /livez, /readyz, /version and the discovery documents served at a time regardless of "+
+		"--max-requests-inflight, so that probes and discovery do not queue behind expensive requests when the server is "+
+		"saturated. Further ones count against --max-requests-inflight. Zero disables the priority.")
+
+	fs.IntVar(&o.MaxWatchesPerUser, "max-watches-per-user", o.MaxWatchesPerUser, ""+
+		"Limit of the watches a user has open at a time, so that a buggy client cannot exhaust the memory of the server. "+
+		"Further watches are rejected with a 429 until others are closed. The internal clients of the server are exempt. "+
+		"Zero, the default, means no limit.")
+
+	fs.IntVar(&o.MaxWatchesPerNamespace, "max-watches-per-namespace", o.MaxWatchesPerNamespace, ""+
+		"Limit of the watches open in a namespace at a time, by all users but the internal clients of the server. Further "+
+		"watches are rejected with a 429 until others are closed. Zero, the default, means no limit.")
+
+	fs.DurationVar(&o.MaxWritePause, "max-write-pause", o.MaxWritePause, ""+
+		"Longest time the writes of a resource, or of all resources, can be paused through /debug/badidea/writes, for "+
+		"example while a backup is taken. Pauses end on their own after it, so a backup that crashed does not leave the "+
+		"server read-only.")
+
+	fs.Int64Var(&o.MaxStoredObjects, "max-stored-objects", o.MaxStoredObjects, ""+
+		"Reject creating, updating and patching objects with 507 Insufficient Storage once as many objects are stored in "+
+		"etcd, as counted every --etcd-count-metric-poll-period, to protect small etcd instances. Deletes are still served, "+
+		"and writes are accepted again below 90% of the quota. /readyz warns above 80%. Zero means no quota.")
+
+	fs.IntVar(&o.MaxDeleteCollectionObjects, "max-delete-collection-objects", o.MaxDeleteCollectionObjects, ""+
+		"Reject deletecollection requests that would delete more objects with 413 Request Entity Too Large before deleting "+
+		"any, so deleting a large collection does not monopolize the server. Clients can delete them in pages with the limit "+
+		"parameter, or in parts with label or field selectors. Zero means no limit.")
+
+	fs.Int64Var(&o.MaxRequestBodyBytes, "max-request-body-bytes", o.MaxRequestBodyBytes, ""+
+		"Reject create, update and patch requests with larger bodies with 413 Request Entity Too Large, and JSON patches "+
+		"copying more bytes with 400, to protect the memory of small instances. Zero, the default, keeps the limits of the "+
+		"endpoint handlers: they read bodies of at most 3 MiB and JSON patches copy at most 3 MiB.")
+
+	fs.IntVar(&o.MaxJSONPatchOperations, "max-json-patch-operations", o.MaxJSONPatchOperations, ""+
+		"Reject JSON patches with more operations with 400 Bad Request. Zero, the default, means no limit.")
+
+	fs.IntVar(&o.MaxRequestNestingDepth, "max-request-nesting-depth", o.MaxRequestNestingDepth, ""+
+		"Reject create, update and patch requests whose JSON or YAML body nests objects and arrays deeper with 400 Bad Request. "+
+		"Zero, the default, means no limit.")
+
+	fs.IntVar(&o.MaxLabelSelectorRequirements, "max-label-selector-requirements", o.MaxLabelSelectorRequirements, ""+
+		"Reject list, watch and deletecollection requests whose label selector has more requirements with 400 Bad Request, "+
+		"since every object of the collection is matched against every requirement. Zero, the default, means no limit.")
+
+	fs.IntVar(&o.MaxLabelSelectorValues, "max-label-selector-values", o.MaxLabelSelectorValues, ""+
+		"Reject list, watch and deletecollection requests whose label selector has a set-based requirement, like in or "+
+		"notin, with more values with 400 Bad Request. Zero, the default, means no limit.")
+}
+
+// addLoggingFlags adds the flags logging requests and attributing them to clients.
+func (o *ServerRunOptions) addLoggingFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&o.EnableRequestLogging, "enable-request-logging", o.EnableRequestLogging, ""+
+		"Log the latency, user, verb, resource and response code of every request.")
+
+	fs.DurationVar(&o.SlowRequestThreshold, "slow-request-threshold", o.SlowRequestThreshold, ""+
+		"Log requests slower than this as warnings, even when request logging is disabled. Long-running requests are exempt. "+
+		"Zero disables the threshold.")
+
+	fs.BoolVar(&o.EnableClientAttribution, "enable-client-attribution", o.EnableClientAttribution, ""+
+		"Count the requests and their latency by user, user agent and resource, to tell which clients load the server. "+
+		"The top clients are served at /debug/badidea/clients and published as the badidea_top_client_requests and "+
+		"badidea_top_client_request_seconds metrics.")
+
+	fs.IntVar(&o.ClientAttributionMaxClients, "client-attribution-max-clients", o.ClientAttributionMaxClients, ""+
+		"Number of clients, by user, user agent and resource, the client attribution keeps track of. Once it is reached, "+
+		"a new client replaces the one with the fewest requests, so the counts of the top clients are upper bounds.")
+
+	fs.IntVar(&o.ClientAttributionTop, "client-attribution-top", o.ClientAttributionTop, ""+
+		"Number of top clients served at /debug/badidea/clients and published as metrics.")
+
+	fs.BoolVar(&o.ClientAttributionHashUsers, "client-attribution-hash-users", o.ClientAttributionHashUsers, ""+
+		"Replace the usernames of the client attribution by their SHA-256 hash, so they are not exposed by the endpoint "+
+		"and the metrics.")
+}
+
+// addHealthFlags adds the flags of the health checks.
+func (o *ServerRunOptions) addHealthFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.ReadyzExclude, "readyz-exclude", o.ReadyzExclude, ""+
+		"List of health checks to exclude from /readyz, for example a flaky check blocking a rollout.")
+
+	fs.StringSliceVar(&o.LivezExclude, "livez-exclude", o.LivezExclude, ""+
+		"List of health checks to exclude from /livez.")
+
+	fs.DurationVar(&o.LivezHeartbeatThreshold, "livez-heartbeat-threshold", o.LivezHeartbeatThreshold, ""+
+		"Fail the controller-heartbeats check of /livez once a controller of the server, like the CRD autoregistration or the "+
+		"garbage collector, sent no heartbeat for longer, so a wedged controller gets the process restarted. Set it well above "+
+		"the resync periods of the controllers, for example to 2m. Zero, the default, disables the check.")
+
+	fs.DurationVar(&o.LivezHeartbeatGracePeriod, "livez-heartbeat-grace-period", o.LivezHeartbeatGracePeriod, ""+
+		"Time the controllers of the server have for their first heartbeat at startup, if it is longer than "+
+		"--livez-heartbeat-threshold.")
+
+	fs.BoolVar(&o.RestartPanickedHooks, "restart-panicked-hooks", o.RestartPanickedHooks, ""+
+		"Restart the controllers started by post-start hooks with backoff when they panic, instead of exiting. "+
+		"Panics are logged and counted in badidea_hook_panics_total either way.")
+}
+
+// addAPIFlags adds the flags selecting and describing the APIs served.
+func (o *ServerRunOptions) addAPIFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.SuppressDeprecationWarningsUserAgents, "suppress-deprecation-warnings-user-agents", o.SuppressDeprecationWarningsUserAgents, ""+
+		"List of user agent prefixes of clients that should not receive Warning headers for deprecated APIs.")
+
+	fs.BoolVar(&o.DisableOpenAPI, "disable-openapi", o.DisableOpenAPI, ""+
+		"Do not build or serve the OpenAPI spec, saving CPU and memory on short-lived instances. "+
+		"kubectl explain and client-side validation of kubectl apply stop working.")
+
+	fs.StringVar(&o.OpenAPITitle, "openapi-title", o.OpenAPITitle, ""+
+		"Title of the OpenAPI spec, which client SDKs generated from it are named after.")
+
+	fs.StringVar(&o.OpenAPIVersion, "openapi-version", o.OpenAPIVersion, ""+
+		"Version of the OpenAPI spec. Defaults to the version of the server.")
+
+	fs.StringVar(&o.OpenAPIDescription, "openapi-description", o.OpenAPIDescription, ""+
+		"Description of the OpenAPI spec.")
+
+	fs.StringVar(&o.OpenAPIContactName, "openapi-contact-name", o.OpenAPIContactName, ""+
+		"Name of the contact of the OpenAPI spec.")
+
+	fs.StringVar(&o.OpenAPIContactURL, "openapi-contact-url", o.OpenAPIContactURL, ""+
+		"Absolute URL of the contact of the OpenAPI spec.")
+
+	fs.StringVar(&o.OpenAPIContactEmail, "openapi-contact-email", o.OpenAPIContactEmail, ""+
+		"Email address of the contact of the OpenAPI spec.")
+
+	fs.BoolVar(&o.DisableAggregator, "disable-aggregator", o.DisableAggregator, ""+
+		"Leave the aggregator out of the server chain, for the smallest instances. The apiregistration.k8s.io group does "+
+		"not exist then and APIServices cannot be used. The OpenAPI spec only covers the API groups added in-process if there "+
+		"are any, and the CRDs otherwise.")
+
+	fs.BoolVar(&o.DisableCRDs, "disable-crds", o.DisableCRDs, ""+
+		"Leave the apiextensions server out of the server chain, for embedders serving only API groups added in-process. "+
+		"The apiextensions.k8s.io group does not exist then and CustomResourceDefinitions cannot be created, so "+
+		"--bootstrap-manifests-dir must not hold any.")
+
+	fs.StringVar(&o.BootstrapManifestsDir, "bootstrap-manifests-dir", o.BootstrapManifestsDir, ""+
+		"Directory of .yaml, .yml and .json manifests to server-side apply once the server is up. CustomResourceDefinitions "+
+		"are created or replaced instead, and applied first with Namespaces, so the directory may hold custom resources of its "+
+		"own CRDs. Namespaces are skipped as this server does not serve them. /readyz fails until all "+
+		"manifests are applied, or for good if some could not be applied. The failed manifests are logged.")
+
+	fs.BoolVar(&o.AllowUnknownRuntimeConfig, "allow-unknown-runtime-config", o.AllowUnknownRuntimeConfig, ""+
+		"Log and ignore --runtime-config keys naming no group version served by this server instead of failing to start, "+
+		"for configurations shared with newer servers.")
+
+	fs.BoolVar(&o.AllowResourceConfigMismatch, "allow-resource-config-mismatch", o.AllowResourceConfigMismatch, ""+
+		"Log the group versions a server of the chain installed although --runtime-config disables them, or did not install "+
+		"although it enables them, instead of failing to start. Discovery advertises the versions that were not installed, "+
+		"and their requests fail with 404 Not Found.")
+
+	fs.BoolVar(&o.StrictConfig, "strict-config", o.StrictConfig, ""+
+		"Fail to start instead of normalizing flag values, like rounding --leader-elect-lease-duration up to whole seconds. "+
+		"Without it the normalizations are logged at startup.")
+}
+
+// addLeaderElectionFlags adds the flags of the leader election of the controllers.
+func (o *ServerRunOptions) addLeaderElectionFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&o.LeaderElect, "leader-elect", o.LeaderElect, ""+
+		"Run the controllers of the server, like the garbage collector, only while it is their leader, elected with "+
+		"the other servers sharing etcd, so replicas do not run them twice. Every controller has its own lock in etcd.")
+
+	fs.DurationVar(&o.LeaderElectLeaseDuration, "leader-elect-lease-duration", o.LeaderElectLeaseDuration, ""+
+		"Time the other servers wait for a leader that stopped renewing its lease, e.g. after a crash, before taking over "+
+		"its controllers. Leaders shutting down hand their controllers off right away. Rounded up to whole seconds.")
+}
+
+// addInternalClientFlags adds the flags of the loopback clients of the controllers.
+func (o *ServerRunOptions) addInternalClientFlags(fs *pflag.FlagSet) {
+	fs.Float32Var(&o.InternalClientQPS, "internal-client-qps", o.InternalClientQPS, ""+
+		"QPS of the loopback clients used by the controllers of the server. Zero keeps the client-go default.")
+
+	fs.IntVar(&o.InternalClientBurst, "internal-client-burst", o.InternalClientBurst, ""+
+		"Burst of the loopback clients used by the controllers of the server. Zero keeps the client-go default.")
+
+	fs.DurationVar(&o.InternalClientDiscoveryTTL, "internal-client-discovery-ttl", o.InternalClientDiscoveryTTL, ""+
+		"Time the loopback clients used by the controllers of the server cache discovery information for at most. "+
+		"They drop it when CustomResourceDefinitions or APIServices change anyway, this bounds how stale it gets when an "+
+		"aggregated server changes its resources. Zero caches it until CustomResourceDefinitions or APIServices change.")
+}
+
+// Validate checks the options as set by flags or by an embedding program, before Complete fills in
+// the missing ones. It returns every problem found, not only the first.
+func (o *ServerRunOptions) Validate() []error {
+	var errs []error
+
+	if o.InternalClientQPS < 0 {
+		errs = append(errs, fmt.Errorf("--internal-client-qps must not be negative, got %v", o.InternalClientQPS))
+	}
+
+	if o.InternalClientBurst < 0 {
+		errs = append(errs, fmt.Errorf("--internal-client-burst must not be negative, got %d", o.InternalClientBurst))
+	}
+
+	if o.InternalClientDiscoveryTTL < 0 {
+		errs = append(errs, fmt.Errorf("--internal-client-discovery-ttl must not be negative, got %v", o.InternalClientDiscoveryTTL))
+	}
+
+	if o.RequestTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("--request-timeout must be positive, got %v", o.RequestTimeout))
+	}
+
+	if o.ShutdownDelayDuration < 0 {
+		errs = append(errs, fmt.Errorf("--shutdown-delay-duration must not be negative, got %v", o.ShutdownDelayDuration))
+	}
+
+	if o.LivezHeartbeatThreshold < 0 {
+		errs = append(errs, fmt.Errorf("--livez-heartbeat-threshold must not be negative, got %v", o.LivezHeartbeatThreshold))
+	}
+
+	if o.LivezHeartbeatGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("--livez-heartbeat-grace-period must not be negative, got %v", o.LivezHeartbeatGracePeriod))
+	}
+
+	if o.LeaderElect && o.LeaderElectLeaseDuration < time.Second {
+		errs = append(errs, fmt.Errorf("--leader-elect-lease-duration must be at least 1s, got %v", o.LeaderElectLeaseDuration))
+	}
+
+	if o.MaxAnnotationBytes < 0 || o.MaxAnnotationBytes > AnnotationBytesLimit {
+		errs = append(errs, fmt.Errorf("--max-annotation-bytes must be between 0 and %d, got %d", AnnotationBytesLimit, o.MaxAnnotationBytes))
+	}
+
+	if o.AnnotationSizeWarningBytes < 0 {
+		errs = append(errs, fmt.Errorf("--annotation-size-warning-bytes must not be negative, got %d", o.AnnotationSizeWarningBytes))
+	}
+
+	if o.MaxStoredObjects < 0 {
+		errs = append(errs, fmt.Errorf("--max-stored-objects must not be negative, got %d", o.MaxStoredObjects))
+	}
+
+	if o.MaxStoredObjects > 0 && o.Extensions.RecommendedOptions.Etcd.StorageConfig.CountMetricPollPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("--max-stored-objects requires a positive --etcd-count-metric-poll-period"))
+	}
+
+	if o.EtcdProbeInterval < 0 {
+		errs = append(errs, fmt.Errorf("--etcd-probe-interval must not be negative, got %v", o.EtcdProbeInterval))
+	}
+
+	if o.EtcdProbeInterval > 0 && o.EtcdProbeSummaryPeriod < o.EtcdProbeInterval {
+		errs = append(errs, fmt.Errorf("--etcd-probe-summary-period must be at least --etcd-probe-interval, got %v", o.EtcdProbeSummaryPeriod))
+	}
+
+	if o.EtcdProbeWarningThreshold < 0 {
+		errs = append(errs, fmt.Errorf("--etcd-probe-warning-threshold must not be negative, got %v", o.EtcdProbeWarningThreshold))
+	}
+
+	if o.OpenAPITitle == "" {
+		errs = append(errs, fmt.Errorf("--openapi-title must not be empty"))
+	}
+
+	if o.OpenAPIContactURL != "" {
+		if u, err := url.Parse(o.OpenAPIContactURL); err != nil || !u.IsAbs() {
+			errs = append(errs, fmt.Errorf("--openapi-contact-url must be an absolute URL, got %q", o.OpenAPIContactURL))
+		}
+	}
+
+	if o.OpenAPIContactEmail != "" {
+		if _, err := mail.ParseAddress(o.OpenAPIContactEmail); err != nil {
+			errs = append(errs, fmt.Errorf("--openapi-contact-email must be an email address, got %q: %v", o.OpenAPIContactEmail, err))
+		}
+	}
+
+	if o.WaitForEtcd && o.EtcdWaitTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("--etcd-wait-timeout must be positive, got %v", o.EtcdWaitTimeout))
+	}
+
+	if o.Extensions.RecommendedOptions.Etcd.StorageConfig.CompactionInterval < 0 {
+		errs = append(errs, fmt.Errorf("--etcd-compaction-interval must not be negative, got %v", o.Extensions.RecommendedOptions.Etcd.StorageConfig.CompactionInterval))
+	}
+
+	if o.Extensions.RecommendedOptions.Etcd.DeleteCollectionWorkers < 1 {
+		errs = append(errs, fmt.Errorf("--delete-collection-workers must be at least 1, got %d", o.Extensions.RecommendedOptions.Etcd.DeleteCollectionWorkers))
+	}
+
+	if o.MaxDeleteCollectionObjects < 0 {
+		errs = append(errs, fmt.Errorf("--max-delete-collection-objects must not be negative, got %d", o.MaxDeleteCollectionObjects))
+	}
+
+	if o.ClientAttributionMaxClients < 1 {
+		errs = append(errs, fmt.Errorf("--client-attribution-max-clients must be at least 1, got %d", o.ClientAttributionMaxClients))
+	}
+
+	if o.ClientAttributionTop < 1 || o.ClientAttributionTop > o.ClientAttributionMaxClients {
+		errs = append(errs, fmt.Errorf("--client-attribution-top must be between 1 and --client-attribution-max-clients, got %d", o.ClientAttributionTop))
+	}
+
+	if o.MaxWritePause <= 0 {
+		errs = append(errs, fmt.Errorf("--max-write-pause must be positive, got %v", o.MaxWritePause))
+	}
+
+	if o.MaxRequestBodyBytes < 0 {
+		errs = append(errs, fmt.Errorf("--max-request-body-bytes must not be negative, got %d", o.MaxRequestBodyBytes))
+	}
+
+	if o.MaxJSONPatchOperations < 0 {
+		errs = append(errs, fmt.Errorf("--max-json-patch-operations must not be negative, got %d", o.MaxJSONPatchOperations))
+	}
+
+	if o.MaxRequestNestingDepth < 0 {
+		errs = append(errs, fmt.Errorf("--max-request-nesting-depth must not be negative, got %d", o.MaxRequestNestingDepth))
+	}
+
+	if o.MaxLabelSelectorRequirements < 0 {
+		errs = append(errs, fmt.Errorf("--max-label-selector-requirements must not be negative, got %d", o.MaxLabelSelectorRequirements))
+	}
+
+	if o.MaxLabelSelectorValues < 0 {
+		errs = append(errs, fmt.Errorf("--max-label-selector-values must not be negative, got %d", o.MaxLabelSelectorValues))
+	}
+
+	if o.AdvertiseAddress != nil && o.AdvertiseAddress.IsUnspecified() {
+		errs = append(errs, fmt.Errorf("--advertise-address must be a specific address, got %v", o.AdvertiseAddress))
+	}
+
+	if o.ExternalHostname != "" {
+		if _, _, err := net.SplitHostPort(o.ExternalHostname); err == nil || strings.HasPrefix(o.ExternalHostname, "[") {
+			errs = append(errs, fmt.Errorf("--external-hostname must be a host name or IP address without port or brackets, got %q", o.ExternalHostname))
+		}
+	}
+
+	if o.BindUnixSocket != "" && o.Extensions.RecommendedOptions.SecureServing.Listener != nil {
+		errs = append(errs, fmt.Errorf("--bind-unix-socket must not be set with a secure serving listener"))
+	}
+
+	if _, err := cliflag.TLSVersion(o.Extensions.RecommendedOptions.SecureServing.MinTLSVersion); err != nil {
+		errs = append(errs, fmt.Errorf("invalid --tls-min-version %q, expected one of %s",
+			o.Extensions.RecommendedOptions.SecureServing.MinTLSVersion, strings.Join(cliflag.TLSPossibleVersions(), ", ")))
+	}
+
+	for _, suite := range o.Extensions.RecommendedOptions.SecureServing.CipherSuites {
+		if _, err := cliflag.TLSCipherSuites([]string{suite}); err != nil {
+			errs = append(errs, fmt.Errorf("unsupported --tls-cipher-suites suite %q, expected some of %s",
+				suite, strings.Join(cliflag.TLSCipherPossibleValues(), ", ")))
+		}
+	}
+
+	// the HTTP/2 server refuses to start without them
+	if suites := sets.NewString(o.Extensions.RecommendedOptions.SecureServing.CipherSuites...); suites.Len() > 0 && !suites.HasAny(http2CipherSuites...) {
+		errs = append(errs, fmt.Errorf("--tls-cipher-suites must include %s, required by HTTP/2", strings.Join(http2CipherSuites, " or ")))
+	}
+
+	if o.MaxPriorityRequestsInFlight < 0 {
+		errs = append(errs, fmt.Errorf("--max-priority-requests-inflight must not be negative, got %d", o.MaxPriorityRequestsInFlight))
+	}
+
+	if o.MaxWatchesPerUser < 0 {
+		errs = append(errs, fmt.Errorf("--max-watches-per-user must not be negative, got %d", o.MaxWatchesPerUser))
+	}
+
+	if o.MaxWatchesPerNamespace < 0 {
+		errs = append(errs, fmt.Errorf("--max-watches-per-namespace must not be negative, got %d", o.MaxWatchesPerNamespace))
+	}
+
+	if o.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("--max-connections must not be negative, got %d", o.MaxConnections))
+	}
+
+	if o.TCPKeepAlivePeriod < 0 {
+		errs = append(errs, fmt.Errorf("--tcp-keepalive-period must not be negative, got %v", o.TCPKeepAlivePeriod))
+	}
+
+	switch o.AuthorizationMode {
+	case AuthorizationModeDelegating:
+	case AuthorizationModeAlwaysAllow, AuthorizationModeAlwaysDeny:
+		if o.Extensions.RecommendedOptions.Authorization.RemoteKubeConfigFile != "" {
+			errs = append(errs, fmt.Errorf("an authorization webhook requires --authorization-mode=%s, got %s", AuthorizationModeDelegating, o.AuthorizationMode))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("--authorization-mode must be one of %s, %s and %s, got %q", AuthorizationModeDelegating, AuthorizationModeAlwaysAllow, AuthorizationModeAlwaysDeny, o.AuthorizationMode))
+	}
+
+	if o.EnableCRDTenancy && o.DisableCRDs {
+		errs = append(errs, fmt.Errorf("--enable-crd-tenancy must not be set with --disable-crds"))
+	}
+
+	errs = append(errs, o.InsecureServing.Validate()...)
+
+	if o.InsecureServing.BindPort > 0 {
+		if !o.InsecureServing.BindAddress.IsLoopback() {
+			errs = append(errs, fmt.Errorf("--insecure-bind-address must be a loopback address, got %v", o.InsecureServing.BindAddress))
+		}
+
+		if o.InsecureUser == "" {
+			errs = append(errs, fmt.Errorf("--insecure-user must not be empty with --insecure-bind-port"))
+		}
+	}
+
+	for _, origin := range o.CorsAllowedOrigins {
+		if _, err := regexp.Compile(origin); err != nil {
+			errs = append(errs, fmt.Errorf("invalid --cors-allowed-origins pattern %q: %w", origin, err))
+		}
+	}
+
+	for _, resource := range o.DisableResponseCompressionFor {
+		if schema.ParseGroupResource(resource).Resource == "" {
+			errs = append(errs, fmt.Errorf("invalid --disable-response-compression-for resource %q, expected resource.group", resource))
+		}
+	}
+
+	return errs
+}
+
+// Complete validates the options and fills in the missing ones.
+func (o *ServerRunOptions) Complete() (CompletedServerRunOptions, error) {
+	if err := utilerrors.NewAggregate(o.Validate()); err != nil {
+		return CompletedServerRunOptions{}, err
+	}
+
+	completed := &completedServerRunOptions{ServerRunOptions: o}
+
+	if o.AdvertiseAddress == nil {
+		if bindAddress := o.Extensions.RecommendedOptions.SecureServing.BindAddress; bindAddress != nil && !bindAddress.IsUnspecified() {
+			o.AdvertiseAddress = bindAddress
+		} else {
+			o.AdvertiseAddress = net.ParseIP("127.0.0.1")
+		}
+	}
+
+	if o.ExternalHostname == "" {
+		o.ExternalHostname = o.AdvertiseAddress.String()
+	}
+
+	for _, resource := range o.DisableResponseCompressionFor {
+		completed.UncompressedResources = append(completed.UncompressedResources, schema.ParseGroupResource(resource))
+	}
+
+	completed.Normalizations = o.normalize()
+
+	if o.StrictConfig && len(completed.Normalizations) > 0 {
+		errs := []error{}
+		for _, normalization := range completed.Normalizations {
+			errs = append(errs, fmt.Errorf("%v (--strict-config forbids normalizations)", normalization))
+		}
+
+		return CompletedServerRunOptions{}, utilerrors.NewAggregate(errs)
+	}
+
+	return CompletedServerRunOptions{completed}, nil
+}
+
+// normalize brings the values set by the user into the form the server uses and returns the values it
+// changed, except the bare --runtime-config keys, which it sets to true. It is the only place
+// normalizing the values of --runtime-config.
+func (o *ServerRunOptions) normalize() []Normalization {
+	normalizations := []Normalization{}
+
+	// the invalid values are rejected with the unknown keys, once the groups of the server are known
+	runtimeConfig := o.Extensions.APIEnablement.RuntimeConfig
+
+	keys := []string{}
+	for key := range runtimeConfig {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := runtimeConfig[key]
+
+		normalized := "true"
+		if value != "" {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				continue
+			}
+
+			normalized = strconv.FormatBool(enabled)
+		}
+
+		if normalized != value {
+			runtimeConfig[key] = normalized
+
+			// a bare key is the documented way of enabling, not a value to report
+			if value == "" {
+				continue
+			}
+
+			normalizations = append(normalizations, Normalization{
+				Flag:   "--runtime-config",
+				From:   key + "=" + value,
+				To:     key + "=" + normalized,
+				Reason: "the values are true or false",
+			})
+		}
+	}
+
+	serverCert := &o.Extensions.RecommendedOptions.SecureServing.ServerCert
+	if o.InMemoryServingCert {
+		// the default directory is not a choice of the user
+		if certDir := serverCert.CertDirectory; certDir != "" && certDir != genericoptions.NewSecureServingOptions().ServerCert.CertDirectory && serverCert.CertKey.CertFile == "" {
+			normalizations = append(normalizations, Normalization{
+				Flag:   "--cert-dir",
+				From:   certDir,
+				Reason: "--in-memory-serving-cert keeps the certificate in memory",
+			})
+		}
+
+		// without a directory the certificate is kept in memory
+		serverCert.CertDirectory = ""
+	}
+
+	if o.LeaderElect {
+		if truncated := o.LeaderElectLeaseDuration.Truncate(time.Second); truncated != o.LeaderElectLeaseDuration {
+			rounded := truncated + time.Second
+			normalizations = append(normalizations, Normalization{
+				Flag:   "--leader-elect-lease-duration",
+				From:   o.LeaderElectLeaseDuration.String(),
+				To:     rounded.String(),
+				Reason: "leases last whole seconds",
+			})
+			o.LeaderElectLeaseDuration = rounded
+		}
+	}
+
+	return normalizations
+}
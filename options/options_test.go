@@ -0,0 +1,775 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/thetirefire/badidea/features"
+)
+
+func TestInstanceScopedFeatureGates(t *testing.T) {
+	parse := func(args ...string) CompletedServerRunOptions {
+		o, err := NewServerRunOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		o.AddFlags(fs)
+
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		completed, err := o.Complete()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return completed
+	}
+
+	enabled := parse("--feature-gates=BadIdeaCRDAutoRegistration=true")
+	disabled := parse("--feature-gates=BadIdeaCRDAutoRegistration=false")
+
+	if !enabled.FeatureGate.Enabled(features.BadIdeaCRDAutoRegistration) {
+		t.Errorf("expected %s to be enabled on the first instance", features.BadIdeaCRDAutoRegistration)
+	}
+
+	if disabled.FeatureGate.Enabled(features.BadIdeaCRDAutoRegistration) {
+		t.Errorf("expected %s to be disabled on the second instance", features.BadIdeaCRDAutoRegistration)
+	}
+}
+
+func TestWatchCacheFlags(t *testing.T) {
+	o, err := NewServerRunOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	o.AddFlags(fs)
+
+	if err := fs.Parse([]string{"--default-watch-cache-size=0", "--watch-cache-sizes=apiservices.apiregistration.k8s.io#0"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	etcd := o.Extensions.RecommendedOptions.Etcd
+	if !etcd.EnableWatchCache {
+		t.Errorf("expected the watch cache to stay enabled")
+	}
+
+	if etcd.DefaultWatchCacheSize != 0 {
+		t.Errorf("expected default watch cache size 0, got %d", etcd.DefaultWatchCacheSize)
+	}
+
+	if len(etcd.WatchCacheSizes) != 1 || etcd.WatchCacheSizes[0] != "apiservices.apiregistration.k8s.io#0" {
+		t.Errorf("unexpected watch cache sizes %v", etcd.WatchCacheSizes)
+	}
+}
+
+func TestServingAddresses(t *testing.T) {
+	tests := []struct {
+		name                     string
+		args                     []string
+		expectedAdvertiseAddress string
+		expectedExternalHostname string
+		expectedErr              bool
+	}{
+		{
+			name:                     "defaults",
+			expectedAdvertiseAddress: "127.0.0.1",
+			expectedExternalHostname: "127.0.0.1",
+		},
+		{
+			name:                     "all IPv6 addresses",
+			args:                     []string{"--bind-address=::"},
+			expectedAdvertiseAddress: "127.0.0.1",
+			expectedExternalHostname: "127.0.0.1",
+		},
+		{
+			name:                     "specific bind address",
+			args:                     []string{"--bind-address=fd00::1"},
+			expectedAdvertiseAddress: "fd00::1",
+			expectedExternalHostname: "fd00::1",
+		},
+		{
+			name:                     "advertise and external hostname",
+			args:                     []string{"--bind-address=0.0.0.0", "--advertise-address=192.168.0.10", "--external-hostname=badidea.example.com"},
+			expectedAdvertiseAddress: "192.168.0.10",
+			expectedExternalHostname: "badidea.example.com",
+		},
+		{
+			name:        "unspecified advertise address",
+			args:        []string{"--advertise-address=::"},
+			expectedErr: true,
+		},
+		{
+			name:        "external hostname with port",
+			args:        []string{"--external-hostname=badidea.example.com:6443"},
+			expectedErr: true,
+		},
+		{
+			name:        "bracketed external hostname",
+			args:        []string{"--external-hostname=[fd00::1]"},
+			expectedErr: true,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			completed, err := o.Complete()
+			if test.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if completed.AdvertiseAddress.String() != test.expectedAdvertiseAddress {
+				t.Errorf("expected advertise address %s, got %v", test.expectedAdvertiseAddress, completed.AdvertiseAddress)
+			}
+
+			if completed.ExternalHostname != test.expectedExternalHostname {
+				t.Errorf("expected external hostname %s, got %s", test.expectedExternalHostname, completed.ExternalHostname)
+			}
+		})
+	}
+}
+
+func TestInsecureServing(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedErr bool
+	}{
+		{name: "disabled"},
+		{name: "loopback", args: []string{"--insecure-bind-port=8080"}},
+		{name: "IPv6 loopback", args: []string{"--insecure-bind-port=8080", "--insecure-bind-address=::1"}},
+		{name: "non-loopback disabled", args: []string{"--insecure-bind-address=0.0.0.0"}},
+		{name: "all addresses", args: []string{"--insecure-bind-port=8080", "--insecure-bind-address=0.0.0.0"}, expectedErr: true},
+		{name: "non-loopback", args: []string{"--insecure-bind-port=8080", "--insecure-bind-address=192.168.0.10"}, expectedErr: true},
+		{name: "invalid port", args: []string{"--insecure-bind-port=70000"}, expectedErr: true},
+		{name: "no user", args: []string{"--insecure-bind-port=8080", "--insecure-user="}, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestCorsAllowedOrigins(t *testing.T) {
+	o, err := NewServerRunOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	o.CorsAllowedOrigins = []string{`^https://dashboard\.example\.com$`, "(unbalanced"}
+
+	if _, err := o.Complete(); err == nil || !strings.Contains(err.Error(), `invalid --cors-allowed-origins pattern "(unbalanced"`) {
+		t.Errorf("expected the invalid pattern to be rejected, got %v", err)
+	}
+}
+
+func TestMaxStoredObjects(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		noCounts    bool
+		expectedErr bool
+	}{
+		{name: "no quota"},
+		{name: "quota", args: []string{"--max-stored-objects=1000"}},
+		{name: "negative", args: []string{"--max-stored-objects=-1"}, expectedErr: true},
+		{name: "without object counts", args: []string{"--max-stored-objects=1000"}, noCounts: true, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if test.noCounts {
+				o.Extensions.RecommendedOptions.Etcd.StorageConfig.CountMetricPollPeriod = 0
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedErr string
+	}{
+		{name: "defaults"},
+		{name: "TLS 1.3", args: []string{"--tls-min-version=VersionTLS13"}},
+		{name: "cipher suites", args: []string{"--tls-cipher-suites=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+		{name: "unknown version", args: []string{"--tls-min-version=TLS13"}, expectedErr: `invalid --tls-min-version "TLS13", expected one of VersionTLS10,`},
+		{name: "unknown suite", args: []string{"--tls-cipher-suites=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_RSA_WITH_ROT13"}, expectedErr: `unsupported --tls-cipher-suites suite "TLS_RSA_WITH_ROT13"`},
+		{name: "no HTTP/2 suite", args: []string{"--tls-cipher-suites=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, expectedErr: "required by HTTP/2"},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = o.Complete()
+			if test.expectedErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if test.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectedErr)) {
+				t.Errorf("expected error %q, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedErr bool
+	}{
+		{name: "defaults"},
+		{name: "no limits", args: []string{"--max-request-body-bytes=0", "--max-json-patch-operations=0", "--max-request-nesting-depth=0"}},
+		{name: "negative body bytes", args: []string{"--max-request-body-bytes=-1"}, expectedErr: true},
+		{name: "negative JSON patch operations", args: []string{"--max-json-patch-operations=-1"}, expectedErr: true},
+		{name: "negative nesting depth", args: []string{"--max-request-nesting-depth=-1"}, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizationMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		webhook     bool
+		expectedErr bool
+	}{
+		{name: "defaults"},
+		{name: "delegating with a webhook", args: []string{"--authorization-mode=Delegating"}, webhook: true},
+		{name: "always allow", args: []string{"--authorization-mode=AlwaysAllow"}},
+		{name: "always deny", args: []string{"--authorization-mode=AlwaysDeny"}},
+		{name: "always deny with a webhook", args: []string{"--authorization-mode=AlwaysDeny"}, webhook: true, expectedErr: true},
+		{name: "RBAC", args: []string{"--authorization-mode=RBAC"}, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if test.webhook {
+				o.Extensions.RecommendedOptions.Authorization.RemoteKubeConfigFile = "/etc/badidea/authz.kubeconfig"
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestLabelSelectorLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedErr bool
+	}{
+		{name: "defaults"},
+		{name: "limits", args: []string{"--max-label-selector-requirements=50", "--max-label-selector-values=500"}},
+		{name: "negative requirements", args: []string{"--max-label-selector-requirements=-1"}, expectedErr: true},
+		{name: "negative values", args: []string{"--max-label-selector-values=-1"}, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDeleteCollectionOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedErr bool
+	}{
+		{name: "defaults"},
+		{name: "limited", args: []string{"--delete-collection-workers=4", "--max-delete-collection-objects=1000"}},
+		{name: "no workers", args: []string{"--delete-collection-workers=0"}, expectedErr: true},
+		{name: "negative objects", args: []string{"--max-delete-collection-objects=-1"}, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestClientAttributionOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedErr bool
+	}{
+		{name: "defaults"},
+		{name: "enabled", args: []string{"--enable-client-attribution", "--client-attribution-max-clients=100", "--client-attribution-top=100", "--client-attribution-hash-users"}},
+		{name: "no clients", args: []string{"--client-attribution-max-clients=0"}, expectedErr: true},
+		{name: "no top clients", args: []string{"--client-attribution-top=0"}, expectedErr: true},
+		{name: "more top clients than clients", args: []string{"--client-attribution-max-clients=5", "--client-attribution-top=6"}, expectedErr: true},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			o, err := NewServerRunOptions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.AddFlags(fs)
+
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err := o.Complete(); (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestEtcdCompactionInterval(t *testing.T) {
+	tests := []struct {
+		args             []string
+		expectedInterval time.Duration
+		expectedErr      bool
+	}{
+		{expectedInterval: 5 * time.Minute},
+		{args: []string{"--etcd-compaction-interval=1h"}, expectedInterval: time.Hour},
+		{args: []string{"--etcd-compaction-interval=0"}},
+		{args: []string{"--etcd-compaction-interval=-1s"}, expectedErr: true},
+	}
+
+	for _, test := range tests {
+		o, err := NewServerRunOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		o.AddFlags(fs)
+
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := o.Complete(); (err != nil) != test.expectedErr {
+			t.Errorf("%v: expected error %v, got %v", test.args, test.expectedErr, err)
+		}
+
+		if interval := o.Extensions.RecommendedOptions.Etcd.StorageConfig.CompactionInterval; !test.expectedErr && interval != test.expectedInterval {
+			t.Errorf("%v: expected an interval of %v, got %v", test.args, test.expectedInterval, interval)
+		}
+	}
+}
+
+func TestLivezHeartbeats(t *testing.T) {
+	tests := []struct {
+		args              []string
+		expectedThreshold time.Duration
+		expectedGrace     time.Duration
+		expectedErr       bool
+	}{
+		{expectedGrace: 5 * time.Minute},
+		{args: []string{"--livez-heartbeat-threshold=2m"}, expectedThreshold: 2 * time.Minute, expectedGrace: 5 * time.Minute},
+		{args: []string{"--livez-heartbeat-threshold=30s", "--livez-heartbeat-grace-period=0"}, expectedThreshold: 30 * time.Second},
+		{args: []string{"--livez-heartbeat-threshold=-1s"}, expectedErr: true},
+		{args: []string{"--livez-heartbeat-grace-period=-1s"}, expectedErr: true},
+	}
+
+	for _, test := range tests {
+		o, err := NewServerRunOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		o.AddFlags(fs)
+
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := o.Complete(); (err != nil) != test.expectedErr {
+			t.Errorf("%v: expected error %v, got %v", test.args, test.expectedErr, err)
+		}
+
+		if !test.expectedErr && (o.LivezHeartbeatThreshold != test.expectedThreshold || o.LivezHeartbeatGracePeriod != test.expectedGrace) {
+			t.Errorf("%v: expected a threshold of %v and a grace period of %v, got %v and %v", test.args, test.expectedThreshold, test.expectedGrace, o.LivezHeartbeatThreshold, o.LivezHeartbeatGracePeriod)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	o, err := NewServerRunOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if errs := o.Validate(); len(errs) > 0 {
+		t.Fatalf("expected the defaults to be valid, got %v", errs)
+	}
+
+	o.RequestTimeout = 0
+	o.MaxConnections = -1
+	o.DisableResponseCompressionFor = []string{""}
+	o.MaxWritePause = 0
+
+	if errs := o.Validate(); len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %v", errs)
+	}
+
+	if _, err := o.Complete(); err == nil {
+		t.Fatal("expected invalid options not to complete")
+	}
+
+	if o.AdvertiseAddress != nil || o.ExternalHostname != "" {
+		t.Errorf("expected invalid options not to be filled in, got %v and %q", o.AdvertiseAddress, o.ExternalHostname)
+	}
+}
+
+func TestOpenAPIInfo(t *testing.T) {
+	tests := []struct {
+		args        []string
+		expectedErr bool
+	}{
+		{},
+		{args: []string{"--openapi-title=Widgets", "--openapi-version=v2.1.0", "--openapi-description=The widget API"}},
+		{args: []string{"--openapi-contact-name=Widget team", "--openapi-contact-url=https://widgets.example.com", "--openapi-contact-email=widgets@example.com"}},
+		{args: []string{"--openapi-title="}, expectedErr: true},
+		{args: []string{"--openapi-contact-url=widgets.example.com"}, expectedErr: true},
+		{args: []string{"--openapi-contact-email=widgets"}, expectedErr: true},
+	}
+
+	for _, test := range tests {
+		o, err := NewServerRunOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		o.AddFlags(fs)
+
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := o.Complete(); (err != nil) != test.expectedErr {
+			t.Errorf("%v: expected error %v, got %v", test.args, test.expectedErr, err)
+		}
+	}
+}
+
+func TestEtcdTimings(t *testing.T) {
+	tests := []struct {
+		args        []string
+		expectedErr bool
+	}{
+		{},
+		{args: []string{"--etcd-probe-interval=0", "--etcd-probe-summary-period=0"}},
+		{args: []string{"--etcd-probe-interval=1s", "--etcd-probe-summary-period=1m", "--etcd-probe-warning-threshold=10ms"}},
+		{args: []string{"--etcd-probe-interval=-1s"}, expectedErr: true},
+		{args: []string{"--etcd-probe-interval=1m", "--etcd-probe-summary-period=30s"}, expectedErr: true},
+		{args: []string{"--etcd-probe-warning-threshold=-1ms"}, expectedErr: true},
+		{args: []string{"--etcd-wait-timeout=5m"}},
+		{args: []string{"--wait-for-etcd=false", "--etcd-wait-timeout=0"}},
+		{args: []string{"--etcd-wait-timeout=0"}, expectedErr: true},
+	}
+
+	for _, test := range tests {
+		o, err := NewServerRunOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		o.AddFlags(fs)
+
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err := o.Complete(); (err != nil) != test.expectedErr {
+			t.Errorf("%v: expected error %v, got %v", test.args, test.expectedErr, err)
+		}
+	}
+}
+
+func TestNormalizations(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// set sets the options without flags of the badidea command
+		set      func(o *ServerRunOptions)
+		expected []Normalization
+	}{
+		{
+			name:     "defaults",
+			args:     []string{"--in-memory-serving-cert", "--leader-elect"},
+			expected: []Normalization{},
+		},
+		{
+			name: "runtime config values",
+			set: func(o *ServerRunOptions) {
+				o.Extensions.APIEnablement.RuntimeConfig = map[string]string{
+					"api/all":        "false",
+					"example.com/v1": "",
+					"example.com/v2": "1",
+					"example.com/v3": "True",
+					"example.com/v4": "maybe",
+				}
+			},
+			expected: []Normalization{
+				{Flag: "--runtime-config", From: "example.com/v2=1", To: "example.com/v2=true", Reason: "the values are true or false"},
+				{Flag: "--runtime-config", From: "example.com/v3=True", To: "example.com/v3=true", Reason: "the values are true or false"},
+			},
+		},
+		{
+			// --strict-config accepts the documented bare key, enabling the group version
+			name: "bare runtime config key",
+			set: func(o *ServerRunOptions) {
+				o.Extensions.APIEnablement.RuntimeConfig = map[string]string{"example.com/v1": ""}
+			},
+			expected: []Normalization{},
+		},
+		{
+			name: "cert dir with in-memory serving cert",
+			args: []string{"--in-memory-serving-cert"},
+			set: func(o *ServerRunOptions) {
+				o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertDirectory = "/var/run/badidea"
+			},
+			expected: []Normalization{
+				{Flag: "--cert-dir", From: "/var/run/badidea", Reason: "--in-memory-serving-cert keeps the certificate in memory"},
+			},
+		},
+		{
+			name: "cert dir with serving cert file",
+			args: []string{"--in-memory-serving-cert"},
+			set: func(o *ServerRunOptions) {
+				o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertDirectory = "/var/run/badidea"
+				o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertKey.CertFile = "tls.crt"
+				o.Extensions.RecommendedOptions.SecureServing.ServerCert.CertKey.KeyFile = "tls.key"
+			},
+			expected: []Normalization{},
+		},
+		{
+			name: "lease duration",
+			args: []string{"--leader-elect", "--leader-elect-lease-duration=1500ms"},
+			expected: []Normalization{
+				{Flag: "--leader-elect-lease-duration", From: "1.5s", To: "2s", Reason: "leases last whole seconds"},
+			},
+		},
+		{
+			name:     "lease duration without leader election",
+			args:     []string{"--leader-elect-lease-duration=1500ms"},
+			expected: []Normalization{},
+		},
+	}
+
+	parse := func(t *testing.T, set func(o *ServerRunOptions), args ...string) *ServerRunOptions {
+		o, err := NewServerRunOptions()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		o.AddFlags(fs)
+
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if set != nil {
+			set(o)
+		}
+
+		return o
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			completed, err := parse(t, test.set, test.args...).Complete()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(completed.Normalizations, test.expected) {
+				t.Errorf("expected the normalizations %v, got %v", test.expected, completed.Normalizations)
+			}
+
+			for key, value := range completed.Extensions.APIEnablement.RuntimeConfig {
+				if value != "true" && value != "false" && value != "maybe" {
+					t.Errorf("expected the value of %s to be normalized, got %q", key, value)
+				}
+			}
+
+			for _, normalization := range test.expected {
+				if normalization.Flag == "--cert-dir" && completed.Extensions.RecommendedOptions.SecureServing.ServerCert.CertDirectory != "" {
+					t.Errorf("expected the cert dir to be cleared")
+				}
+			}
+
+			_, err = parse(t, test.set, append(test.args, "--strict-config")...).Complete()
+			if len(test.expected) == 0 && err != nil {
+				t.Errorf("unexpected error in strict mode: %v", err)
+			}
+
+			if len(test.expected) > 0 && (err == nil || !strings.Contains(err.Error(), test.expected[0].Flag)) {
+				t.Errorf("expected strict mode to fail on %s, got %v", test.expected[0].Flag, err)
+			}
+		})
+	}
+}
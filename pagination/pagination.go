@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pagination walks the objects of a resource in pages, so scans of whole servers neither
+// hold all objects in memory nor bypass the watch cache with unpaginated lists.
+package pagination
+
+import (
+	"context"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+)
+
+// DefaultLimit is the number of objects listed per page unless Options set another.
+const DefaultLimit = 500
+
+// ListFunc lists a page of objects.
+type ListFunc func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error)
+
+// DynamicList returns a ListFunc listing the objects of resource with the dynamic client.
+func DynamicList(resource dynamic.ResourceInterface) ListFunc {
+	return func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+		return resource.List(ctx, opts)
+	}
+}
+
+// MetadataList returns a ListFunc listing the metadata of the objects of resource.
+func MetadataList(resource metadata.ResourceInterface) ListFunc {
+	return func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+		return resource.List(ctx, opts)
+	}
+}
+
+// Progress is the progress of a walk, reported after every page.
+type Progress struct {
+	// Pages is the number of pages listed.
+	Pages int
+	// Items is the number of objects visited.
+	Items int
+	// Restarts is the number of times the walk resumed after its continue token expired.
+	Restarts int
+}
+
+// Options configure a walk.
+type Options struct {
+	// ListOptions are the options of every page, e.g. a label selector. The limit, continue token
+	// and resourceVersion are set by the walk.
+	ListOptions metav1.ListOptions
+	// Limit is the number of objects per page. Zero means DefaultLimit.
+	Limit int64
+	// Progress is called after every page if it is not nil.
+	Progress func(Progress)
+}
+
+// Walk calls visit for the objects listed by list, page by page, in the order of their keys. The
+// pages are a consistent snapshot unless the continue token expires, e.g. because etcd was compacted
+// during a long walk. The walk then resumes after the last object visited with the inconsistent
+// continue token of the error, and without one with a new list skipping the objects visited. Either
+// way no object is visited twice, and no object that exists throughout the walk is missed. The walk
+// stops at the first error of visit.
+func Walk(ctx context.Context, list ListFunc, o Options, visit func(obj runtime.Object) error) error {
+	opts := o.ListOptions
+	opts.Limit = o.Limit
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultLimit
+	}
+
+	opts.Continue = ""
+	opts.ResourceVersion = ""
+
+	progress := Progress{}
+	// after a restart without a continue token, the objects up to lastKey were visited already
+	lastKey, skipping := "", false
+
+	for {
+		result, err := list(ctx, opts)
+		if apierrors.IsResourceExpired(err) && opts.Continue != "" {
+			progress.Restarts++
+
+			opts.Continue = ""
+			if status, ok := err.(apierrors.APIStatus); ok {
+				opts.Continue = status.Status().Continue
+			}
+
+			skipping = opts.Continue == ""
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		listMeta, err := meta.ListAccessor(result)
+		if err != nil {
+			return err
+		}
+
+		if err := meta.EachListItem(result, func(obj runtime.Object) error {
+			key, err := objectKey(obj)
+			if err != nil {
+				return err
+			}
+
+			if skipping && key <= lastKey {
+				return nil
+			}
+
+			skipping = false
+			lastKey = key
+			progress.Items++
+
+			return visit(obj)
+		}); err != nil {
+			return err
+		}
+
+		progress.Pages++
+		if o.Progress != nil {
+			o.Progress(progress)
+		}
+
+		if listMeta.GetContinue() == "" {
+			return nil
+		}
+
+		opts.Continue = listMeta.GetContinue()
+	}
+}
+
+// objectKey returns the key of obj, which orders objects like their keys in etcd.
+func objectKey(obj runtime.Object) (string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return "", err
+	}
+
+	if accessor.GetNamespace() == "" {
+		return accessor.GetName(), nil
+	}
+
+	return accessor.GetNamespace() + "/" + accessor.GetName(), nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pagination
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fakeServer lists names in order, page by page, and expires the continue token of one page.
+type fakeServer struct {
+	names []string
+	// expirePage expires the token of the page with this index, once.
+	expirePage int
+	// inconsistentContinue returns a token resuming after the last object of the previous page with
+	// the expiry.
+	inconsistentContinue bool
+	// created are created after the first page.
+	created []string
+
+	pages int
+}
+
+func (s *fakeServer) list(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+	if opts.Continue != "" {
+		if s.pages == s.expirePage {
+			s.expirePage = -1
+
+			status := apierrors.NewResourceExpired("The provided continue parameter is too old to display a consistent list result.")
+			if s.inconsistentContinue {
+				status.ErrStatus.ListMeta.Continue = opts.Continue
+			}
+
+			return nil, status
+		}
+	}
+
+	s.pages++
+	if s.pages == 2 {
+		s.names = append(s.names, s.created...)
+		sort.Strings(s.names)
+	}
+
+	// like etcd, continue tokens are the key of the last object listed
+	start := 0
+	for start < len(s.names) && opts.Continue != "" && s.names[start] <= opts.Continue {
+		start++
+	}
+
+	list := &metav1.PartialObjectMetadataList{}
+	for i := start; i < len(s.names) && int64(len(list.Items)) < opts.Limit; i++ {
+		list.Items = append(list.Items, metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: s.names[i]}})
+	}
+
+	if end := start + len(list.Items); end < len(s.names) {
+		list.Continue = s.names[end-1]
+	}
+
+	return list, nil
+}
+
+func TestWalk(t *testing.T) {
+	names := []string{}
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("widget-%d", i))
+	}
+
+	tests := []struct {
+		name   string
+		server *fakeServer
+
+		expectedNames    []string
+		expectedRestarts int
+	}{
+		{
+			name:          "consistent",
+			server:        &fakeServer{names: names, expirePage: -1},
+			expectedNames: names,
+		},
+		{
+			name:             "expired with an inconsistent continue token",
+			server:           &fakeServer{names: names, expirePage: 2, inconsistentContinue: true},
+			expectedNames:    names,
+			expectedRestarts: 1,
+		},
+		{
+			name:             "expired without a continue token",
+			server:           &fakeServer{names: names, expirePage: 2},
+			expectedNames:    names,
+			expectedRestarts: 1,
+		},
+		{
+			// the objects created during the walk after the last object visited show up on restarts
+			name:             "expired without a continue token after creates",
+			server:           &fakeServer{names: append([]string{}, names...), expirePage: 2, created: []string{"widget-0a", "widget-9a"}},
+			expectedNames:    append(append([]string{}, names...), "widget-9a"),
+			expectedRestarts: 1,
+		},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			visited := []string{}
+			progress := []Progress{}
+
+			err := Walk(context.TODO(), test.server.list, Options{Limit: 3, Progress: func(p Progress) { progress = append(progress, p) }}, func(obj runtime.Object) error {
+				accessor, err := meta.Accessor(obj)
+				if err != nil {
+					return err
+				}
+
+				visited = append(visited, accessor.GetName())
+
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(visited, test.expectedNames) {
+				t.Errorf("expected to visit %v, got %v", test.expectedNames, visited)
+			}
+
+			last := progress[len(progress)-1]
+			if last.Items != len(test.expectedNames) || last.Restarts != test.expectedRestarts {
+				t.Errorf("expected %d items and %d restarts, got %+v", len(test.expectedNames), test.expectedRestarts, last)
+			}
+		})
+	}
+}
+
+func TestWalkVisitError(t *testing.T) {
+	server := &fakeServer{names: []string{"a", "b", "c", "d"}, expirePage: -1}
+	stop := fmt.Errorf("stop")
+
+	visited := 0
+
+	err := Walk(context.TODO(), server.list, Options{Limit: 1}, func(obj runtime.Object) error {
+		visited++
+		if visited == 2 {
+			return stop
+		}
+
+		return nil
+	})
+	if err != stop {
+		t.Errorf("expected the error of visit, got %v", err)
+	}
+
+	if server.pages != 2 {
+		t.Errorf("expected the walk to stop after 2 pages, got %d", server.pages)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package restmapping maps the kinds and resources served by a server, keeping up with the
+// CustomResourceDefinitions and APIServices created while it runs.
+package restmapping
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+)
+
+// RESTMapper is a meta.RESTMapper caching the discovery information of a server. Lookups without a
+// match reset it and are tried once more, since discovery lags behind new CustomResourceDefinitions
+// and APIServices.
+type RESTMapper struct {
+	discoveryClient discovery.DiscoveryInterface
+
+	lock sync.Mutex
+	// mapper is nil until the first lookup and after a reset
+	mapper meta.RESTMapper
+}
+
+var _ meta.RESTMapper = &RESTMapper{}
+
+// New creates a RESTMapper of the server of discoveryClient.
+func New(discoveryClient discovery.DiscoveryInterface) *RESTMapper {
+	return &RESTMapper{discoveryClient: discoveryClient}
+}
+
+// NewForConfig creates a RESTMapper of the server of config.
+func NewForConfig(config *rest.Config) (*RESTMapper, error) {
+	config = rest.CopyConfig(config)
+	// discovery requests do not take a context
+	config.Timeout = 10 * time.Second
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(discoveryClient), nil
+}
+
+// ResetOn resets m whenever an object of informer is added, updated or deleted, e.g. a
+// CustomResourceDefinition changing its versions.
+func (m *RESTMapper) ResetOn(informer cache.SharedInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { m.Reset() },
+		UpdateFunc: func(oldObj, newObj interface{}) { m.Reset() },
+		DeleteFunc: func(obj interface{}) { m.Reset() },
+	})
+}
+
+// Reset drops the cached discovery information.
+func (m *RESTMapper) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.mapper = nil
+}
+
+// delegate returns the mapper of the cached discovery information, discovering the server if
+// there is none. Groups that fail discovery, like those of unavailable APIServices, are left out.
+func (m *RESTMapper) delegate() (meta.RESTMapper, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.mapper == nil {
+		groupResources, err := restmapper.GetAPIGroupResources(m.discoveryClient)
+		if err != nil {
+			return nil, err
+		}
+
+		m.mapper = restmapper.NewDiscoveryRESTMapper(groupResources)
+	}
+
+	return m.mapper, nil
+}
+
+// retry runs lookup with the delegate, and again after a reset if it found no match.
+func (m *RESTMapper) retry(lookup func(mapper meta.RESTMapper) error) error {
+	mapper, err := m.delegate()
+	if err != nil {
+		return err
+	}
+
+	err = lookup(mapper)
+	if !meta.IsNoMatchError(err) {
+		return err
+	}
+
+	m.Reset()
+
+	if mapper, err = m.delegate(); err != nil {
+		return err
+	}
+
+	return lookup(mapper)
+}
+
+// KindFor implements meta.RESTMapper.
+func (m *RESTMapper) KindFor(resource schema.GroupVersionResource) (gvk schema.GroupVersionKind, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		gvk, err = mapper.KindFor(resource)
+
+		return err
+	})
+
+	return gvk, err
+}
+
+// KindsFor implements meta.RESTMapper.
+func (m *RESTMapper) KindsFor(resource schema.GroupVersionResource) (gvks []schema.GroupVersionKind, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		gvks, err = mapper.KindsFor(resource)
+
+		return err
+	})
+
+	return gvks, err
+}
+
+// ResourceFor implements meta.RESTMapper.
+func (m *RESTMapper) ResourceFor(input schema.GroupVersionResource) (gvr schema.GroupVersionResource, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		gvr, err = mapper.ResourceFor(input)
+
+		return err
+	})
+
+	return gvr, err
+}
+
+// ResourcesFor implements meta.RESTMapper.
+func (m *RESTMapper) ResourcesFor(input schema.GroupVersionResource) (gvrs []schema.GroupVersionResource, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		gvrs, err = mapper.ResourcesFor(input)
+
+		return err
+	})
+
+	return gvrs, err
+}
+
+// RESTMapping implements meta.RESTMapper.
+func (m *RESTMapper) RESTMapping(gk schema.GroupKind, versions ...string) (mapping *meta.RESTMapping, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		mapping, err = mapper.RESTMapping(gk, versions...)
+
+		return err
+	})
+
+	return mapping, err
+}
+
+// RESTMappings implements meta.RESTMapper.
+func (m *RESTMapper) RESTMappings(gk schema.GroupKind, versions ...string) (mappings []*meta.RESTMapping, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		mappings, err = mapper.RESTMappings(gk, versions...)
+
+		return err
+	})
+
+	return mappings, err
+}
+
+// ResourceSingularizer implements meta.RESTMapper.
+func (m *RESTMapper) ResourceSingularizer(resource string) (singular string, err error) {
+	err = m.retry(func(mapper meta.RESTMapper) error {
+		singular, err = mapper.ResourceSingularizer(resource)
+
+		return err
+	})
+
+	return singular, err
+}
@@ -14,24 +14,232 @@ limitations under the License.
 package server
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/thetirefire/badidea/apiserver"
 	"github.com/thetirefire/badidea/etcd"
+	"github.com/thetirefire/badidea/filters"
+	"github.com/thetirefire/badidea/options"
+	"github.com/thetirefire/badidea/restmapping"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+	"k8s.io/kube-openapi/pkg/common"
 )
 
-// RunBadIdeaServer starts a new BadIdeaServer.
-func RunBadIdeaServer(stopCh <-chan struct{}) error {
-	err := etcd.RunEtcdServer(stopCh)
+// BadIdeaServer is a created, not yet running, badidea server with its embedded etcd.
+type BadIdeaServer struct {
+	server      *apiserver.Server
+	config      *apiserver.ServerChainConfig
+	etcdStopped <-chan error
+	stopEtcd    func()
+	stopCh      <-chan struct{}
+	servingCA   []byte
+}
+
+// Option customizes the server chain before its servers are created.
+type Option func(*apiserver.ServerChainConfig) error
+
+// WithAPIGroup serves an API group implemented in-process by the storage in apiGroupInfo, like
+// apiserver.ServerChainConfig.WithAPIGroup.
+func WithAPIGroup(apiGroupInfo genericapiserver.APIGroupInfo, priorities map[schema.GroupVersion]apiserver.Priority, openAPIDefinitions common.GetOpenAPIDefinitions) Option {
+	return func(c *apiserver.ServerChainConfig) error {
+		return c.WithAPIGroup(apiGroupInfo, priorities, openAPIDefinitions)
+	}
+}
+
+// WithScheme registers the types of API groups added with WithAPIGroup with the scheme of the chain,
+// like apiserver.ServerChainConfig.AddToScheme.
+func WithScheme(builders ...func(*runtime.Scheme) error) Option {
+	return func(c *apiserver.ServerChainConfig) error {
+		return c.AddToScheme(builders...)
+	}
+}
+
+// WithDeprecatedResource marks a resource of an API group added with WithAPIGroup deprecated, like
+// apiserver.ServerChainConfig.WithDeprecatedResource.
+func WithDeprecatedResource(gvr schema.GroupVersionResource, deprecation filters.Deprecation) Option {
+	return func(c *apiserver.ServerChainConfig) error {
+		return c.WithDeprecatedResource(gvr, deprecation)
+	}
+}
+
+// RunBadIdeaServer starts a new BadIdeaServer. It returns once the server and etcd have stopped, with
+// the reason of the shutdown.
+func RunBadIdeaServer(o options.CompletedServerRunOptions, stopCh <-chan struct{}) (ShutdownReason, error) {
+	s, err := NewBadIdeaServer(o, stopCh)
+	if err == nil {
+		err = s.Run()
+	}
+
+	return ShutdownReasonFor(err), err
+}
+
+// NewBadIdeaServer starts etcd, or waits for the external one with --wait-for-etcd, and creates the
+// server chain. etcd stops when stopCh is closed, or once Run returns. Errors are apiserver.StageErrors
+// recording the stage that failed.
+func NewBadIdeaServer(o options.CompletedServerRunOptions, stopCh <-chan struct{}, opts ...Option) (*BadIdeaServer, error) {
+	for _, normalization := range o.Normalizations {
+		klog.Warningf("Normalized flag value: %v (--strict-config fails instead)", normalization)
+	}
+
+	etcdStopCh := make(chan struct{})
+
+	var stopEtcdOnce sync.Once
+	stopEtcd := func() { stopEtcdOnce.Do(func() { close(etcdStopCh) }) }
+
+	go func() {
+		<-stopCh
+		stopEtcd()
+	}()
+
+	// etcd and the server configuration take similarly long to come up and do not depend on each other
+	type etcdResult struct {
+		stopped <-chan error
+		err     error
+	}
+
+	etcdCh := make(chan etcdResult, 1)
+
+	go func() {
+		if o.DisableEmbeddedEtcd {
+			err := etcd.CheckServers(o.Extensions.RecommendedOptions.Etcd.StorageConfig.Transport.ServerList)
+			if err == nil && o.WaitForEtcd {
+				err = apiserver.WaitForEtcd(o, etcdStopCh)
+			}
+
+			etcdCh <- etcdResult{err: err}
+
+			return
+		}
+
+		stopped, err := etcd.StartEtcdServer(o.EmbeddedEtcd, etcdStopCh)
+		etcdCh <- etcdResult{stopped: stopped, err: err}
+	}()
+
+	config, err := apiserver.CreateServerChainConfig(o)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	aggregatorServer, err := apiserver.CreateServerChain()
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			return nil, apiserver.NewStageError(apiserver.ErrInvalidOptions, err)
+		}
+	}
+
+	etcdServer := <-etcdCh
+	if etcdServer.err != nil {
+		return nil, apiserver.NewStageError(apiserver.ErrEtcdUnavailable, etcdServer.err)
+	}
+
+	// without waiting for etcd, the storage versions are checked once it answers
+	if !o.DisableEmbeddedEtcd || o.WaitForEtcd {
+		if err := config.CheckStorageVersions(o); err != nil {
+			return nil, err
+		}
+	}
+
+	topServer, err := config.New(o)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return &BadIdeaServer{
+		server:      topServer,
+		config:      config,
+		etcdStopped: etcdServer.stopped,
+		stopEtcd:    stopEtcd,
+		stopCh:      stopCh,
+		servingCA:   config.ServingCA,
+	}, nil
+}
+
+// ServingCA returns the PEM bundle clients have to trust when the serving certificate was generated
+// in memory, and nil otherwise.
+func (s *BadIdeaServer) ServingCA() []byte {
+	return s.servingCA
+}
+
+// RESTMapper returns a mapper of the kinds and resources the server serves, talking to it through
+// the loopback client. It picks up new CRDs and APIServices without a manual Reset.
+func (s *BadIdeaServer) RESTMapper() *restmapping.RESTMapper {
+	return s.config.RESTMapper
+}
+
+// LoopbackClientConfig returns a copy of the config of the loopback clients. Clients constructed from
+// it share the connection pool and rate limiter of the clients of the server.
+func (s *BadIdeaServer) LoopbackClientConfig() *rest.Config {
+	return s.config.Clients.Config()
+}
+
+// DynamicClient returns the dynamic loopback client of the server, constructed on first use and
+// shared with the components of the server.
+func (s *BadIdeaServer) DynamicClient() (dynamic.Interface, error) {
+	return s.config.Clients.Dynamic()
+}
+
+// DiscoveryClient returns the loopback discovery client of the server, caching the discovery
+// information in memory, constructed on first use and shared with the components of the server.
+func (s *BadIdeaServer) DiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	return s.config.Clients.Discovery()
+}
+
+// MetadataClient returns the loopback client of the metadata of objects, constructed on first use
+// and shared with the components of the server.
+func (s *BadIdeaServer) MetadataClient() (metadata.Interface, error) {
+	return s.config.Clients.Metadata()
+}
+
+// Run serves until the stop channel passed to NewBadIdeaServer is closed, or the embedded etcd exits.
+// It returns once the server and etcd have stopped. Errors are apiserver.StageErrors recording the
+// stage that failed.
+func (s *BadIdeaServer) Run() error {
 	// TODO: kubectl explain currently failing on crd resources, but works on apiservices
 	// kubectl get and describe do work, though
 
-	return apiserver.RunAggregator(aggregatorServer, stopCh)
+	// the server stops when etcd exits, which without an embedded etcd it never does
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	etcdErrCh := make(chan error, 1)
+
+	go func() {
+		defer close(stopCh)
+
+		select {
+		case <-s.stopCh:
+		case <-done:
+		case err, ok := <-s.etcdStopped:
+			if ok {
+				etcdErrCh <- err
+			}
+		}
+	}()
+
+	err := s.server.Run(stopCh)
+	close(done)
+	<-stopCh
+
+	s.config.DestroyStorage()
+
+	// a server that failed to serve stops etcd too, so that the process can exit
+	s.stopEtcd()
+
+	if s.etcdStopped != nil {
+		for range s.etcdStopped {
+		}
+	}
+
+	select {
+	case etcdErr := <-etcdErrCh:
+		return apiserver.NewStageError(apiserver.ErrEtcdUnavailable, fmt.Errorf("etcd exited: %w", etcdErr))
+	default:
+		return apiserver.NewStageError(apiserver.ErrServing, err)
+	}
 }
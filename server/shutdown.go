@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+
+	"github.com/thetirefire/badidea/apiserver"
+)
+
+// ShutdownReason is why a badidea server shut down.
+type ShutdownReason int
+
+const (
+	// ShutdownStopped is a clean shutdown after the stop channel was closed, e.g. on a signal.
+	ShutdownStopped ShutdownReason = iota
+	// ShutdownInvalidConfig is a shutdown on invalid options or serving certificates, or on a
+	// downgrade across storage versions.
+	ShutdownInvalidConfig
+	// ShutdownEtcdFailure is a shutdown because etcd did not come up or exited.
+	ShutdownEtcdFailure
+	// ShutdownServingFailure is a shutdown because the server chain could not be created or failed
+	// to serve.
+	ShutdownServingFailure
+)
+
+func (r ShutdownReason) String() string {
+	switch r {
+	case ShutdownStopped:
+		return "stopped"
+	case ShutdownInvalidConfig:
+		return "invalid configuration"
+	case ShutdownEtcdFailure:
+		return "etcd failure"
+	default:
+		return "serving failure"
+	}
+}
+
+// ShutdownReasonFor returns the reason of a shutdown with err, an error returned by NewBadIdeaServer
+// or Run: ShutdownStopped for nil, and the reason of the stage that failed otherwise.
+func ShutdownReasonFor(err error) ShutdownReason {
+	switch {
+	case err == nil:
+		return ShutdownStopped
+	case errors.Is(err, apiserver.ErrInvalidOptions), errors.Is(err, apiserver.ErrInvalidServingCerts), errors.Is(err, apiserver.ErrStorageVersionSkew):
+		return ShutdownInvalidConfig
+	case errors.Is(err, apiserver.ErrEtcdUnavailable):
+		return ShutdownEtcdFailure
+	default:
+		return ShutdownServingFailure
+	}
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package snapshot exports the objects a server serves to an archive of manifests and imports them
+// into another server.
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thetirefire/badidea/bootstrap"
+	"github.com/thetirefire/badidea/pagination"
+	"github.com/thetirefire/badidea/restmapping"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// FieldManager is the field manager of imported objects.
+const FieldManager = "badidea-import"
+
+// automanagedLabel marks the APIServices the aggregator registers for the groups it serves itself.
+const automanagedLabel = "kube-aggregator.kubernetes.io/automanaged"
+
+// Options select the objects of a snapshot.
+type Options struct {
+	// IncludeGroups limits the snapshot to these API groups. Empty includes all groups.
+	IncludeGroups []string
+	// ExcludeGroups leaves these API groups out.
+	ExcludeGroups []string
+	// KeepManagedFields keeps metadata.managedFields in exported objects. They are never imported.
+	KeepManagedFields bool
+}
+
+func (o Options) includes(group string) bool {
+	if len(o.IncludeGroups) > 0 && !sets.NewString(o.IncludeGroups...).Has(group) {
+		return false
+	}
+
+	return !sets.NewString(o.ExcludeGroups...).Has(group)
+}
+
+// serverPopulatedFields are the metadata fields the server sets on every object.
+var serverPopulatedFields = []string{"uid", "resourceVersion", "selfLink", "creationTimestamp", "generation"}
+
+// Export writes the objects served by the server of config to w as a gzipped tar archive of YAML
+// manifests, one file per object. Server-populated metadata is stripped, and so is the status of
+// resources with a status subresource, which cannot be applied. APIServices the aggregator manages
+// itself are left out.
+func Export(ctx context.Context, config *rest.Config, w io.Writer, o Options) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	resources, err := exportedResources(discoveryClient, o)
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, resource := range resources {
+		resource := resource
+
+		// the objects are written page by page, so exports of large servers are not held in memory
+		err := pagination.Walk(ctx, pagination.DynamicList(dynamicClient.Resource(resource.GroupVersionResource)), pagination.Options{}, func(obj runtime.Object) error {
+			object, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("unexpected object %T", obj)
+			}
+
+			if _, ok := object.GetLabels()[automanagedLabel]; ok {
+				return nil
+			}
+
+			strip(object, resource.hasStatus, o.KeepManagedFields)
+
+			data, err := yaml.Marshal(object.Object)
+			if err != nil {
+				return err
+			}
+
+			header := &tar.Header{
+				Name:    entryName(resource.GroupVersionResource.GroupResource(), object),
+				Mode:    0644,
+				Size:    int64(len(data)),
+				ModTime: time.Now(),
+			}
+
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+
+			_, err = tarWriter.Write(data)
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", resource.GroupVersionResource, err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+// Import applies the objects of an archive written by Export to the server of config. The objects
+// are applied like bootstrap manifests, so CustomResourceDefinitions go first. Import gives up when
+// stopCh is closed.
+func Import(config *rest.Config, r io.Reader, o Options, stopCh <-chan struct{}) error {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	manifests := []bootstrap.Manifest{}
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entryManifests, err := bootstrap.DecodeManifests(header.Name, tarReader)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+
+		for _, manifest := range entryManifests {
+			if !o.includes(manifest.Object.GroupVersionKind().Group) {
+				continue
+			}
+
+			// applying objects with managed fields is rejected
+			unstructured.RemoveNestedField(manifest.Object.Object, "metadata", "managedFields")
+			manifests = append(manifests, manifest)
+		}
+	}
+
+	mapper, err := restmapping.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	return bootstrap.Apply(config, mapper, FieldManager, manifests, stopCh)
+}
+
+type exportedResource struct {
+	schema.GroupVersionResource
+
+	hasStatus bool
+}
+
+// exportedResources returns the resources of the preferred versions of the included groups that can
+// be listed and created, sorted by group and resource.
+func exportedResources(discoveryClient discovery.DiscoveryInterface, o Options) ([]exportedResource, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	resources := []exportedResource{}
+
+	for _, group := range groups.Groups {
+		if !o.includes(group.Name) {
+			continue
+		}
+
+		resourceList, err := discoveryClient.ServerResourcesForGroupVersion(group.PreferredVersion.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		names := sets.NewString()
+		for _, resource := range resourceList.APIResources {
+			names.Insert(resource.Name)
+		}
+
+		for _, resource := range resourceList.APIResources {
+			if strings.Contains(resource.Name, "/") || !sets.NewString(resource.Verbs...).HasAll("list", "create") {
+				continue
+			}
+
+			resources = append(resources, exportedResource{
+				GroupVersionResource: gv.WithResource(resource.Name),
+				hasStatus:            names.Has(resource.Name + "/status"),
+			})
+		}
+	}
+
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Group != resources[j].Group {
+			return resources[i].Group < resources[j].Group
+		}
+
+		return resources[i].Resource < resources[j].Resource
+	})
+
+	return resources, nil
+}
+
+func strip(object *unstructured.Unstructured, hasStatus, keepManagedFields bool) {
+	for _, field := range serverPopulatedFields {
+		unstructured.RemoveNestedField(object.Object, "metadata", field)
+	}
+
+	if !keepManagedFields {
+		unstructured.RemoveNestedField(object.Object, "metadata", "managedFields")
+	}
+
+	if hasStatus {
+		unstructured.RemoveNestedField(object.Object, "status")
+	}
+}
+
+// entryName returns the archive path of object, cluster/<resource.group>/<name>.yaml for
+// cluster-scoped objects and namespaces/<namespace>/<resource.group>/<name>.yaml otherwise.
+func entryName(resource schema.GroupResource, object *unstructured.Unstructured) string {
+	if namespace := object.GetNamespace(); namespace != "" {
+		return path.Join("namespaces", namespace, resource.String(), object.GetName()+".yaml")
+	}
+
+	return path.Join("cluster", resource.String(), object.GetName()+".yaml")
+}
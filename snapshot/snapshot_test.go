@@ -0,0 +1,181 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/thetirefire/badidea/badideatest"
+	"go.uber.org/goleak"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m, badideatest.LeakOptions()...)
+}
+
+var widgetsResource = schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+
+func newWidgetCRD() *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "widgets.example.com"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Scope: apiextensionsv1.NamespaceScoped,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   "widgets",
+				Singular: "widget",
+				Kind:     "Widget",
+				ListKind: "WidgetList",
+			},
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{
+					Name:    "v1",
+					Served:  true,
+					Storage: true,
+					Schema: &apiextensionsv1.CustomResourceValidation{
+						OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+							Type:                   "object",
+							XPreserveUnknownFields: func(b bool) *bool { return &b }(true),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// readArchive returns the contents of the entries of an archive written by Export by name.
+func readArchive(t *testing.T, data []byte) map[string]string {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	entries := map[string]string{}
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		entries[header.Name] = string(content)
+	}
+
+	return entries
+}
+
+func export(t *testing.T, s *badideatest.TestServer, o Options) map[string]string {
+	out := &bytes.Buffer{}
+	if err := Export(context.TODO(), s.ClientConfig, out, o); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	return readArchive(t, out.Bytes())
+}
+
+func names(entries map[string]string) []string {
+	result := []string{}
+	for name := range entries {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func TestExportImport(t *testing.T) {
+	source := badideatest.StartTestServer(t, badideatest.WithCRDs(newWidgetCRD()))
+
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("example.com/v1")
+	widget.SetKind("Widget")
+	widget.SetName("gizmo")
+	_ = unstructured.SetNestedField(widget.Object, int64(3), "spec", "size")
+
+	widgets := source.DynamicClient.Resource(widgetsResource).Namespace("fixtures")
+
+	// the CRD is established, but its handler may need a moment to pick it up
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, err := widgets.Create(context.TODO(), widget, metav1.CreateOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}); err != nil {
+		t.Fatalf("failed to create widget: %v", err)
+	}
+
+	exported := export(t, source, Options{})
+
+	expectedNames := []string{
+		"cluster/customresourcedefinitions.apiextensions.k8s.io/widgets.example.com.yaml",
+		"namespaces/fixtures/widgets.example.com/gizmo.yaml",
+	}
+	if !reflect.DeepEqual(names(exported), expectedNames) {
+		t.Fatalf("expected entries %v, got %v", expectedNames, names(exported))
+	}
+
+	if onlyCRDs := export(t, source, Options{ExcludeGroups: []string{"example.com"}}); !reflect.DeepEqual(names(onlyCRDs), expectedNames[:1]) {
+		t.Errorf("expected entries %v with example.com excluded, got %v", expectedNames[:1], names(onlyCRDs))
+	}
+
+	target := badideatest.StartTestServer(t)
+
+	out := &bytes.Buffer{}
+	if err := Export(context.TODO(), source.ClientConfig, out, Options{KeepManagedFields: true}); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	if err := Import(target.ClientConfig, out, Options{}, stopCh); err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+
+	reexported := export(t, target, Options{})
+	if !reflect.DeepEqual(reexported, exported) {
+		t.Errorf("expected the import to round-trip\nexported: %v\nre-exported: %v", exported, reexported)
+	}
+}